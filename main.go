@@ -1,8 +1,15 @@
 package main
 
-import app "smartdns/src"
+import (
+    "os"
+
+    app "smartdns/src"
+)
 
 func main() {
+    if len(os.Args) > 1 {
+        os.Exit(app.RunCommand(os.Args[1:]))
+    }
     app.MustRoot()
     app.RunTUI()
 }
@@ -8,15 +8,25 @@ BIN="smartdnsctl"
 # 提权工具（root 环境无需 sudo）
 SUDO="sudo"; [ "$(id -u)" -eq 0 ] && SUDO=""
 
-# 查找最新 Release 的 linux/amd64 二进制
+# 按本机架构选择二进制（与 Release 中 smartdnsctl_linux_<GOARCH> 对应）
+case "$(uname -m)" in
+  x86_64|amd64) ARCH="amd64" ;;
+  aarch64|arm64) ARCH="arm64" ;;
+  armv7*|armv6*|armhf) ARCH="arm" ;;
+  mips) ARCH="mips" ;;
+  mipsel|mipsle) ARCH="mipsle" ;;
+  *) echo "不支持的架构: $(uname -m)" >&2; exit 1 ;;
+esac
+
+# 查找最新 Release 的 linux/$ARCH 二进制
 API="https://api.github.com/repos/$REPO/releases/latest"
 URL=$(curl -fsSL "$API" \
   | grep -oE '"browser_download_url"\s*:\s*"[^"]+"' \
   | cut -d '"' -f4 \
-  | grep '/smartdnsctl_linux_amd64$' \
+  | grep "/smartdnsctl_linux_${ARCH}\$" \
   | head -n1)
 
-[ -n "$URL" ] || { echo "未找到 linux/amd64 二进制资产" >&2; exit 1; }
+[ -n "$URL" ] || { echo "未找到 linux/$ARCH 二进制资产" >&2; exit 1; }
 
 $SUDO curl -fL "$URL" -o "/usr/local/bin/$BIN"
 $SUDO chmod +x "/usr/local/bin/$BIN"
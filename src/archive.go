@@ -0,0 +1,329 @@
+package src
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Archive extraction for downloaded packages (.tar.gz, .tar.xz, .tar, .zip).
+// Archives are untrusted: every entry must stay inside the target directory,
+// links may only point inside it, sizes are capped, and no entry is ever
+// written through a link (links are created after all regular content).
+
+type extractLimits struct {
+	MaxEntries  int
+	MaxFileSize int64
+	MaxTotal    int64
+}
+
+// defaultExtractLimits is far above any real smartdns / nginx package.
+var defaultExtractLimits = extractLimits{MaxEntries: 10000, MaxFileSize: 256 << 20, MaxTotal: 1 << 30}
+
+var errArchiveLimit = errors.New("安装包超出大小限制")
+
+// archiveEntryPath maps an entry name into dst, rejecting absolute names and
+// any ".." component.
+func archiveEntryPath(dst, name string) (string, error) {
+	name = strings.ReplaceAll(name, "\\", "/")
+	if name == "" || strings.HasPrefix(name, "/") || filepath.VolumeName(name) != "" {
+		return "", fmt.Errorf("非法路径: %q", name)
+	}
+	for _, part := range strings.Split(name, "/") {
+		if part == ".." {
+			return "", fmt.Errorf("非法路径: %q", name)
+		}
+	}
+	return filepath.Join(dst, filepath.FromSlash(name)), nil
+}
+
+// within reports whether path is dst or below it (both cleaned).
+func within(dst, path string) bool {
+	rel, err := filepath.Rel(dst, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) && !filepath.IsAbs(rel)
+}
+
+// extractor writes entries below dst while keeping count of the limits.
+type extractor struct {
+	dst      string
+	lim      extractLimits
+	entries  int
+	total    int64
+	symlinks [][2]string // path, target: created last
+}
+
+func (x *extractor) count() error {
+	x.entries++
+	if x.entries > x.lim.MaxEntries {
+		return fmt.Errorf("%w: 超过 %d 个条目", errArchiveLimit, x.lim.MaxEntries)
+	}
+	return nil
+}
+
+// noLinkParents refuses paths whose existing parents are links (only
+// possible if something else raced us; links are created last).
+func (x *extractor) noLinkParents(path string) error {
+	for dir := filepath.Dir(path); within(x.dst, dir) && dir != x.dst; dir = filepath.Dir(dir) {
+		if fi, err := os.Lstat(dir); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("路径经过符号链接: %s", path)
+		}
+	}
+	return nil
+}
+
+func (x *extractor) dir(name string, mode os.FileMode) error {
+	path, err := archiveEntryPath(x.dst, name)
+	if err != nil {
+		return err
+	}
+	if err := x.noLinkParents(path); err != nil {
+		return err
+	}
+	return os.MkdirAll(path, mode.Perm()|0o700)
+}
+
+// file copies r to the entry, stopping at the size limits even if the
+// archive's own size fields lie.
+func (x *extractor) file(name string, mode os.FileMode, r io.Reader) error {
+	path, err := archiveEntryPath(x.dst, name)
+	if err != nil {
+		return err
+	}
+	if err := x.noLinkParents(path); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	if fi, err := os.Lstat(path); err == nil && !fi.Mode().IsRegular() {
+		return fmt.Errorf("条目与已有的非普通文件冲突: %s", name)
+	}
+	out, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode.Perm()&0o755|0o600) // no setuid/setgid, no world-writable
+	if err != nil {
+		return err
+	}
+	limit := x.lim.MaxFileSize
+	if left := x.lim.MaxTotal - x.total; left < limit {
+		limit = left
+	}
+	n, err := io.Copy(out, io.LimitReader(r, limit+1))
+	x.total += n
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && n > limit {
+		err = fmt.Errorf("%w: %s", errArchiveLimit, name)
+	}
+	return err
+}
+
+// hardlink copies an already extracted regular file (no shared inodes, and
+// the source must itself be inside dst).
+func (x *extractor) hardlink(name, target string) error {
+	src, err := archiveEntryPath(x.dst, target)
+	if err != nil {
+		return err
+	}
+	fi, err := os.Lstat(src)
+	if err != nil || !fi.Mode().IsRegular() {
+		return fmt.Errorf("硬链接 %s 指向的 %s 不是已解压的普通文件", name, target)
+	}
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return x.file(name, fi.Mode(), f)
+}
+
+// symlink checks the target stays inside dst and queues the link.
+func (x *extractor) symlink(name, target string) error {
+	path, err := archiveEntryPath(x.dst, name)
+	if err != nil {
+		return err
+	}
+	if target == "" || filepath.IsAbs(target) || !within(x.dst, filepath.Join(filepath.Dir(path), target)) {
+		return fmt.Errorf("符号链接 %s -> %s 指向解压目录之外", name, target)
+	}
+	x.symlinks = append(x.symlinks, [2]string{path, target})
+	return nil
+}
+
+// finish creates the queued links, then resolves each one for real: a chain
+// of links that are each harmless can still lead out of dst together.
+func (x *extractor) finish() error {
+	for _, l := range x.symlinks {
+		if err := x.noLinkParents(l[0]); err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(l[0]), 0o755); err != nil {
+			return err
+		}
+		if err := os.Symlink(l[1], l[0]); err != nil {
+			return err
+		}
+	}
+	root, err := filepath.EvalSymlinks(x.dst)
+	if err != nil {
+		return err
+	}
+	for _, l := range x.symlinks {
+		if real, err := filepath.EvalSymlinks(l[0]); err == nil && !within(root, real) {
+			_ = os.Remove(l[0])
+			return fmt.Errorf("符号链接 %s 解析到解压目录之外", l[0])
+		}
+	}
+	return nil
+}
+
+func (x *extractor) tar(r io.Reader) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return x.finish()
+		}
+		if err != nil {
+			return err
+		}
+		if err := x.count(); err != nil {
+			return err
+		}
+		mode := os.FileMode(hdr.Mode)
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = x.dir(hdr.Name, mode)
+		case tar.TypeReg, tar.TypeRegA:
+			err = x.file(hdr.Name, mode, tr)
+		case tar.TypeLink:
+			err = x.hardlink(hdr.Name, hdr.Linkname)
+		case tar.TypeSymlink:
+			err = x.symlink(hdr.Name, hdr.Linkname)
+		case tar.TypeXGlobalHeader:
+		default:
+			// devices, fifos and the like have no place in a package
+			err = fmt.Errorf("不支持的条目类型 %q: %s", hdr.Typeflag, hdr.Name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (x *extractor) zip(path string) error {
+	zr, err := zip.OpenReader(path)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+	for _, f := range zr.File {
+		if err := x.count(); err != nil {
+			return err
+		}
+		mode := f.Mode()
+		switch {
+		case mode.IsDir():
+			err = x.dir(f.Name, mode)
+		case mode&os.ModeSymlink != 0:
+			var target []byte
+			if target, err = readZipEntry(f, 4096); err == nil {
+				err = x.symlink(f.Name, string(target))
+			}
+		case mode.IsRegular():
+			if f.UncompressedSize64 > uint64(x.lim.MaxFileSize) {
+				return fmt.Errorf("%w: %s", errArchiveLimit, f.Name)
+			}
+			var rc io.ReadCloser
+			if rc, err = f.Open(); err == nil {
+				err = x.file(f.Name, mode, rc)
+				rc.Close()
+			}
+		default:
+			err = fmt.Errorf("不支持的条目类型: %s", f.Name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return x.finish()
+}
+
+func readZipEntry(f *zip.File, max int64) ([]byte, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(io.LimitReader(rc, max))
+}
+
+// extractArchive unpacks srcPath into dstDir, telling the format from the
+// file's magic bytes (tar.xz needs the xz command).
+func extractArchive(srcPath, dstDir string, lim extractLimits) error {
+	f, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := os.MkdirAll(dstDir, 0o755); err != nil {
+		return err
+	}
+	dst, err := filepath.Abs(dstDir)
+	if err != nil {
+		return err
+	}
+	x := &extractor{dst: filepath.Clean(dst), lim: lim}
+	br := bufio.NewReader(f)
+	magic, _ := br.Peek(6)
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		return x.tar(gz)
+	case bytes.HasPrefix(magic, []byte{0xfd, '7', 'z', 'X', 'Z', 0}):
+		return x.tarXZ(srcPath)
+	case bytes.HasPrefix(magic, []byte("PK\x03\x04")):
+		return x.zip(srcPath)
+	}
+	return x.tar(br) // plain tar; a non-archive fails on the first header
+}
+
+func (x *extractor) tarXZ(path string) error {
+	if _, err := exec.LookPath("xz"); err != nil {
+		return errors.New("解压 .tar.xz 需要 xz 命令（apt install xz-utils）")
+	}
+	cmd := exec.Command("xz", "-dc", path)
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	terr := x.tar(out)
+	if terr != nil {
+		_ = cmd.Process.Kill()
+	}
+	werr := cmd.Wait()
+	if terr != nil {
+		return terr
+	}
+	if werr != nil {
+		return fmt.Errorf("xz: %v %s", werr, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
@@ -0,0 +1,434 @@
+package src
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"hash/crc32"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testEntry is one archive member; the builders below turn a list of them
+// into tar.gz, tar.xz or zip bytes.
+type testEntry struct {
+	name string
+	typ  byte // tar.TypeReg, TypeDir, TypeSymlink, TypeLink, TypeChar, TypeBlock, TypeFifo
+	mode int64
+	body string
+	link string
+}
+
+func tarFile(name, body string) testEntry {
+	return testEntry{name: name, typ: tar.TypeReg, mode: 0o644, body: body}
+}
+func tarDir(name string) testEntry { return testEntry{name: name, typ: tar.TypeDir, mode: 0o755} }
+func tarSymlink(name, target string) testEntry {
+	return testEntry{name: name, typ: tar.TypeSymlink, mode: 0o777, link: target}
+}
+func tarHardlink(name, target string) testEntry {
+	return testEntry{name: name, typ: tar.TypeLink, link: target}
+}
+
+func tarBytes(t *testing.T, entries []testEntry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Typeflag: e.typ, Mode: e.mode, Linkname: e.link, Format: tar.FormatPAX}
+		if e.typ == tar.TypeReg {
+			hdr.Size = int64(len(e.body))
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func tarGzBytes(t *testing.T, entries []testEntry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(tarBytes(t, entries))
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func tarXzBytes(t *testing.T, entries []testEntry) []byte {
+	t.Helper()
+	if _, err := exec.LookPath("xz"); err != nil {
+		t.Skip("xz not installed")
+	}
+	cmd := exec.Command("xz", "-c")
+	cmd.Stdin = bytes.NewReader(tarBytes(t, entries))
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func zipBytes(t *testing.T, entries []testEntry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, e := range entries {
+		h := &zip.FileHeader{Name: e.name, Method: zip.Deflate}
+		body := e.body
+		switch e.typ {
+		case tar.TypeDir:
+			h.Name = strings.TrimSuffix(e.name, "/") + "/"
+			h.SetMode(fs.ModeDir | fs.FileMode(e.mode))
+		case tar.TypeSymlink:
+			h.SetMode(fs.ModeSymlink | 0o777)
+			body = e.link
+		case tar.TypeChar:
+			h.SetMode(fs.ModeDevice | fs.ModeCharDevice | 0o644)
+		case tar.TypeFifo:
+			h.SetMode(fs.ModeNamedPipe | 0o644)
+		case tar.TypeReg:
+			h.SetMode(zipUnixMode(e.mode))
+		default:
+			t.Fatalf("zip cannot hold entry type %q", e.typ)
+		}
+		w, err := zw.CreateHeader(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(body))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// zipUnixMode maps tar permission bits (including setuid/setgid) to fs.FileMode.
+func zipUnixMode(m int64) fs.FileMode {
+	mode := fs.FileMode(m & 0o777)
+	if m&0o4000 != 0 {
+		mode |= fs.ModeSetuid
+	}
+	if m&0o2000 != 0 {
+		mode |= fs.ModeSetgid
+	}
+	return mode
+}
+
+// lyingZip stores body under a header that claims declared bytes.
+func lyingZip(t *testing.T, name, body string, declared uint64) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	h := &zip.FileHeader{
+		Name:               name,
+		Method:             zip.Store,
+		CRC32:              crc32.ChecksumIEEE([]byte(body)),
+		CompressedSize64:   uint64(len(body)),
+		UncompressedSize64: declared,
+	}
+	h.SetMode(0o644)
+	w, err := zw.CreateRaw(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte(body))
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// extractSandbox lays out root/{dst,outside} and extracts data into dst. planted
+// holds links a test put into dst itself before extracting.
+type extractSandbox struct {
+	root, dst, outside string
+	planted            map[string]bool
+}
+
+func newExtractSandbox(t *testing.T) extractSandbox {
+	t.Helper()
+	root := t.TempDir()
+	sb := extractSandbox{root: root, dst: filepath.Join(root, "dst"), outside: filepath.Join(root, "outside"), planted: map[string]bool{}}
+	if err := os.MkdirAll(sb.outside, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(sb.outside, "secret"), []byte("secret"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return sb
+}
+
+// plant creates a link in dst that points outside, as left by an earlier
+// extraction or an attacker with write access to dst.
+func (sb extractSandbox) plant(t *testing.T, name, target string) {
+	t.Helper()
+	link := filepath.Join(sb.dst, name)
+	if err := os.MkdirAll(sb.dst, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(target, link); err != nil {
+		t.Fatal(err)
+	}
+	sb.planted[link] = true
+}
+
+func (sb extractSandbox) extract(t *testing.T, data []byte, lim extractLimits) error {
+	t.Helper()
+	src := filepath.Join(t.TempDir(), "pkg")
+	if err := os.WriteFile(src, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return extractArchive(src, sb.dst, lim)
+}
+
+// assertContained fails if anything besides dst's own tree and the untouched
+// outside/secret exists under root, or if a link in dst resolves outside it.
+func (sb extractSandbox) assertContained(t *testing.T) {
+	t.Helper()
+	err := filepath.WalkDir(sb.root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		switch {
+		case path == sb.root, path == sb.dst, path == sb.outside:
+			return nil
+		case path == filepath.Join(sb.outside, "secret"):
+			if b, _ := os.ReadFile(path); string(b) != "secret" {
+				t.Errorf("outside/secret was modified: %q", b)
+			}
+			return nil
+		case !within(sb.dst, path):
+			t.Errorf("created outside dst: %s", path)
+			return nil
+		}
+		if d.Type()&fs.ModeSymlink != 0 && !sb.planted[path] {
+			if real, err := filepath.EvalSymlinks(path); err == nil && !within(sb.dst, real) {
+				t.Errorf("link %s resolves outside dst: %s", path, real)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+var archiveFormats = map[string]func(*testing.T, []testEntry) []byte{
+	"tar.gz": tarGzBytes,
+	"tar.xz": tarXzBytes,
+	"zip":    zipBytes,
+}
+
+func TestExtractArchiveRejects(t *testing.T) {
+	tarOnly := []string{"tar.gz", "tar.xz"}
+	all := []string{"tar.gz", "tar.xz", "zip"}
+	tests := []struct {
+		name    string
+		formats []string
+		entries []testEntry
+		prepare func(t *testing.T, sb extractSandbox) // runs before extraction
+		lim     extractLimits
+		wantLim bool // error must be errArchiveLimit
+	}{
+		{name: "dotdot", formats: all, entries: []testEntry{tarFile("../outside/secret", "pwned")}},
+		{name: "nested dotdot", formats: all, entries: []testEntry{tarDir("a"), tarFile("a/../../outside/x", "pwned")}},
+		{name: "absolute", formats: all, entries: []testEntry{tarFile("/tmp/smartdnsctl-extract-test", "pwned")}},
+		{name: "backslash dotdot", formats: all, entries: []testEntry{tarFile(`..\outside\x`, "pwned")}},
+		{name: "backslash nested", formats: all, entries: []testEntry{tarFile(`a\..\..\outside\x`, "pwned")}},
+		{name: "symlink escapes", formats: all, entries: []testEntry{tarSymlink("l", "../outside")}},
+		{name: "symlink absolute", formats: all, entries: []testEntry{tarSymlink("l", "/etc")}},
+		{name: "symlink then write through it", formats: all, entries: []testEntry{tarSymlink("l", "../outside"), tarFile("l/secret", "pwned")}},
+		{
+			// each link stays inside on its own; together x/esc is root
+			name:    "chained symlinks",
+			formats: all,
+			entries: []testEntry{tarDir("x"), tarSymlink("x/up", ".."), tarSymlink("x/esc", "up/..")},
+		},
+		{name: "hardlink outside", formats: tarOnly, entries: []testEntry{tarHardlink("h", "../outside/secret")}},
+		{name: "hardlink absolute", formats: tarOnly, entries: []testEntry{tarHardlink("h", "/etc/passwd")}},
+		{name: "hardlink before target", formats: tarOnly, entries: []testEntry{tarHardlink("h", "later"), tarFile("later", "x")}},
+		{name: "hardlink to symlink", formats: tarOnly, entries: []testEntry{tarSymlink("s", "f"), tarFile("f", "x"), tarHardlink("h", "s")}},
+		{
+			name:    "file through symlinked parent",
+			formats: all,
+			entries: []testEntry{tarFile("d/secret", "pwned")},
+			prepare: func(t *testing.T, sb extractSandbox) { sb.plant(t, "d", sb.outside) },
+		},
+		{
+			name:    "file over existing symlink",
+			formats: all,
+			entries: []testEntry{tarFile("s", "pwned")},
+			prepare: func(t *testing.T, sb extractSandbox) { sb.plant(t, "s", filepath.Join(sb.outside, "secret")) },
+		},
+		{name: "char device", formats: all, entries: []testEntry{{name: "dev", typ: tar.TypeChar, mode: 0o644}}},
+		{name: "block device", formats: tarOnly, entries: []testEntry{{name: "blk", typ: tar.TypeBlock, mode: 0o644}}},
+		{name: "fifo", formats: all, entries: []testEntry{{name: "fifo", typ: tar.TypeFifo, mode: 0o644}}},
+		{
+			name:    "too many entries",
+			formats: all,
+			entries: []testEntry{tarFile("a", "1"), tarFile("b", "2"), tarFile("c", "3")},
+			lim:     extractLimits{MaxEntries: 2, MaxFileSize: 1 << 20, MaxTotal: 1 << 20},
+			wantLim: true,
+		},
+		{
+			name:    "file too large",
+			formats: all,
+			entries: []testEntry{tarFile("big", strings.Repeat("x", 2048))},
+			lim:     extractLimits{MaxEntries: 10, MaxFileSize: 1024, MaxTotal: 1 << 20},
+			wantLim: true,
+		},
+		{
+			name:    "total too large",
+			formats: all,
+			entries: []testEntry{tarFile("a", strings.Repeat("x", 600)), tarFile("b", strings.Repeat("y", 600))},
+			lim:     extractLimits{MaxEntries: 10, MaxFileSize: 1024, MaxTotal: 1000},
+			wantLim: true,
+		},
+	}
+	for _, tc := range tests {
+		for _, format := range tc.formats {
+			t.Run(tc.name+"/"+format, func(t *testing.T) {
+				sb := newExtractSandbox(t)
+				if tc.prepare != nil {
+					tc.prepare(t, sb)
+				}
+				lim := tc.lim
+				if lim == (extractLimits{}) {
+					lim = defaultExtractLimits
+				}
+				err := sb.extract(t, archiveFormats[format](t, tc.entries), lim)
+				if err == nil {
+					t.Fatal("extraction succeeded")
+				}
+				if tc.wantLim && !errors.Is(err, errArchiveLimit) {
+					t.Fatalf("want errArchiveLimit, got %v", err)
+				}
+				sb.assertContained(t)
+				if _, err := os.Lstat("/tmp/smartdnsctl-extract-test"); err == nil {
+					os.Remove("/tmp/smartdnsctl-extract-test")
+					t.Fatal("absolute entry written to /tmp")
+				}
+			})
+		}
+	}
+}
+
+// The header sizes of a zip entry are only a claim: the cap must hold on
+// the bytes actually read.
+func TestExtractArchiveLyingSizes(t *testing.T) {
+	lim := extractLimits{MaxEntries: 10, MaxFileSize: 1024, MaxTotal: 4096}
+	for _, declared := range []uint64{10, 1024} {
+		sb := newExtractSandbox(t)
+		err := sb.extract(t, lyingZip(t, "big", strings.Repeat("x", 64<<10), declared), lim)
+		if err == nil {
+			t.Fatalf("declared %d: extraction succeeded", declared)
+		}
+		if fi, err := os.Stat(filepath.Join(sb.dst, "big")); err == nil && fi.Size() > lim.MaxFileSize+1 {
+			t.Fatalf("declared %d: wrote %d bytes past the cap", declared, fi.Size())
+		}
+		sb.assertContained(t)
+	}
+	// a header claiming more than the cap is refused before reading
+	sb := newExtractSandbox(t)
+	if err := sb.extract(t, lyingZip(t, "big", "small", 1<<40), lim); !errors.Is(err, errArchiveLimit) {
+		t.Fatalf("want errArchiveLimit, got %v", err)
+	}
+}
+
+func TestExtractArchiveAccepts(t *testing.T) {
+	entries := []testEntry{
+		tarDir("smartdns/usr/sbin"),
+		{name: "smartdns/usr/sbin/smartdns", typ: tar.TypeReg, mode: 0o4755, body: "#!bin"},
+		{name: "smartdns/etc/world", typ: tar.TypeReg, mode: 0o777, body: "w"},
+		tarFile(`smartdns\etc\win`, "backslash"),
+		tarSymlink("smartdns/current", "usr/sbin/smartdns"),
+		tarSymlink("smartdns/usr/up", ".."),
+	}
+	for format, build := range archiveFormats {
+		t.Run(format, func(t *testing.T) {
+			sb := newExtractSandbox(t)
+			if err := sb.extract(t, build(t, entries), defaultExtractLimits); err != nil {
+				t.Fatal(err)
+			}
+			sb.assertContained(t)
+			bin := filepath.Join(sb.dst, "smartdns/usr/sbin/smartdns")
+			fi, err := os.Stat(bin)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fi.Mode()&(fs.ModeSetuid|fs.ModeSetgid) != 0 || fi.Mode().Perm() != 0o755 {
+				t.Fatalf("binary mode %v: setuid/setgid must be dropped", fi.Mode())
+			}
+			if fi, err := os.Stat(filepath.Join(sb.dst, "smartdns/etc/world")); err != nil || fi.Mode().Perm()&0o022 != 0 {
+				t.Fatalf("world-writable file kept its mode: %v %v", fi, err)
+			}
+			if b, err := os.ReadFile(filepath.Join(sb.dst, "smartdns/etc/win")); err != nil || string(b) != "backslash" {
+				t.Fatalf("backslash name: %q %v", b, err)
+			}
+			if b, err := os.ReadFile(filepath.Join(sb.dst, "smartdns/current")); err != nil || string(b) != "#!bin" {
+				t.Fatalf("internal symlink: %q %v", b, err)
+			}
+		})
+	}
+}
+
+func TestExtractArchiveHardlinkCopies(t *testing.T) {
+	sb := newExtractSandbox(t)
+	data := tarGzBytes(t, []testEntry{tarFile("f", "data"), tarHardlink("h", "f")})
+	if err := sb.extract(t, data, defaultExtractLimits); err != nil {
+		t.Fatal(err)
+	}
+	a, _ := os.Stat(filepath.Join(sb.dst, "f"))
+	b, err := os.Stat(filepath.Join(sb.dst, "h"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if os.SameFile(a, b) {
+		t.Fatal("hardlink shares the inode; it must be a copy")
+	}
+	if got, _ := os.ReadFile(filepath.Join(sb.dst, "h")); string(got) != "data" {
+		t.Fatalf("hardlink content %q", got)
+	}
+	sb.assertContained(t)
+}
+
+func TestArchiveEntryPath(t *testing.T) {
+	dst := "/x/dst"
+	for name, ok := range map[string]bool{
+		"a/b":       true,
+		"./a":       true,
+		`a\b`:       true,
+		"a..b":      true,
+		"":          false,
+		"..":        false,
+		"../a":      false,
+		"a/../../b": false,
+		"/a":        false,
+		`\a`:        false,
+		`a\..\..\b`: false,
+	} {
+		p, err := archiveEntryPath(dst, name)
+		if (err == nil) != ok {
+			t.Errorf("%q: err %v, want ok=%v", name, err, ok)
+		}
+		if err == nil && !within(dst, p) {
+			t.Errorf("%q maps outside: %s", name, p)
+		}
+	}
+}
@@ -0,0 +1,284 @@
+package src
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Upstream DNS benchmark. Every candidate (default servers, group upstreams
+// and the recommended list) gets the same real queries over several rounds:
+// popular names for A and AAAA (cached after the first round) and random
+// subdomains of them (always a cold recursive lookup). Runs are kept in
+// BENCH_HISTORY_FILE and can reorder the default servers.
+
+type recommendedServer struct{ IP, Name string }
+
+var recommendedDNS = []recommendedServer{
+	{"223.5.5.5", "AliDNS"},
+	{"223.6.6.6", "AliDNS"},
+	{"119.29.29.29", "DNSPod"},
+	{"1.1.1.1", "Cloudflare"},
+	{"1.0.0.1", "Cloudflare"},
+	{"8.8.8.8", "Google"},
+	{"8.8.4.4", "Google"},
+	{"9.9.9.9", "Quad9"},
+	{"114.114.114.114", "114DNS"},
+	{"180.76.76.76", "Baidu"},
+}
+
+var benchDomains = []string{"www.google.com", "www.apple.com", "www.microsoft.com", "www.cloudflare.com", "www.amazon.com"}
+
+type benchTarget struct {
+	Server string
+	Label  string // "默认", "分组 xx" or the provider name
+}
+
+type benchResult struct {
+	Server       string        `json:"server"`
+	Label        string        `json:"label"`
+	Sent         int           `json:"sent"`
+	Failures     int           `json:"failures"` // SERVFAIL / REFUSED
+	Lost         int           `json:"lost"`     // no reply
+	CachedMedian time.Duration `json:"cached_median"`
+	CachedP95    time.Duration `json:"cached_p95"`
+	ColdMedian   time.Duration `json:"cold_median"`
+	ColdP95      time.Duration `json:"cold_p95"`
+}
+
+// score orders results: fewer errors first, then faster cached answers.
+func (r benchResult) score() (float64, time.Duration) {
+	if r.Sent == 0 {
+		return 1, 0
+	}
+	return float64(r.Failures+r.Lost) / float64(r.Sent), r.CachedMedian
+}
+
+type benchRun struct {
+	Time    time.Time     `json:"time"`
+	Rounds  int           `json:"rounds"`
+	Results []benchResult `json:"results"`
+}
+
+// benchTargets collects the candidates without duplicates.
+func benchTargets(withRecommended bool) []benchTarget {
+	seen := map[string]bool{}
+	var out []benchTarget
+	add := func(ip, label string) {
+		if ip != "" && !seen[ip] {
+			seen[ip] = true
+			out = append(out, benchTarget{Server: ip, Label: label})
+		}
+	}
+	for _, ip := range parseDefaultServers() {
+		add(ip, "默认")
+	}
+	for _, g := range parseUpstreamGroups() {
+		add(g.IP, "分组 "+g.Name)
+	}
+	if withRecommended {
+		for _, r := range recommendedDNS {
+			add(r.IP, r.Name)
+		}
+	}
+	return out
+}
+
+func percentile(samples []time.Duration, p float64) time.Duration {
+	if len(samples) == 0 {
+		return 0
+	}
+	s := append([]time.Duration(nil), samples...)
+	sort.Slice(s, func(i, j int) bool { return s[i] < s[j] })
+	idx := int(p*float64(len(s)-1) + 0.5)
+	return s[idx]
+}
+
+func randomLabel() string {
+	const letters = "abcdefghijklmnopqrstuvwxyz0123456789"
+	b := make([]byte, 12)
+	for i := range b {
+		b[i] = letters[rand.Intn(len(letters))]
+	}
+	return string(b)
+}
+
+// benchServer runs all rounds against one server.
+func benchServer(t benchTarget, rounds int) benchResult {
+	res := benchResult{Server: t.Server, Label: t.Label}
+	var cached, cold []time.Duration
+	ask := func(name string, qt uint16, into *[]time.Duration) {
+		res.Sent++
+		reply, err := dnsQuery(t.Server, name, qt, 2*time.Second)
+		switch {
+		case err != nil:
+			res.Lost++
+		case reply.Rcode != dnsRcodeNoError && reply.Rcode != dnsRcodeNXDomain:
+			res.Failures++
+		default:
+			*into = append(*into, reply.RTT)
+		}
+	}
+	for r := 0; r < rounds; r++ {
+		for _, d := range benchDomains {
+			dst := &cached
+			if r == 0 {
+				dst = &cold // first round may still be a cache miss
+			}
+			ask(d, dnsTypeA, dst)
+			ask(d, dnsTypeAAAA, dst)
+			ask(randomLabel()+"."+strings.TrimPrefix(d, "www."), dnsTypeA, &cold)
+		}
+	}
+	res.CachedMedian, res.CachedP95 = percentile(cached, 0.5), percentile(cached, 0.95)
+	res.ColdMedian, res.ColdP95 = percentile(cold, 0.5), percentile(cold, 0.95)
+	return res
+}
+
+// runBenchmark benchmarks targets in parallel and saves the run.
+func runBenchmark(targets []benchTarget, rounds int, log func(string)) benchRun {
+	if log == nil {
+		log = func(string) {}
+	}
+	run := benchRun{Time: time.Now(), Rounds: rounds}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, 4)
+	for _, t := range targets {
+		wg.Add(1)
+		go func(t benchTarget) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			r := benchServer(t, rounds)
+			mu.Lock()
+			run.Results = append(run.Results, r)
+			mu.Unlock()
+			log(fmt.Sprintf("完成 %s (%s)", t.Server, t.Label))
+		}(t)
+	}
+	wg.Wait()
+	sort.SliceStable(run.Results, func(i, j int) bool {
+		ei, li := run.Results[i].score()
+		ej, lj := run.Results[j].score()
+		if ei != ej {
+			return ei < ej
+		}
+		return li < lj
+	})
+	if err := appendBenchHistory(run); err != nil {
+		log("[警告] 保存测速记录失败: " + err.Error())
+	}
+	return run
+}
+
+// table renders a run as aligned text lines.
+func (run benchRun) table() []string {
+	ms := func(d time.Duration) string {
+		if d == 0 {
+			return "-"
+		}
+		return fmt.Sprintf("%.1f", float64(d.Microseconds())/1000)
+	}
+	out := []string{
+		fmt.Sprintf("%s  %d 轮", run.Time.Format("2006-01-02 15:04"), run.Rounds),
+		fmt.Sprintf("%-16s %-14s %8s %8s %8s %8s %6s %6s %6s", "服务器", "来源", "缓存中位", "缓存P95", "冷中位", "冷P95", "发送", "失败", "丢失"),
+	}
+	for _, r := range run.Results {
+		out = append(out, fmt.Sprintf("%-16s %-14s %8s %8s %8s %8s %6d %6d %6d",
+			r.Server, r.Label, ms(r.CachedMedian), ms(r.CachedP95), ms(r.ColdMedian), ms(r.ColdP95), r.Sent, r.Failures, r.Lost))
+	}
+	out = append(out, "(单位 ms)")
+	return out
+}
+
+func loadBenchHistory() []benchRun {
+	var runs []benchRun
+	if b, err := os.ReadFile(BENCH_HISTORY_FILE); err == nil {
+		_ = json.Unmarshal(b, &runs)
+	}
+	return runs
+}
+
+// appendBenchHistory keeps the last 20 runs.
+func appendBenchHistory(run benchRun) error {
+	runs := append(loadBenchHistory(), run)
+	if len(runs) > 20 {
+		runs = runs[len(runs)-20:]
+	}
+	b, err := json.MarshalIndent(runs, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(BENCH_HISTORY_FILE), 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(BENCH_HISTORY_FILE, b, 0o644)
+}
+
+// reorderDefaultServers sorts the current default servers by the run's
+// ranking; servers the run didn't measure keep their place at the end.
+func reorderDefaultServers(run benchRun) ([]string, error) {
+	rank := map[string]int{}
+	for i, r := range run.Results {
+		rank[r.Server] = i
+	}
+	servers := parseDefaultServers()
+	sort.SliceStable(servers, func(i, j int) bool {
+		ri, oki := rank[servers[i]]
+		rj, okj := rank[servers[j]]
+		switch {
+		case oki && okj:
+			return ri < rj
+		case oki != okj:
+			return oki
+		}
+		return false
+	})
+	return servers, setDefaultServers(servers)
+}
+
+func runBenchCommand(args []string) int {
+	fs := flag.NewFlagSet("bench", flag.ContinueOnError)
+	rounds := fs.Int("rounds", 3, "测试轮数")
+	withRec := fs.Bool("recommended", true, "同时测试推荐 DNS 列表")
+	reorder := fs.Bool("reorder", false, "按结果重新排序默认上游")
+	history := fs.Bool("history", false, "显示历史记录")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *history {
+		for _, run := range loadBenchHistory() {
+			for _, l := range run.table() {
+				fmt.Println(l)
+			}
+			fmt.Println()
+		}
+		return 0
+	}
+	targets := benchTargets(*withRec)
+	if len(targets) == 0 {
+		fmt.Fprintln(os.Stderr, "没有可测试的 DNS 服务器")
+		return 1
+	}
+	run := runBenchmark(targets, *rounds, func(s string) { fmt.Fprintln(os.Stderr, s) })
+	for _, l := range run.table() {
+		fmt.Println(l)
+	}
+	if *reorder {
+		servers, err := reorderDefaultServers(run)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "重新排序失败:", err)
+			return 1
+		}
+		fmt.Println("默认上游顺序: " + strings.Join(servers, ", "))
+	}
+	return 0
+}
@@ -0,0 +1,77 @@
+package src
+
+import (
+	"fmt"
+	"os"
+)
+
+// runCommand dispatches non-interactive subcommands. Without arguments main runs the TUI.
+func runCommand(args []string) int {
+	switch args[0] {
+	case "proxy":
+		return runProxyCommand(args[1:])
+	case "traffic":
+		return runTrafficCommand(args[1:])
+	case "queries":
+		return runQueriesCommand(args[1:])
+	case "quota":
+		return runQuotaCommand(args[1:])
+	case "supervise":
+		return runSuperviseCommand(args[1:])
+	case "every":
+		return runEveryCommand(args[1:])
+	case "bench":
+		return runBenchCommand(args[1:])
+	case "check":
+		return runCheckCommand(args[1:])
+	case "discover":
+		return runDiscoverCommand(args[1:])
+	case "explain":
+		return runExplainCommand(args[1:])
+	case "watchdog":
+		return runWatchdogCommand(args[1:])
+	case "history":
+		return runHistoryCommand(args[1:])
+	case "smartdns":
+		return runSmartDNSCommand(args[1:])
+	case "bundle":
+		return runBundleCommand(args[1:])
+	case "self-update":
+		return runSelfUpdateCommand(args[1:])
+	case "download":
+		return runDownloadCommand(args[1:])
+	case "help", "-h", "--help":
+		printUsage()
+		return 0
+	case "version", "-v", "--version":
+		fmt.Println(SCRIPT_VERSION)
+		return 0
+	}
+	fmt.Fprintf(os.Stderr, "未知命令: %s\n\n", args[0])
+	printUsage()
+	return 2
+}
+
+func printUsage() {
+	fmt.Println("用法: smartdnsctl [命令]")
+	fmt.Println()
+	fmt.Println("  (无参数)   启动交互界面（需 root）")
+	fmt.Println("  proxy      运行内置 SNI/Host 代理（443 按 SNI、80 按 Host 转发）")
+	fmt.Println("  traffic    汇总访问日志并输出流量统计（traffic rollup 仅汇总；traffic report N 统计最近 N 天）")
+	fmt.Println("  queries    DNS 查询统计：queries enable|disable 开关 smartdns 审计日志；queries report 1h|24h|7d|30d 输出统计")
+	fmt.Println("  quota      查看月配额用量（quota enforce 刷新 nginx 超额名单；quota reset client|platform 名称 重置）")
+	fmt.Println("  supervise  无 init 系统时托管服务（不带参数启动全部已启用服务，可作容器入口）")
+	fmt.Println("  every      每隔 N 秒执行一次命令（无定时器的 init 系统使用）")
+	fmt.Println("  bench      上游 DNS 测速：bench [--rounds N] [--recommended=false] [--reorder] [--history]")
+	fmt.Println("  check      解锁检测：check [--stand-in URL] [平台...]，按平台的 address/分组分配访问检测地址")
+	fmt.Println("  discover   从审计日志发现平台缺失的域名：discover [--window 10s] [--min-hits 2]；discover list|accept 域名...|all|ignore 域名...")
+	fmt.Println("  explain    模拟 smartdns 规则匹配：explain 域名... 输出生效规则、上游组与被遮蔽的规则")
+	fmt.Println("  watchdog   DNS 看门狗：探测 smartdns，失败时重启并切换备用 DNS（watchdog status 查看状态）")
+	fmt.Println("  history    查看操作审计记录：history [-n 50] [--all]（--all 包含普通日志）")
+	fmt.Println("  smartdns   SmartDNS 版本：smartdns status|versions 查看已安装与可用版本；smartdns install [--insecure] [--from 本地路径] [版本] 安装或升级（默认最新）；smartdns rollback|uninstall 回滚或按安装清单卸载")
+	fmt.Println("  bundle     离线包：bundle create 目录 [--smartdns 版本] [--arch 架构] [--no-nginx] 制作；bundle install 路径 [--only smartdns|nginx] 安装")
+	fmt.Println("  self-update 更新 smartdnsctl：self-update [--check] [--channel stable|prerelease] [--version 版本] [--insecure] [--rollback]")
+	fmt.Println("  download   经下载代理与 GitHub 镜像下载（支持断点续传）：download [--proxy socks5://host:port|http://host:port|direct] [--mirror 前缀]... URL [文件]")
+	fmt.Println("  version    显示版本")
+	fmt.Println("  help       显示本帮助")
+}
@@ -37,7 +37,7 @@ func deleteGroupFromConfig(name string) error {
 	if !removed {
 		return fmt.Errorf("未找到分组 %s", name)
 	}
-	return writeLines(SMART_CONFIG_FILE, out)
+	return auditChange("group.delete", name, []string{SMART_CONFIG_FILE}, func() error { return writeLines(SMART_CONFIG_FILE, out) })
 }
 
 func insertServerIntoConfig(serverLine, configFile string) error {
@@ -54,14 +54,17 @@ func insertServerIntoConfig(serverLine, configFile string) error {
 			last = i
 		}
 	}
+	write := func(newLines []string) error {
+		return auditChange("group.add", serverLine, []string{configFile}, func() error { return writeLines(configFile, newLines) })
+	}
 	if last >= 0 {
 		newLines := append([]string{}, lines[:last+1]...)
 		newLines = append(newLines, serverLine)
 		newLines = append(newLines, lines[last+1:]...)
-		return writeLines(configFile, newLines)
+		return write(newLines)
 	}
 	newLines := append([]string{serverLine}, lines...)
-	if err := writeLines(configFile, newLines); err != nil {
+	if err := write(newLines); err != nil {
 		return err
 	}
 	logYellow("未找到 server 条目，新条目已插入到文件开头: " + serverLine)
@@ -154,7 +157,7 @@ func setDefaultServers(ips []string) error {
 	}
 	// prepend default servers at the beginning for determinism
 	newLines = append(newLines, rest...)
-	return writeLines(SMART_CONFIG_FILE, newLines)
+	return auditChange("servers.set", strings.Join(ips, " "), []string{SMART_CONFIG_FILE}, func() error { return writeLines(SMART_CONFIG_FILE, newLines) })
 }
 
 func addDefaultServer(ip string) error {
@@ -9,20 +9,87 @@ const (
 	CYAN   = "\033[1;36m"
 )
 
+// SCRIPT_VERSION is the release tag, set by the release build with
+// -ldflags "-X smartdns/src.SCRIPT_VERSION=v1.2.0"; self-update compares against it.
+var SCRIPT_VERSION = "GO_V1.0.0"
+
 const (
-    SCRIPT_VERSION                    = "GO_V1.0.0"
     REMOTE_SCRIPT_URL                 = "https://raw.githubusercontent.com/kilvil/oneclick_smartdns/main/smartdns_install.sh"
     REMOTE_STREAM_CONFIG_FILE_URL     = "https://raw.githubusercontent.com/kilvil/oneclick_smartdns/main/StreamConfig.yaml"
-    REMOTE_SMARTDNS_URL               = "https://github.com/pymumu/smartdns/releases/download/Release46/smartdns.1.2024.06.12-2222.x86-linux-all.tar.gz"
-    REMOTE_RegionRestrictionCheck_URL = "https://raw.githubusercontent.com/1-stream/RegionRestrictionCheck/main/check.sh"
+    // SmartDNS releases are listed through the GitHub API (or the release_api mirror setting)
+    GITHUB_API_URL = "https://api.github.com"
+    SMARTDNS_REPO  = "pymumu/smartdns"
+    // smartdnsctl's own releases, used by self-update
+    SELF_REPO = "kilvil/oneclick_smartdns"
 
     SMART_CONFIG_FILE = "/etc/smartdns/smartdns.conf"
+    // Natively installed SmartDNS binary (the upgrade keeps the previous one as .prev) and what the install wrote
+    SMARTDNS_BIN           = "/usr/sbin/smartdns"
+    SMARTDNS_MANIFEST_FILE = "/var/lib/smartdnsctl/smartdns-manifest.json"
+    // Release downloads land here first; an interrupted one resumes from <file>.part
+    DOWNLOAD_CACHE_DIR = "/var/cache/smartdnsctl"
 
     // Nginx related paths (replacing sniproxy)
     NGINX_MAIN_CONF        = "/etc/nginx/nginx.conf"
     NGINX_STREAM_DIR       = "/etc/nginx/stream.d"
     NGINX_STREAM_CONF_FILE = "/etc/nginx/stream.d/smartdns_stream.conf"
     NGINX_HTTP_CONF_FILE   = "/etc/nginx/conf.d/smartdns_http.conf"
+    NGINX_STREAM_LOADER    = "/etc/nginx/modules-enabled/50-mod-stream.conf"
+    // smartdnsctl's own settings (proxy backend etc.), kept next to smartdns.conf
+    SETTINGS_FILE = "/etc/smartdns/smartdnsctl.json"
+
+    // Built-in SNI/Host proxy (alternative to nginx)
+    PROXY_SERVICE_NAME = "smartdnsctl-proxy"
+    // Loopback instance of the built-in proxy that nginx hands chained platforms to
+    PROXY_CHAIN_SERVICE_NAME = "smartdnsctl-chain"
+    PROXY_CHAIN_HTTPS_ADDR   = "127.0.0.1:10443"
+    PROXY_CHAIN_HTTP_ADDR    = "127.0.0.1:10080"
+    // UDP 443 (QUIC) policy: reject rules or QUIC proxy, managed as one unit
+    QUIC_SERVICE_NAME = "smartdnsctl-quic"
+    QUIC_NFT_FILE     = "/etc/smartdns/smartdnsctl-quic.nft"
+    PROXY_BACKEND_NGINX   = "nginx"
+    PROXY_BACKEND_BUILTIN = "builtin"
+    // Structured (JSON lines) access logs and their daily rollups
+    TRAFFIC_LOG_DIR         = "/var/log/smartdnsctl"
+    PROXY_ACCESS_LOG        = "/var/log/smartdnsctl/proxy-builtin.log"
+    NGINX_STREAM_ACCESS_LOG = "/var/log/smartdnsctl/nginx-stream.log"
+    NGINX_HTTP_ACCESS_LOG   = "/var/log/smartdnsctl/nginx-http.log"
+    TRAFFIC_STATE_DIR       = "/var/lib/smartdnsctl/traffic"
+    LOGROTATE_FILE          = "/etc/logrotate.d/smartdnsctl"
+    // Monthly quota enforcement for the nginx backend (the built-in proxy enforces itself)
+    QUOTA_SERVICE_NAME = "smartdnsctl-quota"
+    // Supervised mode (no init system): service definitions and supervisor pid files
+    SUPERVISE_DIR     = "/etc/smartdns/services"
+    SUPERVISE_RUN_DIR = "/run/smartdnsctl"
+    // System resolver integration: backend drop-ins and the recorded original state
+    RESOLV_CONF         = "/etc/resolv.conf"
+    RESOLVER_STATE_FILE = "/etc/smartdns/resolver-state.json"
+    RESOLVED_DROPIN     = "/etc/systemd/resolved.conf.d/smartdnsctl.conf"
+    RESOLVED_RESOLV     = "/run/systemd/resolve/resolv.conf"
+    NM_DNS_CONF         = "/etc/NetworkManager/conf.d/90-smartdnsctl-dns.conf"
+    RESOLVCONF_HEAD     = "/etc/resolvconf/resolv.conf.d/head"
+    OPENRESOLV_CONF     = "/etc/resolvconf.conf"
+    // DNS health watchdog: restarts smartdns and falls back to a public resolver
+    WATCHDOG_SERVICE_NAME = "smartdnsctl-watchdog"
+    WATCHDOG_STATE_FILE   = "/var/lib/smartdnsctl/watchdog.json"
+    // Maintenance pauses and resolver changes made by the rest of smartdnsctl, read by the watchdog
+    WATCHDOG_CONTROL_FILE = "/var/lib/smartdnsctl/watchdog-control.json"
+    // Native unlock checks: user check definitions and the last results per platform
+    UNLOCK_CHECKS_FILE  = "/etc/smartdns/unlock-checks.json"
+    UNLOCK_RESULTS_FILE = "/var/lib/smartdnsctl/unlock.json"
+    // Upstream DNS benchmark history
+    BENCH_HISTORY_FILE = "/var/lib/smartdnsctl/dns-bench.json"
+    // smartdns query audit log and its hourly rollups
+    SMARTDNS_AUDIT_LOG = "/var/log/smartdns/smartdns-audit.log"
+    QUERY_STATE_DIR    = "/var/lib/smartdnsctl/queries"
+    QUERY_SERVICE_NAME = "smartdnsctl-queries" // rolls the audit log up every minute while audit is on
+    // Domain discovery: last proposals and names the reviewer rejected
+    DISCOVER_RESULTS_FILE = "/var/lib/smartdnsctl/discover.json"
+    DISCOVER_IGNORE_FILE  = "/etc/smartdns/discover-ignore.json"
+
+    // smartdnsctl's own leveled operation log and audit trail (rotates itself)
+    OPLOG_FILE = "/var/log/smartdnsctl.log"
+
     // Special unlock virtual group name used in UI; method will be 'address' with server's public IPv4 as ident
     SPECIAL_UNLOCK_GROUP_NAME = "解锁机"
 )
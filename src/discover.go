@@ -0,0 +1,424 @@
+package src
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Domain discovery. A platform that only half works is usually missing a CDN
+// or API hostname in StreamConfig.yaml. The smartdns audit log shows what
+// clients really ask for: a name no block covers, asked by the same client
+// shortly before or after an assigned platform's domains, and sharing a
+// second-level domain or a CNAME chain with that platform, is proposed for
+// the platform's block in the local overlay (StreamConfig.local.yaml).
+
+type discoverCandidate struct {
+	Domain   string   `json:"domain"`
+	Top      string   `json:"top"`
+	Platform string   `json:"platform"`
+	Hits     int      `json:"hits"`    // queries near the platform's domains
+	Clients  int      `json:"clients"` // distinct clients behind those queries
+	Evidence []string `json:"evidence"`
+}
+
+type discoverOptions struct {
+	Window  time.Duration // how close to a platform query counts as "near"
+	MinHits int
+	Resolve bool // follow CNAME chains through the local smartdns
+}
+
+// secondLevel returns the registrable part of a name, treating two-letter
+// country suffixes under co/com/net/org/... as one label (example.co.uk).
+func secondLevel(name string) string {
+	labels := strings.Split(strings.Trim(strings.ToLower(name), "."), ".")
+	n := 2
+	if len(labels) >= 3 && len(labels[len(labels)-1]) == 2 {
+		switch labels[len(labels)-2] {
+		case "co", "com", "net", "org", "gov", "edu", "ac", "ne", "or":
+			n = 3
+		}
+	}
+	if len(labels) <= n {
+		return strings.Join(labels, ".")
+	}
+	return strings.Join(labels[len(labels)-n:], ".")
+}
+
+// cnameChain follows CNAMEs of name through the local smartdns.
+func cnameChain(name string) []string {
+	reply, err := dnsQuery("127.0.0.1", name, dnsTypeA, 2*time.Second)
+	if err != nil {
+		return nil
+	}
+	var out []string
+	for _, rr := range reply.Answers {
+		if rr.Type == dnsTypeCNAME {
+			out = append(out, strings.TrimSuffix(strings.ToLower(rr.Data), "."))
+		}
+	}
+	return out
+}
+
+// readAuditRecords returns the audit log records (at most the last 64 MiB), oldest first.
+func readAuditRecords() ([]queryRecord, error) {
+	lines, err := tailLines(queryAuditFile(), 1<<30, 64<<20)
+	if err != nil {
+		return nil, err
+	}
+	var out []queryRecord
+	for _, l := range lines {
+		if r, ok := parseAuditLine(l); ok {
+			out = append(out, r)
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Time.Before(out[j].Time) })
+	return out, nil
+}
+
+// discoverDomains analyses the audit log and returns candidates, most hits first.
+func discoverDomains(opt discoverOptions, log func(string)) ([]discoverCandidate, error) {
+	if log == nil {
+		log = func(string) {}
+	}
+	if opt.Window <= 0 {
+		opt.Window = 10 * time.Second
+	}
+	if opt.MinHits <= 0 {
+		opt.MinHits = 2
+	}
+	cfg, err := loadStreamConfig()
+	if err != nil {
+		return nil, err
+	}
+	records, err := readAuditRecords()
+	if err != nil {
+		return nil, fmt.Errorf("读取审计日志失败（是否已开启查询审计？）: %w", err)
+	}
+	log(fmt.Sprintf("读取 %d 条查询记录", len(records)))
+	rules := loadProxyRules()
+	assigned := parseAssignments()
+	topOf := map[string]string{}
+	slds := map[string]map[string]bool{} // platform -> second-level domains of its block
+	for top, subs := range cfg {
+		for sub, domains := range subs {
+			topOf[sub] = top
+			slds[sub] = map[string]bool{}
+			for _, d := range domains {
+				d = strings.TrimLeft(strings.ToLower(strings.TrimSpace(d)), "*+.")
+				if d != "" {
+					slds[sub][secondLevel(d)] = true
+				}
+			}
+		}
+	}
+	ignored := loadDiscoverIgnored()
+
+	// Per client, find uncovered names near a query of an assigned platform.
+	type key struct{ domain, platform string }
+	hits := map[key]int{}
+	clients := map[key]map[string]bool{}
+	anchors := map[string]map[string]bool{} // platform -> its domains seen in the log
+	byClient := map[string][]queryRecord{}
+	for _, r := range records {
+		byClient[r.Client] = append(byClient[r.Client], r)
+	}
+	for client, rs := range byClient {
+		platforms := make([]string, len(rs))
+		for i, r := range rs {
+			if p := rules.platformOf(r.Domain); p != "" {
+				if _, ok := assigned[p]; ok {
+					platforms[i] = p
+					if anchors[p] == nil {
+						anchors[p] = map[string]bool{}
+					}
+					anchors[p][r.Domain] = true
+				} else {
+					platforms[i] = "-" // covered by a block, just not assigned
+				}
+			}
+		}
+		for i, r := range rs {
+			if platforms[i] != "" || ignored[r.Domain] {
+				continue
+			}
+			near := map[string]bool{}
+			for j := i - 1; j >= 0 && r.Time.Sub(rs[j].Time) <= opt.Window; j-- {
+				near[platforms[j]] = true
+			}
+			for j := i + 1; j < len(rs) && rs[j].Time.Sub(r.Time) <= opt.Window; j++ {
+				near[platforms[j]] = true
+			}
+			for p := range near {
+				if p == "" || p == "-" {
+					continue
+				}
+				k := key{r.Domain, p}
+				hits[k]++
+				if clients[k] == nil {
+					clients[k] = map[string]bool{}
+				}
+				clients[k][client] = true
+			}
+		}
+	}
+
+	// CNAME targets of the platforms' own names count as evidence too.
+	type link struct{ from, platform string }
+	reverse := map[string][]link{} // target -> platform names pointing at it
+	if opt.Resolve {
+		for p, names := range anchors {
+			n := 0
+			for name := range names {
+				if n++; n > 30 {
+					break
+				}
+				for _, target := range cnameChain(name) {
+					reverse[target] = append(reverse[target], link{name, p})
+				}
+			}
+		}
+	}
+
+	var out []discoverCandidate
+	lookups := 0
+	for k, n := range hits {
+		if n < opt.MinHits {
+			continue
+		}
+		var evidence []string
+		if sld := secondLevel(k.domain); slds[k.platform][sld] {
+			evidence = append(evidence, "同主域 "+sld)
+		}
+		for _, l := range reverse[k.domain] {
+			if l.platform == k.platform {
+				evidence = append(evidence, "CNAME 来自 "+l.from)
+			}
+		}
+		if opt.Resolve && lookups < 200 {
+			lookups++
+			for _, target := range cnameChain(k.domain) {
+				if rules.platformOf(target) == k.platform || slds[k.platform][secondLevel(target)] {
+					evidence = append(evidence, "CNAME 指向 "+target)
+					break
+				}
+			}
+		}
+		if len(evidence) == 0 {
+			continue
+		}
+		out = append(out, discoverCandidate{
+			Domain: k.domain, Top: topOf[k.platform], Platform: k.platform,
+			Hits: n, Clients: len(clients[k]), Evidence: evidence,
+		})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Hits != out[j].Hits {
+			return out[i].Hits > out[j].Hits
+		}
+		return out[i].Domain < out[j].Domain
+	})
+	// a name near several platforms is proposed for the strongest one only
+	seen := map[string]bool{}
+	uniq := out[:0]
+	for _, c := range out {
+		if !seen[c.Domain] {
+			seen[c.Domain] = true
+			uniq = append(uniq, c)
+		}
+	}
+	out = uniq
+	log(fmt.Sprintf("发现 %d 个候选域名", len(out)))
+	return out, saveDiscoverCandidates(out)
+}
+
+func (c discoverCandidate) String() string {
+	return fmt.Sprintf("%-40s -> %-16s %4d 次 %3d 客户端  %s", c.Domain, c.Platform, c.Hits, c.Clients, strings.Join(c.Evidence, "; "))
+}
+
+// ----- proposals, review and acceptance -----
+
+func loadDiscoverCandidates() []discoverCandidate {
+	var out []discoverCandidate
+	if b, err := os.ReadFile(DISCOVER_RESULTS_FILE); err == nil {
+		_ = json.Unmarshal(b, &out)
+	}
+	return out
+}
+
+func saveDiscoverCandidates(c []discoverCandidate) error {
+	b, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ensureDir(filepath.Dir(DISCOVER_RESULTS_FILE)); err != nil {
+		return err
+	}
+	return os.WriteFile(DISCOVER_RESULTS_FILE, b, 0o644)
+}
+
+func loadDiscoverIgnored() map[string]bool {
+	out := map[string]bool{}
+	var list []string
+	if b, err := os.ReadFile(DISCOVER_IGNORE_FILE); err == nil {
+		_ = json.Unmarshal(b, &list)
+	}
+	for _, d := range list {
+		out[d] = true
+	}
+	return out
+}
+
+// ignoreDiscovered records rejected names so later runs don't propose them again.
+func ignoreDiscovered(domains []string) error {
+	set := loadDiscoverIgnored()
+	for _, d := range domains {
+		set[d] = true
+	}
+	list := make([]string, 0, len(set))
+	for d := range set {
+		list = append(list, d)
+	}
+	sort.Strings(list)
+	b, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := dropDiscovered(domains); err != nil {
+		return err
+	}
+	return os.WriteFile(DISCOVER_IGNORE_FILE, b, 0o644)
+}
+
+// dropDiscovered removes names from the saved proposals.
+func dropDiscovered(domains []string) error {
+	drop := map[string]bool{}
+	for _, d := range domains {
+		drop[d] = true
+	}
+	var keep []discoverCandidate
+	for _, c := range loadDiscoverCandidates() {
+		if !drop[c.Domain] {
+			keep = append(keep, c)
+		}
+	}
+	return saveDiscoverCandidates(keep)
+}
+
+// acceptDiscovered adds the chosen proposals to the local overlay and rewrites
+// the smartdns.conf blocks of the affected platforms. It reports whether
+// smartdns needs a restart.
+func acceptDiscovered(cands []discoverCandidate, log func(string)) (restart bool, err error) {
+	if len(cands) == 0 {
+		return false, errors.New("没有选中的候选域名")
+	}
+	snaps := snapshotFiles(SMART_CONFIG_FILE, streamConfigLocalPath())
+	defer func() { auditSnapshots("discover.accept", fmt.Sprintf("%d 个域名", len(cands)), snaps, err) }()
+	byPlatform := map[[2]string][]string{}
+	var accepted []string
+	for _, c := range cands {
+		k := [2]string{c.Top, c.Platform}
+		byPlatform[k] = append(byPlatform[k], c.Domain)
+		accepted = append(accepted, c.Domain)
+	}
+	for k, domains := range byPlatform {
+		if err := addLocalDomains(k[0], k[1], domains); err != nil {
+			return false, err
+		}
+		log(fmt.Sprintf("%s: 已加入本地补充 %s", k[1], strings.Join(domains, ", ")))
+	}
+	cfg, err := loadStreamConfig()
+	if err != nil {
+		return false, err
+	}
+	for k := range byPlatform {
+		changed, err := reapplyPlatformRules(k[1], cfg[k[0]][k[1]])
+		if err != nil {
+			return restart, err
+		}
+		if changed {
+			log(k[1] + ": 已更新 smartdns.conf 中的规则")
+			restart = true
+		}
+	}
+	return restart, dropDiscovered(accepted)
+}
+
+// pickDiscovered selects saved proposals by domain, or all of them for "all".
+func pickDiscovered(names []string) []discoverCandidate {
+	all := loadDiscoverCandidates()
+	if len(names) == 1 && names[0] == "all" {
+		return all
+	}
+	want := map[string]bool{}
+	for _, n := range names {
+		want[n] = true
+	}
+	var out []discoverCandidate
+	for _, c := range all {
+		if want[c.Domain] {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// runDiscoverCommand implements
+// `smartdnsctl discover [--window 10s] [--min-hits 2] [--no-resolve]`,
+// `discover list`, `discover accept 域名...|all` and `discover ignore 域名...`.
+func runDiscoverCommand(args []string) int {
+	logOut := func(s string) { fmt.Println(s) }
+	if len(args) > 0 {
+		switch args[0] {
+		case "list":
+			for _, c := range loadDiscoverCandidates() {
+				fmt.Println(c.String())
+			}
+			return 0
+		case "accept":
+			restart, err := acceptDiscovered(pickDiscovered(args[1:]), logOut)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "接受失败:", err)
+				return 1
+			}
+			if restart {
+				if err := serviceAction(logOut, "restart", "smartdns"); err != nil {
+					fmt.Fprintln(os.Stderr, "重启 smartdns 失败:", err)
+					return 1
+				}
+			}
+			return 0
+		case "ignore":
+			if err := ignoreDiscovered(args[1:]); err != nil {
+				fmt.Fprintln(os.Stderr, "保存失败:", err)
+				return 1
+			}
+			return 0
+		}
+	}
+	fs := flag.NewFlagSet("discover", flag.ContinueOnError)
+	window := fs.Duration("window", 10*time.Second, "与平台查询相隔多久内算作相关")
+	minHits := fs.Int("min-hits", 2, "最少出现次数")
+	noResolve := fs.Bool("no-resolve", false, "不查询 CNAME 链")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	cands, err := discoverDomains(discoverOptions{Window: *window, MinHits: *minHits, Resolve: !*noResolve}, func(s string) { fmt.Fprintln(os.Stderr, s) })
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "分析失败:", err)
+		return 1
+	}
+	for _, c := range cands {
+		fmt.Println(c.String())
+	}
+	if len(cands) > 0 {
+		fmt.Println("\n使用 discover accept 域名...|all 加入本地补充，discover ignore 域名... 忽略")
+	}
+	return 0
+}
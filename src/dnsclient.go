@@ -0,0 +1,243 @@
+package src
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strings"
+	"time"
+)
+
+// A small DNS client so health checks and the query page don't depend on dig
+// being installed. It understands A, AAAA, CNAME and SOA.
+
+const (
+	dnsTypeA     uint16 = 1
+	dnsTypeCNAME uint16 = 5
+	dnsTypeSOA   uint16 = 6
+	dnsTypeAAAA  uint16 = 28
+
+	dnsRcodeNoError  = 0
+	dnsRcodeServFail = 2
+	dnsRcodeNXDomain = 3
+)
+
+// dnsRecord is one answer record; Data is the printable rdata.
+type dnsRecord struct {
+	Name string
+	Type uint16
+	TTL  uint32
+	Data string
+}
+
+type dnsReply struct {
+	Rcode     int
+	Answers   []dnsRecord
+	Authority []dnsRecord // SOA of NXDOMAIN / NODATA replies
+	RTT       time.Duration
+}
+
+func dnsTypeName(t uint16) string {
+	switch t {
+	case dnsTypeA:
+		return "A"
+	case dnsTypeAAAA:
+		return "AAAA"
+	case dnsTypeCNAME:
+		return "CNAME"
+	case dnsTypeSOA:
+		return "SOA"
+	}
+	return fmt.Sprintf("TYPE%d", t)
+}
+
+func dnsRcodeName(rcode int) string {
+	switch rcode {
+	case dnsRcodeNoError:
+		return "NOERROR"
+	case dnsRcodeServFail:
+		return "SERVFAIL"
+	case dnsRcodeNXDomain:
+		return "NXDOMAIN"
+	case 5:
+		return "REFUSED"
+	}
+	return fmt.Sprintf("RCODE%d", rcode)
+}
+
+// addresses returns the A/AAAA data in the answer section.
+func (r *dnsReply) addresses() []string {
+	var out []string
+	for _, rr := range r.Answers {
+		if rr.Type == dnsTypeA || rr.Type == dnsTypeAAAA {
+			out = append(out, rr.Data)
+		}
+	}
+	return out
+}
+
+// dnsQuery sends one UDP query to server (host or host:port) and parses the reply.
+func dnsQuery(server, name string, qtype uint16, timeout time.Duration) (*dnsReply, error) {
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "53")
+	}
+	id := uint16(rand.Intn(1 << 16))
+	msg, err := dnsBuildQuery(id, name, qtype)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.DialTimeout("udp", server, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+	start := time.Now()
+	if _, err := conn.Write(msg); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 4096)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		if n < 12 || binary.BigEndian.Uint16(buf) != id {
+			continue // stray or late reply
+		}
+		reply, err := dnsParseReply(buf[:n])
+		if err != nil {
+			return nil, err
+		}
+		reply.RTT = time.Since(start)
+		return reply, nil
+	}
+}
+
+func dnsBuildQuery(id uint16, name string, qtype uint16) ([]byte, error) {
+	msg := make([]byte, 12, 512)
+	binary.BigEndian.PutUint16(msg[0:], id)
+	binary.BigEndian.PutUint16(msg[2:], 0x0100) // RD
+	binary.BigEndian.PutUint16(msg[4:], 1)
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if label == "" || len(label) > 63 {
+			return nil, fmt.Errorf("无效域名: %q", name)
+		}
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	msg = append(msg, 0, byte(qtype>>8), byte(qtype), 0, 1)
+	return msg, nil
+}
+
+var errDNSShort = errors.New("DNS 应答被截断")
+
+func dnsParseReply(msg []byte) (*dnsReply, error) {
+	reply := &dnsReply{Rcode: int(msg[3] & 0x0f)}
+	qd := int(binary.BigEndian.Uint16(msg[4:]))
+	an := int(binary.BigEndian.Uint16(msg[6:]))
+	off := 12
+	for i := 0; i < qd; i++ {
+		_, next, err := dnsReadName(msg, off)
+		if err != nil {
+			return nil, err
+		}
+		off = next + 4
+	}
+	ns := int(binary.BigEndian.Uint16(msg[8:]))
+	for i := 0; i < an+ns; i++ {
+		rr, next, err := dnsReadRecord(msg, off)
+		if err != nil {
+			return nil, err
+		}
+		if i < an {
+			reply.Answers = append(reply.Answers, rr)
+		} else {
+			reply.Authority = append(reply.Authority, rr)
+		}
+		off = next
+	}
+	return reply, nil
+}
+
+func dnsReadRecord(msg []byte, off int) (dnsRecord, int, error) {
+	name, next, err := dnsReadName(msg, off)
+	if err != nil {
+		return dnsRecord{}, 0, err
+	}
+	if next+10 > len(msg) {
+		return dnsRecord{}, 0, errDNSShort
+	}
+	rr := dnsRecord{
+		Name: name,
+		Type: binary.BigEndian.Uint16(msg[next:]),
+		TTL:  binary.BigEndian.Uint32(msg[next+4:]),
+	}
+	rdlen := int(binary.BigEndian.Uint16(msg[next+8:]))
+	start := next + 10
+	if start+rdlen > len(msg) {
+		return dnsRecord{}, 0, errDNSShort
+	}
+	rdata := msg[start : start+rdlen]
+	switch {
+	case rr.Type == dnsTypeA && rdlen == 4, rr.Type == dnsTypeAAAA && rdlen == 16:
+		rr.Data = net.IP(rdata).String()
+	case rr.Type == dnsTypeCNAME:
+		if rr.Data, _, err = dnsReadName(msg, start); err != nil {
+			return dnsRecord{}, 0, err
+		}
+	case rr.Type == dnsTypeSOA:
+		mname, p, err := dnsReadName(msg, start)
+		if err != nil {
+			return dnsRecord{}, 0, err
+		}
+		rname, p, err := dnsReadName(msg, p)
+		if err != nil {
+			return dnsRecord{}, 0, err
+		}
+		if p+20 > start+rdlen {
+			return dnsRecord{}, 0, errDNSShort
+		}
+		rr.Data = fmt.Sprintf("%s %s serial=%d minimum=%d", mname, rname,
+			binary.BigEndian.Uint32(msg[p:]), binary.BigEndian.Uint32(msg[p+16:]))
+	default:
+		rr.Data = fmt.Sprintf("(%d 字节)", rdlen)
+	}
+	return rr, start + rdlen, nil
+}
+
+// dnsReadName decodes a possibly compressed name at off and returns the offset after it.
+func dnsReadName(msg []byte, off int) (string, int, error) {
+	var labels []string
+	end := -1
+	for hops := 0; hops < 64; hops++ {
+		if off >= len(msg) {
+			return "", 0, errDNSShort
+		}
+		l := int(msg[off])
+		switch {
+		case l == 0:
+			if end < 0 {
+				end = off + 1
+			}
+			return strings.Join(labels, ".") + ".", end, nil
+		case l&0xc0 == 0xc0:
+			if off+1 >= len(msg) {
+				return "", 0, errDNSShort
+			}
+			if end < 0 {
+				end = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3fff)
+		default:
+			if off+1+l > len(msg) {
+				return "", 0, errDNSShort
+			}
+			labels = append(labels, string(msg[off+1:off+1+l]))
+			off += 1 + l
+		}
+	}
+	return "", 0, errors.New("DNS 名称压缩指针循环")
+}
@@ -0,0 +1,124 @@
+package src
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// DNS query page: resolve a domain (or every domain of a platform) against the
+// local smartdns, the assigned group's upstream and a default server, and show
+// which smartdns.conf rule should have applied (see explain.go).
+
+type dnsTarget struct {
+	Kind   string // "local", "group" or "default"
+	Label  string
+	Server string
+}
+
+// dnsTraceTargets lists where to ask: local smartdns, the first upstream of
+// the group the name resolves through and the first default server (8.8.8.8
+// when none is configured).
+func dnsTraceTargets(res explainResult) []dnsTarget {
+	targets := []dnsTarget{{Kind: "local", Label: "本机 smartdns", Server: "127.0.0.1"}}
+	if res.Group != "" {
+		for _, u := range res.Upstreams {
+			if !strings.Contains(u.Addr, "/") {
+				targets = append(targets, dnsTarget{Kind: "group", Label: "分组 " + res.Group, Server: u.Addr})
+				break
+			}
+		}
+	}
+	def := "8.8.8.8"
+	if servers := parseDefaultServers(); len(servers) > 0 {
+		def = servers[0]
+	}
+	return append(targets, dnsTarget{Kind: "default", Label: "默认上游", Server: def})
+}
+
+// traceDomain queries domain for A and AAAA at every target and writes a
+// report (tview color tags) line by line to out.
+func traceDomain(domain string, out func(string)) {
+	domain = strings.TrimSpace(domain)
+	res, err := explainDomain(domain)
+	if err != nil {
+		out("  [yellow]读取 smartdns.conf 失败: " + err.Error() + "[-]")
+	}
+	rule := res.Address
+	if rule == nil || rule.Target == "-" {
+		rule = res.Nameserver
+	}
+	out(fmt.Sprintf("[yellow]%s[-]", domain))
+	if rule == nil || rule.Target == "-" {
+		out("  规则: [gray]无匹配，走默认上游[-]")
+		rule = nil
+	} else {
+		where := ""
+		if rule.Sub != "" {
+			where = "（平台 " + rule.Sub + "）"
+		}
+		out(fmt.Sprintf("  规则: %s %s%s", rule.where(), rule.Text, where))
+	}
+	var local []string
+	var group []string
+	for _, t := range dnsTraceTargets(res) {
+		for _, qt := range []uint16{dnsTypeA, dnsTypeAAAA} {
+			reply, err := dnsQuery(t.Server, domain, qt, 3*time.Second)
+			head := fmt.Sprintf("  %s %s %-4s", t.Label, t.Server, dnsTypeName(qt))
+			if err != nil {
+				out(head + " [red]" + err.Error() + "[-]")
+				continue
+			}
+			color := "green"
+			if reply.Rcode != dnsRcodeNoError {
+				color = "red"
+			}
+			out(fmt.Sprintf("%s [%s]%s[-] %s", head, color, dnsRcodeName(reply.Rcode), reply.RTT.Round(time.Millisecond)))
+			for _, rr := range reply.Answers {
+				out(fmt.Sprintf("      %-5s %6ds  %s", dnsTypeName(rr.Type), rr.TTL, rr.Data))
+			}
+			for _, rr := range reply.Authority {
+				if rr.Type == dnsTypeSOA {
+					out(fmt.Sprintf("      SOA   %6ds  %s", rr.TTL, rr.Data))
+				}
+			}
+			switch t.Kind {
+			case "local":
+				local = append(local, reply.addresses()...)
+			case "group":
+				group = append(group, reply.addresses()...)
+			}
+		}
+	}
+	out("  结论: " + traceVerdict(rule, local, group))
+}
+
+// traceVerdict checks whether smartdns's answer is consistent with the rule.
+func traceVerdict(rule *sdnsRule, local, group []string) string {
+	if len(local) == 0 {
+		return "[red]本机 smartdns 没有返回地址[-]"
+	}
+	switch {
+	case rule == nil:
+		return "[green]本机已解析（未分配，走默认上游）[-]"
+	case rule.Kind == "address":
+		for _, ip := range local {
+			if ip == rule.Target {
+				return "[green]符合 address 规则 -> " + rule.Target + "[-]"
+			}
+		}
+		return "[red]本机应答不含 address 规则的 " + rule.Target + "（smartdns 是否已重启？）[-]"
+	case len(group) == 0:
+		return "[yellow]分组上游未返回地址，无法比对[-]"
+	}
+	seen := map[string]bool{}
+	for _, ip := range group {
+		seen[ip] = true
+	}
+	for _, ip := range local {
+		if seen[ip] {
+			return "[green]与分组 " + rule.Target + " 的应答一致[-]"
+		}
+	}
+	return "[yellow]与分组 " + rule.Target + " 的应答不同（CDN 轮换或未生效）[-]"
+}
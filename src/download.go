@@ -0,0 +1,438 @@
+package src
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// One downloader for everything smartdnsctl fetches from GitHub (StreamConfig,
+// SmartDNS releases, checksums, self-update). Requests go through the
+// download_proxy setting (or the usual *_PROXY environment variables), GitHub
+// URLs are retried through the ordered download_mirrors list, and files are
+// written to <dst>.part first so an interrupted download resumes where it
+// stopped (Range request with If-Range) instead of starting over.
+
+// MIRROR_DIRECT marks where the original URL is tried in the mirror list
+// (first when the list does not name it).
+const MIRROR_DIRECT = "direct"
+
+// githubHosts are the hosts mirrors apply to (release assets and raw files;
+// the API is mirrored through release_api instead).
+var githubHosts = map[string]bool{
+	"github.com":                    true,
+	"raw.githubusercontent.com":     true,
+	"objects.githubusercontent.com": true,
+	"codeload.github.com":           true,
+}
+
+// downloadStall is how long an attempt may go without receiving a byte
+// before it is aborted (a var so tests can shorten it).
+var downloadStall = 30 * time.Second
+
+const downloadRetries = 3 // attempts per source while each one makes progress
+
+// downloadOptions overrides the settings (the CLI uses it to try a proxy or
+// mirror without saving it). OriginOnly skips the mirrors, for files that
+// vouch for other downloads (checksums) and so must not come from a mirror.
+type downloadOptions struct {
+	Proxy      *outboundRoute
+	Mirrors    []string
+	OriginOnly bool
+	Log        func(string)
+}
+
+func (o downloadOptions) withSettings() downloadOptions {
+	st := loadSettings()
+	if o.Proxy == nil {
+		o.Proxy = &st.DownloadProxy
+	}
+	if o.Mirrors == nil {
+		o.Mirrors = st.DownloadMirrors
+	}
+	if o.Log == nil {
+		o.Log = func(string) {}
+	}
+	return o
+}
+
+// sources lists the URLs to try for raw under these options.
+func (o downloadOptions) sources(raw string) []string {
+	if o.OriginOnly {
+		return []string{raw}
+	}
+	return downloadSources(raw, o.Mirrors)
+}
+
+// downloadClient builds a client that goes through proxy: SOCKS5 via
+// dialOutbound, HTTP through the transport's own proxy support, and direct
+// honouring HTTP_PROXY / HTTPS_PROXY / ALL_PROXY / NO_PROXY.
+func downloadClient(proxy outboundRoute) *http.Client {
+	d := &net.Dialer{Timeout: 10 * time.Second, KeepAlive: 30 * time.Second}
+	tr := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           d.DialContext,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 20 * time.Second,
+		ForceAttemptHTTP2:     true,
+	}
+	switch proxy.Type {
+	case OUTBOUND_SOCKS5:
+		tr.Proxy = nil
+		tr.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dialOutbound(ctx, d, proxy, addr)
+		}
+	case OUTBOUND_HTTP:
+		u := &url.URL{Scheme: "http", Host: proxy.Addr}
+		if proxy.User != "" {
+			u.User = url.UserPassword(proxy.User, proxy.Pass)
+		}
+		tr.Proxy = http.ProxyURL(u)
+	}
+	return &http.Client{Transport: tr}
+}
+
+// mirrorURL rewrites raw through one mirror entry: "{url}", "{host}" and
+// "{path}" are substituted, otherwise the entry is a ghproxy-style prefix.
+func mirrorURL(mirror, raw string) string {
+	if !strings.Contains(mirror, "{") {
+		return strings.TrimRight(mirror, "/") + "/" + raw
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return raw
+	}
+	return strings.NewReplacer("{url}", raw, "{host}", u.Host, "{path}", u.RequestURI()).Replace(mirror)
+}
+
+// downloadSources lists the URLs to try for raw, in order.
+func downloadSources(raw string, mirrors []string) []string {
+	u, err := url.Parse(raw)
+	if err != nil || !githubHosts[u.Hostname()] || len(mirrors) == 0 {
+		return []string{raw}
+	}
+	var out []string
+	seen := map[string]bool{}
+	add := func(s string) {
+		if !seen[s] {
+			seen[s] = true
+			out = append(out, s)
+		}
+	}
+	named := false
+	for _, m := range mirrors {
+		if strings.TrimSpace(m) == MIRROR_DIRECT {
+			named = true
+		}
+	}
+	if !named {
+		add(raw)
+	}
+	for _, m := range mirrors {
+		switch m = strings.TrimSpace(m); m {
+		case "":
+		case MIRROR_DIRECT:
+			add(raw)
+		default:
+			add(mirrorURL(m, raw))
+		}
+	}
+	return out
+}
+
+// hostOf is the host a source URL points at, for log lines.
+func hostOf(raw string) string {
+	if u, err := url.Parse(raw); err == nil && u.Host != "" {
+		return u.Host
+	}
+	return raw
+}
+
+// download fetches raw into dst, trying each source in turn and resuming
+// <dst>.part across attempts, sources and runs. Progress goes to opt.Log.
+func download(raw, dst string, opt downloadOptions) error {
+	opt = opt.withSettings()
+	if err := ensureDir(filepath.Dir(dst)); err != nil {
+		return err
+	}
+	client := downloadClient(*opt.Proxy)
+	if !opt.Proxy.isDirect() {
+		opt.Log("经代理下载: " + opt.Proxy.String())
+	}
+	part := dst + ".part"
+	var errs []string
+	for _, src := range opt.sources(raw) {
+		if src != raw {
+			opt.Log("尝试镜像 " + hostOf(src) + " ...")
+		}
+		var err error
+		for attempt := 0; attempt < downloadRetries; attempt++ {
+			var progressed bool
+			progressed, err = downloadOnce(client, src, part, opt.Log)
+			if err == nil {
+				_ = os.Remove(part + ".etag")
+				return os.Rename(part, dst)
+			}
+			if !progressed {
+				break
+			}
+			opt.Log("[中断] " + err.Error() + "，断点续传 ...")
+		}
+		opt.Log("[失败] " + hostOf(src) + ": " + err.Error())
+		errs = append(errs, hostOf(src)+": "+err.Error())
+	}
+	return errors.New(strings.Join(errs, "; "))
+}
+
+// downloadOnce requests the rest of part from src and appends to it.
+// progressed reports whether any bytes arrived (worth retrying).
+func downloadOnce(client *http.Client, src, part string, log func(string)) (progressed bool, err error) {
+	// resume only against the validator the partial file was fetched with,
+	// so a file changed upstream is fetched again instead of spliced
+	var have int64
+	validator, _ := os.ReadFile(part + ".etag")
+	if fi, err := os.Stat(part); err == nil && len(validator) > 0 {
+		have = fi.Size()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, src, nil)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("User-Agent", "smartdnsctl/"+SCRIPT_VERSION)
+	if have > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", have))
+		req.Header.Set("If-Range", string(validator))
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	flags := os.O_CREATE | os.O_WRONLY
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && have > 0:
+		flags |= os.O_APPEND
+		log(fmt.Sprintf("从 %s 处继续下载", humanBytes(have)))
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable && have > 0:
+		// the partial file does not fit this source; start over
+		_ = os.Remove(part)
+		_ = os.Remove(part + ".etag")
+		return true, errors.New("无法续传，重新下载")
+	case resp.StatusCode >= 200 && resp.StatusCode <= 299:
+		flags |= os.O_TRUNC
+		have = 0
+		v := resp.Header.Get("ETag")
+		if v == "" || strings.HasPrefix(v, "W/") {
+			v = resp.Header.Get("Last-Modified")
+		}
+		if v == "" {
+			_ = os.Remove(part + ".etag")
+		} else if err := os.WriteFile(part+".etag", []byte(v), 0o644); err != nil {
+			return false, err
+		}
+	default:
+		return false, fmt.Errorf("http error: %s", resp.Status)
+	}
+	f, err := os.OpenFile(part, flags, 0o644)
+	if err != nil {
+		return false, err
+	}
+	total := int64(-1)
+	if resp.ContentLength >= 0 {
+		total = have + resp.ContentLength
+	}
+	p := &progressWriter{log: log, done: have, total: total, start: time.Now(), last: time.Now()}
+	// a stalled connection is cancelled rather than waited on forever
+	stall := time.AfterFunc(downloadStall, cancel)
+	n, err := io.Copy(io.MultiWriter(f, p), &stallReader{r: resp.Body, t: stall})
+	stall.Stop()
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && total >= 0 && have+n < total {
+		err = io.ErrUnexpectedEOF
+	}
+	if errors.Is(ctx.Err(), context.Canceled) && err != nil {
+		err = fmt.Errorf("%s 内没有收到数据", downloadStall)
+	}
+	if err == nil {
+		p.report(true)
+	}
+	return n > 0, err
+}
+
+// stallReader pushes the stall timer back on every read that returns data.
+type stallReader struct {
+	r io.Reader
+	t *time.Timer
+}
+
+func (s *stallReader) Read(b []byte) (int, error) {
+	n, err := s.r.Read(b)
+	if n > 0 {
+		s.t.Reset(downloadStall)
+	}
+	return n, err
+}
+
+// progressWriter logs a progress line every couple of seconds.
+type progressWriter struct {
+	mu    sync.Mutex
+	log   func(string)
+	done  int64
+	total int64
+	got   int64 // this attempt, for the rate
+	start time.Time
+	last  time.Time
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	p.done += int64(len(b))
+	p.got += int64(len(b))
+	p.mu.Unlock()
+	if time.Since(p.last) >= 2*time.Second {
+		p.report(false)
+	}
+	return len(b), nil
+}
+
+func (p *progressWriter) report(final bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.last = time.Now()
+	secs := time.Since(p.start).Seconds()
+	rate := ""
+	if secs > 0 {
+		rate = "，" + humanBytes(int64(float64(p.got)/secs)) + "/s"
+	}
+	switch {
+	case final:
+		p.log("下载完成: " + humanBytes(p.done) + rate)
+	case p.total > 0:
+		p.log(fmt.Sprintf("已下载 %s / %s (%d%%)%s", humanBytes(p.done), humanBytes(p.total), p.done*100/p.total, rate))
+	default:
+		p.log("已下载 " + humanBytes(p.done) + rate)
+	}
+}
+
+// fetchURL downloads a small document (checksums, release listings) into
+// memory through the same proxy and, unless opt.OriginOnly, mirrors.
+func fetchURL(raw string, headers map[string]string, timeout time.Duration, opt downloadOptions) ([]byte, error) {
+	opt = opt.withSettings()
+	client := downloadClient(*opt.Proxy)
+	client.Timeout = timeout
+	var errs []string
+	for _, src := range opt.sources(raw) {
+		req, err := http.NewRequest(http.MethodGet, src, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("User-Agent", "smartdnsctl/"+SCRIPT_VERSION) // the GitHub API rejects requests without one
+		if src == raw {
+			for k, v := range headers { // credentials only ever go to the original host
+				req.Header.Set(k, v)
+			}
+		}
+		b, err := func() ([]byte, error) {
+			resp, err := client.Do(req)
+			if err != nil {
+				return nil, err
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode < 200 || resp.StatusCode > 299 {
+				return nil, fmt.Errorf("http error: %s", resp.Status)
+			}
+			return io.ReadAll(io.LimitReader(resp.Body, 16<<20))
+		}()
+		if err == nil {
+			return b, nil
+		}
+		errs = append(errs, hostOf(src)+": "+err.Error())
+	}
+	return nil, errors.New(strings.Join(errs, "; "))
+}
+
+// parseProxyURL reads socks5://[user:pass@]host:port or http://... into a route.
+func parseProxyURL(s string) (outboundRoute, error) {
+	if s == "" || s == OUTBOUND_DIRECT {
+		return outboundRoute{Type: OUTBOUND_DIRECT}, nil
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return outboundRoute{}, err
+	}
+	o := outboundRoute{Addr: u.Host}
+	switch u.Scheme {
+	case "socks5", "socks5h":
+		o.Type = OUTBOUND_SOCKS5
+	case "http":
+		o.Type = OUTBOUND_HTTP
+	default:
+		return outboundRoute{}, fmt.Errorf("代理需为 socks5:// 或 http://: %s", s)
+	}
+	if u.User != nil {
+		o.User = u.User.Username()
+		o.Pass, _ = u.User.Password()
+	}
+	return o, o.validate()
+}
+
+// runDownloadCommand implements `smartdnsctl download`: fetch one URL with the
+// configured (or given) proxy and mirrors, e.g. to check them or to point a
+// mirror at a local HTTP stand-in.
+func runDownloadCommand(args []string) int {
+	fs := flag.NewFlagSet("download", flag.ContinueOnError)
+	proxy := fs.String("proxy", "", "本次使用的代理: socks5://[用户:密码@]host:port、http://host:port 或 direct")
+	var mirrors []string
+	fs.Func("mirror", "本次使用的镜像（可重复，按顺序尝试；direct 表示原地址）", func(s string) error {
+		mirrors = append(mirrors, s)
+		return nil
+	})
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() < 1 || fs.NArg() > 2 {
+		fmt.Fprintln(os.Stderr, "用法: smartdnsctl download [--proxy URL] [--mirror 前缀]... URL [文件]")
+		return 2
+	}
+	raw := fs.Arg(0)
+	dst := fs.Arg(1)
+	if dst == "" {
+		u, err := url.Parse(raw)
+		if err != nil || filepath.Base(u.Path) == "/" || filepath.Base(u.Path) == "." {
+			fmt.Fprintln(os.Stderr, "无法从 URL 推断文件名，请指定文件")
+			return 2
+		}
+		dst = filepath.Base(u.Path)
+	}
+	opt := downloadOptions{Mirrors: mirrors, Log: func(s string) { fmt.Println(s) }}
+	if *proxy != "" {
+		o, err := parseProxyURL(*proxy)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		opt.Proxy = &o
+	}
+	if err := download(raw, dst, opt); err != nil {
+		fmt.Fprintln(os.Stderr, "下载失败:", err)
+		return 1
+	}
+	if sum, err := fileSHA256(dst); err == nil {
+		fmt.Println(dst, "sha256:", sum)
+	}
+	return 0
+}
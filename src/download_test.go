@@ -0,0 +1,332 @@
+package src
+
+import (
+	"bytes"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testContent is what the stand-in servers hand out.
+var testContent = bytes.Repeat([]byte("0123456789abcdef"), 4096)
+
+// seenRequest is one request a stand-in server received.
+type seenRequest struct {
+	url     string // absolute when the request came through the proxy
+	rng     string
+	ifRange string
+	auth    string
+	proxy   string
+}
+
+type requestRecorder struct {
+	mu   sync.Mutex
+	reqs []seenRequest
+}
+
+func (rec *requestRecorder) all() []seenRequest {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	return append([]seenRequest(nil), rec.reqs...)
+}
+
+func (rec *requestRecorder) urls() []string {
+	var out []string
+	for _, r := range rec.all() {
+		out = append(out, r.url)
+	}
+	return out
+}
+
+// newTestServer starts h behind a recorder; it doubles as an HTTP proxy since
+// proxied requests arrive with an absolute URL.
+func newTestServer(t *testing.T, h http.HandlerFunc) (*httptest.Server, *requestRecorder) {
+	t.Helper()
+	rec := &requestRecorder{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec.mu.Lock()
+		rec.reqs = append(rec.reqs, seenRequest{
+			url:     r.URL.String(),
+			rng:     r.Header.Get("Range"),
+			ifRange: r.Header.Get("If-Range"),
+			auth:    r.Header.Get("Authorization"),
+			proxy:   r.Header.Get("Proxy-Authorization"),
+		})
+		rec.mu.Unlock()
+		h(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, rec
+}
+
+// serveTestContent answers with Range / If-Range support against ETag "v1".
+func serveTestContent(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("ETag", `"v1"`)
+	http.ServeContent(w, r, "f", time.Time{}, bytes.NewReader(testContent))
+}
+
+func directTestOpts(t *testing.T) downloadOptions {
+	return downloadOptions{
+		Proxy:   &outboundRoute{Type: OUTBOUND_DIRECT},
+		Mirrors: []string{},
+		Log:     func(s string) { t.Log(s) },
+	}
+}
+
+func assertTestDownload(t *testing.T, dst string) {
+	t.Helper()
+	got, err := os.ReadFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, testContent) {
+		t.Fatalf("content mismatch: %d bytes, want %d", len(got), len(testContent))
+	}
+	for _, leftover := range []string{dst + ".part", dst + ".part.etag"} {
+		if fileExists(leftover) {
+			t.Fatalf("%s left behind", leftover)
+		}
+	}
+}
+
+func TestDownloadSources(t *testing.T) {
+	raw := "https://github.com/o/r/releases/download/v1/f.tar.gz"
+	tests := []struct {
+		name    string
+		raw     string
+		mirrors []string
+		want    []string
+	}{
+		{"no mirrors", raw, nil, []string{raw}},
+		{"origin first by default", raw, []string{"https://m1/"}, []string{raw, "https://m1/" + raw}},
+		{
+			"direct placed explicitly",
+			raw,
+			[]string{"https://m1", " direct ", "http://10.0.0.2:8080{path}"},
+			[]string{"https://m1/" + raw, raw, "http://10.0.0.2:8080/o/r/releases/download/v1/f.tar.gz"},
+		},
+		{
+			"templates, blanks and duplicates",
+			raw,
+			[]string{"direct", "", "https://m/{host}{path}", "https://m/{url}", "direct"},
+			[]string{raw, "https://m/github.com/o/r/releases/download/v1/f.tar.gz", "https://m/" + raw},
+		},
+		{"non-github host", "https://example.com/f", []string{"https://m1/", "direct"}, []string{"https://example.com/f"}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := downloadSources(tc.raw, tc.mirrors); !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("got %q\nwant %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestDownloadResume(t *testing.T) {
+	const have = 1000
+	ignoreRange := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		w.Write(testContent)
+	}
+	tests := []struct {
+		name      string
+		handler   http.HandlerFunc
+		part      []byte
+		validator string        // "" leaves no .etag next to the part
+		want      []seenRequest // rng and ifRange of each request
+	}{
+		{
+			name: "range with if-range", handler: serveTestContent,
+			part: testContent[:have], validator: `"v1"`,
+			want: []seenRequest{{rng: "bytes=1000-", ifRange: `"v1"`}},
+		},
+		{
+			name: "changed upstream", handler: serveTestContent,
+			part: []byte(strings.Repeat("x", have)), validator: `"v0"`,
+			want: []seenRequest{{rng: "bytes=1000-", ifRange: `"v0"`}},
+		},
+		{
+			name: "part without validator", handler: serveTestContent,
+			part: []byte(strings.Repeat("x", have)),
+			want: []seenRequest{{}},
+		},
+		{
+			name: "200 answering a range request", handler: ignoreRange,
+			part: []byte(strings.Repeat("x", have)), validator: `"v1"`,
+			want: []seenRequest{{rng: "bytes=1000-", ifRange: `"v1"`}},
+		},
+		{
+			name: "416 restarts", handler: serveTestContent,
+			part: append(append([]byte{}, testContent...), "trailing"...), validator: `"v1"`,
+			want: []seenRequest{{rng: "bytes=65544-", ifRange: `"v1"`}, {}},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			srv, rec := newTestServer(t, tc.handler)
+			dst := filepath.Join(t.TempDir(), "f")
+			if err := os.WriteFile(dst+".part", tc.part, 0o644); err != nil {
+				t.Fatal(err)
+			}
+			if tc.validator != "" {
+				os.WriteFile(dst+".part.etag", []byte(tc.validator), 0o644)
+			}
+			if err := download(srv.URL+"/f", dst, directTestOpts(t)); err != nil {
+				t.Fatal(err)
+			}
+			assertTestDownload(t, dst)
+			var got []seenRequest
+			for _, r := range rec.all() {
+				got = append(got, seenRequest{rng: r.rng, ifRange: r.ifRange})
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("requests %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestDownloadStall(t *testing.T) {
+	old := downloadStall
+	downloadStall = 200 * time.Millisecond
+	t.Cleanup(func() { downloadStall = old })
+
+	hang := func(t *testing.T, w http.ResponseWriter, r *http.Request, body []byte) {
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Content-Length", "65536")
+		w.Write(body)
+		w.(http.Flusher).Flush()
+		select {
+		case <-r.Context().Done():
+		case <-time.After(10 * time.Second):
+			t.Error("stalled request was not aborted")
+		}
+	}
+
+	t.Run("resumes after stall", func(t *testing.T) {
+		var n int
+		var mu sync.Mutex
+		srv, rec := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			n++
+			first := n == 1
+			mu.Unlock()
+			if first {
+				hang(t, w, r, testContent[:len(testContent)/2])
+				return
+			}
+			serveTestContent(w, r)
+		})
+		dst := filepath.Join(t.TempDir(), "f")
+		if err := download(srv.URL+"/f", dst, directTestOpts(t)); err != nil {
+			t.Fatal(err)
+		}
+		assertTestDownload(t, dst)
+		reqs := rec.all()
+		if len(reqs) != 2 || reqs[1].rng != "bytes=32768-" {
+			t.Fatalf("requests %+v, want a resume from 32768", reqs)
+		}
+	})
+
+	t.Run("gives up without progress", func(t *testing.T) {
+		srv, rec := newTestServer(t, func(w http.ResponseWriter, r *http.Request) { hang(t, w, r, nil) })
+		dst := filepath.Join(t.TempDir(), "f")
+		start := time.Now()
+		err := download(srv.URL+"/f", dst, directTestOpts(t))
+		if err == nil || !strings.Contains(err.Error(), "内没有收到数据") {
+			t.Fatalf("want a stall error, got %v", err)
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("stall took %s to detect", time.Since(start))
+		}
+		if n := len(rec.all()); n != 1 {
+			t.Fatalf("%d requests; an attempt without progress must not be retried", n)
+		}
+	})
+}
+
+// githubOrigin is what the proxy stand-in refuses, to force the mirrors.
+const githubOrigin = "http://github.com/o/r/releases/download/v1/f"
+
+// mirrorProxy is an HTTP proxy stand-in: github.com fails, m1.test 404s and
+// any other host is served testContent.
+func mirrorProxy(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Host {
+	case "github.com":
+		http.Error(w, "unreachable", http.StatusBadGateway)
+	case "m1.test":
+		http.NotFound(w, r)
+	default:
+		serveTestContent(w, r)
+	}
+}
+
+func proxyTestOpts(t *testing.T, srv *httptest.Server, mirrors ...string) downloadOptions {
+	opt := directTestOpts(t)
+	opt.Proxy = &outboundRoute{Type: OUTBOUND_HTTP, Addr: srv.Listener.Addr().String(), User: "u", Pass: "p"}
+	opt.Mirrors = mirrors
+	return opt
+}
+
+func TestDownloadMirrorsThroughHTTPProxy(t *testing.T) {
+	srv, rec := newTestServer(t, mirrorProxy)
+	dst := filepath.Join(t.TempDir(), "f")
+	opt := proxyTestOpts(t, srv, "http://m1.test/", "direct", "http://m2.test{path}")
+	if err := download(githubOrigin, dst, opt); err != nil {
+		t.Fatal(err)
+	}
+	assertTestDownload(t, dst)
+	want := []string{"http://m1.test/" + githubOrigin, githubOrigin, "http://m2.test/o/r/releases/download/v1/f"}
+	if got := rec.urls(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("tried %q\nwant %q", got, want)
+	}
+	auth := "Basic " + base64.StdEncoding.EncodeToString([]byte("u:p"))
+	for _, r := range rec.all() {
+		if r.proxy != auth {
+			t.Fatalf("%s: Proxy-Authorization %q, want %q", r.url, r.proxy, auth)
+		}
+	}
+}
+
+func TestFetchURLHeadersOnlyToOrigin(t *testing.T) {
+	srv, rec := newTestServer(t, mirrorProxy)
+	headers := map[string]string{"Authorization": "Bearer secret"}
+	b, err := fetchURL(githubOrigin, headers, 5*time.Second, proxyTestOpts(t, srv, "http://m1.test/", "http://m2.test/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, testContent) {
+		t.Fatal("content mismatch")
+	}
+	reqs := rec.all()
+	if len(reqs) != 3 {
+		t.Fatalf("requests %+v, want origin then both mirrors", reqs)
+	}
+	if reqs[0].url != githubOrigin || reqs[0].auth != "Bearer secret" {
+		t.Fatalf("origin request %+v must carry the header", reqs[0])
+	}
+	for _, r := range reqs[1:] {
+		if r.auth != "" {
+			t.Fatalf("header leaked to mirror %s", r.url)
+		}
+	}
+}
+
+func TestFetchURLOriginOnly(t *testing.T) {
+	srv, rec := newTestServer(t, mirrorProxy)
+	opt := proxyTestOpts(t, srv, "http://m2.test/", "direct")
+	opt.OriginOnly = true
+	if _, err := fetchURL(githubOrigin, nil, 5*time.Second, opt); err == nil {
+		t.Fatal("fetch succeeded although only a mirror could serve it")
+	}
+	if got := rec.urls(); !reflect.DeepEqual(got, []string{githubOrigin}) {
+		t.Fatalf("tried %q, want only the origin", got)
+	}
+}
@@ -0,0 +1,381 @@
+package src
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Rule resolution simulator (`smartdnsctl explain <domain>`). It parses
+// smartdns.conf (following conf-file includes and domain-set files) and models
+// how smartdns picks rules for a name:
+//   - a rule for example.com also covers every subdomain; "*.example.com" only
+//     the subdomains and "+.example.com" both;
+//   - the longest matching suffix wins, and for the same suffix the later line
+//     wins;
+//   - address and nameserver are chosen independently; a matching address
+//     answers directly so the nameserver rule is never consulted;
+//   - "-" as target cancels a rule from a shorter suffix;
+//   - names without a nameserver rule go to the default group: plain servers
+//     plus grouped servers without -exclude-default-group.
+
+// sdnsServer is one server/server-tcp/server-tls/server-https line.
+type sdnsServer struct {
+	File           string
+	Line           int
+	Text           string
+	Addr           string
+	Groups         []string
+	ExcludeDefault bool
+}
+
+// sdnsRule is one nameserver/address line.
+type sdnsRule struct {
+	File    string
+	Line    int
+	Text    string
+	Kind    string // "nameserver" or "address"
+	Pattern string // domain as written, or "domain-set:name"
+	Target  string // group, address, "-" (cancel) or "#" (block)
+	Sub     string // platform from the enclosing "#> sub ident" block
+}
+
+func (r *sdnsRule) where() string { return fmt.Sprintf("%s:%d", filepath.Base(r.File), r.Line) }
+
+type sdnsDomainSet struct {
+	File    string
+	Domains []string
+	Err     error
+}
+
+type sdnsConfig struct {
+	Servers    []sdnsServer
+	Rules      []sdnsRule
+	DomainSets map[string]*sdnsDomainSet
+}
+
+func loadSmartDNSConfig() (*sdnsConfig, error) {
+	cfg := &sdnsConfig{DomainSets: map[string]*sdnsDomainSet{}}
+	if err := cfg.parseFile(SMART_CONFIG_FILE, 0); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func (cfg *sdnsConfig) parseFile(path string, depth int) error {
+	if depth > 8 {
+		return fmt.Errorf("conf-file 嵌套过深: %s", path)
+	}
+	lines, err := readLines(path)
+	if err != nil {
+		return err
+	}
+	sub := ""
+	for i, l := range lines {
+		t := strings.TrimSpace(l)
+		if strings.HasPrefix(t, "#> ") {
+			sub = ""
+			if f := strings.Fields(strings.TrimPrefix(t, "#> ")); len(f) > 0 {
+				sub = f[0]
+			}
+			continue
+		}
+		if t == "" {
+			sub = ""
+			continue
+		}
+		if strings.HasPrefix(t, "#") {
+			continue
+		}
+		f := strings.Fields(t)
+		switch {
+		case f[0] == "server" || strings.HasPrefix(f[0], "server-"):
+			if len(f) < 2 {
+				continue
+			}
+			s := sdnsServer{File: path, Line: i + 1, Text: t, Addr: f[1]}
+			for j := 2; j < len(f); j++ {
+				switch f[j] {
+				case "-group", "-g":
+					if j+1 < len(f) {
+						s.Groups = append(s.Groups, f[j+1])
+						j++
+					}
+				case "-exclude-default-group", "-e":
+					s.ExcludeDefault = true
+				}
+			}
+			cfg.Servers = append(cfg.Servers, s)
+		case f[0] == "nameserver" || f[0] == "address":
+			parts := strings.Split(strings.TrimSpace(strings.TrimPrefix(t, f[0])), "/")
+			if len(parts) != 3 || parts[0] != "" {
+				continue
+			}
+			cfg.Rules = append(cfg.Rules, sdnsRule{File: path, Line: i + 1, Text: t, Kind: f[0],
+				Pattern: strings.ToLower(parts[1]), Target: strings.TrimSpace(parts[2]), Sub: sub})
+		case f[0] == "domain-set":
+			name, file := flagValue(f, "-name", "-n"), flagValue(f, "-file", "-f")
+			if name == "" || file == "" {
+				continue
+			}
+			if !filepath.IsAbs(file) {
+				file = filepath.Join(filepath.Dir(path), file)
+			}
+			ds := &sdnsDomainSet{File: file}
+			if dl, err := readLines(file); err != nil {
+				ds.Err = err
+			} else {
+				for _, d := range dl {
+					if d = strings.TrimSpace(d); d != "" && !strings.HasPrefix(d, "#") {
+						ds.Domains = append(ds.Domains, strings.ToLower(d))
+					}
+				}
+			}
+			cfg.DomainSets[name] = ds
+		case f[0] == "conf-file" && len(f) > 1:
+			inc := f[len(f)-1]
+			if !filepath.IsAbs(inc) {
+				inc = filepath.Join(filepath.Dir(path), inc)
+			}
+			matches, _ := filepath.Glob(inc)
+			for _, m := range matches {
+				if err := cfg.parseFile(m, depth+1); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func flagValue(f []string, names ...string) string {
+	for i := 0; i < len(f)-1; i++ {
+		for _, n := range names {
+			if f[i] == n {
+				return f[i+1]
+			}
+		}
+	}
+	return ""
+}
+
+// patternMatch reports whether a single domain pattern covers name and how
+// specific the match is (length of the matched suffix), -1 if it doesn't.
+func patternMatch(pattern, name string) int {
+	subOnly := false
+	switch {
+	case strings.HasPrefix(pattern, "*."):
+		subOnly, pattern = true, pattern[2:]
+	case strings.HasPrefix(pattern, "+."):
+		pattern = pattern[2:]
+	case strings.HasPrefix(pattern, "."):
+		pattern = pattern[1:]
+	}
+	switch {
+	case name == pattern && !subOnly:
+		return len(pattern)
+	case strings.HasSuffix(name, "."+pattern):
+		return len(pattern)
+	}
+	return -1
+}
+
+// specificity returns how specifically r matches name, -1 if not at all.
+func (cfg *sdnsConfig) specificity(r *sdnsRule, name string) int {
+	if set, ok := strings.CutPrefix(r.Pattern, "domain-set:"); ok {
+		best := -1
+		if ds := cfg.DomainSets[set]; ds != nil {
+			for _, d := range ds.Domains {
+				if n := patternMatch(d, name); n > best {
+					best = n
+				}
+			}
+		}
+		return best
+	}
+	return patternMatch(r.Pattern, name)
+}
+
+// groupServers lists the servers in group; "" means the default group.
+func (cfg *sdnsConfig) groupServers(group string) []sdnsServer {
+	var out []sdnsServer
+	for _, s := range cfg.Servers {
+		in := false
+		if group == "" {
+			in = len(s.Groups) == 0 || !s.ExcludeDefault
+		} else {
+			for _, g := range s.Groups {
+				in = in || g == group
+			}
+		}
+		if in {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+type explainShadow struct {
+	Rule   *sdnsRule
+	Reason string
+}
+
+type explainResult struct {
+	Domain     string
+	Address    *sdnsRule // winning address rule (may be a "-" cancel)
+	Nameserver *sdnsRule // winning nameserver rule (may be a "-" cancel)
+	Shadowed   []explainShadow
+	Path       []string
+	// Group is the group queried ("" = default) and Upstreams its servers;
+	// both empty when an address rule answers.
+	Group     string
+	Upstreams []sdnsServer
+}
+
+// explain resolves which rules smartdns applies to name.
+func (cfg *sdnsConfig) explain(name string) explainResult {
+	name = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(name)), ".")
+	res := explainResult{Domain: name}
+	type cand struct {
+		r    *sdnsRule
+		spec int
+	}
+	byKind := map[string][]cand{}
+	for i := range cfg.Rules {
+		r := &cfg.Rules[i]
+		if n := cfg.specificity(r, name); n >= 0 {
+			byKind[r.Kind] = append(byKind[r.Kind], cand{r, n})
+		}
+	}
+	winner := func(kind string) *sdnsRule {
+		cs := byKind[kind]
+		if len(cs) == 0 {
+			return nil
+		}
+		// longest suffix first, then the later line first
+		for i, j := 0, len(cs)-1; i < j; i, j = i+1, j-1 {
+			cs[i], cs[j] = cs[j], cs[i]
+		}
+		sort.SliceStable(cs, func(i, j int) bool { return cs[i].spec > cs[j].spec })
+		for _, c := range cs[1:] {
+			reason := "被更具体的 " + cs[0].r.where() + " 覆盖"
+			if c.spec == cs[0].spec {
+				reason = "同一域名，被后面的 " + cs[0].r.where() + " 覆盖"
+			}
+			res.Shadowed = append(res.Shadowed, explainShadow{c.r, reason})
+		}
+		return cs[0].r
+	}
+	res.Address = winner("address")
+	res.Nameserver = winner("nameserver")
+
+	if a := res.Address; a != nil && a.Target != "-" {
+		if a.Target == "#" || a.Target == "#4" || a.Target == "#6" {
+			res.Path = append(res.Path, fmt.Sprintf("address %s 屏蔽，直接返回 SOA", a.where()))
+		} else {
+			res.Path = append(res.Path, fmt.Sprintf("address %s 直接应答 %s，不查询上游", a.where(), a.Target))
+		}
+		if res.Nameserver != nil {
+			res.Shadowed = append(res.Shadowed, explainShadow{res.Nameserver, "address 规则优先，nameserver 不生效"})
+		}
+		return res
+	}
+	if a := res.Address; a != nil {
+		res.Path = append(res.Path, "address "+a.where()+" 为 \"-\"，取消上级 address 规则")
+	}
+	if ns := res.Nameserver; ns != nil && ns.Target != "-" {
+		res.Group = ns.Target
+		res.Upstreams = cfg.groupServers(ns.Target)
+		if len(res.Upstreams) == 0 {
+			res.Path = append(res.Path, fmt.Sprintf("nameserver %s 指向组 %s，但该组没有 server，回退到默认组", ns.where(), ns.Target))
+			res.Group = ""
+			res.Upstreams = cfg.groupServers("")
+		} else {
+			res.Path = append(res.Path, fmt.Sprintf("nameserver %s -> 组 %s", ns.where(), ns.Target))
+		}
+	} else {
+		if ns != nil {
+			res.Path = append(res.Path, "nameserver "+ns.where()+" 为 \"-\"，使用默认组")
+		} else {
+			res.Path = append(res.Path, "没有 nameserver 规则，使用默认组")
+		}
+		res.Upstreams = cfg.groupServers("")
+	}
+	if len(res.Upstreams) == 0 {
+		res.Path = append(res.Path, "没有可用的上游 server")
+	}
+	return res
+}
+
+// lines renders the result for the CLI and the TUI.
+func (res explainResult) lines() []string {
+	out := []string{res.Domain}
+	win := func(label string, r *sdnsRule) {
+		if r == nil {
+			out = append(out, "  "+label+": 无")
+			return
+		}
+		extra := ""
+		if r.Sub != "" {
+			extra = "  （平台 " + r.Sub + "）"
+		}
+		out = append(out, fmt.Sprintf("  %s: %s  %s%s", label, r.where(), r.Text, extra))
+	}
+	win("address", res.Address)
+	win("nameserver", res.Nameserver)
+	out = append(out, "  路径:")
+	for _, p := range res.Path {
+		out = append(out, "    "+p)
+	}
+	for _, s := range res.Upstreams {
+		tag := ""
+		if len(s.Groups) == 0 {
+			tag = "（默认）"
+		}
+		out = append(out, fmt.Sprintf("    上游 %s%s  %s:%d", s.Addr, tag, filepath.Base(s.File), s.Line))
+	}
+	if len(res.Shadowed) > 0 {
+		out = append(out, "  被遮蔽的规则:")
+		for _, s := range res.Shadowed {
+			out = append(out, fmt.Sprintf("    %s  %s  — %s", s.Rule.where(), s.Rule.Text, s.Reason))
+		}
+	}
+	return out
+}
+
+// explainDomain is explain against the current smartdns.conf.
+func explainDomain(name string) (explainResult, error) {
+	cfg, err := loadSmartDNSConfig()
+	if err != nil {
+		return explainResult{Domain: name}, err
+	}
+	return cfg.explain(name), nil
+}
+
+func runExplainCommand(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "用法: smartdnsctl explain <域名>...")
+		return 2
+	}
+	cfg, err := loadSmartDNSConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "读取 %s 失败: %v\n", SMART_CONFIG_FILE, err)
+		return 1
+	}
+	for name, ds := range cfg.DomainSets {
+		if ds.Err != nil {
+			fmt.Fprintf(os.Stderr, "警告: domain-set %s 读取失败: %v\n", name, ds.Err)
+		}
+	}
+	for i, name := range args {
+		if i > 0 {
+			fmt.Println()
+		}
+		for _, l := range cfg.explain(name).lines() {
+			fmt.Println(l)
+		}
+	}
+	return 0
+}
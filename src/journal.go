@@ -0,0 +1,329 @@
+package src
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Service logs for the TUI: the systemd journal of a unit, or on other init
+// systems the file the service writes (smartdns's log-file, nginx's
+// error.log, /var/log/smartdnsctl/<name>.log for supervised services).
+// Severities use syslog numbers (0 emerg ... 7 debug).
+
+const (
+	sevErr     = 3
+	sevWarning = 4
+	sevInfo    = 6
+	sevDebug   = 7
+)
+
+type journalLine struct {
+	Time     time.Time
+	Severity int
+	Text     string
+}
+
+// journalSource is either a systemd unit (read through journalctl) or a file.
+type journalSource struct {
+	Unit string
+	File string
+}
+
+func (src journalSource) String() string {
+	if src.Unit != "" {
+		return "journalctl -u " + src.Unit
+	}
+	return src.File
+}
+
+// smartdnsLogFile is smartdns's log-file directive or its default.
+func smartdnsLogFile() string {
+	path := "/var/log/smartdns/smartdns.log"
+	if lines, err := readLines(SMART_CONFIG_FILE); err == nil {
+		for _, l := range lines {
+			if f := strings.Fields(l); len(f) == 2 && f[0] == "log-file" {
+				path = f[1]
+			}
+		}
+	}
+	return path
+}
+
+// journalSourceFor picks where the logs of service name live on this host.
+func journalSourceFor(name string) journalSource {
+	if svc().Name() == INIT_SYSTEMD {
+		if _, err := exec.LookPath("journalctl"); err == nil {
+			return journalSource{Unit: name}
+		}
+	}
+	candidates := []string{TRAFFIC_LOG_DIR + "/" + name + ".log"}
+	switch name {
+	case "smartdns":
+		candidates = append([]string{smartdnsLogFile()}, candidates...)
+	case "nginx":
+		candidates = append([]string{"/var/log/nginx/error.log"}, candidates...)
+	}
+	// the most recently written file wins (supervised smartdns logs to our dir)
+	best, bestMod := candidates[0], time.Time{}
+	for _, c := range candidates {
+		if fi, err := os.Stat(c); err == nil && fi.ModTime().After(bestMod) {
+			best, bestMod = c, fi.ModTime()
+		}
+	}
+	return journalSource{File: best}
+}
+
+var (
+	reSeverityTag  = regexp.MustCompile(`(?i)\[\s*(emerg|alert|crit|error|err|warn|warning|notice|info|debug)\s*\]`)
+	reSeverityWord = regexp.MustCompile(`(?i)\b(emerg|alert|crit|critical|fatal|error|failed|warn|warning)\b`)
+	reLogTime      = regexp.MustCompile(`(\d{4}[-/]\d{2}[-/]\d{2}[ T]\d{2}:\d{2}:\d{2})`)
+)
+
+// severityOf guesses a file line's severity: "[error]"-style tags as written
+// by smartdns and nginx first, then telling words; info otherwise.
+func severityOf(text string) int {
+	word := ""
+	if m := reSeverityTag.FindStringSubmatch(text); m != nil {
+		word = m[1]
+	} else if m := reSeverityWord.FindStringSubmatch(text); m != nil {
+		word = m[1]
+	}
+	switch strings.ToLower(word) {
+	case "emerg":
+		return 0
+	case "alert":
+		return 1
+	case "crit", "critical", "fatal":
+		return 2
+	case "error", "err", "failed":
+		return sevErr
+	case "warn", "warning":
+		return sevWarning
+	case "notice":
+		return 5
+	case "debug":
+		return sevDebug
+	}
+	return sevInfo
+}
+
+func parseFileLine(text string) journalLine {
+	jl := journalLine{Text: text, Severity: severityOf(text)}
+	if m := reLogTime.FindStringSubmatch(text); m != nil {
+		ts := strings.NewReplacer("/", "-", "T", " ").Replace(m[1])
+		if t, err := time.ParseInLocation("2006-01-02 15:04:05", ts, time.Local); err == nil {
+			jl.Time = t
+		}
+	}
+	return jl
+}
+
+// parseJournalJSON decodes one `journalctl -o json` record.
+func parseJournalJSON(b []byte) (journalLine, bool) {
+	var rec map[string]any
+	if json.Unmarshal(b, &rec) != nil {
+		return journalLine{}, false
+	}
+	msg, _ := rec["MESSAGE"].(string) // binary messages come as byte arrays; skip them
+	if msg == "" {
+		return journalLine{}, false
+	}
+	jl := journalLine{Text: msg, Severity: sevInfo}
+	if p, ok := rec["PRIORITY"].(string); ok {
+		if n, err := strconv.Atoi(p); err == nil {
+			jl.Severity = n
+		}
+	}
+	if ts, ok := rec["__REALTIME_TIMESTAMP"].(string); ok {
+		if us, err := strconv.ParseInt(ts, 10, 64); err == nil {
+			jl.Time = time.UnixMicro(us)
+		}
+	}
+	if comm, ok := rec["_COMM"].(string); ok {
+		jl.Text = comm + ": " + msg
+	}
+	return jl, true
+}
+
+// readJournal returns up to n of the newest lines with severity <= maxSev.
+func readJournal(src journalSource, n, maxSev int) ([]journalLine, error) {
+	var out []journalLine
+	if src.Unit != "" {
+		args := []string{"-u", src.Unit, "-n", strconv.Itoa(n), "-o", "json", "--no-pager", "-p", strconv.Itoa(maxSev)}
+		b, err := exec.Command("journalctl", args...).Output()
+		if err != nil {
+			return nil, err
+		}
+		for _, l := range strings.Split(string(b), "\n") {
+			if jl, ok := parseJournalJSON([]byte(l)); ok {
+				out = append(out, jl)
+			}
+		}
+		return out, nil
+	}
+	lines, err := tailLines(src.File, 1<<20, 1<<20)
+	if err != nil {
+		return nil, err
+	}
+	for _, l := range lines {
+		if jl := parseFileLine(l); l != "" && jl.Severity <= maxSev {
+			out = append(out, jl)
+		}
+	}
+	if len(out) > n {
+		out = out[len(out)-n:]
+	}
+	return out, nil
+}
+
+// followJournal streams new lines to fn until ctx is cancelled.
+func followJournal(ctx context.Context, src journalSource, fn func(journalLine)) error {
+	if src.Unit != "" {
+		cmd := exec.CommandContext(ctx, "journalctl", "-u", src.Unit, "-f", "-n", "0", "-o", "json", "--no-pager")
+		out, err := cmd.StdoutPipe()
+		if err != nil {
+			return err
+		}
+		if err := cmd.Start(); err != nil {
+			return err
+		}
+		sc := bufio.NewScanner(out)
+		sc.Buffer(make([]byte, 64*1024), 1<<20)
+		for sc.Scan() {
+			if jl, ok := parseJournalJSON(sc.Bytes()); ok {
+				fn(jl)
+			}
+		}
+		return cmd.Wait()
+	}
+	// files: poll for growth, starting from the current end
+	var off int64
+	if fi, err := os.Stat(src.File); err == nil {
+		off = fi.Size()
+	}
+	t := time.NewTicker(time.Second)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-t.C:
+		}
+		fi, err := os.Stat(src.File)
+		if err != nil {
+			continue
+		}
+		if fi.Size() < off {
+			off = 0 // truncated or rotated
+		}
+		if fi.Size() == off {
+			continue
+		}
+		f, err := os.Open(src.File)
+		if err != nil {
+			continue
+		}
+		if _, err := f.Seek(off, io.SeekStart); err == nil {
+			br := bufio.NewReader(f)
+			for {
+				line, err := br.ReadString('\n')
+				if err != nil {
+					break
+				}
+				off += int64(len(line))
+				if l := strings.TrimRight(line, "\r\n"); l != "" {
+					fn(parseFileLine(l))
+				}
+			}
+		}
+		f.Close()
+	}
+}
+
+// journalMark remembers where a service's log stood before an action, so the
+// lines the action produced can be shown if it fails.
+type journalMark struct {
+	src    journalSource
+	at     time.Time
+	offset int64
+}
+
+func markJournal(name string) journalMark {
+	m := journalMark{src: journalSourceFor(name), at: time.Now()}
+	if m.src.File != "" {
+		if fi, err := os.Stat(m.src.File); err == nil {
+			m.offset = fi.Size()
+		}
+	}
+	return m
+}
+
+// since returns up to n lines with severity <= maxSev logged after the mark.
+func (m journalMark) since(n, maxSev int) []journalLine {
+	var out []journalLine
+	if m.src.Unit != "" {
+		args := []string{"-u", m.src.Unit, "--since", "@" + strconv.FormatInt(m.at.Add(-time.Second).Unix(), 10),
+			"-o", "json", "--no-pager", "-p", strconv.Itoa(maxSev)}
+		b, err := exec.Command("journalctl", args...).Output()
+		if err != nil {
+			return nil
+		}
+		for _, l := range strings.Split(string(b), "\n") {
+			if jl, ok := parseJournalJSON([]byte(l)); ok {
+				out = append(out, jl)
+			}
+		}
+	} else if f, err := os.Open(m.src.File); err == nil {
+		if fi, err := f.Stat(); err == nil && fi.Size() >= m.offset {
+			_, _ = f.Seek(m.offset, io.SeekStart)
+		}
+		sc := bufio.NewScanner(f)
+		sc.Buffer(make([]byte, 64*1024), 1<<20)
+		for sc.Scan() {
+			if jl := parseFileLine(sc.Text()); jl.Severity <= maxSev {
+				out = append(out, jl)
+			}
+		}
+		f.Close()
+	}
+	if len(out) > n {
+		out = out[len(out)-n:]
+	}
+	return out
+}
+
+// explainFailure, on err, writes the errors the service logged since the mark
+// (warnings when there are none) to log.
+func (m journalMark) explainFailure(log func(string), err error) error {
+	if err == nil || log == nil {
+		return err
+	}
+	lines := m.since(10, sevErr)
+	if len(lines) == 0 {
+		lines = m.since(10, sevWarning)
+	}
+	if len(lines) == 0 {
+		return err
+	}
+	log(fmt.Sprintf("最近的错误日志（%s）:", m.src))
+	for _, l := range lines {
+		log("  " + l.String())
+	}
+	return err
+}
+
+func (l journalLine) String() string {
+	if l.Time.IsZero() || reLogTime.MatchString(l.Text) {
+		return l.Text
+	}
+	return l.Time.Format("01-02 15:04:05") + " " + l.Text
+}
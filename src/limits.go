@@ -0,0 +1,497 @@
+package src
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// trafficLimit caps one client or one platform. Zero means unlimited.
+type trafficLimit struct {
+	Conns int   `json:"conns,omitempty"` // concurrent connections
+	Rate  int64 `json:"rate,omitempty"`  // bytes per second, per connection and direction
+	Quota int64 `json:"quota,omitempty"` // bytes per calendar month (in + out)
+}
+
+func (l trafficLimit) empty() bool { return l.Conns == 0 && l.Rate == 0 && l.Quota == 0 }
+
+func (l trafficLimit) String() string {
+	if l.empty() {
+		return "不限"
+	}
+	var parts []string
+	if l.Conns > 0 {
+		parts = append(parts, fmt.Sprintf("连接 %d", l.Conns))
+	}
+	if l.Rate > 0 {
+		parts = append(parts, "速率 "+humanBytes(l.Rate)+"/s")
+	}
+	if l.Quota > 0 {
+		parts = append(parts, "月配额 "+humanBytes(l.Quota))
+	}
+	return strings.Join(parts, " / ")
+}
+
+// quotaBaseline is the month usage recorded when a quota was reset; usage above it counts.
+type quotaBaseline struct {
+	Month string `json:"month"`
+	Bytes int64  `json:"bytes"`
+}
+
+// quotaKey names a quota subject in QuotaResets: "client:<ip>" or "platform:<sub>".
+func quotaKey(kind, name string) string { return kind + ":" + name }
+
+// parseSize accepts "0", "512", "10k", "20M", "1.5G", "2T" (binary units).
+func parseSize(s string) (int64, error) {
+	s = strings.TrimSpace(strings.ToUpper(s))
+	s = strings.TrimSuffix(strings.TrimSuffix(s, "B"), "I")
+	if s == "" {
+		return 0, nil
+	}
+	mult := int64(1)
+	switch s[len(s)-1] {
+	case 'K':
+		mult = 1 << 10
+	case 'M':
+		mult = 1 << 20
+	case 'G':
+		mult = 1 << 30
+	case 'T':
+		mult = 1 << 40
+	}
+	if mult > 1 {
+		s = s[:len(s)-1]
+	}
+	f, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil || f < 0 {
+		return 0, fmt.Errorf("无法识别的大小: %s", s)
+	}
+	return int64(f * float64(mult)), nil
+}
+
+// formatSize is the inverse of parseSize for form fields.
+func formatSize(n int64) string {
+	if n == 0 {
+		return ""
+	}
+	for _, u := range []struct {
+		suffix string
+		size   int64
+	}{{"T", 1 << 40}, {"G", 1 << 30}, {"M", 1 << 20}, {"K", 1 << 10}} {
+		if n%u.size == 0 {
+			return strconv.FormatInt(n/u.size, 10) + u.suffix
+		}
+	}
+	return strconv.FormatInt(n, 10)
+}
+
+// ----- quota accounting -----
+
+// quotaUsage is one subject's month usage against its quota.
+type quotaUsage struct {
+	Kind  string // "client" / "platform"
+	Name  string
+	Used  int64
+	Quota int64
+}
+
+func (u quotaUsage) over() bool { return u.Quota > 0 && u.Used >= u.Quota }
+
+// quotaBlock is the set of subjects currently over quota.
+type quotaBlock struct {
+	clients   map[string]bool
+	platforms map[string]bool
+}
+
+func (b *quotaBlock) empty() bool { return b == nil || len(b.clients)+len(b.platforms) == 0 }
+
+func (b *quotaBlock) blocks(client, platform string) bool {
+	if b == nil {
+		return false
+	}
+	return b.clients[client] || (platform != "" && b.platforms[platform])
+}
+
+func hasQuota(st ctlSettings) bool {
+	if st.ClientLimit.Quota > 0 {
+		return true
+	}
+	for _, l := range st.PlatformLimits {
+		if l.Quota > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// monthUsage sums this month's rollups per client and per platform.
+func monthUsage() trafficSummary {
+	now := time.Now()
+	first := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
+	_, today := lastNDays(1)
+	return summarizeTraffic(first, today)
+}
+
+// quotaReport lists every subject with a quota, over-quota first. Clients are only
+// listed once they show up in the month's traffic.
+func quotaReport() []quotaUsage {
+	st := loadSettings()
+	if !hasQuota(st) {
+		return nil
+	}
+	month := time.Now().Format("2006-01")
+	usage := monthUsage()
+	used := func(kind, name string, c *trafficCounter) int64 {
+		var n int64
+		if c != nil {
+			n = c.total()
+		}
+		if b, ok := st.QuotaResets[quotaKey(kind, name)]; ok && b.Month == month {
+			n -= b.Bytes
+		}
+		if n < 0 {
+			n = 0
+		}
+		return n
+	}
+	var out []quotaUsage
+	if st.ClientLimit.Quota > 0 {
+		for client, c := range usage.Clients {
+			out = append(out, quotaUsage{Kind: "client", Name: client, Used: used("client", client, c), Quota: st.ClientLimit.Quota})
+		}
+	}
+	for sub, l := range st.PlatformLimits {
+		if l.Quota > 0 {
+			out = append(out, quotaUsage{Kind: "platform", Name: sub, Used: used("platform", sub, usage.Platforms[sub]), Quota: l.Quota})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].over() != out[j].over() {
+			return out[i].over()
+		}
+		if out[i].Used != out[j].Used {
+			return out[i].Used > out[j].Used
+		}
+		return out[i].Kind+out[i].Name < out[j].Kind+out[j].Name
+	})
+	return out
+}
+
+// currentQuotaBlock rolls up the access logs and returns who is over quota,
+// or nil when no quota is configured.
+func currentQuotaBlock() *quotaBlock {
+	if !hasQuota(loadSettings()) {
+		return nil
+	}
+	b := &quotaBlock{clients: map[string]bool{}, platforms: map[string]bool{}}
+	if err := rollupTraffic(); err != nil {
+		// the last saved rollups can only undercount, never block too early
+		logYellow("[配额] 汇总访问日志失败，按上次的统计判断: " + err.Error())
+	}
+	for _, u := range quotaReport() {
+		if !u.over() {
+			continue
+		}
+		if u.Kind == "client" {
+			b.clients[u.Name] = true
+		} else {
+			b.platforms[u.Name] = true
+		}
+	}
+	return b
+}
+
+// resetQuota starts a subject's quota over by recording its current month usage.
+func resetQuota(kind, name string) error {
+	_ = rollupTraffic()
+	usage := monthUsage()
+	var c *trafficCounter
+	if kind == "client" {
+		c = usage.Clients[name]
+	} else {
+		c = usage.Platforms[name]
+	}
+	var n int64
+	if c != nil {
+		n = c.total()
+	}
+	month := time.Now().Format("2006-01")
+	return updateSettings(func(st *ctlSettings) {
+		if st.QuotaResets == nil {
+			st.QuotaResets = map[string]quotaBaseline{}
+		}
+		for k, b := range st.QuotaResets {
+			if b.Month != month {
+				delete(st.QuotaResets, k)
+			}
+		}
+		st.QuotaResets[quotaKey(kind, name)] = quotaBaseline{Month: month, Bytes: n}
+	})
+}
+
+// enforceQuotas refreshes the nginx over-quota maps when the blocked set changed.
+// The built-in proxy checks quotas itself; this is what the quota timer runs.
+func enforceQuotas(log func(string)) error {
+	if log == nil {
+		log = func(string) {}
+	}
+	if loadSettings().ProxyBackend != PROXY_BACKEND_NGINX || !fileExists(NGINX_STREAM_CONF_FILE) {
+		return nil
+	}
+	rules := loadProxyRules()
+	rules.quota = currentQuotaBlock()
+	cur, _ := os.ReadFile(NGINX_STREAM_CONF_FILE)
+	if string(cur) == strings.Join(nginxStreamConf(rules), "\n") {
+		return nil
+	}
+	log("超额名单变化，刷新 nginx 配置")
+	return applyNginxChange(log, func() error { return ensureNginxProxyConfigs(log) })
+}
+
+// ----- nginx directives -----
+
+// nginxLimitConf renders the limit directives for the stream (443) or http (80) context.
+// head belongs at context level, body inside the stream server / http location. Zone
+// names carry the context because shared memory zones are global across modules.
+func nginxLimitConf(ctx string, rules *proxyRules) (head, body []string) {
+	key, zone := "$ssl_preread_server_name", "smartdns_s_"
+	if ctx == "http" {
+		key, zone = "$host", "smartdns_h_"
+	}
+	if n := rules.clientLimit.Conns; n > 0 {
+		head = append(head, "limit_conn_zone $binary_remote_addr zone="+zone+"client:10m;")
+		body = append(body, fmt.Sprintf("limit_conn %sclient %d;", zone, n))
+	}
+	subs := make([]string, 0, len(rules.platformLimits))
+	for sub := range rules.platformLimits {
+		subs = append(subs, sub)
+	}
+	sort.Strings(subs)
+	rates := map[string]string{}
+	for i, sub := range subs {
+		l := rules.platformLimits[sub]
+		if l.Conns > 0 && len(rules.domains[sub]) > 0 {
+			// one map + zone per platform: every connection of the platform shares key "1"
+			v := fmt.Sprintf("$%spl_%d", zone, i)
+			head = append(head, "# "+sub)
+			head = append(head, nginxDomainMap(key, v, rules.domainValues(map[string]string{sub: "1"}), `""`)...)
+			head = append(head, fmt.Sprintf("limit_conn_zone %s zone=%spl_%d:1m;", v, zone, i))
+			body = append(body, fmt.Sprintf("limit_conn %spl_%d %d;", zone, i, l.Conns))
+		}
+		if r := rules.connRate(sub); r > 0 && r != rules.clientLimit.Rate {
+			rates[sub] = strconv.FormatInt(r, 10)
+		}
+	}
+	rate := strconv.FormatInt(rules.clientLimit.Rate, 10)
+	if len(rates) > 0 {
+		head = append(head, nginxDomainMap(key, "$"+zone+"rate", rules.domainValues(rates), rate)...)
+		rate = "$" + zone + "rate"
+	}
+	if rate != "0" {
+		if ctx == "http" {
+			body = append(body, "limit_rate "+rate+";")
+		} else {
+			body = append(body, "proxy_download_rate "+rate+";", "proxy_upload_rate "+rate+";")
+		}
+	}
+	if rules.quota != nil {
+		clients := make([]string, 0, len(rules.quota.clients))
+		for c := range rules.quota.clients {
+			clients = append(clients, c)
+		}
+		sort.Strings(clients)
+		head = append(head, "map $remote_addr $"+zone+"client_over {", "    default 0;")
+		for _, c := range clients {
+			head = append(head, "    "+c+" 1;")
+		}
+		head = append(head, "}")
+		over := map[string]string{}
+		for sub := range rules.quota.platforms {
+			over[sub] = "1"
+		}
+		head = append(head, nginxDomainMap(key, "$"+zone+"platform_over", rules.domainValues(over), "0")...)
+	}
+	return head, body
+}
+
+// nginxDomainMap renders `map key $var { hostnames; .domain value; default def; }`.
+func nginxDomainMap(key, variable string, byDomain map[string]string, def string) []string {
+	domains := make([]string, 0, len(byDomain))
+	for d := range byDomain {
+		domains = append(domains, d)
+	}
+	sort.Strings(domains)
+	lines := []string{"map " + key + " " + variable + " {", "    hostnames;"}
+	for _, d := range domains {
+		lines = append(lines, "    ."+d+" "+byDomain[d]+";")
+	}
+	return append(lines, "    default "+def+";", "}")
+}
+
+// ----- quota timer (nginx backend) -----
+
+// syncQuotaTimer runs `quota enforce` every minute while nginx serves 80/443 and a
+// monthly quota is configured; otherwise the job is removed from the schedule.
+func syncQuotaTimer(log func(string)) error {
+	if log == nil {
+		log = func(string) {}
+	}
+	st := loadSettings()
+	if !hasQuota(st) || st.ProxyBackend != PROXY_BACKEND_NGINX {
+		stopDisabled(QUOTA_SERVICE_NAME, log)
+		return nil
+	}
+	spec, err := selfServiceSpec(QUOTA_SERVICE_NAME, "quota enforcement for nginx", "quota", "enforce")
+	if err != nil {
+		return err
+	}
+	spec.Every = time.Minute
+	if err := svc().Install(spec, log); err != nil {
+		return err
+	}
+	if err := startEnabled(QUOTA_SERVICE_NAME, log); err != nil {
+		return fmt.Errorf("启用配额定时任务失败: %w", err)
+	}
+	return nil
+}
+
+// applyLimits pushes the saved limits to whichever backend serves 80/443.
+// The built-in proxy picks them up from SETTINGS_FILE on its own.
+func applyLimits(log func(string)) error {
+	if loadSettings().ProxyBackend == PROXY_BACKEND_NGINX && fileExists(NGINX_MAIN_CONF) {
+		return applyNginxProxyConfigs(log)
+	}
+	return syncQuotaTimer(log)
+}
+
+// runQuotaCommand implements `smartdnsctl quota [enforce | reset client|platform NAME]`.
+func runQuotaCommand(args []string) int {
+	if len(args) > 0 && args[0] == "enforce" {
+		if err := enforceQuotas(func(s string) { fmt.Println(s) }); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		return 0
+	}
+	if len(args) == 3 && args[0] == "reset" && (args[1] == "client" || args[1] == "platform") {
+		if err := resetQuota(args[1], args[2]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		if err := enforceQuotas(nil); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		return 0
+	}
+	_ = rollupTraffic()
+	report := quotaReport()
+	if len(report) == 0 {
+		fmt.Println("未配置月配额")
+	}
+	for _, u := range report {
+		mark := ""
+		if u.over() {
+			mark = "  [超额]"
+		}
+		fmt.Printf("%-8s %-28s %10s / %s%s\n", u.Kind, u.Name, humanBytes(u.Used), humanBytes(u.Quota), mark)
+	}
+	return 0
+}
+
+// ----- enforcement in the built-in proxy -----
+
+// connLimiter counts open connections per client and per platform.
+type connLimiter struct {
+	mu        sync.Mutex
+	clients   map[string]int
+	platforms map[string]int
+}
+
+func newConnLimiter() *connLimiter {
+	return &connLimiter{clients: map[string]int{}, platforms: map[string]int{}}
+}
+
+// acquire takes a slot for client and platform, or reports false when either is full.
+func (l *connLimiter) acquire(rules *proxyRules, client, platform string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if max := rules.clientLimit.Conns; max > 0 && l.clients[client] >= max {
+		return false
+	}
+	if max := rules.platformLimits[platform].Conns; platform != "" && max > 0 && l.platforms[platform] >= max {
+		return false
+	}
+	l.clients[client]++
+	if platform != "" {
+		l.platforms[platform]++
+	}
+	return true
+}
+
+func (l *connLimiter) release(client, platform string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.clients[client]--; l.clients[client] <= 0 {
+		delete(l.clients, client)
+	}
+	if platform != "" {
+		if l.platforms[platform]--; l.platforms[platform] <= 0 {
+			delete(l.platforms, platform)
+		}
+	}
+}
+
+// connRate is the per-connection rate for a client on a platform: the stricter of both limits.
+func (r *proxyRules) connRate(platform string) int64 {
+	rate := r.clientLimit.Rate
+	if p := r.platformLimits[platform].Rate; p > 0 && (rate == 0 || p < rate) {
+		rate = p
+	}
+	return rate
+}
+
+// rateReader paces reads to at most rate bytes per second (averaged since the first read).
+type rateReader struct {
+	r     io.Reader
+	rate  int64
+	start time.Time
+	n     int64
+}
+
+func newRateReader(r io.Reader, rate int64) io.Reader {
+	if rate <= 0 {
+		return r
+	}
+	return &rateReader{r: r, rate: rate}
+}
+
+func (rr *rateReader) Read(p []byte) (int, error) {
+	if rr.start.IsZero() {
+		rr.start = time.Now()
+	}
+	// keep single reads to ~100ms worth of data so pacing stays smooth
+	if max := rr.rate / 10; max > 0 && int64(len(p)) > max {
+		p = p[:max]
+	}
+	n, err := rr.r.Read(p)
+	rr.n += int64(n)
+	due := time.Duration(float64(rr.n) / float64(rr.rate) * float64(time.Second))
+	if wait := due - time.Since(rr.start); wait > 0 {
+		time.Sleep(wait)
+	}
+	return n, err
+}
+
+// watchQuota refreshes the over-quota set every 30 seconds while quotas are configured.
+func (p *sniProxy) watchQuota() {
+	p.quota.Store(currentQuotaBlock())
+	for range time.Tick(30 * time.Second) {
+		p.quota.Store(currentQuotaBlock())
+	}
+}
@@ -1,10 +1,12 @@
 package src
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 )
 
 // installNginxStream installs nginx via apt and enables the service. Logs stream into provided logger.
@@ -14,21 +16,20 @@ func installNginxStream(log func(string)) error {
 	}
 	// 预写入模块加载文件，避免系统已有 stream{} 时 postinst 失败
 	if err := writeStreamLoaderConf(); err == nil {
-		log("已写入模块加载文件 /etc/nginx/modules-enabled/50-mod-stream.conf")
+		log("已写入模块加载文件 " + NGINX_STREAM_LOADER)
 	}
     // 强制以非交互模式运行 apt，避免 needrestart/tty 交互阻塞 TUI
     log("执行: apt-get update (noninteractive)")
     if err := runCmdPipe(func(s string) { log(s) }, "sh", "-lc", "DEBIAN_FRONTEND=noninteractive NEEDRESTART_MODE=a APT_LISTCHANGES_FRONTEND=none apt-get update"); err != nil {
-        return err
+        return &downloadError{fmt.Errorf("apt-get update 失败: %w", err)}
     }
     // 使用 nginx-extras（包含大部分模块），更省心
     log("执行: apt-get install -y nginx-extras (noninteractive)")
     if err := runCmdPipe(func(s string) { log(s) }, "sh", "-lc", "DEBIAN_FRONTEND=noninteractive NEEDRESTART_MODE=a APT_LISTCHANGES_FRONTEND=none apt-get install -y nginx-extras"); err != nil {
-        return err
+        return &downloadError{fmt.Errorf("apt-get install 失败: %w", err)}
     }
 	log("启动并启用 nginx 服务")
-	_ = runCmdPipe(func(s string) { log(s) }, "systemctl", "enable", "nginx")
-	_ = runCmdPipe(func(s string) { log(s) }, "systemctl", "start", "nginx")
+	_ = startEnabled("nginx", log)
 	log("nginx 安装完成")
 	return nil
 }
@@ -46,36 +47,161 @@ func ensureNginxProxyConfigs(log func(string)) error {
 	if err := ensureNginxStreamInclude(); err != nil {
 		return err
 	}
+	warnPortConflicts(log, []int{80, 443}, proxyPortOwners())
 	// Ensure dirs
 	_ = os.MkdirAll(NGINX_STREAM_DIR, 0o755)
-	// Write stream conf (generic SNI passthrough for HTTPS)
-	streamConf := strings.Join([]string{
-		"# Generated by smartdns TUI: generic SNI passthrough for HTTPS",
-		"map $ssl_preread_server_name $proxy_host {",
-		"    default $ssl_preread_server_name;",
-		"}",
+	if err := ensureTrafficLogging(); err != nil {
+		log("准备访问日志目录失败: " + err.Error())
+	}
+	rules := loadProxyRules()
+	rules.quota = currentQuotaBlock()
+	// Write stream conf (SNI passthrough for HTTPS, limited to the allow-list when nginx_allow_list is set)
+	streamConf := strings.Join(nginxStreamConf(rules), "\n")
+	if err := writeFileIfChanged(NGINX_STREAM_CONF_FILE, streamConf, 0o644); err != nil {
+		return fmt.Errorf("写入 stream 配置失败: %w", err)
+	}
+	// Write http conf (Host 透传)
+	httpConf := strings.Join(nginxHTTPConf(rules), "\n")
+	if err := writeFileIfChanged(NGINX_HTTP_CONF_FILE, httpConf, 0o644); err != nil {
+		return fmt.Errorf("写入 http 配置失败: %w", err)
+	}
+	return nil
+}
+
+// nginxStreamConf renders the stream (443) config. With nginx_allow_list set, hosts outside
+// the allow-list are sent to a closed local port so the client gets an immediate reset, same
+// as the built-in proxy; otherwise every SNI is passed through.
+func nginxStreamConf(rules *proxyRules) []string {
+	lines := []string{
+		"# Generated by smartdns TUI: SNI passthrough for HTTPS",
+		"log_format smartdns_stream escape=json '{\"time\":\"$time_iso8601\",\"client\":\"$remote_addr\",'",
+		"    '\"host\":\"$ssl_preread_server_name\",\"bytes_in\":$bytes_received,\"bytes_out\":$bytes_sent,'",
+		"    '\"duration\":$session_time,\"status\":\"$status\",\"proto\":\"tls\"}';",
+		"map $ssl_preread_server_name $smartdns_upstream {",
+	}
+	chained := rules.chainedDomains()
+	if !rules.nginxOpen() || len(chained) > 0 {
+		lines = append(lines, "    hostnames;")
+	}
+	// platforms with an outbound route go through the loopback chain proxy
+	isChained := map[string]bool{}
+	for _, d := range chained {
+		isChained[d] = true
+		lines = append(lines, "    ."+d+" "+PROXY_CHAIN_HTTPS_ADDR+";")
+	}
+	if rules.nginxOpen() {
+		lines = append(lines, "    default $ssl_preread_server_name:443;")
+	} else {
+		for _, d := range rules.allowedDomains() {
+			if !isChained[d] {
+				lines = append(lines, "    ."+d+" $ssl_preread_server_name:443;")
+			}
+		}
+		lines = append(lines, "    default 127.0.0.1:1;")
+	}
+	lines = append(lines, "}")
+	lines = append(lines, nginxEgressMap("$ssl_preread_server_name", rules)...)
+	head, body := nginxLimitConf("stream", rules)
+	lines = append(lines, head...)
+	upstream := "$smartdns_upstream"
+	if rules.quota != nil {
+		// over-quota clients and platforms get the same closed port as disallowed hosts
+		lines = append(lines,
+			"map \"$smartdns_s_client_over$smartdns_s_platform_over\" $smartdns_s_target {",
+			"    \"00\" $smartdns_upstream;",
+			"    default 127.0.0.1:1;",
+			"}",
+		)
+		upstream = "$smartdns_s_target"
+	}
+	lines = append(lines,
 		"server {",
 		"    listen 443 reuseport;",
-		"    proxy_pass $proxy_host:443;",
+		"    proxy_pass "+upstream+";",
+		"    access_log "+NGINX_STREAM_ACCESS_LOG+" smartdns_stream;",
+	)
+	if len(rules.egressByDomain()) > 0 {
+		lines = append(lines, "    proxy_bind $smartdns_egress;")
+	}
+	for _, l := range body {
+		lines = append(lines, "    "+l)
+	}
+	return append(lines,
 		"    resolver 1.1.1.1 8.8.8.8 valid=10s;",
 		"    resolver_timeout 5s;",
 		"    ssl_preread on;",
 		"    proxy_ssl_server_name on;",
 		"}",
 		"",
-	}, "\n")
-	if err := writeFileIfChanged(NGINX_STREAM_CONF_FILE, streamConf, 0o644); err != nil {
-		return fmt.Errorf("写入 stream 配置失败: %w", err)
-	}
-	// Write http conf (Host 透传)
-	httpConf := strings.Join([]string{
+	)
+}
+
+// nginxHTTPConf renders the plain HTTP (80) config; with nginx_allow_list set, disallowed hosts get 403.
+func nginxHTTPConf(rules *proxyRules) []string {
+	lines := []string{
 		"# Generated by smartdns TUI: plain HTTP reverse proxy",
+		"log_format smartdns_http escape=json '{\"time\":\"$time_iso8601\",\"client\":\"$remote_addr\",'",
+		"    '\"host\":\"$host\",\"bytes_in\":$request_length,\"bytes_out\":$bytes_sent,'",
+		"    '\"duration\":$request_time,\"status\":\"$status\",\"proto\":\"http\"}';",
+	}
+	if !rules.nginxOpen() {
+		lines = append(lines, "map $host $smartdns_allowed {", "    hostnames;")
+		for _, d := range rules.allowedDomains() {
+			lines = append(lines, "    ."+d+" 1;")
+		}
+		lines = append(lines, "    default 0;", "}")
+	}
+	lines = append(lines, nginxEgressMap("$host", rules)...)
+	head, body := nginxLimitConf("http", rules)
+	lines = append(lines, head...)
+	if rules.quota != nil {
+		lines = append(lines,
+			"map \"$smartdns_h_client_over$smartdns_h_platform_over\" $smartdns_h_over {",
+			"    \"00\" 0;",
+			"    default 1;",
+			"}",
+		)
+	}
+	upstream := "$host"
+	if chained := rules.chainedDomains(); len(chained) > 0 {
+		// chained platforms go to the loopback chain proxy, which routes by Host
+		lines = append(lines, "map $host $smartdns_http_upstream {", "    hostnames;")
+		for _, d := range chained {
+			lines = append(lines, "    ."+d+" "+PROXY_CHAIN_HTTP_ADDR+";")
+		}
+		lines = append(lines, "    default $host;", "}")
+		upstream = "$smartdns_http_upstream"
+	}
+	lines = append(lines,
 		"server {",
 		"    listen 80 reuseport;",
+		"    access_log "+NGINX_HTTP_ACCESS_LOG+" smartdns_http;",
 		"    resolver 1.1.1.1 8.8.8.8 valid=10s;",
 		"    resolver_timeout 5s;",
-		"    set $upstream $host;",
+		"    set $upstream "+upstream+";",
 		"    location / {",
+	)
+	if !rules.nginxOpen() {
+		lines = append(lines,
+			"        if ($smartdns_allowed = 0) {",
+			"            return 403;",
+			"        }",
+		)
+	}
+	if rules.quota != nil {
+		lines = append(lines,
+			"        if ($smartdns_h_over) {",
+			"            return 429;",
+			"        }",
+		)
+	}
+	if len(rules.egressByDomain()) > 0 {
+		lines = append(lines, "        proxy_bind $smartdns_egress;")
+	}
+	for _, l := range body {
+		lines = append(lines, "        "+l)
+	}
+	return append(lines,
 		"        proxy_pass http://$upstream$request_uri;",
 		"        proxy_set_header Host $host;",
 		"        proxy_set_header X-Real-IP $remote_addr;",
@@ -85,11 +211,17 @@ func ensureNginxProxyConfigs(log func(string)) error {
 		"    }",
 		"}",
 		"",
-	}, "\n")
-	if err := writeFileIfChanged(NGINX_HTTP_CONF_FILE, httpConf, 0o644); err != nil {
-		return fmt.Errorf("写入 http 配置失败: %w", err)
+	)
+}
+
+// nginxEgressMap renders the per-platform source address map used by proxy_bind.
+// An empty value leaves the connection unbound (default route).
+func nginxEgressMap(key string, rules *proxyRules) []string {
+	byDomain := rules.egressByDomain()
+	if len(byDomain) == 0 {
+		return nil
 	}
-	return nil
+	return nginxDomainMap(key, "$smartdns_egress", byDomain, `""`)
 }
 
 // ensureNginxStreamModules ensures nginx loads required dynamic modules for stream and ssl_preread.
@@ -120,14 +252,13 @@ func ensureNginxStreamModules(log func(string)) error {
 
 // writeStreamLoaderConf writes the modules-enabled loader file unconditionally (idempotent).
 func writeStreamLoaderConf() error {
-	_ = os.MkdirAll("/etc/nginx/modules-enabled", 0o755)
-	loader := "/etc/nginx/modules-enabled/50-mod-stream.conf"
+	_ = os.MkdirAll(filepath.Dir(NGINX_STREAM_LOADER), 0o755)
 	content := strings.Join([]string{
 		"# Auto-generated by smartdns TUI",
 		"load_module /usr/lib/nginx/modules/ngx_stream_module.so;",
 		"",
 	}, "\n")
-	return writeFileIfChanged(loader, content, 0o644)
+	return writeFileIfChanged(NGINX_STREAM_LOADER, content, 0o644)
 }
 
 // ensureModulesIncludeInMainConf ensures nginx.conf includes the modules-enabled loader early.
@@ -198,19 +329,138 @@ func ensureNginxStreamInclude() error {
 	return os.WriteFile(NGINX_MAIN_CONF, []byte(strings.Join(out, "\n")), 0o644)
 }
 
-// nginxTestAndReload validates and reloads nginx.
+// nginxTestAndReload validates and reloads nginx, then verifies that 80/443 are listening.
+// Any failure is returned with the tail of nginx/init output so callers can show the real reason.
 func nginxTestAndReload(log func(string)) error {
 	if log == nil {
 		log = func(string) {}
 	}
 	log("校验 Nginx 配置: nginx -t")
-	if err := runCmdPipe(func(s string) { log(s) }, "nginx", "-t"); err != nil {
-		return err
+	if out, err := runCmdPipeTail(log, 5, "nginx", "-t"); err != nil {
+		return fmt.Errorf("nginx -t 校验失败: %w\n%s", err, out)
 	}
 	log("重载 Nginx")
-	if err := runCmdPipe(func(s string) { log(s) }, "systemctl", "reload", "nginx"); err != nil {
+	if err := svc().Reload("nginx", log); err != nil {
 		// fallback to restart if reload fails (e.g., service not running yet)
-		_ = runCmdPipe(func(s string) { log(s) }, "systemctl", "restart", "nginx")
+		log("重载失败，尝试重启 Nginx")
+		if err := svc().Restart("nginx", log); err != nil {
+			return fmt.Errorf("nginx 重载与重启均失败: %w", err)
+		}
+	}
+	log("检查 80/443 端口监听 ...")
+	if missing := waitPortsListening([]int{80, 443}, 5*time.Second); len(missing) > 0 {
+		return &portsNotListeningError{ports: missing}
+	}
+	log("80/443 端口监听正常")
+	return nil
+}
+
+// portsNotListeningError reports a successful reload after which some ports are still closed.
+type portsNotListeningError struct{ ports []int }
+
+func (e *portsNotListeningError) Error() string {
+	return fmt.Sprintf("nginx 已重载，但端口未监听: %v", e.ports)
+}
+
+// nginxSnapshot keeps the previous content of files touched by a config change.
+type nginxSnapshot struct {
+	path    string
+	data    []byte
+	existed bool
+}
+
+func snapshotFiles(paths ...string) []nginxSnapshot {
+	snaps := make([]nginxSnapshot, 0, len(paths))
+	for _, p := range paths {
+		b, err := os.ReadFile(p)
+		snaps = append(snaps, nginxSnapshot{path: p, data: b, existed: err == nil})
+	}
+	return snaps
+}
+
+func restoreSnapshots(snaps []nginxSnapshot) error {
+	var errs []string
+	for _, sn := range snaps {
+		if !sn.existed {
+			if err := removeIfExists(sn.path); err != nil {
+				errs = append(errs, err.Error())
+			}
+			continue
+		}
+		if err := writeFileIfChanged(sn.path, string(sn.data), 0o644); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("恢复文件失败: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// nginxManagedFiles lists every file the tool may write when generating nginx config.
+func nginxManagedFiles() []string {
+	return []string{NGINX_MAIN_CONF, NGINX_STREAM_LOADER, NGINX_STREAM_CONF_FILE, NGINX_HTTP_CONF_FILE}
+}
+
+// applyNginxChange snapshots all managed nginx files, runs mutate, then tests and reloads.
+// On any write, test, reload or restart failure the previous files are restored and the
+// running nginx is reloaded back onto them; the original error is returned.
+func applyNginxChange(log func(string), mutate func() error) error {
+	if log == nil {
+		log = func(string) {}
+	}
+	snaps := snapshotFiles(nginxManagedFiles()...)
+	wasActive := isNginxActive()
+	err := mutate()
+	if err == nil {
+		err = nginxTestAndReload(log)
+		var pe *portsNotListeningError
+		if errors.As(err, &pe) {
+			// config is valid and live; nothing to roll back
+			auditSnapshots("nginx.write", "", snaps, err)
+			return err
+		}
+	}
+	if err == nil {
+		auditSnapshots("nginx.write", "", snaps, nil)
+		return nil
+	}
+	opAudit("nginx.write", "已回滚", nil, err)
+	log("[回滚] " + err.Error())
+	if rerr := restoreSnapshots(snaps); rerr != nil {
+		log("[回滚] " + rerr.Error())
+		return fmt.Errorf("%w（%s）", err, rerr.Error())
+	}
+	log("[回滚] 已恢复修改前的 Nginx 配置文件")
+	if wasActive {
+		if _, terr := runCmdPipeTail(log, 5, "nginx", "-t"); terr == nil {
+			_ = svc().Reload("nginx", log)
+		}
+	}
+	return err
+}
+
+// applyNginxProxyConfigs writes the 80/443 proxy configs transactionally and keeps the
+// loopback chain proxy in step with the outbound routes nginx now points at.
+func applyNginxProxyConfigs(log func(string)) error {
+	if err := applyNginxChange(log, func() error { return ensureNginxProxyConfigs(log) }); err != nil {
+		return err
+	}
+	if err := syncChainService(log); err != nil {
+		return err
+	}
+	return syncQuotaTimer(log)
+}
+
+// setNginxAllowList records nginx_allow_list and regenerates the nginx configs; the setting is
+// put back when the new config does not apply.
+func setNginxAllowList(on bool, log func(string)) error {
+	if err := updateSettings(func(st *ctlSettings) { st.NginxAllowList = on }); err != nil {
+		return err
+	}
+	if err := applyNginxProxyConfigs(log); err != nil {
+		_ = updateSettings(func(st *ctlSettings) { st.NginxAllowList = !on })
+		return err
 	}
 	return nil
 }
@@ -0,0 +1,436 @@
+package src
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Installs without internet access. A local source is a SmartDNS tarball
+// (.tar.gz / .tar.xz / .zip), a .deb, or a bundle directory made by
+// `smartdnsctl bundle create` on a machine that does have access: the
+// SmartDNS release tarball for the target architecture plus nginx-extras and
+// its dependency debs, listed with their sha256 in bundle.json.
+
+const bundleManifestName = "bundle.json"
+
+// downloadError marks failures to reach the network, after which the UI
+// offers to install from a local source instead.
+type downloadError struct{ err error }
+
+func (e *downloadError) Error() string { return e.err.Error() }
+func (e *downloadError) Unwrap() error { return e.err }
+
+func isDownloadError(err error) bool {
+	var de *downloadError
+	return errors.As(err, &de)
+}
+
+type bundleFile struct {
+	File    string `json:"file"` // relative to the bundle directory
+	SHA256  string `json:"sha256"`
+	Package string `json:"package,omitempty"`
+	Version string `json:"version,omitempty"`
+}
+
+type installBundle struct {
+	Created  time.Time    `json:"created"`
+	GOARCH   string       `json:"goarch"`
+	Distro   string       `json:"distro,omitempty"` // e.g. debian/bookworm, which the debs were resolved for
+	SmartDNS *bundleFile  `json:"smartdns,omitempty"`
+	Tag      string       `json:"smartdns_tag,omitempty"`
+	Nginx    []bundleFile `json:"nginx,omitempty"`
+}
+
+// hostDistro is ID/VERSION_CODENAME from os-release.
+func hostDistro() string {
+	lines, err := readLines("/etc/os-release")
+	if err != nil {
+		return ""
+	}
+	kv := map[string]string{}
+	for _, l := range lines {
+		if k, v, ok := strings.Cut(l, "="); ok {
+			kv[k] = strings.Trim(v, `"`)
+		}
+	}
+	if kv["ID"] == "" {
+		return ""
+	}
+	return kv["ID"] + "/" + kv["VERSION_CODENAME"]
+}
+
+func loadBundle(dir string) (installBundle, error) {
+	var b installBundle
+	data, err := os.ReadFile(filepath.Join(dir, bundleManifestName))
+	if err != nil {
+		return b, fmt.Errorf("%s 不是离线包目录: %w", dir, err)
+	}
+	if err := json.Unmarshal(data, &b); err != nil {
+		return b, fmt.Errorf("%s 格式错误: %w", bundleManifestName, err)
+	}
+	return b, nil
+}
+
+// path returns the verified absolute path of a bundle file.
+func (f bundleFile) path(dir string) (string, error) {
+	p, err := archiveEntryPath(dir, f.File)
+	if err != nil {
+		return "", err
+	}
+	got, err := fileSHA256(p)
+	if err != nil {
+		return "", err
+	}
+	if got != f.SHA256 {
+		return "", fmt.Errorf("%s 校验失败: sha256 为 %s，离线包记录为 %s", f.File, got, f.SHA256)
+	}
+	return p, nil
+}
+
+// debField reads one control field of a .deb.
+func debField(path, field string) string {
+	out, err := exec.Command("dpkg-deb", "-f", path, field).Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// debInstalled reports whether a package is installed at any version.
+func debInstalled(pkg string) bool {
+	out, err := exec.Command("dpkg-query", "-W", "-f", "${Status}", pkg).Output()
+	return err == nil && strings.Contains(string(out), "install ok installed")
+}
+
+// aptDependencyClosure lists pkg and everything it needs (recommends and
+// suggests excluded), as apt resolves it on this machine.
+func aptDependencyClosure(pkg string) ([]string, error) {
+	out, err := exec.Command("apt-cache", "depends", "--recurse", "--no-recommends", "--no-suggests",
+		"--no-conflicts", "--no-breaks", "--no-replaces", "--no-enhances", pkg).Output()
+	if err != nil {
+		return nil, fmt.Errorf("apt-cache depends %s: %w", pkg, err)
+	}
+	seen := map[string]bool{}
+	var pkgs []string
+	for _, l := range strings.Split(string(out), "\n") {
+		// package lines start at column 0; virtual packages are shown as <name>
+		if l == "" || l[0] == ' ' || l[0] == '<' || seen[l] {
+			continue
+		}
+		seen[l] = true
+		pkgs = append(pkgs, l)
+	}
+	return pkgs, nil
+}
+
+type bundleOptions struct {
+	Tag    string // SmartDNS release, "" for the newest stable
+	GOARCH string // target architecture, the local one by default
+	Nginx  bool
+}
+
+// createBundle downloads everything an offline install needs into dir.
+func createBundle(dir string, opt bundleOptions, log func(string)) (err error) {
+	defer func() { opAudit("bundle.create", dir, nil, err) }()
+	if opt.GOARCH == "" {
+		opt.GOARCH = runtime.GOARCH
+	}
+	if err := ensureDir(filepath.Join(dir, "smartdns")); err != nil {
+		return err
+	}
+	b := installBundle{Created: time.Now(), GOARCH: opt.GOARCH, Distro: hostDistro()}
+
+	log("获取 SmartDNS 发布列表 ...")
+	all, err := fetchReleases(SMARTDNS_REPO)
+	if err != nil {
+		return err
+	}
+	rels, err := releasesForArch(all, opt.GOARCH)
+	if err != nil {
+		return err
+	}
+	rel, err := selectSmartDNSRelease(rels, opt.Tag)
+	if err != nil {
+		return err
+	}
+	want, err := rel.expectedSHA256()
+	if err != nil {
+		return err
+	}
+	assetFile := filepath.Join("smartdns", rel.Asset.Name)
+	log("下载 " + rel.String() + ": " + rel.Asset.URL)
+	if err := download(rel.Asset.URL, filepath.Join(dir, assetFile), downloadOptions{Log: log}); err != nil {
+		return &downloadError{fmt.Errorf("下载失败: %w", err)}
+	}
+	got, err := fileSHA256(filepath.Join(dir, assetFile))
+	if err != nil {
+		return err
+	}
+	if want != "" && got != want {
+		return fmt.Errorf("校验失败: sha256 为 %s，发布值为 %s", got, want)
+	}
+	if want == "" {
+		log("[警告] 该版本未发布校验值，离线包中记录下载所得的 sha256")
+	}
+	b.SmartDNS = &bundleFile{File: assetFile, SHA256: got, Version: rel.Version}
+	b.Tag = rel.Tag
+
+	switch {
+	case !opt.Nginx:
+	case opt.GOARCH != runtime.GOARCH:
+		log("[警告] 目标架构与本机不同，跳过 nginx（deb 需在同架构、同发行版的机器上制作）")
+	default:
+		if b.Nginx, err = downloadNginxDebs(dir, log); err != nil {
+			return err
+		}
+	}
+	data, err := json.MarshalIndent(b, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dir, bundleManifestName), append(data, '\n'), 0o644); err != nil {
+		return err
+	}
+	log("离线包已生成: " + dir)
+	return nil
+}
+
+// downloadNginxDebs fetches nginx-extras and its dependency closure into dir/debs.
+func downloadNginxDebs(dir string, log func(string)) ([]bundleFile, error) {
+	if _, err := exec.LookPath("apt-get"); err != nil {
+		return nil, errors.New("制作 nginx 离线包需要 apt（Debian/Ubuntu）")
+	}
+	pkgs, err := aptDependencyClosure("nginx-extras")
+	if err != nil {
+		return nil, err
+	}
+	debDir := filepath.Join(dir, "debs")
+	if err := ensureDir(debDir); err != nil {
+		return nil, err
+	}
+	log(fmt.Sprintf("下载 nginx-extras 及 %d 个依赖包 ...", len(pkgs)-1))
+	script := "cd " + shellQuote([]string{debDir}) + " && apt-get download " + shellQuote(pkgs)
+	if err := runCmdPipe(log, "sh", "-c", script); err != nil {
+		return nil, &downloadError{fmt.Errorf("apt-get download 失败: %w", err)}
+	}
+	debs, _ := filepath.Glob(filepath.Join(debDir, "*.deb"))
+	sort.Strings(debs)
+	var out []bundleFile
+	for _, d := range debs {
+		sum, err := fileSHA256(d)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, bundleFile{File: filepath.Join("debs", filepath.Base(d)), SHA256: sum,
+			Package: debField(d, "Package"), Version: debField(d, "Version")})
+	}
+	return out, nil
+}
+
+// verifySibling checks path against path.sha256 when one sits next to it.
+func verifySibling(path string, log func(string)) error {
+	got, err := fileSHA256(path)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(path + ".sha256")
+	if err != nil {
+		log("sha256: " + got + "（未找到 " + filepath.Base(path) + ".sha256，未校验）")
+		return nil
+	}
+	want := checksumFor(string(data), filepath.Base(path), true)
+	if want != got {
+		return fmt.Errorf("校验失败: sha256 为 %s，%s.sha256 记录为 %s", got, filepath.Base(path), want)
+	}
+	log("sha256 校验通过: " + got)
+	return nil
+}
+
+// installSmartDNSFrom installs SmartDNS from a tarball, a .deb or a bundle directory.
+func installSmartDNSFrom(path string, log func(string)) error {
+	if log == nil {
+		log = func(string) {}
+	}
+	tag := "local"
+	if fi, err := os.Stat(path); err != nil {
+		return err
+	} else if fi.IsDir() {
+		b, err := loadBundle(path)
+		if err != nil {
+			return err
+		}
+		if b.SmartDNS == nil {
+			return errors.New("离线包中没有 SmartDNS")
+		}
+		if b.GOARCH != runtime.GOARCH {
+			return fmt.Errorf("离线包为 %s 架构，本机为 %s", b.GOARCH, runtime.GOARCH)
+		}
+		if path, err = b.SmartDNS.path(path); err != nil {
+			return err
+		}
+		log("离线包: " + b.Tag + " (" + b.SmartDNS.Version + ")，sha256 校验通过")
+		tag = b.Tag
+	} else if err := verifySibling(path, log); err != nil {
+		return err
+	}
+
+	tmpDir, err := os.MkdirTemp("", "smartdnsctl-install-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+	pkgDir := filepath.Join(tmpDir, "pkg")
+	log("解压 " + filepath.Base(path) + " ...")
+	if strings.HasSuffix(path, ".deb") {
+		if err := os.MkdirAll(pkgDir, 0o755); err != nil {
+			return err
+		}
+		if err := runCmdPipe(log, "dpkg-deb", "-x", path, pkgDir); err != nil {
+			return fmt.Errorf("解包 deb 失败: %w", err)
+		}
+	} else if err := extractArchive(path, pkgDir, defaultExtractLimits); err != nil {
+		return fmt.Errorf("解压失败: %w", err)
+	}
+	bin, err := findReleaseBinary(pkgDir)
+	if err != nil {
+		return err
+	}
+	out, _ := exec.Command(bin, "-v").CombinedOutput()
+	rel := smartdnsRelease{ghRelease: ghRelease{Tag: tag}, Version: reSmartDNSVersion.FindString(string(out))}
+	releaseDNSPort(log)
+	if err := installSmartDNSBinary(rel, bin, log); err != nil {
+		return err
+	}
+	log("SmartDNS " + rel.Version + " 安装成功！")
+	return nil
+}
+
+// installNginxFrom installs nginx from one .deb, a directory of debs or a bundle.
+func installNginxFrom(path string, log func(string)) (err error) {
+	if log == nil {
+		log = func(string) {}
+	}
+	defer func() { opAudit("nginx.install", path, nil, err) }()
+	var debs []string
+	fi, err := os.Stat(path)
+	switch {
+	case err != nil:
+		return err
+	case !fi.IsDir():
+		if err := verifySibling(path, log); err != nil {
+			return err
+		}
+		debs = []string{path}
+	case fileExists(filepath.Join(path, bundleManifestName)):
+		b, err := loadBundle(path)
+		if err != nil {
+			return err
+		}
+		if len(b.Nginx) == 0 {
+			return errors.New("离线包中没有 nginx")
+		}
+		if d := hostDistro(); b.Distro != "" && d != b.Distro {
+			log("[警告] 离线包为 " + b.Distro + " 制作，本机为 " + d + "，依赖可能不匹配")
+		}
+		for _, f := range b.Nginx {
+			p, err := f.path(path)
+			if err != nil {
+				return err
+			}
+			debs = append(debs, p)
+		}
+		log(fmt.Sprintf("离线包: %d 个 deb，sha256 校验通过", len(debs)))
+	default:
+		debs, _ = filepath.Glob(filepath.Join(path, "*.deb"))
+		if len(debs) == 0 {
+			return fmt.Errorf("%s 中没有 .deb 文件", path)
+		}
+	}
+	// packages already present stay as they are: a bundle made elsewhere may
+	// carry other versions of shared libraries
+	var todo []string
+	for _, d := range debs {
+		if pkg := debField(d, "Package"); pkg != "" && debInstalled(pkg) && pkg != "nginx-extras" {
+			continue
+		}
+		todo = append(todo, d)
+	}
+	if len(todo) == 0 {
+		return errors.New("所有软件包均已安装")
+	}
+	if err := writeStreamLoaderConf(); err == nil {
+		log("已写入模块加载文件 " + NGINX_STREAM_LOADER)
+	}
+	log(fmt.Sprintf("安装 %d 个本地软件包 ...", len(todo)))
+	env := "DEBIAN_FRONTEND=noninteractive NEEDRESTART_MODE=a APT_LISTCHANGES_FRONTEND=none "
+	cmd := env + "apt-get install -y --no-download " + shellQuote(todo)
+	if _, err := exec.LookPath("apt-get"); err != nil {
+		cmd = env + "dpkg -i " + shellQuote(todo)
+	}
+	if err := runCmdPipe(log, "sh", "-c", cmd); err != nil {
+		return fmt.Errorf("安装本地软件包失败: %w", err)
+	}
+	log("启动并启用 nginx 服务")
+	_ = startEnabled("nginx", log)
+	log("nginx 安装完成")
+	return nil
+}
+
+// runBundleCommand implements `smartdnsctl bundle create|install`.
+func runBundleCommand(args []string) int {
+	usage := func() int {
+		fmt.Fprintln(os.Stderr, "用法: smartdnsctl bundle create 目录 [--smartdns 版本] [--arch amd64|arm64|arm|mips|mipsle] [--no-nginx]")
+		fmt.Fprintln(os.Stderr, "      smartdnsctl bundle install 路径 [--only smartdns|nginx]")
+		return 2
+	}
+	if len(args) < 2 {
+		return usage()
+	}
+	logf := func(s string) { fmt.Println(s) }
+	sub, dir := args[0], args[1]
+	switch sub {
+	case "create":
+		fs := flag.NewFlagSet("bundle create", flag.ContinueOnError)
+		tag := fs.String("smartdns", "", "SmartDNS 版本（默认最新稳定版）")
+		arch := fs.String("arch", runtime.GOARCH, "目标架构")
+		noNginx := fs.Bool("no-nginx", false, "不包含 nginx")
+		if err := fs.Parse(args[2:]); err != nil {
+			return 2
+		}
+		if err := createBundle(dir, bundleOptions{Tag: *tag, GOARCH: *arch, Nginx: !*noNginx}, logf); err != nil {
+			fmt.Fprintln(os.Stderr, "制作离线包失败:", err)
+			return 1
+		}
+		return 0
+	case "install":
+		fs := flag.NewFlagSet("bundle install", flag.ContinueOnError)
+		only := fs.String("only", "", "只安装 smartdns 或 nginx")
+		if err := fs.Parse(args[2:]); err != nil {
+			return 2
+		}
+		code := 0
+		if *only != "nginx" {
+			if err := installSmartDNSFrom(dir, logf); err != nil {
+				fmt.Fprintln(os.Stderr, "安装 SmartDNS 失败:", err)
+				code = 1
+			}
+		}
+		if *only != "smartdns" {
+			if err := installNginxFrom(dir, logf); err != nil {
+				fmt.Fprintln(os.Stderr, "安装 nginx 失败:", err)
+				code = 1
+			}
+		}
+		return code
+	}
+	return usage()
+}
@@ -0,0 +1,315 @@
+package src
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rivo/tview"
+)
+
+// smartdnsctl's own operation log. Every log* message and every audit entry
+// goes to OPLOG_FILE as one JSON object per line; the file rotates itself by
+// size so it works without logrotate. Audit entries record a mutating
+// operation: who ran it (SUDO_USER), what it was and which lines it changed.
+
+const (
+	LOG_DEBUG = "debug"
+	LOG_INFO  = "info"
+	LOG_WARN  = "warn"
+	LOG_ERROR = "error"
+
+	oplogMaxSize = 5 << 20
+	oplogKeep    = 3
+)
+
+var logLevelRank = map[string]int{LOG_DEBUG: 0, LOG_INFO: 1, LOG_WARN: 2, LOG_ERROR: 3}
+
+type opEntry struct {
+	Time  time.Time `json:"time"`
+	Level string    `json:"level"`
+	User  string    `json:"user,omitempty"`
+	Op    string    `json:"op,omitempty"` // set on audit entries
+	Msg   string    `json:"msg"`
+	Diff  []string  `json:"diff,omitempty"`
+	Error string    `json:"error,omitempty"`
+}
+
+var (
+	oplogMu       sync.Mutex
+	oplogRankOnce sync.Once
+	oplogRank     int
+	// consoleQuiet stops log* helpers from printing while the TUI owns the terminal.
+	consoleQuiet atomic.Bool
+)
+
+// oplogMinRank is the configured log_level (info by default).
+func oplogMinRank() int {
+	oplogRankOnce.Do(func() {
+		oplogRank = logLevelRank[LOG_INFO]
+		if r, ok := logLevelRank[loadSettings().LogLevel]; ok {
+			oplogRank = r
+		}
+	})
+	return oplogRank
+}
+
+// invokingUser is the human behind the command: SUDO_USER when run via sudo.
+func invokingUser() string {
+	for _, k := range []string{"SUDO_USER", "USER", "LOGNAME"} {
+		if v := os.Getenv(k); v != "" {
+			return v
+		}
+	}
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return strconv.Itoa(os.Getuid())
+}
+
+func writeOpEntry(e opEntry) {
+	if e.Op == "" && logLevelRank[e.Level] < oplogMinRank() {
+		return
+	}
+	e.Time = time.Now()
+	e.User = invokingUser()
+	b, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	oplogMu.Lock()
+	defer oplogMu.Unlock()
+	if fi, err := os.Stat(OPLOG_FILE); err == nil && fi.Size()+int64(len(b)) > oplogMaxSize {
+		rotateOplog()
+	}
+	if err := ensureDir(filepath.Dir(OPLOG_FILE)); err != nil {
+		return
+	}
+	f, err := os.OpenFile(OPLOG_FILE, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o640)
+	if err != nil {
+		return
+	}
+	_, _ = f.Write(append(b, '\n'))
+	f.Close()
+}
+
+// rotateOplog shifts OPLOG_FILE to .1, .1 to .2 ... keeping oplogKeep files.
+func rotateOplog() {
+	for i := oplogKeep - 1; i >= 1; i-- {
+		_ = os.Rename(fmt.Sprintf("%s.%d", OPLOG_FILE, i), fmt.Sprintf("%s.%d", OPLOG_FILE, i+1))
+	}
+	_ = os.Rename(OPLOG_FILE, OPLOG_FILE+".1")
+}
+
+func opLog(level, msg string) { writeOpEntry(opEntry{Level: level, Msg: msg}) }
+
+// opAudit records a mutating operation.
+func opAudit(op, msg string, diff []string, err error) {
+	e := opEntry{Level: LOG_INFO, Op: op, Msg: msg, Diff: diff}
+	if err != nil {
+		e.Level, e.Error = LOG_ERROR, err.Error()
+	}
+	writeOpEntry(e)
+}
+
+// auditSnapshots compares files with their snapshots and records the change
+// (successful no-op writes are skipped). Secret values never reach the diff.
+func auditSnapshots(op, msg string, before []nginxSnapshot, err error) {
+	var diff []string
+	for _, sn := range before {
+		after, _ := os.ReadFile(sn.path)
+		oldText, oldSecrets := redactSecrets(string(sn.data))
+		newText, newSecrets := redactSecrets(string(after))
+		diff = append(diff, diffSummary(sn.path, oldText, newText)...)
+		if oldSecrets != newSecrets {
+			diff = append(diff, sn.path+": 密码字段有变化（内容已隐藏）")
+		}
+	}
+	if err == nil && len(diff) == 0 {
+		return // nothing changed
+	}
+	opAudit(op, msg, diff, err)
+}
+
+// auditChange runs fn and records what it changed in paths.
+func auditChange(op, msg string, paths []string, fn func() error) error {
+	snaps := snapshotFiles(paths...)
+	err := fn()
+	auditSnapshots(op, msg, snaps, err)
+	return err
+}
+
+// secretLine matches a JSON line holding a credential (outbound and download
+// proxy passwords in SETTINGS_FILE), which must not be copied into OPLOG_FILE.
+var secretLine = regexp.MustCompile(`^(\s*"(?:pass|password|token|secret)"\s*:\s*)"(?:[^"\\]|\\.)*"`)
+
+// redactSecrets masks secret values in text; secrets joins the original values
+// so a caller can still tell that one changed.
+func redactSecrets(text string) (redacted, secrets string) {
+	lines := strings.Split(text, "\n")
+	var found []string
+	for i, l := range lines {
+		if m := secretLine.FindStringIndex(l); m != nil {
+			found = append(found, l[:m[1]])
+			lines[i] = secretLine.ReplaceAllString(l, `$1"***"`)
+		}
+	}
+	return strings.Join(lines, "\n"), strings.Join(found, "\n")
+}
+
+// diffSummary lists added and removed lines of one file (order-insensitive,
+// enough to see what an operation did); at most 20 lines are kept.
+func diffSummary(path, before, after string) []string {
+	if before == after {
+		return nil
+	}
+	count := map[string]int{}
+	for _, l := range strings.Split(before, "\n") {
+		count[l]++
+	}
+	var added []string
+	for _, l := range strings.Split(after, "\n") {
+		if count[l] > 0 {
+			count[l]--
+			continue
+		}
+		added = append(added, "+ "+l)
+	}
+	var removed []string
+	for _, l := range strings.Split(before, "\n") {
+		if count[l] > 0 {
+			count[l]--
+			removed = append(removed, "- "+l)
+		}
+	}
+	out := []string{fmt.Sprintf("%s: +%d -%d", path, len(added), len(removed))}
+	lines := append(removed, added...)
+	if len(lines) > 20 {
+		lines = append(lines[:20], fmt.Sprintf("... 其余 %d 行", len(lines)-20))
+	}
+	return append(out, lines...)
+}
+
+// auditedManager records every state change made through the service manager.
+type auditedManager struct{ ServiceManager }
+
+func (m auditedManager) audit(action, name string, err error) error {
+	opAudit("service."+action, name+" ("+m.Name()+")", nil, err)
+	return err
+}
+
+// Start, Restart and Reload also show what the service logged when they fail.
+func (m auditedManager) Start(name string, log func(string)) error {
+	mark := markJournal(name)
+	return m.audit("start", name, mark.explainFailure(log, m.ServiceManager.Start(name, log)))
+}
+
+func (m auditedManager) Stop(name string, log func(string)) error {
+	return m.audit("stop", name, m.ServiceManager.Stop(name, log))
+}
+
+func (m auditedManager) Restart(name string, log func(string)) error {
+	mark := markJournal(name)
+	return m.audit("restart", name, mark.explainFailure(log, m.ServiceManager.Restart(name, log)))
+}
+
+func (m auditedManager) Reload(name string, log func(string)) error {
+	mark := markJournal(name)
+	return m.audit("reload", name, mark.explainFailure(log, m.ServiceManager.Reload(name, log)))
+}
+
+func (m auditedManager) Enable(name string, log func(string)) error {
+	return m.audit("enable", name, m.ServiceManager.Enable(name, log))
+}
+
+func (m auditedManager) Disable(name string, log func(string)) error {
+	return m.audit("disable", name, m.ServiceManager.Disable(name, log))
+}
+
+func (m auditedManager) Install(spec serviceSpec, log func(string)) error {
+	return m.audit("install", spec.Name+" "+strings.Join(spec.Command, " "), m.ServiceManager.Install(spec, log))
+}
+
+func (m auditedManager) Remove(name string, log func(string)) error {
+	return m.audit("remove", name, m.ServiceManager.Remove(name, log))
+}
+
+// ----- reading the history -----
+
+// readOpEntries returns the newest n entries (audit entries only unless all), oldest first.
+func readOpEntries(n int, all bool) []opEntry {
+	var out []opEntry
+	for _, path := range []string{OPLOG_FILE + ".1", OPLOG_FILE} {
+		lines, err := tailLines(path, 1<<30, 4<<20)
+		if err != nil {
+			continue
+		}
+		for _, l := range lines {
+			var e opEntry
+			if json.Unmarshal([]byte(l), &e) != nil || (!all && e.Op == "") {
+				continue
+			}
+			out = append(out, e)
+		}
+	}
+	if len(out) > n {
+		out = out[len(out)-n:]
+	}
+	return out
+}
+
+// lines renders an entry; color adds tview tags.
+func (e opEntry) lines(color bool) []string {
+	tag := map[string]string{LOG_DEBUG: "gray", LOG_INFO: "white", LOG_WARN: "yellow", LOG_ERROR: "red"}[e.Level]
+	head := fmt.Sprintf("%s %-5s %-10s", e.Time.Local().Format("2006-01-02 15:04:05"), strings.ToUpper(e.Level), e.User)
+	if e.Op != "" {
+		head += " " + e.Op
+	}
+	head += " " + e.Msg
+	if e.Error != "" {
+		head += " 失败: " + e.Error
+	}
+	if color && tag != "" {
+		head = "[" + tag + "]" + tview.Escape(head) + "[-]"
+	}
+	out := []string{head}
+	for _, d := range e.Diff {
+		if color {
+			switch {
+			case strings.HasPrefix(d, "+ "):
+				d = "[green]" + tview.Escape(d) + "[-]"
+			case strings.HasPrefix(d, "- "):
+				d = "[red]" + tview.Escape(d) + "[-]"
+			default:
+				d = tview.Escape(d)
+			}
+		}
+		out = append(out, "    "+d)
+	}
+	return out
+}
+
+// runHistoryCommand implements `smartdnsctl history [-n N] [--all]`.
+func runHistoryCommand(args []string) int {
+	fs := flag.NewFlagSet("history", flag.ContinueOnError)
+	n := fs.Int("n", 50, "显示条数")
+	all := fs.Bool("all", false, "包含普通日志（默认只显示审计记录）")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	for _, e := range readOpEntries(*n, *all) {
+		for _, l := range e.lines(false) {
+			fmt.Println(l)
+		}
+	}
+	return 0
+}
@@ -0,0 +1,46 @@
+package src
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestRedactSecretsInSettingsDiff(t *testing.T) {
+	settings := func(pass, mirror string) string {
+		st := ctlSettings{
+			Outbounds:       map[string]outboundRoute{"netflix": {Type: OUTBOUND_SOCKS5, Addr: "10.0.0.2:1080", User: "u", Pass: pass}},
+			DownloadProxy:   outboundRoute{Type: OUTBOUND_HTTP, Addr: "10.0.0.3:3128", User: "d", Pass: pass + `"q\`},
+			DownloadMirrors: []string{mirror},
+		}
+		b, err := json.MarshalIndent(st, "", "  ")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+	before, oldSecrets := redactSecrets(settings("old-secret", "https://m1/"))
+	after, newSecrets := redactSecrets(settings("new-secret", "https://m2/"))
+	if oldSecrets == newSecrets {
+		t.Fatal("a changed password must still be detectable")
+	}
+	diff := strings.Join(diffSummary(SETTINGS_FILE, before, after), "\n")
+	for _, leak := range []string{"old-secret", "new-secret", `q\`} {
+		if strings.Contains(before+after+diff, leak) {
+			t.Fatalf("%q leaked:\n%s", leak, diff)
+		}
+	}
+	if !strings.Contains(diff, "https://m2/") {
+		t.Fatalf("non-secret change missing from the diff:\n%s", diff)
+	}
+	if strings.Count(after, `"pass": "***"`) != 2 {
+		t.Fatalf("passwords not masked:\n%s", after)
+	}
+
+	// a password-only change leaves the masked text equal
+	a, _ := redactSecrets(settings("one", "https://m1/"))
+	b, _ := redactSecrets(settings("two", "https://m1/"))
+	if a != b {
+		t.Fatalf("masked texts differ:\n%s\n%s", a, b)
+	}
+}
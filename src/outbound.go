@@ -0,0 +1,246 @@
+package src
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	OUTBOUND_DIRECT = "direct"
+	OUTBOUND_SOCKS5 = "socks5"
+	OUTBOUND_HTTP   = "http"
+)
+
+// outboundRoute is how a platform leaves the unlock node: directly, or through
+// another hop such as a WARP or residential SOCKS5 / HTTP CONNECT endpoint.
+type outboundRoute struct {
+	Type string `json:"type"`
+	Addr string `json:"addr,omitempty"` // host:port of the hop
+	User string `json:"user,omitempty"`
+	Pass string `json:"pass,omitempty"`
+}
+
+func (o outboundRoute) isDirect() bool { return o.Type == "" || o.Type == OUTBOUND_DIRECT }
+
+func (o outboundRoute) String() string {
+	if o.isDirect() {
+		return OUTBOUND_DIRECT
+	}
+	if o.User != "" {
+		return o.Type + "://" + o.User + "@" + o.Addr
+	}
+	return o.Type + "://" + o.Addr
+}
+
+func (o outboundRoute) validate() error {
+	switch o.Type {
+	case "", OUTBOUND_DIRECT:
+		return nil
+	case OUTBOUND_SOCKS5, OUTBOUND_HTTP:
+	default:
+		return fmt.Errorf("未知出站类型: %s", o.Type)
+	}
+	if _, port, err := net.SplitHostPort(o.Addr); err != nil || port == "" {
+		return fmt.Errorf("出站地址需为 host:port: %s", o.Addr)
+	}
+	if len(o.User) > 255 || len(o.Pass) > 255 {
+		return errors.New("用户名或密码过长")
+	}
+	return nil
+}
+
+// dialOutbound connects to target (host:port) through the route. The hop itself is
+// dialled with d, so an egress LocalAddr on d applies to the first hop.
+func dialOutbound(ctx context.Context, d *net.Dialer, o outboundRoute, target string) (net.Conn, error) {
+	if o.isDirect() {
+		return d.DialContext(ctx, "tcp", target)
+	}
+	conn, err := d.DialContext(ctx, "tcp", o.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("连接出站 %s 失败: %w", o.Addr, err)
+	}
+	if dl, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(dl)
+	}
+	switch o.Type {
+	case OUTBOUND_SOCKS5:
+		err = socks5Connect(conn, target, o.User, o.Pass)
+	case OUTBOUND_HTTP:
+		conn, err = httpConnect(conn, target, o.User, o.Pass)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("%s 握手失败: %w", o.Type, err)
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// socks5Connect performs a RFC 1928 CONNECT (with RFC 1929 auth when user is set).
+// The target hostname is sent as-is so the hop resolves it from its own location.
+func socks5Connect(conn net.Conn, target, user, pass string) error {
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return err
+	}
+	methods := []byte{0x00}
+	if user != "" {
+		methods = []byte{0x00, 0x02}
+	}
+	if _, err := conn.Write(append([]byte{0x05, byte(len(methods))}, methods...)); err != nil {
+		return err
+	}
+	resp := make([]byte, 2)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return err
+	}
+	if resp[0] != 0x05 {
+		return errors.New("不是 SOCKS5 服务")
+	}
+	switch resp[1] {
+	case 0x00:
+	case 0x02:
+		req := []byte{0x01, byte(len(user))}
+		req = append(req, user...)
+		req = append(req, byte(len(pass)))
+		req = append(req, pass...)
+		if _, err := conn.Write(req); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, resp); err != nil {
+			return err
+		}
+		if resp[1] != 0x00 {
+			return errors.New("用户名或密码错误")
+		}
+	default:
+		return errors.New("服务端不接受可用的认证方式")
+	}
+	req := []byte{0x05, 0x01, 0x00}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			req = append(append(req, 0x01), ip4...)
+		} else {
+			req = append(append(req, 0x04), ip.To16()...)
+		}
+	} else {
+		if len(host) > 255 {
+			return errors.New("域名过长")
+		}
+		req = append(append(req, 0x03, byte(len(host))), host...)
+	}
+	req = append(req, byte(port>>8), byte(port))
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+	head := make([]byte, 4)
+	if _, err := io.ReadFull(conn, head); err != nil {
+		return err
+	}
+	if head[1] != 0x00 {
+		return fmt.Errorf("CONNECT 被拒绝 (REP=%d)", head[1])
+	}
+	var skip int
+	switch head[3] {
+	case 0x01:
+		skip = 4
+	case 0x04:
+		skip = 16
+	case 0x03:
+		l := make([]byte, 1)
+		if _, err := io.ReadFull(conn, l); err != nil {
+			return err
+		}
+		skip = int(l[0])
+	default:
+		return errors.New("无法识别的 BND.ADDR 类型")
+	}
+	_, err = io.ReadFull(conn, make([]byte, skip+2))
+	return err
+}
+
+// httpConnect opens a tunnel with an HTTP CONNECT request.
+func httpConnect(conn net.Conn, target, user, pass string) (net.Conn, error) {
+	req := "CONNECT " + target + " HTTP/1.1\r\nHost: " + target + "\r\n"
+	if user != "" {
+		req += "Proxy-Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+pass)) + "\r\n"
+	}
+	if _, err := io.WriteString(conn, req+"\r\n"); err != nil {
+		return conn, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		return conn, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return conn, fmt.Errorf("CONNECT 返回 %s", resp.Status)
+	}
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn replays bytes a bufio.Reader already pulled off the connection.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) { return c.r.Read(p) }
+
+func (c *bufferedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
+// testOutbound opens a tunnel to host:443 through the route and completes a TLS handshake,
+// reporting the time spent on each step.
+func testOutbound(o outboundRoute, egress, host string, log func(string)) error {
+	if log == nil {
+		log = func(string) {}
+	}
+	if err := o.validate(); err != nil {
+		return err
+	}
+	d := &net.Dialer{Timeout: 10 * time.Second}
+	if ip := net.ParseIP(egress); ip != nil {
+		d.LocalAddr = &net.TCPAddr{IP: ip}
+		log("出口地址: " + egress)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	log(fmt.Sprintf("通过 %s 连接 %s:443 ...", o, host))
+	start := time.Now()
+	conn, err := dialOutbound(ctx, d, o, net.JoinHostPort(host, "443"))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	log(fmt.Sprintf("隧道建立: %s", time.Since(start).Round(time.Millisecond)))
+	tstart := time.Now()
+	tc := tls.Client(conn, &tls.Config{ServerName: host})
+	_ = tc.SetDeadline(time.Now().Add(10 * time.Second))
+	if err := tc.Handshake(); err != nil {
+		return fmt.Errorf("TLS 握手失败: %w", err)
+	}
+	log(fmt.Sprintf("TLS 握手: %s (%s)", time.Since(tstart).Round(time.Millisecond), tls.VersionName(tc.ConnectionState().Version)))
+	return nil
+}
@@ -0,0 +1,279 @@
+package src
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Port owner detection for 53/80/443. smartdns and nginx fail to start quietly
+// when dnsmasq, named, caddy or apache already hold their ports, so we read the
+// listening sockets from /proc/net, map socket inodes to processes through
+// /proc/<pid>/fd and name the owning unit from /proc/<pid>/cgroup.
+
+// portListener is one listening socket and its owner (PID 0 when the owner
+// couldn't be found, e.g. in another PID namespace).
+type portListener struct {
+	Proto string
+	Addr  string
+	Port  int
+	Inode string
+	PID   int
+	Comm  string
+	Unit  string
+}
+
+func (l portListener) owner() string {
+	switch {
+	case l.PID == 0:
+		return "未知进程"
+	case l.Unit != "":
+		return fmt.Sprintf("%s (%s, pid %d)", l.Comm, l.Unit, l.PID)
+	}
+	return fmt.Sprintf("%s (pid %d)", l.Comm, l.PID)
+}
+
+func (l portListener) String() string {
+	return fmt.Sprintf("%s %s:%d ← %s", l.Proto, l.Addr, l.Port, l.owner())
+}
+
+// service is the name to hand to the service manager, or "" for a bare process.
+func (l portListener) service() string {
+	return strings.TrimSuffix(l.Unit, ".service")
+}
+
+// portListeners returns the TCP listeners and bound UDP sockets on ports.
+func portListeners(ports ...int) []portListener {
+	want := map[int]bool{}
+	for _, p := range ports {
+		want[p] = true
+	}
+	var out []portListener
+	for _, proto := range []string{"tcp", "tcp6", "udp", "udp6"} {
+		out = append(out, readProcNet(proto, want)...)
+	}
+	if len(out) == 0 {
+		return nil
+	}
+	owners := socketOwners()
+	for i := range out {
+		if pid, ok := owners[out[i].Inode]; ok {
+			out[i].PID = pid
+			out[i].Comm = procComm(pid)
+			out[i].Unit = procUnit(pid)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Port != out[j].Port {
+			return out[i].Port < out[j].Port
+		}
+		return out[i].Proto < out[j].Proto
+	})
+	return out
+}
+
+// readProcNet parses /proc/net/{tcp,tcp6,udp,udp6}. Columns: sl local_address
+// rem_address st ... inode; TCP state 0A is LISTEN, UDP 07 is an unconnected bind.
+func readProcNet(proto string, want map[int]bool) []portListener {
+	b, err := os.ReadFile("/proc/net/" + proto)
+	if err != nil {
+		return nil
+	}
+	state := "0A"
+	if strings.HasPrefix(proto, "udp") {
+		state = "07"
+	}
+	var out []portListener
+	for _, line := range strings.Split(string(b), "\n")[1:] {
+		f := strings.Fields(line)
+		if len(f) < 10 || f[3] != state {
+			continue
+		}
+		host, port, ok := strings.Cut(f[1], ":")
+		if !ok {
+			continue
+		}
+		p, err := strconv.ParseInt(port, 16, 32)
+		if err != nil || !want[int(p)] {
+			continue
+		}
+		out = append(out, portListener{Proto: proto, Addr: procNetIP(host), Port: int(p), Inode: f[9]})
+	}
+	return out
+}
+
+// procNetIP decodes the kernel's hex address: 32-bit words in host (little-endian) order.
+func procNetIP(h string) string {
+	raw, err := hex.DecodeString(h)
+	if err != nil || len(raw)%4 != 0 {
+		return h
+	}
+	for i := 0; i < len(raw); i += 4 {
+		raw[i], raw[i+1], raw[i+2], raw[i+3] = raw[i+3], raw[i+2], raw[i+1], raw[i]
+	}
+	ip := net.IP(raw)
+	if ip.To4() == nil {
+		return "[" + ip.String() + "]"
+	}
+	return ip.String()
+}
+
+// socketOwners maps socket inodes to the first PID holding them.
+func socketOwners() map[string]int {
+	owners := map[string]int{}
+	procs, _ := filepath.Glob("/proc/[0-9]*")
+	for _, dir := range procs {
+		pid, err := strconv.Atoi(filepath.Base(dir))
+		if err != nil {
+			continue
+		}
+		fds, err := os.ReadDir(dir + "/fd")
+		if err != nil {
+			continue
+		}
+		for _, fd := range fds {
+			link, err := os.Readlink(dir + "/fd/" + fd.Name())
+			if err != nil || !strings.HasPrefix(link, "socket:[") {
+				continue
+			}
+			inode := strings.TrimSuffix(strings.TrimPrefix(link, "socket:["), "]")
+			if _, seen := owners[inode]; !seen {
+				owners[inode] = pid
+			}
+		}
+	}
+	return owners
+}
+
+func procComm(pid int) string {
+	b, _ := os.ReadFile(fmt.Sprintf("/proc/%d/comm", pid))
+	return strings.TrimSpace(string(b))
+}
+
+// procUnit returns the systemd unit from the process cgroup, or the name of
+// our supervised / OpenRC service when the cgroup has none.
+func procUnit(pid int) string {
+	b, _ := os.ReadFile(fmt.Sprintf("/proc/%d/cgroup", pid))
+	for _, line := range strings.Split(string(b), "\n") {
+		parts := strings.SplitN(line, ":", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		segs := strings.Split(parts[2], "/")
+		for i := len(segs) - 1; i >= 0; i-- {
+			if strings.HasSuffix(segs[i], ".service") {
+				return segs[i]
+			}
+		}
+		// OpenRC with cgroups: /openrc.<service>
+		for _, seg := range segs {
+			if strings.HasPrefix(seg, "openrc.") {
+				return strings.TrimPrefix(seg, "openrc.")
+			}
+		}
+	}
+	return ""
+}
+
+// Expected owners: a listener run by one of these process names is ours.
+func dnsPortOwners() []string { return []string{"smartdns"} }
+
+func proxyPortOwners() []string {
+	owners := []string{"nginx"}
+	if exe, err := os.Executable(); err == nil {
+		// comm is truncated to 15 bytes
+		name := filepath.Base(exe)
+		if len(name) > 15 {
+			name = name[:15]
+		}
+		owners = append(owners, name)
+	}
+	return owners
+}
+
+// portConflicts lists listeners on ports not run by one of owners.
+func portConflicts(ports []int, owners []string) []portListener {
+	var out []portListener
+	for _, l := range portListeners(ports...) {
+		mine := false
+		for _, o := range owners {
+			if l.Comm == o {
+				mine = true
+				break
+			}
+		}
+		if !mine {
+			out = append(out, l)
+		}
+	}
+	return out
+}
+
+// currentPortConflicts checks 53 for smartdns and 80/443 for the proxy backend.
+func currentPortConflicts() []portListener {
+	out := portConflicts([]int{53}, dnsPortOwners())
+	return append(out, portConflicts([]int{80, 443}, proxyPortOwners())...)
+}
+
+// warnPortConflicts logs conflicting listeners; it never blocks the caller.
+func warnPortConflicts(log func(string), ports []int, owners []string) {
+	for _, l := range portConflicts(ports, owners) {
+		log(fmt.Sprintf("[警告] 端口被占用: %s", l))
+	}
+}
+
+// stopPortOwners stops (and optionally disables) the services behind the
+// listeners; bare processes without a unit get SIGTERM.
+func stopPortOwners(log func(string), ls []portListener, disable bool) error {
+	done := map[string]bool{}
+	var errs []string
+	for _, l := range ls {
+		switch name := l.service(); {
+		case l.PID == 0:
+			errs = append(errs, fmt.Sprintf("%d 端口的占用者未知", l.Port))
+		case name == "systemd-resolved":
+			// keep resolved, just take its stub off port 53
+			if done[name] {
+				continue
+			}
+			done[name] = true
+			if err := releasePort53(log); err != nil {
+				errs = append(errs, err.Error())
+			}
+		case name != "":
+			if done[name] {
+				continue
+			}
+			done[name] = true
+			log("停止 " + name)
+			if err := serviceAction(log, "stop", name); err != nil {
+				errs = append(errs, err.Error())
+				continue
+			}
+			if disable {
+				log("禁用 " + name + " 开机自启")
+				_ = serviceAction(log, "disable", name)
+			}
+		default:
+			key := strconv.Itoa(l.PID)
+			if done[key] {
+				continue
+			}
+			done[key] = true
+			log(fmt.Sprintf("结束进程 %s (pid %d)", l.Comm, l.PID))
+			if err := syscall.Kill(l.PID, syscall.SIGTERM); err != nil {
+				errs = append(errs, err.Error())
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,756 @@
+package src
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Public resolvers used to find the real upstream. The local resolver is smartdns,
+// which answers unlocked platforms with this node's own address and would loop.
+var proxyResolvers = []string{"1.1.1.1:53", "8.8.8.8:53"}
+
+const (
+	proxyPeekTimeout  = 10 * time.Second
+	proxyDialTimeout  = 10 * time.Second
+	proxyMaxHeaderLen = 16 * 1024
+)
+
+// ----- allow-list shared with the nginx generator -----
+
+// proxyRules maps hostnames to StreamConfig platforms and decides which may be proxied.
+// The allow-list is every platform assigned with the address method (i.e. resolved to an
+// unlock node); when there is none the proxy stays open like the original nginx passthrough.
+type proxyRules struct {
+	platforms map[string][]string // domain -> platforms (subs) listing it
+	domains   map[string][]string // platform -> domains
+	allowed   map[string]bool     // platform -> proxied
+	egress    map[string]string   // platform -> local source address
+	outbounds map[string]outboundRoute
+	// nginxAllowList applies the allow-list to the nginx generator too (the built-in proxy always applies it)
+	nginxAllowList bool
+
+	clientLimit    trafficLimit
+	platformLimits map[string]trafficLimit
+	quota          *quotaBlock // over-quota subjects for the nginx generator; nil without quotas
+}
+
+func loadProxyRules() *proxyRules {
+	r := &proxyRules{platforms: map[string][]string{}, domains: map[string][]string{}, allowed: map[string]bool{}, egress: map[string]string{}, outbounds: map[string]outboundRoute{}}
+	if cfg, err := loadStreamConfig(); err == nil {
+		for _, subs := range cfg {
+			for sub, domains := range subs {
+				for _, d := range domains {
+					d = strings.ToLower(strings.TrimSpace(d))
+					if d == "" {
+						continue
+					}
+					r.platforms[d] = append(r.platforms[d], sub)
+					r.domains[sub] = append(r.domains[sub], d)
+				}
+			}
+		}
+	}
+	for sub, a := range parseAssignments() {
+		if a.Method == "address" {
+			r.allowed[sub] = true
+		}
+	}
+	st := loadSettings()
+	r.nginxAllowList = st.NginxAllowList
+	for sub, addr := range st.Egress {
+		if net.ParseIP(addr) != nil {
+			r.egress[sub] = addr
+		}
+	}
+	for sub, o := range st.Outbounds {
+		if !o.isDirect() && o.validate() == nil {
+			r.outbounds[sub] = o
+		}
+	}
+	r.clientLimit = st.ClientLimit
+	r.platformLimits = map[string]trafficLimit{}
+	for sub, l := range st.PlatformLimits {
+		if !l.empty() {
+			r.platformLimits[sub] = l
+		}
+	}
+	return r
+}
+
+// open reports whether no allow-list is in effect.
+func (r *proxyRules) open() bool { return len(r.allowed) == 0 }
+
+// nginxOpen is open() for the nginx generator, which passes everything through
+// unless nginx_allow_list is set.
+func (r *proxyRules) nginxOpen() bool { return !r.nginxAllowList || r.open() }
+
+// platformOf returns the platform whose domain equals host or is a parent of host.
+// An allowed platform wins when several list the same domain.
+func (r *proxyRules) platformOf(host string) string {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	for host != "" {
+		if subs, ok := r.platforms[host]; ok {
+			for _, sub := range subs {
+				if r.allowed[sub] {
+					return sub
+				}
+			}
+			return subs[0]
+		}
+		i := strings.IndexByte(host, '.')
+		if i < 0 {
+			break
+		}
+		host = host[i+1:]
+	}
+	return ""
+}
+
+// allow returns the platform of host and whether it may be proxied.
+func (r *proxyRules) allow(host string) (string, bool) {
+	p := r.platformOf(host)
+	if r.open() {
+		return p, true
+	}
+	return p, p != "" && r.allowed[p]
+}
+
+// allowedDomains returns the sorted, de-duplicated domains of allowed platforms.
+func (r *proxyRules) allowedDomains() []string {
+	seen := map[string]bool{}
+	var out []string
+	for sub := range r.allowed {
+		for _, d := range r.domains[sub] {
+			if !seen[d] {
+				seen[d] = true
+				out = append(out, d)
+			}
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// chainedDomains returns the sorted domains of platforms that leave through another hop.
+func (r *proxyRules) chainedDomains() []string {
+	seen := map[string]bool{}
+	var out []string
+	for sub := range r.outbounds {
+		for _, d := range r.domains[sub] {
+			if !seen[d] {
+				seen[d] = true
+				out = append(out, d)
+			}
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// egressByDomain maps every domain of a platform with an egress address to that address.
+// Chained platforms are left out: nginx hands them to the loopback chain proxy, which binds itself.
+func (r *proxyRules) egressByDomain() map[string]string {
+	values := map[string]string{}
+	for sub, addr := range r.egress {
+		if _, chained := r.outbounds[sub]; !chained {
+			values[sub] = addr
+		}
+	}
+	return r.domainValues(values)
+}
+
+// domainValues spreads a per-platform value over the platform's domains. A domain listed
+// by several platforms keeps the first platform in sorted order.
+func (r *proxyRules) domainValues(values map[string]string) map[string]string {
+	subs := make([]string, 0, len(values))
+	for sub := range values {
+		subs = append(subs, sub)
+	}
+	sort.Strings(subs)
+	out := map[string]string{}
+	for _, sub := range subs {
+		for _, d := range r.domains[sub] {
+			if _, ok := out[d]; !ok {
+				out[d] = values[sub]
+			}
+		}
+	}
+	return out
+}
+
+// ----- proxy server -----
+
+type sniProxy struct {
+	httpsAddr string
+	httpAddr  string
+	quicAddr  string
+	rules     atomic.Pointer[proxyRules]
+	resolver  *net.Resolver
+	localIPs  map[string]bool
+	access    *accessLogger
+	limits    bool // enforce connection, rate and quota limits
+	limiter   *connLimiter
+	quota     atomic.Pointer[quotaBlock]
+}
+
+func newSNIProxy(httpsAddr, httpAddr string) *sniProxy {
+	p := &sniProxy{httpsAddr: httpsAddr, httpAddr: httpAddr, localIPs: map[string]bool{}, limits: true, limiter: newConnLimiter()}
+	var next uint32
+	p.resolver = &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			i := atomic.AddUint32(&next, 1)
+			d := net.Dialer{Timeout: 3 * time.Second}
+			return d.DialContext(ctx, network, proxyResolvers[int(i)%len(proxyResolvers)])
+		},
+	}
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, a := range addrs {
+			if ipn, ok := a.(*net.IPNet); ok {
+				p.localIPs[ipn.IP.String()] = true
+			}
+		}
+	}
+	return p
+}
+
+// runProxyCommand implements `smartdnsctl proxy`.
+func runProxyCommand(args []string) int {
+	fs := flag.NewFlagSet("proxy", flag.ContinueOnError)
+	httpsAddr := fs.String("https", ":443", "TLS 监听地址（按 SNI 转发），留空禁用")
+	httpAddr := fs.String("http", ":80", "HTTP 监听地址（按 Host 转发），留空禁用")
+	quicAddr := fs.String("quic", "", "QUIC/UDP 监听地址（按 Initial 包中的 SNI 转发），默认禁用")
+	accessLog := fs.String("access-log", PROXY_ACCESS_LOG, "JSON 访问日志路径，留空禁用")
+	limits := fs.Bool("limits", true, "执行连接数/速率/月配额限制")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	p := newSNIProxy(*httpsAddr, *httpAddr)
+	p.quicAddr = *quicAddr
+	p.limits = *limits
+	access, err := openAccessLog(*accessLog)
+	if err != nil {
+		log.Printf("内置代理: 访问日志不可用: %v", err)
+		access = &accessLogger{}
+	}
+	p.access = access
+	if err := p.serve(); err != nil {
+		log.Printf("内置代理: %v", err)
+		return 1
+	}
+	return 0
+}
+
+func (p *sniProxy) serve() error {
+	p.rules.Store(loadProxyRules())
+	p.logRules()
+	go p.watchRules()
+	if p.limits {
+		go p.watchQuota()
+	}
+	errc := make(chan error, 3)
+	listeners := 0
+	for _, l := range []struct {
+		addr   string
+		handle func(net.Conn)
+	}{{p.httpsAddr, p.handleTLS}, {p.httpAddr, p.handleHTTP}} {
+		if l.addr == "" {
+			continue
+		}
+		ln, err := net.Listen("tcp", l.addr)
+		if err != nil {
+			return err
+		}
+		log.Printf("内置代理: 监听 %s", ln.Addr())
+		listeners++
+		go func(ln net.Listener, handle func(net.Conn)) {
+			for {
+				c, err := ln.Accept()
+				if err != nil {
+					var ne net.Error
+					if errors.As(err, &ne) && ne.Timeout() {
+						continue
+					}
+					errc <- err
+					return
+				}
+				go handle(c)
+			}
+		}(ln, l.handle)
+	}
+	if p.quicAddr != "" {
+		listeners++
+		go func() { errc <- p.serveQUIC(p.quicAddr) }()
+	}
+	if listeners == 0 {
+		return errors.New("未配置任何监听地址")
+	}
+	return <-errc
+}
+
+func (p *sniProxy) logRules() {
+	r := p.rules.Load()
+	if r.open() {
+		log.Printf("内置代理: 没有以 address 方式分配的平台，放行全部域名")
+		return
+	}
+	log.Printf("内置代理: 放行列表共 %d 个平台 / %d 个域名", len(r.allowed), len(r.allowedDomains()))
+}
+
+// watchRules reloads the allow-list whenever smartdns.conf or StreamConfig.yaml change.
+func (p *sniProxy) watchRules() {
+	stamp := func() string {
+		var b strings.Builder
+		for _, path := range []string{SMART_CONFIG_FILE, streamConfigPath(), SETTINGS_FILE} {
+			if fi, err := os.Stat(path); err == nil {
+				fmt.Fprintf(&b, "%s:%d:%d;", path, fi.Size(), fi.ModTime().UnixNano())
+			}
+		}
+		return b.String()
+	}
+	last := stamp()
+	for range time.Tick(5 * time.Second) {
+		if cur := stamp(); cur != last {
+			last = cur
+			p.rules.Store(loadProxyRules())
+			p.logRules()
+		}
+	}
+}
+
+func (p *sniProxy) handleTLS(c net.Conn) {
+	defer c.Close()
+	_ = c.SetReadDeadline(time.Now().Add(proxyPeekTimeout))
+	br := bufio.NewReaderSize(c, proxyMaxHeaderLen+5)
+	host, err := peekClientHelloSNI(br)
+	if err != nil {
+		log.Printf("内置代理: %s: %v", c.RemoteAddr(), err)
+		return
+	}
+	_ = c.SetReadDeadline(time.Time{})
+	p.forward(c, br, host, "443", "tls")
+}
+
+func (p *sniProxy) handleHTTP(c net.Conn) {
+	defer c.Close()
+	_ = c.SetReadDeadline(time.Now().Add(proxyPeekTimeout))
+	br := bufio.NewReaderSize(c, proxyMaxHeaderLen)
+	host, err := peekHTTPHost(br)
+	if err != nil {
+		log.Printf("内置代理: %s: %v", c.RemoteAddr(), err)
+		return
+	}
+	_ = c.SetReadDeadline(time.Time{})
+	p.forward(c, br, host, "80", "http")
+}
+
+// forward checks host against the allow-list, dials the upstream and splices both sides.
+// br holds the peeked bytes that still have to be sent upstream. Every connection ends
+// up as one access-log record, with nginx-like status codes (200 / 403 / 502).
+func (p *sniProxy) forward(c net.Conn, br *bufio.Reader, host, port, proto string) {
+	start := time.Now()
+	rec := trafficRecord{Time: start.Format(time.RFC3339), Client: remoteIP(c.RemoteAddr()), Host: host, Proto: proto}
+	defer func() {
+		rec.Duration = time.Since(start).Seconds()
+		p.access.write(rec)
+	}()
+	rules := p.rules.Load()
+	platform, ok := rules.allow(host)
+	if !ok {
+		rec.Status = "403"
+		log.Printf("内置代理: %s -> %s 已拒绝（不在放行列表）", c.RemoteAddr(), host)
+		return
+	}
+	var rate int64
+	if p.limits {
+		if p.quota.Load().blocks(rec.Client, platform) {
+			rec.Status = "429"
+			log.Printf("内置代理: %s -> %s [%s] 已拒绝（超出配额）", c.RemoteAddr(), host, platform)
+			return
+		}
+		if !p.limiter.acquire(rules, rec.Client, platform) {
+			rec.Status = "429"
+			log.Printf("内置代理: %s -> %s [%s] 已拒绝（超出连接数限制）", c.RemoteAddr(), host, platform)
+			return
+		}
+		defer p.limiter.release(rec.Client, platform)
+		rate = rules.connRate(platform)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), proxyDialTimeout)
+	up, err := p.dialUpstream(ctx, platform, host, port)
+	cancel()
+	if err != nil {
+		rec.Status = "502"
+		log.Printf("内置代理: %s -> %s:%s [%s] 连接失败: %v", c.RemoteAddr(), host, port, platform, err)
+		return
+	}
+	defer up.Close()
+	rec.Status = "200"
+	rec.BytesIn, rec.BytesOut = pipeConns(c, br, up, rate)
+}
+
+func remoteIP(a net.Addr) string {
+	if host, _, err := net.SplitHostPort(a.String()); err == nil {
+		return host
+	}
+	return a.String()
+}
+
+// dialUpstream resolves host via public resolvers and connects, refusing addresses
+// that belong to this machine so a wrong DNS answer cannot make the proxy loop.
+// When the platform has an egress address the connection is bound to it and only
+// upstream addresses of the same family are tried. Platforms with an outbound route
+// go through that hop instead, and the hop resolves host itself.
+func (p *sniProxy) dialUpstream(ctx context.Context, platform, host, port string) (net.Conn, error) {
+	rules := p.rules.Load()
+	if o, ok := rules.outbounds[platform]; ok {
+		d := &net.Dialer{}
+		if bind := net.ParseIP(rules.egress[platform]); bind != nil && p.localIPs[bind.String()] {
+			if hop, _, _ := net.SplitHostPort(o.Addr); !net.ParseIP(hop).IsLoopback() {
+				d.LocalAddr = &net.TCPAddr{IP: bind}
+			}
+		}
+		return dialOutbound(ctx, d, o, net.JoinHostPort(host, port))
+	}
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	} else {
+		addrs, err := p.resolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range addrs {
+			ips = append(ips, a.IP)
+		}
+	}
+	var lastErr error = fmt.Errorf("%s 没有可用地址", host)
+	d := net.Dialer{}
+	var bind net.IP
+	if addr := rules.egress[platform]; addr != "" {
+		if bind = net.ParseIP(addr); p.localIPs[bind.String()] {
+			d.LocalAddr = &net.TCPAddr{IP: bind}
+		} else {
+			log.Printf("内置代理: %[2]s 的出口地址 %[1]s 不在本机，改用默认路由", addr, platform)
+			bind = nil
+		}
+	}
+	for _, ip := range ips {
+		if ip.IsLoopback() || ip.IsUnspecified() || p.localIPs[ip.String()] {
+			lastErr = fmt.Errorf("%s 解析到本机地址 %s，拒绝回环", host, ip)
+			continue
+		}
+		if bind != nil && (bind.To4() == nil) != (ip.To4() == nil) {
+			lastErr = fmt.Errorf("%s 没有与出口地址 %s 同协议族的地址", host, bind)
+			continue
+		}
+		conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// pipeConns copies both directions until each side is done, half-closing as it goes.
+// A non-zero rate caps each direction in bytes per second. It returns bytes sent
+// upstream and bytes sent back to the client.
+func pipeConns(client net.Conn, clientR io.Reader, up net.Conn, rate int64) (int64, int64) {
+	var wg sync.WaitGroup
+	var sent int64
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		sent, _ = io.Copy(up, newRateReader(clientR, rate))
+		closeWrite(up)
+	}()
+	recv, _ := io.Copy(client, newRateReader(up, rate))
+	closeWrite(client)
+	wg.Wait()
+	return sent, recv
+}
+
+func closeWrite(c net.Conn) {
+	if cw, ok := c.(interface{ CloseWrite() error }); ok {
+		_ = cw.CloseWrite()
+		return
+	}
+	_ = c.Close()
+}
+
+// ----- protocol sniffing -----
+
+// peekClientHelloSNI peeks the first TLS record and returns the SNI without consuming it.
+func peekClientHelloSNI(br *bufio.Reader) (string, error) {
+	hdr, err := br.Peek(5)
+	if err != nil {
+		return "", err
+	}
+	if hdr[0] != 0x16 {
+		return "", errors.New("不是 TLS 握手")
+	}
+	recLen := int(hdr[3])<<8 | int(hdr[4])
+	if recLen < 4 || recLen > proxyMaxHeaderLen {
+		return "", fmt.Errorf("TLS 记录长度异常: %d", recLen)
+	}
+	rec, err := br.Peek(5 + recLen)
+	if err != nil {
+		return "", err
+	}
+	if rec[5] != 0x01 {
+		return "", errors.New("首个握手消息不是 ClientHello")
+	}
+	return parseClientHelloSNI(rec[9:])
+}
+
+// parseClientHelloSNI extracts server_name from a ClientHello body (after the 4-byte
+// handshake header). A truncated body is fine as long as the SNI extension is inside it.
+func parseClientHelloSNI(b []byte) (string, error) {
+	errShort := errors.New("ClientHello 不完整")
+	skip := func(n int) bool {
+		if len(b) < n {
+			return false
+		}
+		b = b[n:]
+		return true
+	}
+	vec := func(lenBytes int) ([]byte, bool) {
+		if len(b) < lenBytes {
+			return nil, false
+		}
+		n := 0
+		for i := 0; i < lenBytes; i++ {
+			n = n<<8 | int(b[i])
+		}
+		if len(b) < lenBytes+n {
+			return nil, false
+		}
+		v := b[lenBytes : lenBytes+n]
+		b = b[lenBytes+n:]
+		return v, true
+	}
+	if !skip(2 + 32) { // legacy_version + random
+		return "", errShort
+	}
+	if _, ok := vec(1); !ok { // session id
+		return "", errShort
+	}
+	if _, ok := vec(2); !ok { // cipher suites
+		return "", errShort
+	}
+	if _, ok := vec(1); !ok { // compression methods
+		return "", errShort
+	}
+	if len(b) < 2 {
+		return "", errors.New("ClientHello 没有扩展")
+	}
+	b = b[2:] // extensions length; parse as far as the data goes
+	for len(b) >= 4 {
+		typ := int(b[0])<<8 | int(b[1])
+		b = b[2:]
+		ext, ok := vec(2)
+		if !ok {
+			return "", errShort
+		}
+		if typ != 0 {
+			continue
+		}
+		// server_name_list
+		if len(ext) < 2 {
+			return "", errShort
+		}
+		ext = ext[2:]
+		for len(ext) >= 3 {
+			nameType := ext[0]
+			n := int(ext[1])<<8 | int(ext[2])
+			if len(ext) < 3+n {
+				return "", errShort
+			}
+			if nameType == 0 {
+				return strings.ToLower(string(ext[3 : 3+n])), nil
+			}
+			ext = ext[3+n:]
+		}
+	}
+	return "", errors.New("ClientHello 未携带 SNI")
+}
+
+// peekHTTPHost peeks the request head and returns the Host header without the port.
+func peekHTTPHost(br *bufio.Reader) (string, error) {
+	if _, err := br.Peek(1); err != nil {
+		return "", err
+	}
+	for {
+		head, _ := br.Peek(br.Buffered())
+		if end := bytes.Index(head, []byte("\r\n\r\n")); end >= 0 {
+			head = head[:end]
+			break
+		}
+		if br.Buffered() >= proxyMaxHeaderLen {
+			return "", errors.New("HTTP 请求头过长")
+		}
+		if _, err := br.Peek(br.Buffered() + 1); err != nil {
+			return "", err
+		}
+	}
+	head, _ := br.Peek(br.Buffered())
+	for _, line := range strings.Split(string(head), "\r\n")[1:] {
+		if line == "" {
+			break
+		}
+		k, v, ok := strings.Cut(line, ":")
+		if !ok || !strings.EqualFold(strings.TrimSpace(k), "host") {
+			continue
+		}
+		host := strings.TrimSpace(v)
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		host = strings.Trim(host, "[]")
+		if host == "" {
+			break
+		}
+		return strings.ToLower(host), nil
+	}
+	return "", errors.New("HTTP 请求缺少 Host")
+}
+
+// ----- service and backend switching -----
+
+// installProxyService writes the service definition for the built-in proxy.
+func installProxyService(log func(string)) error {
+	return installSelfService(PROXY_SERVICE_NAME, "built-in SNI/Host proxy", log, "proxy")
+}
+
+// installSelfService registers a daemon running this binary with the init system.
+func installSelfService(name, desc string, log func(string), args ...string) error {
+	spec, err := selfServiceSpec(name, desc, args...)
+	if err != nil {
+		return err
+	}
+	return svc().Install(spec, log)
+}
+
+// startEnabled enables a service at boot and starts it now.
+func startEnabled(name string, log func(string)) error {
+	if err := svc().Enable(name, log); err != nil {
+		return err
+	}
+	return svc().Start(name, log)
+}
+
+// stopDisabled stops a service and removes it from boot if the init system knows it.
+func stopDisabled(name string, log func(string)) {
+	if !svc().Installed(name) {
+		return
+	}
+	_ = svc().Stop(name, log)
+	_ = svc().Disable(name, log)
+}
+
+// syncChainService runs the loopback chain proxy while nginx serves 80/443 and some
+// platform has a non-direct outbound; otherwise it is stopped.
+func syncChainService(log func(string)) error {
+	if log == nil {
+		log = func(string) {}
+	}
+	need := len(loadProxyRules().outbounds) > 0 && loadSettings().ProxyBackend == PROXY_BACKEND_NGINX
+	if !need {
+		stopDisabled(PROXY_CHAIN_SERVICE_NAME, log)
+		return nil
+	}
+	err := installSelfService(PROXY_CHAIN_SERVICE_NAME, "outbound chain proxy for nginx", log,
+		"proxy", "--https", PROXY_CHAIN_HTTPS_ADDR, "--http", PROXY_CHAIN_HTTP_ADDR,
+		// nginx already logs and limits these connections with the real client address
+		"--access-log=", "--limits=false")
+	if err != nil {
+		return err
+	}
+	if err := startEnabled(PROXY_CHAIN_SERVICE_NAME, log); err != nil {
+		return fmt.Errorf("启动出站链路代理失败: %w", err)
+	}
+	return nil
+}
+
+func isProxyActive() bool { return svc().Status(PROXY_SERVICE_NAME) }
+
+// switchProxyBackend moves 80/443 between nginx and the built-in proxy and records the choice.
+func switchProxyBackend(to string, log func(string)) error {
+	if log == nil {
+		log = func(string) {}
+	}
+	switch to {
+	case PROXY_BACKEND_BUILTIN:
+		if err := installProxyService(log); err != nil {
+			return err
+		}
+		if err := ensureTrafficLogging(); err != nil {
+			log("准备访问日志目录失败: " + err.Error())
+		}
+		stopDisabled(PROXY_CHAIN_SERVICE_NAME, log)
+		if fileExists(NGINX_MAIN_CONF) {
+			log("停止并禁用 nginx（释放 80/443）")
+			stopDisabled("nginx", log)
+		}
+		log("启用并启动 " + PROXY_SERVICE_NAME)
+		_ = svc().Enable(PROXY_SERVICE_NAME, log)
+		if err := svc().Restart(PROXY_SERVICE_NAME, log); err != nil {
+			return fmt.Errorf("启动内置代理失败: %w", err)
+		}
+		if missing := waitPortsListening([]int{80, 443}, 5*time.Second); len(missing) > 0 {
+			return fmt.Errorf("内置代理已启动，但端口未监听: %v", missing)
+		}
+		if err := updateSettings(func(st *ctlSettings) { st.ProxyBackend = to }); err != nil {
+			return fmt.Errorf("保存设置失败: %w", err)
+		}
+		_ = syncQuotaTimer(log)
+	case PROXY_BACKEND_NGINX:
+		if !fileExists(NGINX_MAIN_CONF) {
+			return errors.New("未检测到 nginx，请先在 Nginx 菜单中安装")
+		}
+		if svc().Installed(PROXY_SERVICE_NAME) {
+			log("停止并禁用 " + PROXY_SERVICE_NAME)
+			stopDisabled(PROXY_SERVICE_NAME, log)
+		}
+		log("启用 nginx")
+		_ = svc().Enable("nginx", log)
+		_ = svc().Start("nginx", log)
+		if err := applyNginxProxyConfigs(log); err != nil {
+			return err
+		}
+		if err := updateSettings(func(st *ctlSettings) { st.ProxyBackend = to }); err != nil {
+			return fmt.Errorf("保存设置失败: %w", err)
+		}
+		if err := syncChainService(log); err != nil {
+			return err
+		}
+		if err := syncQuotaTimer(log); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("未知代理后端: %s", to)
+	}
+	log("代理后端已切换为 " + proxyBackendLabel(to))
+	return nil
+}
+
+func proxyBackendLabel(b string) string {
+	if b == PROXY_BACKEND_BUILTIN {
+		return "内置代理"
+	}
+	return "nginx"
+}
@@ -4,3 +4,5 @@ package src
 
 func MustRoot() { mustRoot() }
 func RunTUI()   { runTUI() }
+
+func RunCommand(args []string) int { return runCommand(args) }
@@ -0,0 +1,635 @@
+package src
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// DNS query statistics from the smartdns audit log. smartdns writes one line
+// per answered query when audit-enable is on:
+//
+//	[2024-06-12 22:22:22,123] 192.168.1.2 query www.netflix.com, type 1, time 3ms, speed: -1.0ms, group hk, result 1.2.3.4
+//
+// (older releases have no "group" field). Lines are folded incrementally into
+// hourly buckets under QUERY_STATE_DIR, attributed to a StreamConfig platform
+// and to the group / address that platform is assigned to in smartdns.conf.
+
+var reAuditLine = regexp.MustCompile(`^\[([^\]]+)\]\s+(\S+)\s+query\s+(\S+?),\s+type\s+(\d+),.*?\bresult\s*(.*)$`)
+
+type queryRecord struct {
+	Time   time.Time
+	Client string
+	Domain string
+	Type   int
+	Result string
+}
+
+// parseAuditLine parses one audit log line; ok is false for anything else.
+func parseAuditLine(line string) (queryRecord, bool) {
+	m := reAuditLine.FindStringSubmatch(strings.TrimSpace(line))
+	if m == nil {
+		return queryRecord{}, false
+	}
+	t, err := time.ParseInLocation("2006-01-02 15:04:05,000", m[1], time.Local)
+	if err != nil {
+		t = time.Now()
+	}
+	var typ int
+	fmt.Sscanf(m[4], "%d", &typ)
+	return queryRecord{
+		Time:   t,
+		Client: m[2],
+		Domain: strings.TrimSuffix(strings.ToLower(m[3]), "."),
+		Type:   typ,
+		Result: strings.TrimSpace(m[5]),
+	}, true
+}
+
+type queryCounter struct {
+	Queries  int64 `json:"queries"`
+	SOA      int64 `json:"soa"`      // answered without an address (SOA / blocked / NODATA)
+	NXDomain int64 `json:"nxdomain"` // result explicitly NXDOMAIN
+}
+
+func (c *queryCounter) add(r queryRecord) {
+	c.Queries++
+	switch {
+	case strings.Contains(strings.ToUpper(r.Result), "NXDOMAIN"):
+		c.NXDomain++
+	case r.Result == "" || strings.Contains(strings.ToUpper(r.Result), "SOA"):
+		c.SOA++
+	}
+}
+
+func (c *queryCounter) merge(o *queryCounter) {
+	c.Queries += o.Queries
+	c.SOA += o.SOA
+	c.NXDomain += o.NXDomain
+}
+
+// queryHour is one hour of counters.
+type queryHour struct {
+	Platforms map[string]*queryCounter `json:"platforms"`
+	Groups    map[string]*queryCounter `json:"groups"`
+	Clients   map[string]*queryCounter `json:"clients"`
+	Domains   map[string]*queryCounter `json:"domains"`
+}
+
+// queryMaxDomains caps the distinct domains kept per hour; the rest is
+// counted under "(其他)" so a scan of random names can't bloat the state.
+const queryMaxDomains = 5000
+
+func newQueryHour() *queryHour {
+	return &queryHour{Platforms: map[string]*queryCounter{}, Groups: map[string]*queryCounter{}, Clients: map[string]*queryCounter{}, Domains: map[string]*queryCounter{}}
+}
+
+func bumpQuery(m map[string]*queryCounter, key string, r queryRecord) {
+	c := m[key]
+	if c == nil {
+		c = &queryCounter{}
+		m[key] = c
+	}
+	c.add(r)
+}
+
+// queryDay is the on-disk rollup (QUERY_STATE_DIR/YYYY-MM-DD.json), keyed by hour.
+type queryDay struct {
+	Date  string             `json:"date"`
+	Hours map[int]*queryHour `json:"hours"`
+}
+
+func queryDayPath(date string) string { return filepath.Join(QUERY_STATE_DIR, date+".json") }
+
+func loadQueryDay(date string) *queryDay {
+	d := &queryDay{Date: date, Hours: map[int]*queryHour{}}
+	if b, err := os.ReadFile(queryDayPath(date)); err == nil {
+		_ = json.Unmarshal(b, d)
+	}
+	if d.Hours == nil {
+		d.Hours = map[int]*queryHour{}
+	}
+	return d
+}
+
+func saveQueryDay(d *queryDay) error {
+	b, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	tmp := queryDayPath(d.Date) + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, queryDayPath(d.Date))
+}
+
+// queryAttribution maps a domain to its platform and to where smartdns sends
+// it: the assigned nameserver group, an address, or the default servers.
+type queryAttribution struct {
+	rules    *proxyRules
+	assigned map[string]Assignment
+}
+
+func loadQueryAttribution() queryAttribution {
+	return queryAttribution{rules: loadProxyRules(), assigned: parseAssignments()}
+}
+
+func (a queryAttribution) of(domain string) (platform, group string) {
+	platform = a.rules.platformOf(domain)
+	if platform == "" {
+		return "(其他)", "默认"
+	}
+	as, ok := a.assigned[platform]
+	switch {
+	case !ok:
+		group = "默认"
+	case as.Method == "address":
+		group = "address " + as.Ident
+	default:
+		group = as.Ident
+	}
+	return platform, group
+}
+
+func (h *queryHour) add(a queryAttribution, r queryRecord) {
+	platform, group := a.of(r.Domain)
+	bumpQuery(h.Platforms, platform, r)
+	bumpQuery(h.Groups, group, r)
+	bumpQuery(h.Clients, r.Client, r)
+	domain := r.Domain
+	if _, ok := h.Domains[domain]; !ok && len(h.Domains) >= queryMaxDomains {
+		domain = "(其他)"
+	}
+	bumpQuery(h.Domains, domain, r)
+}
+
+func queryOffsetsPath() string { return filepath.Join(QUERY_STATE_DIR, "offsets.json") }
+
+// queryOffset is how far the audit log has been rolled up. First (the file's
+// first line) recognises the file after smartdns has rotated it away, renamed
+// or gzipped, when the inode no longer helps.
+type queryOffset struct {
+	Inode  uint64 `json:"inode"`
+	Offset int64  `json:"offset"`
+	First  string `json:"first,omitempty"`
+}
+
+var queryRollupMu sync.Mutex
+
+// rollupQueries folds new audit log lines into the hourly rollups. The
+// timer, the CLI and the TUI all run it, so it holds a flock like
+// rollupTraffic. When smartdns has rotated the log since the last run, the
+// rest of the old file (and any rotated after it) is read before the new
+// one starts from zero.
+func rollupQueries() error {
+	queryRollupMu.Lock()
+	defer queryRollupMu.Unlock()
+	if err := ensureDir(QUERY_STATE_DIR); err != nil {
+		return err
+	}
+	return withFileLock(filepath.Join(QUERY_STATE_DIR, "rollup.lock"), rollupQueriesLocked)
+}
+
+func rollupQueriesLocked() error {
+	offsets := map[string]queryOffset{}
+	if b, err := os.ReadFile(queryOffsetsPath()); err == nil {
+		_ = json.Unmarshal(b, &offsets)
+	}
+	path := queryAuditFile()
+	f, err := os.Open(path)
+	if err != nil {
+		return nil // audit not enabled yet, or nothing logged
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	inode := fileInode(fi)
+	attr := loadQueryAttribution()
+	days := map[string]*queryDay{}
+	// fold reads complete lines from r and returns the bytes consumed; a
+	// partial trailing line stays for the next run unless the file is final.
+	fold := func(r io.Reader, final bool) int64 {
+		var n int64
+		br := bufio.NewReader(r)
+		for {
+			line, err := br.ReadString('\n')
+			if err != nil && !(final && line != "") {
+				return n
+			}
+			n += int64(len(line))
+			if rec, ok := parseAuditLine(line); ok {
+				date := rec.Time.Format("2006-01-02")
+				d := days[date]
+				if d == nil {
+					d = loadQueryDay(date)
+					days[date] = d
+				}
+				h := d.Hours[rec.Time.Hour()]
+				if h == nil {
+					h = newQueryHour()
+					d.Hours[rec.Time.Hour()] = h
+				}
+				h.add(attr, rec)
+			}
+			if err != nil {
+				return n
+			}
+		}
+	}
+
+	off := offsets[path]
+	switch {
+	case off.Inode != inode:
+		if off.Inode != 0 {
+			finishRotatedAudit(path, off, fold)
+		}
+		off = queryOffset{Inode: inode}
+	case off.Offset > fi.Size():
+		logYellow(fmt.Sprintf("[查询统计] %s 的偏移量回退（已统计 %d 字节，文件现为 %d 字节），从头重新统计", path, off.Offset, fi.Size()))
+		off = queryOffset{Inode: inode}
+	}
+	if off.First == "" {
+		off.First = firstLine(f)
+	}
+	if _, err := f.Seek(off.Offset, io.SeekStart); err != nil {
+		return err
+	}
+	off.Offset += fold(f, false)
+	for _, d := range days {
+		if err := saveQueryDay(d); err != nil {
+			return err
+		}
+	}
+	offsets[path] = off
+	b, _ := json.Marshal(offsets)
+	tmp := queryOffsetsPath() + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, queryOffsetsPath())
+}
+
+func fileInode(fi os.FileInfo) uint64 {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return st.Ino
+	}
+	return 0
+}
+
+// firstLine is r's first complete line (without the newline), or "".
+func firstLine(r io.ReaderAt) string {
+	buf := make([]byte, 1024)
+	n, _ := r.ReadAt(buf, 0)
+	if i := bytes.IndexByte(buf[:n], '\n'); i > 0 {
+		return string(buf[:i])
+	}
+	return ""
+}
+
+// rotatedAuditFiles lists what smartdns rotated path into (same directory,
+// same name stem, plain or .gz), oldest first.
+func rotatedAuditFiles(path string) []string {
+	dir, base := filepath.Split(path)
+	stem := strings.TrimSuffix(base, filepath.Ext(base))
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	type rotated struct {
+		path string
+		mod  time.Time
+	}
+	var out []rotated
+	for _, e := range entries {
+		name := e.Name()
+		if name == base || !strings.HasPrefix(name, stem) || strings.HasSuffix(name, ".tmp") || !e.Type().IsRegular() {
+			continue
+		}
+		if info, err := e.Info(); err == nil {
+			out = append(out, rotated{filepath.Join(dir, name), info.ModTime()})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].mod.Before(out[j].mod) })
+	paths := make([]string, len(out))
+	for i, r := range out {
+		paths[i] = r.path
+	}
+	return paths
+}
+
+// openAuditFile opens a (possibly gzipped) audit log for reading from the start.
+func openAuditFile(path string) (io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(path, ".gz") {
+		return f, nil
+	}
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{zr, f}, nil
+}
+
+// rotatedMatches reports whether the rotated file at path is the one off was
+// recorded against: same inode when it was only renamed, else same first line.
+func rotatedMatches(path string, off queryOffset) bool {
+	if fi, err := os.Stat(path); err == nil && !strings.HasSuffix(path, ".gz") && fileInode(fi) == off.Inode {
+		return true
+	}
+	if off.First == "" {
+		return false
+	}
+	rc, err := openAuditFile(path)
+	if err != nil {
+		return false
+	}
+	defer rc.Close()
+	line, _ := bufio.NewReader(rc).ReadString('\n')
+	return strings.TrimSuffix(line, "\n") == off.First
+}
+
+// finishRotatedAudit reads the rest of the file off pointed into before
+// smartdns rotated it, plus every file rotated after it.
+func finishRotatedAudit(path string, off queryOffset, fold func(io.Reader, bool) int64) {
+	files := rotatedAuditFiles(path)
+	for i := len(files) - 1; i >= 0; i-- {
+		if !rotatedMatches(files[i], off) {
+			continue
+		}
+		for j, name := range files[i:] {
+			rc, err := openAuditFile(name)
+			if err != nil {
+				logYellow("[查询统计] 读取轮转的审计日志失败: " + err.Error())
+				return
+			}
+			r := io.Reader(rc)
+			if j == 0 {
+				if _, err := io.CopyN(io.Discard, rc, off.Offset); err != nil {
+					rc.Close()
+					continue
+				}
+			}
+			fold(r, true)
+			rc.Close()
+		}
+		return
+	}
+	if off.Offset > 0 {
+		logYellow("[查询统计] 未找到轮转前的审计日志，" + path + " 轮转前未汇总的查询已丢失")
+	}
+}
+
+// syncQueryTimer rolls the audit log up every minute while audit is on, so
+// nothing is lost to smartdns's own rotation between visits to the stats page.
+func syncQueryTimer(log func(string)) error {
+	if log == nil {
+		log = func(string) {}
+	}
+	if !queryAuditEnabled() {
+		stopDisabled(QUERY_SERVICE_NAME, log)
+		return nil
+	}
+	spec, err := selfServiceSpec(QUERY_SERVICE_NAME, "smartdns query statistics rollup", "queries", "rollup")
+	if err != nil {
+		return err
+	}
+	spec.Every = time.Minute
+	if err := svc().Install(spec, log); err != nil {
+		return err
+	}
+	if err := startEnabled(QUERY_SERVICE_NAME, log); err != nil {
+		return fmt.Errorf("启用查询统计定时任务失败: %w", err)
+	}
+	return nil
+}
+
+// querySummary aggregates every hour bucket in a window.
+type querySummary struct {
+	Total     queryCounter
+	Platforms map[string]*queryCounter
+	Groups    map[string]*queryCounter
+	Clients   map[string]*queryCounter
+	Domains   map[string]*queryCounter
+}
+
+func summarizeQueries(window time.Duration) querySummary {
+	sum := querySummary{Platforms: map[string]*queryCounter{}, Groups: map[string]*queryCounter{}, Clients: map[string]*queryCounter{}, Domains: map[string]*queryCounter{}}
+	merge := func(dst, src map[string]*queryCounter) {
+		for k, c := range src {
+			if dst[k] == nil {
+				dst[k] = &queryCounter{}
+			}
+			dst[k].merge(c)
+		}
+	}
+	now := time.Now()
+	from := now.Add(-window).Truncate(time.Hour)
+	var day *queryDay
+	for t := from; !t.After(now); t = t.Add(time.Hour) {
+		if date := t.Format("2006-01-02"); day == nil || day.Date != date {
+			day = loadQueryDay(date)
+		}
+		h := day.Hours[t.Hour()]
+		if h == nil {
+			continue
+		}
+		for _, c := range h.Platforms {
+			sum.Total.merge(c)
+		}
+		merge(sum.Platforms, h.Platforms)
+		merge(sum.Groups, h.Groups)
+		merge(sum.Clients, h.Clients)
+		merge(sum.Domains, h.Domains)
+	}
+	return sum
+}
+
+// queryWindows are the selectable report windows, in the order the page cycles them.
+var queryWindows = []struct {
+	Key   string
+	Label string
+	Span  time.Duration
+}{
+	{"1h", "最近 1 小时", time.Hour},
+	{"24h", "最近 24 小时", 24 * time.Hour},
+	{"7d", "最近 7 天", 7 * 24 * time.Hour},
+	{"30d", "最近 30 天", 30 * 24 * time.Hour},
+}
+
+func rate(n, total int64) string {
+	if total == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.1f%%", float64(n)*100/float64(total))
+}
+
+// renderQueryReport formats the statistics for the TUI page (tview color tags).
+func renderQueryReport(window int) string {
+	w := queryWindows[window]
+	sum := summarizeQueries(w.Span)
+	var b strings.Builder
+	fmt.Fprintf(&b, "[yellow]范围: %s  审计: %s[-]\n", w.Label, queryAuditStatus())
+	fmt.Fprintf(&b, "总查询 %d  无地址(SOA) %s  NXDOMAIN %s\n\n", sum.Total.Queries,
+		rate(sum.Total.SOA, sum.Total.Queries), rate(sum.Total.NXDomain, sum.Total.Queries))
+	table := func(title string, m map[string]*queryCounter, limit int) {
+		fmt.Fprintf(&b, "[green]%s[-]\n", title)
+		fmt.Fprintf(&b, "  %-36s %10s %8s %8s\n", "", "查询", "SOA", "NX")
+		keys := make([]string, 0, len(m))
+		for k := range m {
+			keys = append(keys, k)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			if m[keys[i]].Queries != m[keys[j]].Queries {
+				return m[keys[i]].Queries > m[keys[j]].Queries
+			}
+			return keys[i] < keys[j]
+		})
+		if len(keys) == 0 {
+			b.WriteString("  (无数据)\n")
+		}
+		for i, k := range keys {
+			if i >= limit {
+				fmt.Fprintf(&b, "  ... 其余 %d 项\n", len(keys)-limit)
+				break
+			}
+			c := m[k]
+			fmt.Fprintf(&b, "  %-36s %10d %8s %8s\n", k, c.Queries, rate(c.SOA, c.Queries), rate(c.NXDomain, c.Queries))
+		}
+		b.WriteString("\n")
+	}
+	table("按平台", sum.Platforms, 30)
+	table("按分组", sum.Groups, 20)
+	table("按客户端", sum.Clients, 20)
+	table("热门域名", sum.Domains, 30)
+	return b.String()
+}
+
+// ----- smartdns.conf audit directives -----
+
+// queryAuditFile is the audit-file smartdns writes (its default when unset).
+func queryAuditFile() string {
+	path := SMARTDNS_AUDIT_LOG
+	if lines, err := readLines(SMART_CONFIG_FILE); err == nil {
+		for _, l := range lines {
+			if f := strings.Fields(l); len(f) == 2 && f[0] == "audit-file" {
+				path = f[1] // last one wins, as in smartdns
+			}
+		}
+	}
+	return path
+}
+
+func queryAuditEnabled() bool {
+	on := false
+	if lines, err := readLines(SMART_CONFIG_FILE); err == nil {
+		for _, l := range lines {
+			if f := strings.Fields(l); len(f) == 2 && f[0] == "audit-enable" {
+				on = f[1] == "yes"
+			}
+		}
+	}
+	return on
+}
+
+func queryAuditStatus() string {
+	if queryAuditEnabled() {
+		return "已开启 (" + queryAuditFile() + ")"
+	}
+	return "未开启"
+}
+
+// setQueryAudit rewrites the audit-* directives in smartdns.conf: enabling
+// appends audit-enable/audit-file plus smartdns's own rotation (audit-size,
+// audit-num); disabling removes them. smartdns must be restarted afterwards.
+func setQueryAudit(enable bool) error {
+	lines, err := readLines(SMART_CONFIG_FILE)
+	if err != nil {
+		return err
+	}
+	var out []string
+	for _, l := range lines {
+		if f := strings.Fields(l); len(f) > 0 && strings.HasPrefix(f[0], "audit-") {
+			continue
+		}
+		out = append(out, l)
+	}
+	for len(out) > 0 && strings.TrimSpace(out[len(out)-1]) == "" {
+		out = out[:len(out)-1]
+	}
+	if enable {
+		if err := ensureDir(filepath.Dir(SMARTDNS_AUDIT_LOG)); err != nil {
+			return err
+		}
+		out = append(out, "", "audit-enable yes", "audit-file "+SMARTDNS_AUDIT_LOG, "audit-size 16M", "audit-num 4")
+	}
+	err = auditChange("queries.audit", fmt.Sprintf("audit-enable=%v", enable), []string{SMART_CONFIG_FILE}, func() error {
+		return writeLines(SMART_CONFIG_FILE, out)
+	})
+	if err != nil {
+		return err
+	}
+	return syncQueryTimer(nil)
+}
+
+// runQueriesCommand implements `smartdnsctl queries [enable|disable|rollup|report [1h|24h|7d|30d]]`.
+func runQueriesCommand(args []string) int {
+	if len(args) > 0 && (args[0] == "enable" || args[0] == "disable") {
+		if err := setQueryAudit(args[0] == "enable"); err != nil {
+			fmt.Fprintln(os.Stderr, "修改 smartdns.conf 失败:", err)
+			return 1
+		}
+		if err := serviceAction(func(s string) { fmt.Println(s) }, "restart", "smartdns"); err != nil {
+			fmt.Fprintln(os.Stderr, "重启 smartdns 失败:", err)
+			return 1
+		}
+		fmt.Println("查询审计: " + queryAuditStatus())
+		return 0
+	}
+	if err := rollupQueries(); err != nil {
+		fmt.Fprintln(os.Stderr, "汇总失败:", err)
+		return 1
+	}
+	if len(args) > 0 && args[0] == "rollup" {
+		return 0
+	}
+	window := 1
+	if len(args) > 1 && args[0] == "report" {
+		window = -1
+		for i, w := range queryWindows {
+			if w.Key == args[1] {
+				window = i
+			}
+		}
+		if window < 0 {
+			fmt.Fprintln(os.Stderr, "未知时间窗口:", args[1], "(可选 1h/24h/7d/30d)")
+			return 2
+		}
+	}
+	report := renderQueryReport(window)
+	for _, tag := range []string{"[yellow]", "[green]", "[-]"} {
+		report = strings.ReplaceAll(report, tag, "")
+	}
+	fmt.Print(report)
+	return 0
+}
@@ -0,0 +1,537 @@
+package src
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Per-node policy for UDP 443. Streaming apps try HTTP/3 first; a silently dropped
+// UDP port makes them wait for a timeout before falling back to TCP.
+const (
+	QUIC_POLICY_NONE   = ""       // leave UDP 443 alone
+	QUIC_POLICY_REJECT = "reject" // nftables reject so clients fall back to TCP at once
+	QUIC_POLICY_PROXY  = "proxy"  // proxy QUIC by the SNI in the Initial packet
+)
+
+const (
+	quicSessionIdle  = 60 * time.Second
+	quicSniffTimeout = 3 * time.Second
+	quicSniffPackets = 8
+)
+
+var quicV1Salt = []byte{0x38, 0x76, 0x2c, 0xf7, 0xf5, 0x59, 0x34, 0xb3, 0x4d, 0x17, 0x9a, 0xe6, 0xa4, 0xc8, 0x0c, 0xad, 0xcc, 0xbb, 0x7f, 0x0a}
+
+func quicPolicyLabel(p string) string {
+	switch p {
+	case QUIC_POLICY_REJECT:
+		return "拒绝"
+	case QUIC_POLICY_PROXY:
+		return "代理"
+	}
+	return "不处理"
+}
+
+// ----- Initial packet decryption (RFC 9001 §5) -----
+
+func hkdfExtract(salt, ikm []byte) []byte {
+	m := hmac.New(sha256.New, salt)
+	m.Write(ikm)
+	return m.Sum(nil)
+}
+
+func hkdfExpandLabel(secret []byte, label string, length int) []byte {
+	full := "tls13 " + label
+	info := make([]byte, 0, 4+len(full))
+	info = binary.BigEndian.AppendUint16(info, uint16(length))
+	info = append(info, byte(len(full)))
+	info = append(info, full...)
+	info = append(info, 0) // empty context
+	var out, prev []byte
+	for i := byte(1); len(out) < length; i++ {
+		m := hmac.New(sha256.New, secret)
+		m.Write(prev)
+		m.Write(info)
+		m.Write([]byte{i})
+		prev = m.Sum(nil)
+		out = append(out, prev...)
+	}
+	return out[:length]
+}
+
+func readQUICVarint(b []byte) (uint64, int, bool) {
+	if len(b) == 0 {
+		return 0, 0, false
+	}
+	n := 1 << (b[0] >> 6)
+	if len(b) < n {
+		return 0, 0, false
+	}
+	v := uint64(b[0] & 0x3f)
+	for i := 1; i < n; i++ {
+		v = v<<8 | uint64(b[i])
+	}
+	return v, n, true
+}
+
+// quicInitialFrames decrypts a client Initial (QUIC v1) datagram and returns its plaintext frames.
+func quicInitialFrames(pkt []byte) ([]byte, error) {
+	errShort := errors.New("QUIC 包不完整")
+	if len(pkt) < 7 || pkt[0]&0x80 == 0 {
+		return nil, errors.New("不是 QUIC 长包头")
+	}
+	if binary.BigEndian.Uint32(pkt[1:5]) != 1 {
+		return nil, errors.New("仅支持 QUIC v1")
+	}
+	if pkt[0]&0x30 != 0 {
+		return nil, errors.New("不是 Initial 包")
+	}
+	off := 5
+	dcidLen := int(pkt[off])
+	off++
+	if len(pkt) < off+dcidLen+1 {
+		return nil, errShort
+	}
+	dcid := pkt[off : off+dcidLen]
+	off += dcidLen
+	off += 1 + int(pkt[off]) // scid
+	if len(pkt) < off {
+		return nil, errShort
+	}
+	tokLen, n, ok := readQUICVarint(pkt[off:])
+	if !ok {
+		return nil, errShort
+	}
+	off += n + int(tokLen)
+	if len(pkt) < off {
+		return nil, errShort
+	}
+	length, n, ok := readQUICVarint(pkt[off:])
+	if !ok {
+		return nil, errShort
+	}
+	off += n
+	pnOff := off
+	if len(pkt) < pnOff+int(length) || length < 20 {
+		return nil, errShort
+	}
+
+	initial := hkdfExtract(quicV1Salt, dcid)
+	client := hkdfExpandLabel(initial, "client in", 32)
+	key := hkdfExpandLabel(client, "quic key", 16)
+	iv := hkdfExpandLabel(client, "quic iv", 12)
+	hp := hkdfExpandLabel(client, "quic hp", 16)
+
+	hpBlock, err := aes.NewCipher(hp)
+	if err != nil {
+		return nil, err
+	}
+	mask := make([]byte, aes.BlockSize)
+	hpBlock.Encrypt(mask, pkt[pnOff+4:pnOff+4+aes.BlockSize])
+	hdr := append([]byte{}, pkt[:pnOff+4]...)
+	hdr[0] ^= mask[0] & 0x0f
+	pnLen := int(hdr[0]&0x03) + 1
+	var pn uint64
+	for i := 0; i < pnLen; i++ {
+		hdr[pnOff+i] ^= mask[1+i]
+		pn = pn<<8 | uint64(hdr[pnOff+i])
+	}
+	hdr = hdr[:pnOff+pnLen]
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := append([]byte{}, iv...)
+	for i := 0; i < 8; i++ {
+		nonce[len(nonce)-1-i] ^= byte(pn >> (8 * i))
+	}
+	payload := pkt[pnOff+pnLen : pnOff+int(length)]
+	plain, err := aead.Open(nil, nonce, payload, hdr)
+	if err != nil {
+		return nil, fmt.Errorf("Initial 解密失败: %w", err)
+	}
+	return plain, nil
+}
+
+// quicCryptoBuffer reassembles CRYPTO frames across the client's Initial packets;
+// large (post-quantum) ClientHellos are split over two or more datagrams.
+type quicCryptoBuffer struct {
+	chunks map[uint64][]byte
+}
+
+func (q *quicCryptoBuffer) addFrames(frames []byte) error {
+	if q.chunks == nil {
+		q.chunks = map[uint64][]byte{}
+	}
+	for len(frames) > 0 {
+		typ, n, ok := readQUICVarint(frames)
+		if !ok {
+			return errors.New("帧不完整")
+		}
+		frames = frames[n:]
+		switch {
+		case typ == 0x00 || typ == 0x01: // PADDING, PING
+		case typ == 0x02 || typ == 0x03: // ACK
+			// largest, delay, range count, first range; then ranges (+ ECN counts)
+			vals := make([]uint64, 0, 4)
+			for i := 0; i < 4; i++ {
+				v, n, ok := readQUICVarint(frames)
+				if !ok {
+					return errors.New("ACK 帧不完整")
+				}
+				vals = append(vals, v)
+				frames = frames[n:]
+			}
+			extra := int(vals[2]) * 2
+			if typ == 0x03 {
+				extra += 3
+			}
+			for i := 0; i < extra; i++ {
+				_, n, ok := readQUICVarint(frames)
+				if !ok {
+					return errors.New("ACK 帧不完整")
+				}
+				frames = frames[n:]
+			}
+		case typ == 0x06: // CRYPTO
+			offset, n1, ok1 := readQUICVarint(frames)
+			if !ok1 {
+				return errors.New("CRYPTO 帧不完整")
+			}
+			length, n2, ok2 := readQUICVarint(frames[n1:])
+			if !ok2 || len(frames) < n1+n2+int(length) {
+				return errors.New("CRYPTO 帧不完整")
+			}
+			q.chunks[offset] = append([]byte{}, frames[n1+n2:n1+n2+int(length)]...)
+			frames = frames[n1+n2+int(length):]
+		default:
+			return nil // nothing else matters before the ClientHello is complete
+		}
+	}
+	return nil
+}
+
+// contiguous returns the CRYPTO stream bytes available from offset 0.
+func (q *quicCryptoBuffer) contiguous() []byte {
+	var out []byte
+	for {
+		c, ok := q.chunks[uint64(len(out))]
+		if !ok || len(c) == 0 {
+			return out
+		}
+		out = append(out, c...)
+	}
+}
+
+// sni returns the server name once enough of the ClientHello has arrived.
+func (q *quicCryptoBuffer) sni() (string, bool) {
+	data := q.contiguous()
+	if len(data) < 4 || data[0] != 0x01 {
+		return "", false
+	}
+	name, err := parseClientHelloSNI(data[4:])
+	return name, err == nil
+}
+
+// ----- UDP session proxy -----
+
+type quicSession struct {
+	client   *net.UDPAddr
+	upstream *net.UDPConn
+	pending  [][]byte
+	crypto   quicCryptoBuffer
+	dialing  bool
+	started  time.Time
+	last     time.Time
+	bytesIn  int64 // client -> upstream, guarded by the sessions mutex
+	bytesOut int64
+}
+
+// serveQUIC proxies UDP 443 datagrams by the SNI of the client's QUIC Initial packets.
+// Chained platforms are dropped so their clients fall back to TCP through the hop.
+func (p *sniProxy) serveQUIC(addr string) error {
+	ua, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return err
+	}
+	ln, err := net.ListenUDP("udp", ua)
+	if err != nil {
+		return err
+	}
+	log.Printf("内置代理: QUIC 监听 %s/udp", ln.LocalAddr())
+	var mu sync.Mutex
+	sessions := map[string]*quicSession{}
+	go func() {
+		for range time.Tick(10 * time.Second) {
+			mu.Lock()
+			for k, s := range sessions {
+				if s.dialing && s.upstream == nil {
+					continue // startQUICSession drops it if the dial fails
+				}
+				if time.Since(s.last) > quicSessionIdle || (s.upstream == nil && time.Since(s.started) > quicSniffTimeout) {
+					if s.upstream != nil {
+						s.upstream.Close()
+					}
+					delete(sessions, k)
+				}
+			}
+			mu.Unlock()
+		}
+	}()
+	buf := make([]byte, 64*1024)
+	for {
+		n, client, err := ln.ReadFromUDP(buf)
+		if err != nil {
+			return err
+		}
+		pkt := append([]byte{}, buf[:n]...)
+		key := client.String()
+		mu.Lock()
+		s := sessions[key]
+		if s == nil {
+			s = &quicSession{client: client, started: time.Now()}
+			sessions[key] = s
+		}
+		s.last = time.Now()
+		if s.upstream != nil {
+			up := s.upstream
+			s.bytesIn += int64(n)
+			mu.Unlock()
+			_, _ = up.Write(pkt)
+			continue
+		}
+		if len(s.pending) >= quicSniffPackets {
+			mu.Unlock()
+			continue
+		}
+		s.pending = append(s.pending, pkt)
+		if s.dialing {
+			mu.Unlock() // queued; forwarded once the upstream is up
+			continue
+		}
+		if frames, err := quicInitialFrames(pkt); err == nil {
+			_ = s.crypto.addFrames(frames)
+		}
+		host, ok := s.crypto.sni()
+		if !ok {
+			mu.Unlock()
+			continue
+		}
+		pending := s.pending
+		s.pending = nil
+		s.dialing = true
+		mu.Unlock()
+		go p.startQUICSession(ln, &mu, sessions, key, s, host, pending)
+	}
+}
+
+func (p *sniProxy) startQUICSession(ln *net.UDPConn, mu *sync.Mutex, sessions map[string]*quicSession, key string, s *quicSession, host string, pending [][]byte) {
+	status := "200"
+	drop := func() {
+		mu.Lock()
+		if sessions[key] == s { // a newer session may have taken the key
+			delete(sessions, key)
+		}
+		rec := trafficRecord{Time: s.started.Format(time.RFC3339), Client: s.client.IP.String(), Host: host,
+			BytesIn: s.bytesIn, BytesOut: s.bytesOut, Duration: time.Since(s.started).Seconds(), Status: status, Proto: "quic"}
+		mu.Unlock()
+		p.access.write(rec)
+	}
+	rules := p.rules.Load()
+	platform, ok := rules.allow(host)
+	if !ok {
+		log.Printf("内置代理: QUIC %s -> %s 已拒绝（不在放行列表）", s.client, host)
+		status = "403"
+		drop()
+		return
+	}
+	if _, chained := rules.outbounds[platform]; chained {
+		status = "403"
+		drop()
+		return
+	}
+	if p.limits && p.quota.Load().blocks(s.client.IP.String(), platform) {
+		status = "429"
+		drop()
+		return
+	}
+	up, err := p.dialQUICUpstream(platform, host)
+	if err != nil {
+		log.Printf("内置代理: QUIC %s -> %s [%s] 连接失败: %v", s.client, host, platform, err)
+		status = "502"
+		drop()
+		return
+	}
+	var sent int64
+	for _, pkt := range pending {
+		_, _ = up.Write(pkt)
+		sent += int64(len(pkt))
+	}
+	// packets that arrived while dialling go out before any later ones
+	mu.Lock()
+	for _, pkt := range s.pending {
+		_, _ = up.Write(pkt)
+		sent += int64(len(pkt))
+	}
+	s.pending = nil
+	s.upstream = up
+	s.bytesIn += sent
+	mu.Unlock()
+	buf := make([]byte, 64*1024)
+	for {
+		_ = up.SetReadDeadline(time.Now().Add(quicSessionIdle))
+		n, err := up.Read(buf)
+		if err != nil {
+			up.Close()
+			drop()
+			return
+		}
+		mu.Lock()
+		s.last = time.Now()
+		s.bytesOut += int64(n)
+		mu.Unlock()
+		_, _ = ln.WriteToUDP(buf[:n], s.client)
+	}
+}
+
+// dialQUICUpstream opens a connected UDP socket to host:443, honouring the platform's
+// egress address and refusing addresses of this machine.
+func (p *sniProxy) dialQUICUpstream(platform, host string) (*net.UDPConn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), proxyDialTimeout)
+	defer cancel()
+	addrs, err := p.resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	var laddr *net.UDPAddr
+	if bind := net.ParseIP(p.rules.Load().egress[platform]); bind != nil && p.localIPs[bind.String()] {
+		laddr = &net.UDPAddr{IP: bind}
+	}
+	for _, a := range addrs {
+		if a.IP.IsLoopback() || a.IP.IsUnspecified() || p.localIPs[a.IP.String()] {
+			continue
+		}
+		if laddr != nil && (laddr.IP.To4() == nil) != (a.IP.To4() == nil) {
+			continue
+		}
+		if c, err := net.DialUDP("udp", laddr, &net.UDPAddr{IP: a.IP, Port: 443}); err == nil {
+			return c, nil
+		}
+	}
+	return nil, fmt.Errorf("%s 没有可用地址", host)
+}
+
+// ----- policy management (nftables / service) -----
+
+const quicNftTable = "smartdnsctl_quic"
+
+func quicRejectRuleset() string {
+	return strings.Join([]string{
+		"# Generated by smartdnsctl: reject UDP 443 so clients fall back from QUIC to TCP",
+		"table inet " + quicNftTable,
+		"delete table inet " + quicNftTable,
+		"table inet " + quicNftTable + " {",
+		"    chain input {",
+		"        type filter hook input priority 0; policy accept;",
+		"        udp dport 443 reject",
+		"    }",
+		"}",
+		"",
+	}, "\n")
+}
+
+func quicServiceSpec(policy string) (serviceSpec, error) {
+	if policy == QUIC_POLICY_PROXY {
+		return selfServiceSpec(QUIC_SERVICE_NAME, "QUIC (UDP 443) proxy", "proxy", "--https=", "--http=", "--quic", ":443")
+	}
+	nft, err := exec.LookPath("nft")
+	if err != nil {
+		return serviceSpec{}, errors.New("未找到 nft 命令，请先安装 nftables")
+	}
+	return serviceSpec{
+		Name:        QUIC_SERVICE_NAME,
+		Description: "QUIC (UDP 443) reject rules",
+		Command:     []string{nft, "-f", QUIC_NFT_FILE},
+		StopCommand: []string{nft, "delete", "table", "inet", quicNftTable},
+		Oneshot:     true,
+	}, nil
+}
+
+// applyQUICPolicy installs the service for the chosen policy (or removes it) and records it.
+func applyQUICPolicy(policy string, log func(string)) error {
+	if log == nil {
+		log = func(string) {}
+	}
+	if svc().Installed(QUIC_SERVICE_NAME) {
+		log("停止现有 " + QUIC_SERVICE_NAME)
+		stopDisabled(QUIC_SERVICE_NAME, log)
+	}
+	switch policy {
+	case QUIC_POLICY_NONE:
+		_ = svc().Remove(QUIC_SERVICE_NAME, log)
+		_ = removeIfExists(QUIC_NFT_FILE)
+	case QUIC_POLICY_REJECT:
+		if _, err := runCmdCapture("nft", "--version"); err != nil {
+			return errors.New("未找到 nft 命令，请先安装 nftables")
+		}
+		if err := writeFileIfChanged(QUIC_NFT_FILE, quicRejectRuleset(), 0o644); err != nil {
+			return err
+		}
+		log("已写入 " + QUIC_NFT_FILE)
+	case QUIC_POLICY_PROXY:
+	default:
+		return fmt.Errorf("未知 QUIC 策略: %s", policy)
+	}
+	if policy != QUIC_POLICY_NONE {
+		spec, err := quicServiceSpec(policy)
+		if err != nil {
+			return err
+		}
+		if err := svc().Install(spec, log); err != nil {
+			return err
+		}
+		if err := startEnabled(QUIC_SERVICE_NAME, log); err != nil {
+			return fmt.Errorf("启动 %s 失败: %w", QUIC_SERVICE_NAME, err)
+		}
+	}
+	if err := updateSettings(func(st *ctlSettings) { st.QUICPolicy = policy }); err != nil {
+		return fmt.Errorf("保存设置失败: %w", err)
+	}
+	log("UDP 443 策略: " + quicPolicyLabel(policy))
+	return nil
+}
+
+// quicPolicyStatus describes the configured policy and whether it is actually in effect.
+func quicPolicyStatus() string {
+	policy := loadSettings().QUICPolicy
+	label := quicPolicyLabel(policy)
+	switch policy {
+	case QUIC_POLICY_REJECT:
+		if _, err := runCmdCapture("nft", "list", "table", "inet", quicNftTable); err != nil {
+			return label + "（nft 规则未加载）"
+		}
+		return label + "（nft 规则已加载）"
+	case QUIC_POLICY_PROXY:
+		if !svc().Status(QUIC_SERVICE_NAME) {
+			return label + "（服务未运行）"
+		}
+		return label + "（服务运行中）"
+	}
+	return label + "（客户端 HTTP/3 可能超时后才回退）"
+}
@@ -0,0 +1,408 @@
+package src
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/exec"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SmartDNS releases from GitHub (or a mirror speaking the same API): listing,
+// picking the asset for this machine's architecture and checking its sha256
+// before anything is installed.
+
+type ghAsset struct {
+	Name   string `json:"name"`
+	URL    string `json:"browser_download_url"`
+	Size   int64  `json:"size"`
+	Digest string `json:"digest"` // "sha256:<hex>" on assets GitHub has hashed
+}
+
+type ghRelease struct {
+	Tag        string    `json:"tag_name"`
+	Name       string    `json:"name"`
+	Body       string    `json:"body"`
+	Draft      bool      `json:"draft"`
+	Prerelease bool      `json:"prerelease"`
+	Published  time.Time `json:"published_at"`
+	Assets     []ghAsset `json:"assets"`
+
+	Repo       string `json:"-"` // owner/name it was listed from
+	FromOrigin bool   `json:"-"` // listed by GitHub's own API, not a release_api mirror
+}
+
+// releaseAPIBase is the configured release_api or GitHub's own API.
+func releaseAPIBase() string {
+	if base := strings.TrimRight(loadSettings().ReleaseAPI, "/"); base != "" {
+		return base
+	}
+	return GITHUB_API_URL
+}
+
+// githubAPIHeaders carries GITHUB_TOKEN, which lifts the 60/h anonymous limit.
+func githubAPIHeaders() map[string]string {
+	if tok := os.Getenv("GITHUB_TOKEN"); tok != "" {
+		return map[string]string{"Authorization": "Bearer " + tok}
+	}
+	return nil
+}
+
+// fetchReleases lists the newest releases of repo ("owner/name"), drafts excluded.
+func fetchReleases(repo string) ([]ghRelease, error) {
+	base := releaseAPIBase()
+	url := base + "/repos/" + repo + "/releases?per_page=30"
+	origin := base == GITHUB_API_URL
+	b, err := fetchURL(url, githubAPIHeaders(), 20*time.Second, downloadOptions{OriginOnly: origin})
+	if err != nil {
+		return nil, &downloadError{fmt.Errorf("获取发布列表失败 (%s): %w", url, err)}
+	}
+	var all []ghRelease
+	if err := json.Unmarshal(b, &all); err != nil {
+		return nil, fmt.Errorf("发布列表格式错误: %w", err)
+	}
+	out := all[:0]
+	for _, r := range all {
+		if !r.Draft {
+			r.Repo, r.FromOrigin = repo, origin
+			out = append(out, r)
+		}
+	}
+	return out, nil
+}
+
+// fetchOriginRelease reads one release straight from GitHub's API, for the
+// metadata that must not come from a mirror.
+func fetchOriginRelease(repo, tag string) (ghRelease, error) {
+	api := GITHUB_API_URL + "/repos/" + repo + "/releases/tags/" + url.PathEscape(tag)
+	b, err := fetchURL(api, githubAPIHeaders(), 20*time.Second, downloadOptions{OriginOnly: true})
+	if err != nil {
+		return ghRelease{}, err
+	}
+	var r ghRelease
+	if err := json.Unmarshal(b, &r); err != nil {
+		return ghRelease{}, fmt.Errorf("发布信息格式错误: %w", err)
+	}
+	r.Repo, r.FromOrigin = repo, true
+	return r, nil
+}
+
+// smartdnsArchTokensFor are the architecture names smartdns uses in its
+// asset names for a GOARCH, best match first.
+func smartdnsArchTokensFor(goarch string) []string {
+	switch goarch {
+	case "amd64":
+		return []string{"x86_64", "x86"} // the x86 tarball carries both binaries
+	case "386":
+		return []string{"x86"}
+	case "arm64":
+		return []string{"aarch64"}
+	case "arm":
+		return []string{"arm"} // armv7 hard-float builds
+	case "mips":
+		return []string{"mips"}
+	case "mipsle":
+		return []string{"mipsel"}
+	}
+	return nil
+}
+
+// smartdns.<version>.<arch>-linux-all.tar.gz
+var reSmartDNSAsset = regexp.MustCompile(`^smartdns\.(.+)\.([a-z0-9_]+)-linux-all\.tar\.gz$`)
+
+// smartdnsRelease is a release that has a tarball for this architecture.
+type smartdnsRelease struct {
+	ghRelease
+	Version string  // e.g. 1.2024.06.12-2222, as printed by `smartdns -v`
+	Asset   ghAsset // the tarball for this architecture
+}
+
+func (r smartdnsRelease) String() string {
+	s := r.Tag + " (" + r.Version + ")"
+	if r.Prerelease {
+		s += " [预发布]"
+	}
+	return s
+}
+
+// pickSmartDNSAsset finds the tarball for tokens in a release.
+func pickSmartDNSAsset(rel ghRelease, tokens []string) (smartdnsRelease, bool) {
+	for _, tok := range tokens {
+		for _, a := range rel.Assets {
+			if m := reSmartDNSAsset.FindStringSubmatch(a.Name); m != nil && m[2] == tok {
+				return smartdnsRelease{ghRelease: rel, Version: m[1], Asset: a}, true
+			}
+		}
+	}
+	return smartdnsRelease{}, false
+}
+
+var (
+	smartdnsReleaseMu    sync.Mutex
+	smartdnsReleaseCache []smartdnsRelease
+	smartdnsReleaseAt    time.Time
+)
+
+// smartdnsReleases lists releases installable on this machine, newest first.
+// The list is cached for ten minutes to stay clear of API rate limits.
+func smartdnsReleases() ([]smartdnsRelease, error) {
+	smartdnsReleaseMu.Lock()
+	defer smartdnsReleaseMu.Unlock()
+	if smartdnsReleaseCache != nil && time.Since(smartdnsReleaseAt) < 10*time.Minute {
+		return smartdnsReleaseCache, nil
+	}
+	all, err := fetchReleases(SMARTDNS_REPO)
+	if err != nil {
+		return nil, err
+	}
+	out, err := releasesForArch(all, runtime.GOARCH)
+	if err != nil {
+		return nil, err
+	}
+	smartdnsReleaseCache, smartdnsReleaseAt = out, time.Now()
+	return out, nil
+}
+
+// latestSmartDNSRelease is the newest stable release (the newest at all if
+// every listed release is a prerelease).
+func latestSmartDNSRelease(list []smartdnsRelease) smartdnsRelease {
+	for _, r := range list {
+		if !r.Prerelease {
+			return r
+		}
+	}
+	return list[0]
+}
+
+// releasesForArch keeps the releases that have a tarball for goarch.
+func releasesForArch(all []ghRelease, goarch string) ([]smartdnsRelease, error) {
+	tokens := smartdnsArchTokensFor(goarch)
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("SmartDNS 未提供 %s 架构的发布包", goarch)
+	}
+	var out []smartdnsRelease
+	for _, r := range all {
+		if sr, ok := pickSmartDNSAsset(r, tokens); ok {
+			out = append(out, sr)
+		}
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("发布列表中没有 %s 架构的安装包", goarch)
+	}
+	return out, nil
+}
+
+// findSmartDNSRelease resolves tag ("" or "latest" for the newest stable).
+func findSmartDNSRelease(tag string) (smartdnsRelease, error) {
+	list, err := smartdnsReleases()
+	if err != nil {
+		return smartdnsRelease{}, err
+	}
+	return selectSmartDNSRelease(list, tag)
+}
+
+func selectSmartDNSRelease(list []smartdnsRelease, tag string) (smartdnsRelease, error) {
+	if tag == "" || tag == "latest" {
+		return latestSmartDNSRelease(list), nil
+	}
+	for _, r := range list {
+		if strings.EqualFold(r.Tag, tag) || r.Version == tag {
+			return r, nil
+		}
+	}
+	return smartdnsRelease{}, fmt.Errorf("未找到版本 %s（或该版本没有对应架构的安装包）", tag)
+}
+
+// expectedSHA256 is the published sha256 of the release's tarball: GitHub's
+// asset digest, else a line from a checksum file attached to the release.
+// Empty when the release publishes neither.
+func (r smartdnsRelease) expectedSHA256() (string, error) {
+	return releaseAssetSHA256(r.ghRelease, r.Asset)
+}
+
+// releaseAssetSHA256 is the published sha256 of one asset of rel. A listing
+// from a release_api mirror could pair a tampered package with a matching
+// digest or checksum file, so the release is then looked up again on GitHub
+// and only its metadata is trusted; verification fails if GitHub is unreachable.
+func releaseAssetSHA256(rel ghRelease, asset ghAsset) (string, error) {
+	if !rel.FromOrigin {
+		orig, err := fetchOriginRelease(rel.Repo, rel.Tag)
+		if err != nil {
+			return "", &downloadError{fmt.Errorf("无法从 GitHub 确认 %s 的校验值（不采用发布 API 镜像提供的校验值）: %w", rel.Tag, err)}
+		}
+		found := false
+		for _, a := range orig.Assets {
+			if a.Name == asset.Name {
+				asset, found = a, true
+				break
+			}
+		}
+		if !found {
+			return "", fmt.Errorf("GitHub 上的 %s 发布中没有 %s", rel.Tag, asset.Name)
+		}
+		rel = orig
+	}
+	if d, ok := strings.CutPrefix(asset.Digest, "sha256:"); ok && d != "" {
+		return strings.ToLower(d), nil
+	}
+	for _, a := range rel.Assets {
+		name := strings.ToLower(a.Name)
+		if a.Name != asset.Name+".sha256" && !strings.Contains(name, "sha256sum") && !strings.Contains(name, "checksum") {
+			continue
+		}
+		// a mirror could hand out a checksum matching its own tampered
+		// package, so checksums only ever come from the original host
+		b, err := fetchURL(a.URL, nil, 30*time.Second, downloadOptions{OriginOnly: true})
+		if err != nil {
+			return "", &downloadError{fmt.Errorf("下载校验文件 %s 失败（校验文件只从原地址获取，不经镜像）: %w", a.Name, err)}
+		}
+		if sum := checksumFor(string(b), asset.Name, a.Name == asset.Name+".sha256"); sum != "" {
+			return sum, nil
+		}
+	}
+	return "", nil
+}
+
+// checksumFor finds name's hash in sha256sum output ("<hex>  [*]name"); a
+// lone hash is accepted when the file belongs to name alone.
+func checksumFor(text, name string, alone bool) string {
+	sc := bufio.NewScanner(strings.NewReader(text))
+	for sc.Scan() {
+		f := strings.Fields(sc.Text())
+		switch {
+		case alone && len(f) == 1 && len(f[0]) == 64:
+			return strings.ToLower(f[0])
+		case len(f) >= 2 && len(f[0]) == 64 && strings.TrimPrefix(f[len(f)-1], "*") == name:
+			return strings.ToLower(f[0])
+		}
+	}
+	return ""
+}
+
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+var reSmartDNSVersion = regexp.MustCompile(`\d+\.\d{4}\.\d{2}\.\d{2}-\d{4}`)
+
+// installedSmartDNSVersion asks the installed binary (`smartdns -v`); empty
+// when smartdns is not installed or prints something unexpected.
+func installedSmartDNSVersion() string {
+	bin, err := exec.LookPath("smartdns")
+	if err != nil {
+		if !fileExists("/usr/sbin/smartdns") {
+			return ""
+		}
+		bin = "/usr/sbin/smartdns"
+	}
+	out, _ := exec.Command(bin, "-v").CombinedOutput()
+	return reSmartDNSVersion.FindString(string(out))
+}
+
+// smartdnsVersionStatus is "已安装 X / 最新 Y" for menus; latest is looked up online.
+func smartdnsVersionStatus() (installed string, latest smartdnsRelease, err error) {
+	installed = installedSmartDNSVersion()
+	list, err := smartdnsReleases()
+	if err != nil {
+		return installed, smartdnsRelease{}, err
+	}
+	return installed, latestSmartDNSRelease(list), nil
+}
+
+// newerThan reports whether the release is newer than an installed version
+// (versions are date-stamped, so they compare as strings).
+func (r smartdnsRelease) newerThan(installed string) bool {
+	return installed == "" || r.Version > installed
+}
+
+// runSmartDNSCommand implements `smartdnsctl smartdns status|versions|install [版本]|rollback|uninstall`.
+func runSmartDNSCommand(args []string) int {
+	sub := "status"
+	if len(args) > 0 {
+		sub, args = args[0], args[1:]
+	}
+	switch sub {
+	case "status":
+		installed, latest, err := smartdnsVersionStatus()
+		if installed == "" {
+			installed = "未安装"
+		}
+		fmt.Println("已安装: " + installed)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Println("最新:   " + latest.String())
+		if latest.newerThan(installedSmartDNSVersion()) {
+			fmt.Println("可升级: smartdnsctl smartdns install " + latest.Tag)
+		}
+		return 0
+	case "versions":
+		list, err := smartdnsReleases()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		installed := installedSmartDNSVersion()
+		for _, r := range list {
+			mark := ""
+			if r.Version == installed {
+				mark = "  [已安装]"
+			}
+			fmt.Printf("%-14s %-20s %s  %s%s\n", r.Tag, r.Version, r.Published.Format("2006-01-02"), r.Asset.Name, mark)
+		}
+		return 0
+	case "install":
+		fs := flag.NewFlagSet("smartdns install", flag.ContinueOnError)
+		insecure := fs.Bool("insecure", false, "发布未提供校验值时仍然安装")
+		from := fs.String("from", "", "从本地安装包（.tar.gz/.tar.xz/.zip/.deb）或离线包目录安装")
+		if err := fs.Parse(args); err != nil {
+			return 2
+		}
+		var err error
+		if *from != "" {
+			err = installSmartDNSFrom(*from, func(s string) { fmt.Println(s) })
+		} else {
+			err = installSmartDNSStream(fs.Arg(0), *insecure, func(s string) { fmt.Println(s) })
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "安装失败:", err)
+			if isDownloadError(err) {
+				fmt.Fprintln(os.Stderr, "无法联网时可用 --from 指定本地安装包或 `smartdnsctl bundle create` 制作的离线包")
+			}
+			return 1
+		}
+		return 0
+	case "rollback", "uninstall":
+		fn := rollbackSmartDNS
+		if sub == "uninstall" {
+			fn = uninstallSmartDNSStream
+		}
+		if err := fn(func(s string) { fmt.Println(s) }); err != nil {
+			fmt.Fprintln(os.Stderr, "失败:", err)
+			return 1
+		}
+		return 0
+	}
+	fmt.Fprintln(os.Stderr, "用法: smartdnsctl smartdns status|versions|install [--insecure] [--from 路径] [版本]|rollback|uninstall")
+	return 2
+}
@@ -0,0 +1,585 @@
+package src
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// System resolver integration.
+//
+// Pointing the host at smartdns used to mean disabling systemd-resolved and
+// overwriting /etc/resolv.conf with a single nameserver line, which dropped
+// search/options and was undone by NetworkManager, DHCP or netplan on the next
+// lease. Instead we tell whichever component owns resolv.conf what we want
+// (a resolved drop-in, NetworkManager dns=none, resolvconf head) and record
+// every file we touch before the first change so "restore" puts them back
+// byte for byte.
+
+const (
+	RESOLVER_SYSTEMD    = "systemd-resolved"
+	RESOLVER_NM         = "NetworkManager"
+	RESOLVER_RESOLVCONF = "resolvconf"
+	RESOLVER_FILE       = "file"
+)
+
+const resolverMarker = "# managed by smartdnsctl"
+
+// savedFile is the original state of a file touched by a resolver backend.
+type savedFile struct {
+	Path      string `json:"path"`
+	Exists    bool   `json:"exists"`
+	Symlink   string `json:"symlink,omitempty"`
+	Content   []byte `json:"content,omitempty"`
+	Mode      uint32 `json:"mode,omitempty"`
+	Immutable bool   `json:"immutable,omitempty"`
+}
+
+// resolverState is persisted in RESOLVER_STATE_FILE from the first change
+// until the system resolver is restored.
+type resolverState struct {
+	Backend         string      `json:"backend"`
+	Saved           time.Time   `json:"saved"`
+	Files           []savedFile `json:"files"`
+	ResolvedActive  bool        `json:"resolved_active,omitempty"`
+	ResolvedEnabled bool        `json:"resolved_enabled,omitempty"`
+}
+
+type resolverBackend interface {
+	name() string
+	// apply points the system resolver at ip; an empty ip only frees port 53
+	apply(st *resolverState, ip string, log func(string)) error
+	// reload makes the owning service pick up restored files
+	reload(st *resolverState, log func(string)) error
+}
+
+func resolverBackendFor(name string) resolverBackend {
+	switch name {
+	case RESOLVER_SYSTEMD:
+		return resolvedBackend{}
+	case RESOLVER_NM:
+		return nmBackend{}
+	case RESOLVER_RESOLVCONF:
+		return resolvconfBackend{}
+	}
+	return fileBackend{}
+}
+
+// detectResolverBackend reports who currently owns /etc/resolv.conf.
+func detectResolverBackend() string {
+	target, _ := os.Readlink(RESOLV_CONF)
+	if target != "" && !filepath.IsAbs(target) {
+		target = filepath.Join(filepath.Dir(RESOLV_CONF), target)
+	}
+	switch {
+	case strings.Contains(target, "/run/systemd/resolve/") && svc().Status("systemd-resolved"):
+		return RESOLVER_SYSTEMD
+	case svc().Status("NetworkManager") && nmManagesResolvConf():
+		return RESOLVER_NM
+	case strings.Contains(target, "/run/resolvconf/") || (target == "" && resolvconfGenerated()):
+		if _, err := exec.LookPath("resolvconf"); err == nil {
+			return RESOLVER_RESOLVCONF
+		}
+	}
+	return RESOLVER_FILE
+}
+
+// nmManagesResolvConf is true unless NetworkManager was told to keep its hands off.
+func nmManagesResolvConf() bool {
+	out, err := runCmdCapture("NetworkManager", "--print-config")
+	if err != nil {
+		return true
+	}
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.ReplaceAll(strings.TrimSpace(line), " ", "")
+		if line == "dns=none" || line == "rc-manager=unmanaged" {
+			return false
+		}
+	}
+	return true
+}
+
+func resolvconfGenerated() bool {
+	b, err := os.ReadFile(RESOLV_CONF)
+	return err == nil && strings.Contains(string(b), "resolvconf")
+}
+
+// currentResolverBackend prefers the backend recorded in the state file: after
+// our first change resolv.conf no longer looks like it did originally.
+func currentResolverBackend() string {
+	if st, err := loadResolverState(); err == nil && st != nil {
+		return st.Backend
+	}
+	return detectResolverBackend()
+}
+
+func loadResolverState() (*resolverState, error) {
+	b, err := os.ReadFile(RESOLVER_STATE_FILE)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var st resolverState
+	if err := json.Unmarshal(b, &st); err != nil {
+		return nil, fmt.Errorf("解析 %s 失败: %w", RESOLVER_STATE_FILE, err)
+	}
+	return &st, nil
+}
+
+func saveResolverState(st *resolverState) error {
+	b, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(RESOLVER_STATE_FILE), 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(RESOLVER_STATE_FILE, b, 0o600)
+}
+
+// record snapshots path into the state the first time it's about to change.
+func (st *resolverState) record(path string) error {
+	for _, f := range st.Files {
+		if f.Path == path {
+			return nil
+		}
+	}
+	f, err := snapshotFile(path)
+	if err != nil {
+		return err
+	}
+	st.Files = append(st.Files, f)
+	return saveResolverState(st)
+}
+
+// snapshotFile captures path (content, symlink target, mode, immutable flag).
+func snapshotFile(path string) (savedFile, error) {
+	f := savedFile{Path: path}
+	fi, err := os.Lstat(path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		return f, err
+	case fi.Mode()&os.ModeSymlink != 0:
+		f.Exists = true
+		if f.Symlink, err = os.Readlink(path); err != nil {
+			return f, err
+		}
+	default:
+		f.Exists = true
+		f.Mode = uint32(fi.Mode().Perm())
+		if f.Content, err = os.ReadFile(path); err != nil {
+			return f, err
+		}
+		f.Immutable = isImmutable(path)
+	}
+	return f, nil
+}
+
+// restore puts a recorded file back exactly as it was.
+func (f savedFile) restore() error {
+	if fi, err := os.Lstat(f.Path); err == nil && fi.Mode()&os.ModeSymlink == 0 && isImmutable(f.Path) {
+		_ = setImmutable(f.Path, false)
+	}
+	if !f.Exists {
+		if err := os.Remove(f.Path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(f.Path), 0o755); err != nil {
+		return err
+	}
+	if f.Symlink != "" {
+		if err := os.Remove(f.Path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return os.Symlink(f.Symlink, f.Path)
+	}
+	if err := replaceFile(f.Path, f.Content, os.FileMode(f.Mode)); err != nil {
+		return err
+	}
+	if f.Immutable {
+		return setImmutable(f.Path, true)
+	}
+	return nil
+}
+
+// isImmutable checks the ext*/xfs immutable attribute (chattr +i), a common
+// way to stop DHCP clients from rewriting resolv.conf.
+func isImmutable(path string) bool {
+	out, err := runCmdCapture("lsattr", "-d", path)
+	if err != nil {
+		return false
+	}
+	fields := strings.Fields(out)
+	return len(fields) > 0 && strings.Contains(fields[0], "i")
+}
+
+func setImmutable(path string, on bool) error {
+	flag := "-i"
+	if on {
+		flag = "+i"
+	}
+	if out, err := runCmdCapture("chattr", flag, path); err != nil {
+		return fmt.Errorf("chattr %s %s: %v %s", flag, path, err, strings.TrimSpace(out))
+	}
+	return nil
+}
+
+// replaceFile writes path as a regular file, replacing a symlink rather than
+// writing through it.
+func replaceFile(path string, content []byte, mode os.FileMode) error {
+	if mode == 0 {
+		mode = 0o644
+	}
+	tmp := path + ".smartdnsctl.tmp"
+	if err := os.WriteFile(tmp, content, mode); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// resolvConfWith returns resolv.conf content with ip as the only nameserver,
+// keeping search/domain/options and any other lines from base.
+func resolvConfWith(base, ip string) string {
+	var keep []string
+	for _, line := range strings.Split(base, "\n") {
+		t := strings.TrimSpace(line)
+		if t == resolverMarker || strings.HasPrefix(t, "nameserver") {
+			continue
+		}
+		keep = append(keep, line)
+	}
+	for len(keep) > 0 && strings.TrimSpace(keep[len(keep)-1]) == "" {
+		keep = keep[:len(keep)-1]
+	}
+	out := []string{resolverMarker, "nameserver " + ip}
+	out = append(out, keep...)
+	return strings.Join(out, "\n") + "\n"
+}
+
+// writeResolvConf rewrites /etc/resolv.conf as a regular file pointing at ip.
+// search/options come from base (or the current file when base is empty); a
+// symlink is replaced and an immutable flag is lifted for the write and set again.
+func writeResolvConf(st *resolverState, ip, base string, log func(string)) error {
+	if err := st.record(RESOLV_CONF); err != nil {
+		return err
+	}
+	return writeResolvConfFile(ip, base, log)
+}
+
+// writeResolvConfFile is writeResolvConf without recording the original.
+func writeResolvConfFile(ip, base string, log func(string)) error {
+	if base == "" {
+		b, _ := os.ReadFile(RESOLV_CONF)
+		base = string(b)
+	}
+	fi, err := os.Lstat(RESOLV_CONF)
+	immutable := false
+	if err == nil && fi.Mode()&os.ModeSymlink != 0 {
+		target, _ := os.Readlink(RESOLV_CONF)
+		log(fmt.Sprintf("%s 是指向 %s 的符号链接，替换为普通文件", RESOLV_CONF, target))
+	} else if err == nil && isImmutable(RESOLV_CONF) {
+		immutable = true
+		log(RESOLV_CONF + " 带有 immutable 属性，临时解除后写入")
+		if err := setImmutable(RESOLV_CONF, false); err != nil {
+			return err
+		}
+	}
+	if err := replaceFile(RESOLV_CONF, []byte(resolvConfWith(base, ip)), 0o644); err != nil {
+		return fmt.Errorf("写入 %s 失败: %w", RESOLV_CONF, err)
+	}
+	if immutable {
+		return setImmutable(RESOLV_CONF, true)
+	}
+	return nil
+}
+
+// writeManaged records path and replaces it with content.
+func writeManaged(st *resolverState, path, content string) error {
+	if err := st.record(path); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	return replaceFile(path, []byte(content), 0o644)
+}
+
+// ----- backends -----
+
+type resolvedBackend struct{}
+
+func (resolvedBackend) name() string { return RESOLVER_SYSTEMD }
+
+func (resolvedBackend) apply(st *resolverState, ip string, log func(string)) error {
+	conf := resolverMarker + "\n[Resolve]\n"
+	if ip != "" {
+		conf += "DNS=" + ip + "\nDomains=~.\n"
+	}
+	conf += "DNSStubListener=no\n"
+	log("写入 " + RESOLVED_DROPIN + "（DNSStubListener=no）")
+	if err := writeManaged(st, RESOLVED_DROPIN, conf); err != nil {
+		return err
+	}
+	if err := serviceAction(log, "restart", "systemd-resolved"); err != nil {
+		return err
+	}
+	if ip == "" {
+		// the stub is gone: point resolv.conf at resolved's list of real upstreams
+		if target, _ := os.Readlink(RESOLV_CONF); target == RESOLVED_RESOLV {
+			return nil
+		}
+		if err := st.record(RESOLV_CONF); err != nil {
+			return err
+		}
+		log(RESOLV_CONF + " -> " + RESOLVED_RESOLV)
+		_ = os.Remove(RESOLV_CONF)
+		return os.Symlink(RESOLVED_RESOLV, RESOLV_CONF)
+	}
+	// keep the search domains resolved learned from DHCP/netplan
+	base, _ := os.ReadFile(RESOLVED_RESOLV)
+	return writeResolvConf(st, ip, string(base), log)
+}
+
+func (resolvedBackend) reload(st *resolverState, log func(string)) error {
+	if !st.ResolvedActive {
+		return nil
+	}
+	return serviceAction(log, "restart", "systemd-resolved")
+}
+
+type nmBackend struct{}
+
+func (nmBackend) name() string { return RESOLVER_NM }
+
+func (nmBackend) apply(st *resolverState, ip string, log func(string)) error {
+	if ip == "" {
+		return nil
+	}
+	log("写入 " + NM_DNS_CONF + "（dns=none，NetworkManager 不再改写 resolv.conf）")
+	if err := writeManaged(st, NM_DNS_CONF, resolverMarker+"\n[main]\ndns=none\nrc-manager=unmanaged\n"); err != nil {
+		return err
+	}
+	if err := nmReload(log); err != nil {
+		return err
+	}
+	return writeResolvConf(st, ip, "", log)
+}
+
+func (nmBackend) reload(st *resolverState, log func(string)) error { return nmReload(log) }
+
+func nmReload(log func(string)) error {
+	if _, err := exec.LookPath("nmcli"); err == nil {
+		return svcRun(log, "nmcli", "general", "reload", "conf", "dns-rc")
+	}
+	return serviceAction(log, "reload", "NetworkManager")
+}
+
+type resolvconfBackend struct{}
+
+func (resolvconfBackend) name() string { return RESOLVER_RESOLVCONF }
+
+func (resolvconfBackend) apply(st *resolverState, ip string, log func(string)) error {
+	if ip == "" {
+		return nil
+	}
+	if fileExists(filepath.Dir(RESOLVCONF_HEAD)) {
+		// Debian resolvconf: head is copied verbatim above the interface servers
+		head, _ := os.ReadFile(RESOLVCONF_HEAD)
+		log("写入 " + RESOLVCONF_HEAD)
+		if err := writeManaged(st, RESOLVCONF_HEAD, withManagedLine(string(head), "nameserver "+ip)); err != nil {
+			return err
+		}
+	} else {
+		// openresolv: name_servers are prepended to every generated resolv.conf
+		conf, _ := os.ReadFile(OPENRESOLV_CONF)
+		log("写入 " + OPENRESOLV_CONF)
+		if err := writeManaged(st, OPENRESOLV_CONF, withManagedLine(string(conf), `name_servers="`+ip+`"`)); err != nil {
+			return err
+		}
+	}
+	return svcRun(log, "resolvconf", "-u")
+}
+
+func (resolvconfBackend) reload(st *resolverState, log func(string)) error {
+	return svcRun(log, "resolvconf", "-u")
+}
+
+// withManagedLine replaces the line we previously added (tagged with the marker).
+func withManagedLine(content, line string) string {
+	var keep []string
+	for _, l := range strings.Split(strings.TrimRight(content, "\n"), "\n") {
+		if strings.HasSuffix(l, resolverMarker) || (l == "" && len(keep) == 0) {
+			continue
+		}
+		keep = append(keep, l)
+	}
+	return strings.Join(append([]string{line + " " + resolverMarker}, keep...), "\n") + "\n"
+}
+
+type fileBackend struct{}
+
+func (fileBackend) name() string { return RESOLVER_FILE }
+
+func (fileBackend) apply(st *resolverState, ip string, log func(string)) error {
+	if ip == "" {
+		return nil
+	}
+	return writeResolvConf(st, ip, "", log)
+}
+
+func (fileBackend) reload(*resolverState, func(string)) error { return nil }
+
+// ----- entry points -----
+
+func beginResolverChange(backend string) (*resolverState, error) {
+	st, err := loadResolverState()
+	if err != nil || st != nil {
+		return st, err
+	}
+	st = &resolverState{
+		Backend:         backend,
+		Saved:           time.Now(),
+		ResolvedActive:  svc().Status("systemd-resolved"),
+		ResolvedEnabled: svc().Enabled("systemd-resolved"),
+	}
+	return st, saveResolverState(st)
+}
+
+// pointSystemDNS makes the host resolve through ip via the detected backend.
+func pointSystemDNS(ip string, log func(string)) (err error) {
+	noteResolverChanged()
+	snaps := snapshotFiles(RESOLV_CONF, RESOLVED_DROPIN, NM_DNS_CONF, RESOLVCONF_HEAD, OPENRESOLV_CONF)
+	defer func() { auditSnapshots("resolver.point", ip, snaps, err) }()
+	if log == nil {
+		log = func(string) {}
+	}
+	backend := currentResolverBackend()
+	st, err := beginResolverChange(backend)
+	if err != nil {
+		return err
+	}
+	log("系统解析器: " + backend)
+	if err := resolverBackendFor(st.Backend).apply(st, ip, log); err != nil {
+		return err
+	}
+	log(fmt.Sprintf("系统 DNS 已指向 %s（原始状态已记录，可恢复）", ip))
+	return nil
+}
+
+// forceResolvConf is the emergency path: write resolv.conf directly whatever
+// owns it, still recording the original so it can be restored later.
+func forceResolvConf(ip string, log func(string)) (err error) {
+	noteResolverChanged()
+	snaps := snapshotFiles(RESOLV_CONF, RESOLVED_DROPIN, NM_DNS_CONF, RESOLVCONF_HEAD, OPENRESOLV_CONF)
+	defer func() { auditSnapshots("resolver.force", ip, snaps, err) }()
+	if log == nil {
+		log = func(string) {}
+	}
+	st, err := beginResolverChange(currentResolverBackend())
+	if err != nil {
+		return err
+	}
+	return writeResolvConf(st, ip, "", log)
+}
+
+// releasePort53 stops systemd-resolved's stub from holding port 53 without
+// disabling resolved, so smartdns can bind while the host keeps resolving.
+func releasePort53(log func(string)) error {
+	if log == nil {
+		log = func(string) {}
+	}
+	if detectResolverBackend() != RESOLVER_SYSTEMD && !svc().Status("systemd-resolved") {
+		return nil
+	}
+	if resolvedStubDisabled() {
+		return nil
+	}
+	st, err := beginResolverChange(RESOLVER_SYSTEMD)
+	if err != nil {
+		return err
+	}
+	if st.Backend != RESOLVER_SYSTEMD {
+		// resolved is running beside another owner: only the drop-in matters
+		st.Backend = RESOLVER_SYSTEMD
+		if err := saveResolverState(st); err != nil {
+			return err
+		}
+	}
+	return resolvedBackend{}.apply(st, "", log)
+}
+
+// resolvedStubDisabled reports whether our drop-in turned off resolved's 127.0.0.53 listener.
+func resolvedStubDisabled() bool {
+	b, err := os.ReadFile(RESOLVED_DROPIN)
+	return err == nil && strings.Contains(string(b), "DNSStubListener=no")
+}
+
+// restoreSystemResolver puts every recorded file back, restarts the owning
+// service and forgets the state. Without a record it falls back to re-enabling
+// systemd-resolved, as older versions did.
+func restoreSystemResolver(log func(string)) (err error) {
+	noteResolverChanged()
+	snaps := snapshotFiles(RESOLV_CONF, RESOLVED_DROPIN, NM_DNS_CONF, RESOLVCONF_HEAD, OPENRESOLV_CONF)
+	defer func() { auditSnapshots("resolver.restore", "", snaps, err) }()
+	if log == nil {
+		log = func(string) {}
+	}
+	st, err := loadResolverState()
+	if err != nil {
+		return err
+	}
+	if st == nil {
+		log("未找到记录的原始解析器状态")
+		if !svc().Installed("systemd-resolved") {
+			return nil
+		}
+		_ = serviceAction(log, "enable", "systemd-resolved")
+		return serviceAction(log, "start", "systemd-resolved")
+	}
+	var errs []string
+	for i := len(st.Files) - 1; i >= 0; i-- {
+		f := st.Files[i]
+		log("恢复 " + f.Path)
+		if err := f.restore(); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if st.ResolvedEnabled && !svc().Enabled("systemd-resolved") {
+		_ = serviceAction(log, "enable", "systemd-resolved")
+	}
+	if st.ResolvedActive && !svc().Status("systemd-resolved") {
+		_ = serviceAction(log, "start", "systemd-resolved")
+	}
+	if err := resolverBackendFor(st.Backend).reload(st, log); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	_ = os.Remove(RESOLVER_STATE_FILE)
+	log("系统解析器已恢复为 " + st.Backend + " 的原始状态")
+	return nil
+}
+
+// resolverStatus is a one-line description for menus.
+func resolverStatus() string {
+	st, _ := loadResolverState()
+	if st == nil {
+		return "系统解析器: " + detectResolverBackend()
+	}
+	return "系统解析器: " + st.Backend + "（已修改，记录于 " + st.Saved.Format("2006-01-02 15:04") + "）"
+}
@@ -0,0 +1,372 @@
+package src
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Self-update from this project's GitHub releases (smartdnsctl_linux_<GOARCH>
+// assets, see .github/workflows). The new binary is downloaded into the
+// cache directory, checked against the published sha256, copied next to the
+// running one, tried once and then renamed over it; the replaced binary
+// stays as <exe>.prev for rollback.
+
+const (
+	UPDATE_STABLE     = "stable"
+	UPDATE_PRERELEASE = "prerelease"
+)
+
+type selfRelease struct {
+	ghRelease
+	Asset ghAsset
+}
+
+// updateChannel is the configured channel (stable unless set to prerelease).
+func updateChannel() string {
+	if loadSettings().UpdateChannel == UPDATE_PRERELEASE {
+		return UPDATE_PRERELEASE
+	}
+	return UPDATE_STABLE
+}
+
+func selfAssetName() string { return "smartdnsctl_linux_" + runtime.GOARCH }
+
+// selfReleases lists the releases on channel that carry a binary for this
+// architecture, newest first.
+func selfReleases(channel string) ([]selfRelease, error) {
+	all, err := fetchReleases(SELF_REPO)
+	if err != nil {
+		return nil, err
+	}
+	var out []selfRelease
+	for _, r := range all {
+		if r.Prerelease && channel != UPDATE_PRERELEASE {
+			continue
+		}
+		for _, a := range r.Assets {
+			if a.Name == selfAssetName() {
+				out = append(out, selfRelease{ghRelease: r, Asset: a})
+				break
+			}
+		}
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("%s 的发布中没有 %s", SELF_REPO, selfAssetName())
+	}
+	return out, nil
+}
+
+type semver struct {
+	core [3]int
+	pre  []string // dot-separated pre-release identifiers; empty for a release
+}
+
+// parseSemver reads "v1.2.3[-pre][+build]"; build metadata is ignored.
+func parseSemver(v string) (semver, bool) {
+	var out semver
+	v = strings.TrimPrefix(v, "v")
+	if i := strings.IndexByte(v, '+'); i >= 0 {
+		v = v[:i]
+	}
+	if i := strings.IndexByte(v, '-'); i >= 0 {
+		out.pre = strings.Split(v[i+1:], ".")
+		v = v[:i]
+		for _, id := range out.pre {
+			if id == "" {
+				return out, false
+			}
+		}
+	}
+	parts := strings.Split(v, ".")
+	if len(parts) != 3 {
+		return out, false
+	}
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil {
+			return out, false
+		}
+		out.core[i] = n
+	}
+	return out, true
+}
+
+// comparePre orders pre-release identifiers as SemVer does: a release
+// (no identifiers) ranks above any pre-release of the same version, numeric
+// identifiers compare numerically and below alphanumeric ones, and a longer
+// list wins when all shared identifiers are equal.
+func comparePre(a, b []string) int {
+	switch {
+	case len(a) == 0 && len(b) == 0:
+		return 0
+	case len(a) == 0:
+		return 1
+	case len(b) == 0:
+		return -1
+	}
+	for i := 0; i < len(a) && i < len(b); i++ {
+		na, errA := strconv.Atoi(a[i])
+		nb, errB := strconv.Atoi(b[i])
+		switch {
+		case errA == nil && errB == nil:
+			if na != nb {
+				if na > nb {
+					return 1
+				}
+				return -1
+			}
+		case errA == nil:
+			return -1
+		case errB == nil:
+			return 1
+		case a[i] != b[i]:
+			if a[i] > b[i] {
+				return 1
+			}
+			return -1
+		}
+	}
+	switch {
+	case len(a) > len(b):
+		return 1
+	case len(a) < len(b):
+		return -1
+	}
+	return 0
+}
+
+// newerVersion reports whether tag a is newer than b. A build without a
+// release tag (b unparsable) is older than any release.
+func newerVersion(a, b string) bool {
+	va, oka := parseSemver(a)
+	vb, okb := parseSemver(b)
+	switch {
+	case !oka:
+		return false
+	case !okb:
+		return true
+	}
+	for i := range va.core {
+		if va.core[i] != vb.core[i] {
+			return va.core[i] > vb.core[i]
+		}
+	}
+	return comparePre(va.pre, vb.pre) > 0
+}
+
+type selfUpdateInfo struct {
+	Current string
+	Channel string
+	Latest  selfRelease
+	Newer   []selfRelease // releases after Current, newest first (their notes form the changelog)
+}
+
+func checkSelfUpdate() (selfUpdateInfo, error) {
+	info := selfUpdateInfo{Current: SCRIPT_VERSION, Channel: updateChannel()}
+	rels, err := selfReleases(info.Channel)
+	if err != nil {
+		return info, err
+	}
+	info.Latest = rels[0]
+	for _, r := range rels {
+		if newerVersion(r.Tag, info.Current) {
+			info.Newer = append(info.Newer, r)
+		}
+	}
+	return info, nil
+}
+
+func (info selfUpdateInfo) available() bool { return len(info.Newer) > 0 }
+
+// changelog renders the notes of every newer release.
+func (info selfUpdateInfo) changelog() []string {
+	var out []string
+	for _, r := range info.Newer {
+		out = append(out, "== "+r.Tag+" ("+r.Published.Format("2006-01-02")+") ==")
+		body := strings.TrimSpace(strings.ReplaceAll(r.Body, "\r\n", "\n"))
+		if body == "" {
+			body = "(无更新说明)"
+		}
+		out = append(out, strings.Split(body, "\n")...)
+		out = append(out, "")
+	}
+	return out
+}
+
+// selfExecutable is the real path of the running binary.
+func selfExecutable() (string, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	return filepath.EvalSymlinks(exe)
+}
+
+// findSelfRelease resolves tag ("" for the newest on the channel; an
+// explicit tag may also name a prerelease).
+func findSelfRelease(tag string) (selfRelease, error) {
+	channel := UPDATE_PRERELEASE
+	if tag == "" {
+		channel = updateChannel()
+	}
+	rels, err := selfReleases(channel)
+	if err != nil {
+		return selfRelease{}, err
+	}
+	if tag == "" {
+		return rels[0], nil
+	}
+	for _, r := range rels {
+		if r.Tag == tag || r.Tag == "v"+tag {
+			return r, nil
+		}
+	}
+	return selfRelease{}, fmt.Errorf("未找到版本 %s", tag)
+}
+
+// applySelfUpdate replaces the running binary with rel's.
+func applySelfUpdate(rel selfRelease, insecure bool, log func(string)) (err error) {
+	defer func() { opAudit("self.update", SCRIPT_VERSION+" -> "+rel.Tag, nil, err) }()
+	exe, err := selfExecutable()
+	if err != nil {
+		return err
+	}
+	want, err := releaseAssetSHA256(rel.ghRelease, rel.Asset)
+	if err != nil {
+		return err
+	}
+	if want == "" && !insecure {
+		return fmt.Errorf("%s 未发布校验值，无法校验（确认来源可信后可用 --insecure 跳过）", rel.Tag)
+	}
+	// downloaded into the cache directory (where an interrupted download
+	// resumes and its .part files live), then copied next to the binary
+	cached := filepath.Join(DOWNLOAD_CACHE_DIR, rel.Asset.Name)
+	defer os.Remove(cached)
+	log("下载 " + rel.Asset.URL)
+	if err := download(rel.Asset.URL, cached, downloadOptions{Log: log}); err != nil {
+		return &downloadError{fmt.Errorf("下载失败: %w", err)}
+	}
+	got, err := fileSHA256(cached)
+	if err != nil {
+		return err
+	}
+	switch {
+	case want == "":
+		log("[警告] 已跳过校验，sha256: " + got)
+	case got != want:
+		return fmt.Errorf("校验失败: sha256 为 %s，发布值为 %s", got, want)
+	default:
+		log("sha256 校验通过: " + got)
+	}
+	tmp := exe + ".new" // same directory, so the final rename is atomic
+	defer os.Remove(tmp)
+	if err := copyExecutable(cached, tmp); err != nil {
+		return err
+	}
+	out, err := exec.Command(tmp, "version").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("新版本无法运行: %v %s", err, strings.TrimSpace(string(out)))
+	}
+	log("新版本: " + strings.TrimSpace(string(out)))
+	if err := copyExecutable(exe, exe+".prev"); err != nil {
+		return fmt.Errorf("备份当前版本失败: %w", err)
+	}
+	if err := os.Rename(tmp, exe); err != nil {
+		return err
+	}
+	log("已更新 " + exe + "（上一版本保留为 " + exe + ".prev）")
+	log("已在运行的 smartdnsctl 服务（内置代理、看门狗等）重启后才会使用新版本")
+	return nil
+}
+
+// rollbackSelf puts <exe>.prev back.
+func rollbackSelf(log func(string)) (err error) {
+	defer func() { opAudit("self.rollback", SCRIPT_VERSION, nil, err) }()
+	exe, err := selfExecutable()
+	if err != nil {
+		return err
+	}
+	if !fileExists(exe + ".prev") {
+		return errors.New("没有可回滚的上一版本")
+	}
+	if err := os.Rename(exe+".prev", exe); err != nil {
+		return err
+	}
+	out, _ := exec.Command(exe, "version").Output()
+	log("已回滚到 " + strings.TrimSpace(string(out)))
+	return nil
+}
+
+// reexecSelf replaces this process with the (updated) binary, same arguments.
+func reexecSelf() error {
+	exe, err := selfExecutable()
+	if err != nil {
+		return err
+	}
+	return syscall.Exec(exe, os.Args, os.Environ())
+}
+
+// runSelfUpdateCommand implements `smartdnsctl self-update`.
+func runSelfUpdateCommand(args []string) int {
+	fs := flag.NewFlagSet("self-update", flag.ContinueOnError)
+	check := fs.Bool("check", false, "只检查并显示更新说明")
+	channel := fs.String("channel", "", "设置更新通道: stable 或 prerelease")
+	version := fs.String("version", "", "更新到指定版本（默认通道中的最新版本）")
+	insecure := fs.Bool("insecure", false, "发布未提供校验值时仍然更新")
+	rollback := fs.Bool("rollback", false, "回滚到上一版本")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	logf := func(s string) { fmt.Println(s) }
+	if *rollback {
+		if err := rollbackSelf(logf); err != nil {
+			fmt.Fprintln(os.Stderr, "回滚失败:", err)
+			return 1
+		}
+		return 0
+	}
+	if *channel != "" {
+		if *channel != UPDATE_STABLE && *channel != UPDATE_PRERELEASE {
+			fmt.Fprintln(os.Stderr, "更新通道只能是 stable 或 prerelease")
+			return 2
+		}
+		if err := updateSettings(func(st *ctlSettings) { st.UpdateChannel = *channel }); err != nil {
+			fmt.Fprintln(os.Stderr, "保存设置失败:", err)
+			return 1
+		}
+	}
+	info, err := checkSelfUpdate()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Printf("当前版本: %s  通道: %s  最新: %s\n", info.Current, info.Channel, info.Latest.Tag)
+	for _, l := range info.changelog() {
+		fmt.Println(l)
+	}
+	if *check {
+		return 0
+	}
+	if *version == "" && !info.available() {
+		fmt.Println("已是最新版本")
+		return 0
+	}
+	rel, err := findSelfRelease(*version)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if err := applySelfUpdate(rel, *insecure, logf); err != nil {
+		fmt.Fprintln(os.Stderr, "更新失败:", err)
+		return 1
+	}
+	return 0
+}
@@ -2,14 +2,12 @@ package src
 
 import (
     "fmt"
-    "os"
     "os/exec"
-    "strings"
 )
 
 func manageService(service, action, desc string) error {
 	logCyan(fmt.Sprintf("正在%s %s 服务...", desc, service))
-	if err := runCmdInteractive("systemctl", action, service); err != nil {
+	if err := serviceAction(func(s string) { fmt.Println(s) }, action, service); err != nil {
 		logRed(fmt.Sprintf("%s %s失败，请检查系统日志。", service, desc))
 		return err
 	}
@@ -18,10 +16,8 @@ func manageService(service, action, desc string) error {
 }
 
 func checkServiceStatus(service, serviceName string) {
-	activeOut, _ := runCmdCapture("systemctl", "is-active", service)
-	enabledOut, _ := runCmdCapture("systemctl", "is-enabled", service)
-	isActive := strings.TrimSpace(activeOut) == "active"
-	isEnabled := strings.TrimSpace(enabledOut) == "enabled"
+	isActive := svc().Status(service)
+	isEnabled := svc().Enabled(service)
 	fmt.Printf("%s%s 服务状态：%s\n", CYAN, serviceName, RESET)
 	if isActive {
 		fmt.Printf("  运行状态: %s运行中%s\n", GREEN, RESET)
@@ -50,8 +46,11 @@ func checkSystemDNSStatus() { checkServiceStatus("systemd-resolved", "系统 DNS
 
 func restoreSystemDNS() {
 	stopService("smartdns")
-	restoreService("systemd-resolved")
-	logGreen("系统 DNS 服务已启动并设置为开机启动。")
+	if err := restoreSystemResolver(func(s string) { fmt.Println(s) }); err != nil {
+		logRed("恢复系统 DNS 失败: " + err.Error())
+		return
+	}
+	logGreen("系统 DNS 已恢复为原始配置。")
 }
 // (sniproxy 已弃用)
 
@@ -61,9 +60,14 @@ func startSmartDNS() {
     restoreService("smartdns")
     logGreen("SmartDNS 服务已启动并设置为开机启动（未修改系统 DNS）。")
 }
+// stopSystemDNS frees port 53 for smartdns; systemd-resolved keeps running
+// with its stub listener turned off.
 func stopSystemDNS() {
-	stopService("systemd-resolved")
-	logGreen("系统 DNS 服务已停止并关闭开机自启。")
+	if err := releasePort53(func(s string) { fmt.Println(s) }); err != nil {
+		logRed("释放 53 端口失败: " + err.Error())
+		return
+	}
+	logGreen("已关闭 systemd-resolved 的 53 端口监听。")
 }
 func stopSmartDNS() {
 	stopService("smartdns")
@@ -77,19 +81,19 @@ func restartSmartDNS()              { restartService("smartdns") }
 
 // (sniproxy 已弃用)
 
-// emergencyResetDNS stops smartdns and systemd-resolved, then writes resolv.conf to 8.8.8.8
+// emergencyResetDNS stops smartdns and writes resolv.conf to 8.8.8.8 directly,
+// whatever manages it. The original state is recorded so it can be restored.
 // This helps recover networking when DNS is misconfigured.
 func emergencyResetDNS() {
 	stopService("smartdns")
-	stopService("systemd-resolved")
 	modifyResolv("8.8.8.8")
-	logGreen("已将系统 DNS 紧急重置为 8.8.8.8（已停止 smartdns 与 systemd-resolved）")
+	logGreen("已将系统 DNS 紧急重置为 8.8.8.8（已停止 smartdns）")
 }
 
+// modifyResolv points /etc/resolv.conf at ip, keeping search/options lines.
 func modifyResolv(ip string) {
-	content := fmt.Sprintf("nameserver %s\n", ip)
-	if err := os.WriteFile("/etc/resolv.conf", []byte(content), 0o644); err != nil {
-		logRed("修改 /etc/resolv.conf 失败，请检查文件权限。")
+	if err := forceResolvConf(ip, func(s string) { fmt.Println(s) }); err != nil {
+		logRed("修改 /etc/resolv.conf 失败: " + err.Error())
 		return
 	}
 	logGreen("/etc/resolv.conf 已成功修改为 nameserver " + ip)
@@ -0,0 +1,882 @@
+package src
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	INIT_SYSTEMD    = "systemd"
+	INIT_OPENRC     = "openrc"
+	INIT_SYSVINIT   = "sysvinit"
+	INIT_SUPERVISED = "supervised"
+)
+
+// ServiceManager drives the host's init system. All service handling in the tool goes
+// through svc(), so the same flows work under systemd, OpenRC, sysvinit, or in a container
+// without any init where smartdnsctl supervises the processes itself.
+type ServiceManager interface {
+	Name() string
+	Status(name string) bool  // running (or, for one-shot services, applied)
+	Enabled(name string) bool // started at boot
+	Start(name string, log func(string)) error
+	Stop(name string, log func(string)) error
+	Restart(name string, log func(string)) error
+	Reload(name string, log func(string)) error
+	Enable(name string, log func(string)) error
+	Disable(name string, log func(string)) error
+	// Installed reports whether the init system knows the service.
+	Installed(name string) bool
+	// Install writes or refreshes the definition of a service smartdnsctl runs itself.
+	Install(spec serviceSpec, log func(string)) error
+	// Remove stops, disables and deletes a definition written by Install.
+	Remove(name string, log func(string)) error
+}
+
+// serviceSpec describes a service smartdnsctl generates (proxy, chain, QUIC, quota...).
+type serviceSpec struct {
+	Name        string        `json:"name"`
+	Description string        `json:"description"`
+	Command     []string      `json:"command"`                // argv, runs in the foreground
+	StopCommand []string      `json:"stop_command,omitempty"` // one-shot only: undo Command
+	Oneshot     bool          `json:"oneshot,omitempty"`      // runs once at start and stays applied
+	Every       time.Duration `json:"every,omitempty"`        // periodic job instead of a daemon
+	Enabled     bool          `json:"enabled,omitempty"`      // supervised manager only
+}
+
+// selfServiceSpec runs this binary with args.
+func selfServiceSpec(name, desc string, args ...string) (serviceSpec, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return serviceSpec{}, err
+	}
+	return serviceSpec{Name: name, Description: desc, Command: append([]string{exe}, args...)}, nil
+}
+
+// daemonCommand turns a periodic spec into a long-running command for init systems
+// without timers (`smartdnsctl every <秒> ...`).
+func (sp serviceSpec) daemonCommand() []string {
+	if sp.Every <= 0 || len(sp.Command) == 0 {
+		return sp.Command
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		exe = "smartdnsctl"
+	}
+	return append([]string{exe, "every", strconv.Itoa(int(sp.Every.Seconds())), "--"}, sp.Command...)
+}
+
+var (
+	svcOnce sync.Once
+	svcMgr  ServiceManager
+)
+
+// svc returns the service manager detected for this host (see detectServiceManager).
+func svc() ServiceManager {
+	svcOnce.Do(func() { svcMgr = auditedManager{detectServiceManager()} })
+	return svcMgr
+}
+
+// detectServiceManager picks the init system: an explicit init_system setting wins, then
+// whichever init is actually running as PID 1; without one the tool supervises itself.
+func detectServiceManager() ServiceManager {
+	switch loadSettings().InitSystem {
+	case INIT_SYSTEMD:
+		return systemdManager{}
+	case INIT_OPENRC:
+		return openrcManager{}
+	case INIT_SYSVINIT:
+		return sysvinitManager{}
+	case INIT_SUPERVISED:
+		return supervisedManager{}
+	}
+	if _, err := exec.LookPath("systemctl"); err == nil && fileExists("/run/systemd/system") {
+		return systemdManager{}
+	}
+	if _, err := exec.LookPath("rc-service"); err == nil && fileExists("/run/openrc") {
+		return openrcManager{}
+	}
+	if comm, err := os.ReadFile("/proc/1/comm"); err == nil && strings.TrimSpace(string(comm)) == "init" && fileExists("/etc/inittab") {
+		return sysvinitManager{}
+	}
+	return supervisedManager{}
+}
+
+// svcRun runs an init command and folds the output tail into the error.
+func svcRun(log func(string), name string, args ...string) error {
+	if log == nil {
+		log = func(string) {}
+	}
+	out, err := runCmdPipeTail(log, 5, name, args...)
+	if err != nil {
+		if out = strings.TrimSpace(out); out != "" {
+			return fmt.Errorf("%w\n%s", err, out)
+		}
+		return err
+	}
+	return nil
+}
+
+func svcSucceeds(name string, args ...string) bool {
+	return exec.Command(name, args...).Run() == nil
+}
+
+func shellQuote(args []string) string {
+	out := make([]string, len(args))
+	for i, a := range args {
+		if a != "" && strings.IndexFunc(a, func(r rune) bool {
+			return !(r == '/' || r == '-' || r == '_' || r == '.' || r == ':' || r == '=' || r == ',' ||
+				(r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9'))
+		}) < 0 {
+			out[i] = a
+			continue
+		}
+		out[i] = "'" + strings.ReplaceAll(a, "'", `'\''`) + "'"
+	}
+	return strings.Join(out, " ")
+}
+
+// ----- systemd -----
+
+type systemdManager struct{}
+
+func (systemdManager) Name() string { return INIT_SYSTEMD }
+
+const systemdUnitDir = "/etc/systemd/system"
+
+// unit addresses the timer of periodic services generated by Install.
+func (systemdManager) unit(name string) string {
+	if fileExists(filepath.Join(systemdUnitDir, name+".timer")) {
+		return name + ".timer"
+	}
+	return name
+}
+
+func (m systemdManager) Status(name string) bool {
+	out, _ := runCmdCapture("systemctl", "is-active", m.unit(name))
+	return strings.TrimSpace(out) == "active"
+}
+
+func (m systemdManager) Enabled(name string) bool {
+	out, _ := runCmdCapture("systemctl", "is-enabled", m.unit(name))
+	return strings.TrimSpace(out) == "enabled"
+}
+
+func (m systemdManager) Start(name string, log func(string)) error {
+	return svcRun(log, "systemctl", "start", m.unit(name))
+}
+
+func (m systemdManager) Stop(name string, log func(string)) error {
+	return svcRun(log, "systemctl", "stop", m.unit(name))
+}
+
+func (m systemdManager) Restart(name string, log func(string)) error {
+	return svcRun(log, "systemctl", "restart", m.unit(name))
+}
+
+func (m systemdManager) Reload(name string, log func(string)) error {
+	return svcRun(log, "systemctl", "reload", m.unit(name))
+}
+
+func (m systemdManager) Enable(name string, log func(string)) error {
+	return svcRun(log, "systemctl", "enable", m.unit(name))
+}
+
+func (m systemdManager) Disable(name string, log func(string)) error {
+	return svcRun(log, "systemctl", "disable", m.unit(name))
+}
+
+func (systemdManager) Installed(name string) bool {
+	for _, dir := range []string{systemdUnitDir, "/run/systemd/system", "/lib/systemd/system", "/usr/lib/systemd/system"} {
+		if fileExists(filepath.Join(dir, name+".service")) {
+			return true
+		}
+	}
+	return false
+}
+
+func (systemdManager) Install(sp serviceSpec, log func(string)) error {
+	if log == nil {
+		log = func(string) {}
+	}
+	service := []string{
+		"# Generated by smartdnsctl: " + sp.Description,
+		"[Unit]",
+		"Description=smartdnsctl " + sp.Description,
+		"After=network-online.target",
+		"Wants=network-online.target",
+		"",
+		"[Service]",
+	}
+	switch {
+	case sp.Oneshot:
+		service = append(service, "Type=oneshot", "RemainAfterExit=yes", "ExecStart="+shellQuote(sp.Command))
+		if len(sp.StopCommand) > 0 {
+			service = append(service, "ExecStop="+shellQuote(sp.StopCommand))
+		}
+	case sp.Every > 0:
+		service = append(service, "Type=oneshot", "ExecStart="+shellQuote(sp.Command))
+	default:
+		service = append(service,
+			"ExecStart="+shellQuote(sp.Command),
+			"Restart=on-failure",
+			"RestartSec=2",
+			"AmbientCapabilities=CAP_NET_BIND_SERVICE",
+			"LimitNOFILE=65535",
+		)
+	}
+	service = append(service, "WorkingDirectory="+getScriptDir())
+	if sp.Every <= 0 {
+		service = append(service, "", "[Install]", "WantedBy=multi-user.target")
+	}
+	path := filepath.Join(systemdUnitDir, sp.Name+".service")
+	if err := writeFileIfChanged(path, strings.Join(append(service, ""), "\n"), 0o644); err != nil {
+		return fmt.Errorf("写入服务文件失败: %w", err)
+	}
+	log("已写入 " + path)
+	if sp.Every > 0 {
+		secs := strconv.Itoa(int(sp.Every.Seconds()))
+		timer := strings.Join([]string{
+			"# Generated by smartdnsctl",
+			"[Unit]",
+			"Description=smartdnsctl " + sp.Description + " timer",
+			"",
+			"[Timer]",
+			"OnBootSec=" + secs + "s",
+			"OnUnitActiveSec=" + secs + "s",
+			"",
+			"[Install]",
+			"WantedBy=timers.target",
+			"",
+		}, "\n")
+		tpath := filepath.Join(systemdUnitDir, sp.Name+".timer")
+		if err := writeFileIfChanged(tpath, timer, 0o644); err != nil {
+			return fmt.Errorf("写入定时器失败: %w", err)
+		}
+		log("已写入 " + tpath)
+	}
+	return svcRun(log, "systemctl", "daemon-reload")
+}
+
+func (m systemdManager) Remove(name string, log func(string)) error {
+	_ = svcRun(log, "systemctl", "disable", "--now", m.unit(name))
+	_ = removeIfExists(filepath.Join(systemdUnitDir, name+".timer"))
+	_ = removeIfExists(filepath.Join(systemdUnitDir, name+".service"))
+	return svcRun(log, "systemctl", "daemon-reload")
+}
+
+// ----- OpenRC -----
+
+type openrcManager struct{}
+
+func (openrcManager) Name() string { return INIT_OPENRC }
+
+func (openrcManager) Status(name string) bool { return svcSucceeds("rc-service", name, "status") }
+
+func (openrcManager) Enabled(name string) bool {
+	out, _ := runCmdCapture("rc-update", "show", "default")
+	for _, line := range strings.Split(out, "\n") {
+		if f := strings.Fields(line); len(f) > 0 && f[0] == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (openrcManager) Start(name string, log func(string)) error {
+	return svcRun(log, "rc-service", name, "start")
+}
+
+func (openrcManager) Stop(name string, log func(string)) error {
+	return svcRun(log, "rc-service", name, "stop")
+}
+
+func (openrcManager) Restart(name string, log func(string)) error {
+	return svcRun(log, "rc-service", name, "restart")
+}
+
+func (openrcManager) Reload(name string, log func(string)) error {
+	return svcRun(log, "rc-service", name, "reload")
+}
+
+func (openrcManager) Enable(name string, log func(string)) error {
+	return svcRun(log, "rc-update", "add", name, "default")
+}
+
+func (openrcManager) Disable(name string, log func(string)) error {
+	return svcRun(log, "rc-update", "del", name, "default")
+}
+
+func (openrcManager) Installed(name string) bool { return fileExists("/etc/init.d/" + name) }
+
+func (openrcManager) Install(sp serviceSpec, log func(string)) error {
+	if log == nil {
+		log = func(string) {}
+	}
+	lines := []string{
+		"#!/sbin/openrc-run",
+		"# Generated by smartdnsctl: " + sp.Description,
+		`description="smartdnsctl ` + sp.Description + `"`,
+	}
+	if sp.Oneshot {
+		lines = append(lines,
+			"start() {",
+			`    ebegin "Starting ${RC_SVCNAME}"`,
+			"    cd "+shellQuote([]string{getScriptDir()})+" && "+shellQuote(sp.Command),
+			"    eend $?",
+			"}",
+		)
+		if len(sp.StopCommand) > 0 {
+			lines = append(lines,
+				"stop() {",
+				`    ebegin "Stopping ${RC_SVCNAME}"`,
+				"    "+shellQuote(sp.StopCommand),
+				"    eend $?",
+				"}",
+			)
+		}
+	} else {
+		cmd := sp.daemonCommand()
+		lines = append(lines,
+			"supervisor=supervise-daemon",
+			"command="+shellQuote(cmd[:1]),
+			"command_args="+shellQuote([]string{shellQuote(cmd[1:])}),
+			"directory="+shellQuote([]string{getScriptDir()}),
+			"respawn_delay=2",
+			"output_log=/var/log/smartdnsctl/"+sp.Name+".log",
+			"error_log=/var/log/smartdnsctl/"+sp.Name+".log",
+		)
+	}
+	lines = append(lines, "depend() {", "    need net", "}", "")
+	_ = ensureDir(TRAFFIC_LOG_DIR)
+	path := "/etc/init.d/" + sp.Name
+	if err := writeFileIfChanged(path, strings.Join(lines, "\n"), 0o755); err != nil {
+		return fmt.Errorf("写入服务脚本失败: %w", err)
+	}
+	log("已写入 " + path)
+	return os.Chmod(path, 0o755)
+}
+
+func (m openrcManager) Remove(name string, log func(string)) error {
+	_ = m.Stop(name, log)
+	_ = m.Disable(name, log)
+	return removeIfExists("/etc/init.d/" + name)
+}
+
+// ----- sysvinit -----
+
+type sysvinitManager struct{}
+
+func (sysvinitManager) Name() string { return INIT_SYSVINIT }
+
+func (sysvinitManager) script(name string) string { return "/etc/init.d/" + name }
+
+func (m sysvinitManager) Status(name string) bool {
+	return fileExists(m.script(name)) && svcSucceeds(m.script(name), "status")
+}
+
+func (sysvinitManager) Enabled(name string) bool {
+	for _, lvl := range []string{"2", "3", "4", "5"} {
+		if matches, _ := filepath.Glob("/etc/rc" + lvl + ".d/S*" + name); len(matches) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (m sysvinitManager) Start(name string, log func(string)) error {
+	return svcRun(log, m.script(name), "start")
+}
+
+func (m sysvinitManager) Stop(name string, log func(string)) error {
+	return svcRun(log, m.script(name), "stop")
+}
+
+func (m sysvinitManager) Restart(name string, log func(string)) error {
+	return svcRun(log, m.script(name), "restart")
+}
+
+func (m sysvinitManager) Reload(name string, log func(string)) error {
+	return svcRun(log, m.script(name), "reload")
+}
+
+func (sysvinitManager) Enable(name string, log func(string)) error {
+	if _, err := exec.LookPath("update-rc.d"); err == nil {
+		return svcRun(log, "update-rc.d", name, "defaults")
+	}
+	return svcRun(log, "chkconfig", name, "on")
+}
+
+func (sysvinitManager) Disable(name string, log func(string)) error {
+	if _, err := exec.LookPath("update-rc.d"); err == nil {
+		return svcRun(log, "update-rc.d", "-f", name, "remove")
+	}
+	return svcRun(log, "chkconfig", name, "off")
+}
+
+func (m sysvinitManager) Installed(name string) bool { return fileExists(m.script(name)) }
+
+func (m sysvinitManager) Install(sp serviceSpec, log func(string)) error {
+	if log == nil {
+		log = func(string) {}
+	}
+	pid := "/run/" + sp.Name + ".pid"
+	logFile := "/var/log/smartdnsctl/" + sp.Name + ".log"
+	lines := []string{
+		"#!/bin/sh",
+		"### BEGIN INIT INFO",
+		"# Provides:          " + sp.Name,
+		"# Required-Start:    $network $remote_fs",
+		"# Required-Stop:     $network $remote_fs",
+		"# Default-Start:     2 3 4 5",
+		"# Default-Stop:      0 1 6",
+		"# Short-Description: smartdnsctl " + sp.Description,
+		"### END INIT INFO",
+		"# Generated by smartdnsctl",
+		"cd " + shellQuote([]string{getScriptDir()}) + " || exit 1",
+		"case \"$1\" in",
+	}
+	if sp.Oneshot {
+		done := "/run/" + sp.Name + ".done"
+		lines = append(lines,
+			"start)",
+			"    "+shellQuote(sp.Command)+" && touch "+done,
+			"    ;;",
+			"stop)",
+			"    rm -f "+done,
+		)
+		if len(sp.StopCommand) > 0 {
+			lines = append(lines, "    "+shellQuote(sp.StopCommand))
+		}
+		lines = append(lines,
+			"    ;;",
+			"restart|reload)",
+			"    \"$0\" stop; \"$0\" start",
+			"    ;;",
+			"status)",
+			"    [ -f "+done+" ]",
+			"    ;;",
+		)
+	} else {
+		lines = append(lines,
+			"start)",
+			"    if [ -f "+pid+" ] && kill -0 \"$(cat "+pid+")\" 2>/dev/null; then exit 0; fi",
+			"    nohup "+shellQuote(sp.daemonCommand())+" >>"+logFile+" 2>&1 &",
+			"    echo $! >"+pid,
+			"    ;;",
+			"stop)",
+			"    [ -f "+pid+" ] && kill \"$(cat "+pid+")\" 2>/dev/null",
+			"    rm -f "+pid,
+			"    ;;",
+			"restart|reload)",
+			"    \"$0\" stop; sleep 1; \"$0\" start",
+			"    ;;",
+			"status)",
+			"    [ -f "+pid+" ] && kill -0 \"$(cat "+pid+")\" 2>/dev/null",
+			"    ;;",
+		)
+	}
+	lines = append(lines,
+		"*)",
+		"    echo \"Usage: $0 {start|stop|restart|reload|status}\"",
+		"    exit 2",
+		"    ;;",
+		"esac",
+		"",
+	)
+	_ = ensureDir(TRAFFIC_LOG_DIR)
+	if err := writeFileIfChanged(m.script(sp.Name), strings.Join(lines, "\n"), 0o755); err != nil {
+		return fmt.Errorf("写入服务脚本失败: %w", err)
+	}
+	log("已写入 " + m.script(sp.Name))
+	return os.Chmod(m.script(sp.Name), 0o755)
+}
+
+func (m sysvinitManager) Remove(name string, log func(string)) error {
+	_ = m.Stop(name, log)
+	_ = m.Disable(name, log)
+	return removeIfExists(m.script(name))
+}
+
+// ----- supervised (no init system) -----
+
+// supervisedManager runs services as children of `smartdnsctl supervise <name>` processes,
+// which restart them on failure. `smartdnsctl supervise` with no name is meant as a
+// container entrypoint: it starts every enabled service and reaps orphans.
+type supervisedManager struct{}
+
+func (supervisedManager) Name() string { return INIT_SUPERVISED }
+
+// knownSupervisedSpecs are the third-party daemons the tool manages, in foreground form.
+func knownSupervisedSpecs() map[string]serviceSpec {
+	return map[string]serviceSpec{
+		"smartdns": {Name: "smartdns", Description: "SmartDNS", Command: []string{"smartdns", "-f", "-c", SMART_CONFIG_FILE}},
+		"nginx":    {Name: "nginx", Description: "nginx", Command: []string{"nginx", "-g", "daemon off;"}},
+	}
+}
+
+func supervisedSpecPath(name string) string { return filepath.Join(SUPERVISE_DIR, name+".json") }
+func supervisedPidPath(name string) string  { return filepath.Join(SUPERVISE_RUN_DIR, name+".pid") }
+func supervisedDonePath(name string) string { return filepath.Join(SUPERVISE_RUN_DIR, name+".done") }
+
+func loadSupervisedSpec(name string) (serviceSpec, bool) {
+	var sp serviceSpec
+	if b, err := os.ReadFile(supervisedSpecPath(name)); err == nil && json.Unmarshal(b, &sp) == nil {
+		return sp, true
+	}
+	if sp, ok := knownSupervisedSpecs()[name]; ok {
+		if _, err := exec.LookPath(sp.Command[0]); err == nil {
+			return sp, true
+		}
+	}
+	return serviceSpec{}, false
+}
+
+func saveSupervisedSpec(sp serviceSpec) error {
+	if err := ensureDir(SUPERVISE_DIR); err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(sp, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(supervisedSpecPath(sp.Name), append(b, '\n'), 0o644)
+}
+
+func supervisedPid(name string) int {
+	b, err := os.ReadFile(supervisedPidPath(name))
+	if err != nil {
+		return 0
+	}
+	pid, _ := strconv.Atoi(strings.TrimSpace(string(b)))
+	if pid <= 0 || syscall.Kill(pid, 0) != nil {
+		return 0
+	}
+	return pid
+}
+
+func (supervisedManager) Status(name string) bool {
+	if sp, ok := loadSupervisedSpec(name); ok && sp.Oneshot {
+		return fileExists(supervisedDonePath(name))
+	}
+	return supervisedPid(name) > 0
+}
+
+func (supervisedManager) Enabled(name string) bool {
+	sp, ok := loadSupervisedSpec(name)
+	return ok && sp.Enabled
+}
+
+func (supervisedManager) Start(name string, log func(string)) error {
+	if log == nil {
+		log = func(string) {}
+	}
+	sp, ok := loadSupervisedSpec(name)
+	if !ok {
+		return fmt.Errorf("未找到服务: %s", name)
+	}
+	if err := ensureDir(SUPERVISE_RUN_DIR); err != nil {
+		return err
+	}
+	if sp.Oneshot {
+		if err := svcRun(log, sp.Command[0], sp.Command[1:]...); err != nil {
+			return err
+		}
+		return os.WriteFile(supervisedDonePath(name), nil, 0o644)
+	}
+	if supervisedPid(name) > 0 {
+		return nil
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if err := ensureDir(TRAFFIC_LOG_DIR); err != nil {
+		return err
+	}
+	out, err := os.OpenFile(filepath.Join(TRAFFIC_LOG_DIR, name+".log"), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o640)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	cmd := exec.Command(exe, "supervise", name)
+	cmd.Dir = getScriptDir()
+	cmd.Stdout, cmd.Stderr = out, out
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	pid := cmd.Process.Pid
+	_ = cmd.Process.Release()
+	log(fmt.Sprintf("已启动 %s (supervisor pid %d)", name, pid))
+	return nil
+}
+
+func (supervisedManager) Stop(name string, log func(string)) error {
+	if log == nil {
+		log = func(string) {}
+	}
+	if sp, ok := loadSupervisedSpec(name); ok && sp.Oneshot {
+		_ = os.Remove(supervisedDonePath(name))
+		if len(sp.StopCommand) > 0 {
+			return svcRun(log, sp.StopCommand[0], sp.StopCommand[1:]...)
+		}
+		return nil
+	}
+	pid := supervisedPid(name)
+	if pid == 0 {
+		return nil
+	}
+	_ = syscall.Kill(pid, syscall.SIGTERM)
+	for i := 0; i < 50 && syscall.Kill(pid, 0) == nil; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if syscall.Kill(pid, 0) == nil {
+		_ = syscall.Kill(pid, syscall.SIGKILL)
+	}
+	_ = os.Remove(supervisedPidPath(name))
+	log("已停止 " + name)
+	return nil
+}
+
+func (m supervisedManager) Restart(name string, log func(string)) error {
+	if err := m.Stop(name, log); err != nil {
+		return err
+	}
+	return m.Start(name, log)
+}
+
+// Reload sends SIGHUP through the supervisor; nginx reloads on it, other daemons restart.
+func (m supervisedManager) Reload(name string, log func(string)) error {
+	pid := supervisedPid(name)
+	if pid == 0 {
+		return fmt.Errorf("%s 未运行", name)
+	}
+	return syscall.Kill(pid, syscall.SIGHUP)
+}
+
+func (supervisedManager) setEnabled(name string, on bool) error {
+	sp, ok := loadSupervisedSpec(name)
+	if !ok {
+		return fmt.Errorf("未找到服务: %s", name)
+	}
+	sp.Enabled = on
+	return saveSupervisedSpec(sp)
+}
+
+func (m supervisedManager) Enable(name string, log func(string)) error {
+	return m.setEnabled(name, true)
+}
+
+func (m supervisedManager) Disable(name string, log func(string)) error {
+	if !fileExists(supervisedSpecPath(name)) {
+		if _, known := knownSupervisedSpecs()[name]; !known {
+			return nil
+		}
+	}
+	return m.setEnabled(name, false)
+}
+
+func (supervisedManager) Installed(name string) bool {
+	_, ok := loadSupervisedSpec(name)
+	return ok
+}
+
+func (supervisedManager) Install(sp serviceSpec, log func(string)) error {
+	if log == nil {
+		log = func(string) {}
+	}
+	if old, ok := loadSupervisedSpec(sp.Name); ok {
+		sp.Enabled = old.Enabled
+	}
+	if err := saveSupervisedSpec(sp); err != nil {
+		return fmt.Errorf("写入服务定义失败: %w", err)
+	}
+	log("已写入 " + supervisedSpecPath(sp.Name))
+	return nil
+}
+
+func (m supervisedManager) Remove(name string, log func(string)) error {
+	_ = m.Stop(name, log)
+	return removeIfExists(supervisedSpecPath(name))
+}
+
+// runSuperviseCommand implements `smartdnsctl supervise [name]`.
+func runSuperviseCommand(args []string) int {
+	if len(args) == 0 {
+		return superviseAll()
+	}
+	sp, ok := loadSupervisedSpec(args[0])
+	if !ok {
+		fmt.Fprintln(os.Stderr, "未找到服务:", args[0])
+		return 2
+	}
+	if err := superviseOne(sp); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// superviseOne keeps one service running until SIGTERM, restarting it two seconds
+// after every exit. SIGHUP is forwarded to the child.
+func superviseOne(sp serviceSpec) error {
+	if err := ensureDir(SUPERVISE_RUN_DIR); err != nil {
+		return err
+	}
+	if err := os.WriteFile(supervisedPidPath(sp.Name), []byte(strconv.Itoa(os.Getpid())), 0o644); err != nil {
+		return err
+	}
+	defer os.Remove(supervisedPidPath(sp.Name))
+	sigs := make(chan os.Signal, 4)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+	command := sp.daemonCommand()
+	for {
+		cmd := exec.Command(command[0], command[1:]...)
+		cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+		if err := cmd.Start(); err != nil {
+			fmt.Fprintf(os.Stderr, "supervise %s: %v\n", sp.Name, err)
+		} else {
+			done := make(chan error, 1)
+			go func() { done <- cmd.Wait() }()
+		wait:
+			for {
+				select {
+				case err := <-done:
+					fmt.Fprintf(os.Stderr, "supervise %s: exited: %v\n", sp.Name, err)
+					break wait
+				case sig := <-sigs:
+					if sig == syscall.SIGHUP {
+						_ = cmd.Process.Signal(syscall.SIGHUP)
+						continue
+					}
+					_ = cmd.Process.Signal(syscall.SIGTERM)
+					select {
+					case <-done:
+					case <-time.After(5 * time.Second):
+						_ = cmd.Process.Kill()
+						<-done
+					}
+					return nil
+				}
+			}
+		}
+		select {
+		case sig := <-sigs:
+			if sig != syscall.SIGHUP {
+				return nil
+			}
+		case <-time.After(2 * time.Second):
+		}
+	}
+}
+
+// superviseAll starts every enabled service and then reaps orphaned children, which is
+// what PID 1 has to do in a container.
+func superviseAll() int {
+	entries, _ := os.ReadDir(SUPERVISE_DIR)
+	var names []string
+	for _, e := range entries {
+		if name, ok := strings.CutSuffix(e.Name(), ".json"); ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	m := supervisedManager{}
+	log := func(s string) { fmt.Println(s) }
+	for _, name := range names {
+		if m.Enabled(name) {
+			if err := m.Start(name, log); err != nil {
+				fmt.Fprintf(os.Stderr, "启动 %s 失败: %v\n", name, err)
+			}
+		}
+	}
+	sigs := make(chan os.Signal, 4)
+	signal.Notify(sigs, syscall.SIGCHLD, syscall.SIGTERM, syscall.SIGINT)
+	for sig := range sigs {
+		if sig == syscall.SIGCHLD {
+			for {
+				pid, err := syscall.Wait4(-1, nil, syscall.WNOHANG, nil)
+				if pid <= 0 || errors.Is(err, syscall.ECHILD) {
+					break
+				}
+			}
+			continue
+		}
+		for _, name := range names {
+			_ = m.Stop(name, nil)
+		}
+		return 0
+	}
+	return 0
+}
+
+// runEveryCommand implements `smartdnsctl every <秒> -- <命令...>`, the periodic-job
+// daemon used where the init system has no timers.
+func runEveryCommand(args []string) int {
+	if len(args) < 2 {
+		fmt.Fprintln(os.Stderr, "用法: smartdnsctl every <秒> -- <命令...>")
+		return 2
+	}
+	secs, err := strconv.Atoi(args[0])
+	if err != nil || secs <= 0 {
+		fmt.Fprintln(os.Stderr, "间隔需为正整数秒")
+		return 2
+	}
+	command := args[1:]
+	if command[0] == "--" {
+		command = command[1:]
+	}
+	if len(command) == 0 {
+		return 2
+	}
+	for {
+		cmd := exec.Command(command[0], command[1:]...)
+		cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+		if err := cmd.Run(); err != nil {
+			fmt.Fprintf(os.Stderr, "every: %v\n", err)
+		}
+		time.Sleep(time.Duration(secs) * time.Second)
+	}
+}
+
+// serviceAction runs a named action (start, stop, restart, reload, enable, disable)
+// through the detected service manager.
+func serviceAction(log func(string), action, name string) error {
+	m := svc()
+	if name == "smartdns" {
+		// a deliberate stop must not look like a crash to the watchdog
+		switch action {
+		case "stop":
+			pauseWatchdog("smartdns 已手动停止", 0)
+		case "start", "restart":
+			resumeWatchdog()
+		}
+	}
+	switch action {
+	case "start":
+		return m.Start(name, log)
+	case "stop":
+		return m.Stop(name, log)
+	case "restart":
+		return m.Restart(name, log)
+	case "reload":
+		return m.Reload(name, log)
+	case "enable":
+		return m.Enable(name, log)
+	case "disable":
+		return m.Disable(name, log)
+	}
+	return fmt.Errorf("未知服务操作: %s", action)
+}
@@ -0,0 +1,78 @@
+package src
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+)
+
+// ctlSettings holds smartdnsctl's own preferences. smartdns options stay in smartdns.conf.
+type ctlSettings struct {
+	// ProxyBackend selects who serves 80/443 on an unlock node: "nginx" (default) or "builtin".
+	ProxyBackend string `json:"proxy_backend,omitempty"`
+	// NginxAllowList makes the generated nginx config refuse hosts outside the allow-list as the
+	// built-in proxy does; off by default so nginx keeps passing every SNI / Host through.
+	NginxAllowList bool `json:"nginx_allow_list,omitempty"`
+	// Egress binds a platform's (StreamConfig sub) outbound connections to a local address.
+	Egress map[string]string `json:"egress,omitempty"`
+	// Outbounds routes a platform through another hop (SOCKS5 / HTTP CONNECT) instead of direct.
+	Outbounds map[string]outboundRoute `json:"outbounds,omitempty"`
+	// QUICPolicy decides what happens to UDP 443 on this node: "", "reject" or "proxy".
+	QUICPolicy string `json:"quic_policy,omitempty"`
+	// ClientLimit applies to every client IP; PlatformLimits to all clients of one platform.
+	ClientLimit    trafficLimit            `json:"client_limit,omitempty"`
+	PlatformLimits map[string]trafficLimit `json:"platform_limits,omitempty"`
+	// InitSystem forces a service manager (systemd / openrc / sysvinit / supervised); empty auto-detects.
+	InitSystem string `json:"init_system,omitempty"`
+	// QuotaResets holds the month usage at the last manual reset, keyed by quotaKey.
+	QuotaResets map[string]quotaBaseline `json:"quota_resets,omitempty"`
+	// Watchdog configures the smartdns health check service.
+	Watchdog watchdogConfig `json:"watchdog,omitempty"`
+	// LogLevel is the lowest level written to OPLOG_FILE (debug / info / warn / error); audit entries are always kept.
+	LogLevel string `json:"log_level,omitempty"`
+	// ReleaseAPI replaces https://api.github.com for release listings (a mirror serving the same API).
+	ReleaseAPI string `json:"release_api,omitempty"`
+	// UpdateChannel selects which smartdnsctl releases self-update follows: "stable" (default) or "prerelease".
+	UpdateChannel string `json:"update_channel,omitempty"`
+	// DownloadProxy carries downloads (StreamConfig, releases, self-update); direct falls back to *_PROXY variables.
+	DownloadProxy outboundRoute `json:"download_proxy,omitempty"`
+	// DownloadMirrors are tried in order for GitHub URLs: ghproxy-style prefixes or templates with {url}/{host}/{path}; "direct" places the original URL.
+	DownloadMirrors []string `json:"download_mirrors,omitempty"`
+}
+
+// loadSettings reads SETTINGS_FILE; a missing or broken file yields defaults.
+func loadSettings() ctlSettings {
+	var st ctlSettings
+	if b, err := os.ReadFile(SETTINGS_FILE); err == nil {
+		_ = json.Unmarshal(b, &st)
+	}
+	if st.ProxyBackend != PROXY_BACKEND_BUILTIN {
+		st.ProxyBackend = PROXY_BACKEND_NGINX
+	}
+	return st
+}
+
+// saveSettings writes SETTINGS_FILE atomically (tmp file + rename).
+func saveSettings(st ctlSettings) error {
+	b, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ensureDir(filepath.Dir(SETTINGS_FILE)); err != nil {
+		return err
+	}
+	return auditChange("settings.save", "", []string{SETTINGS_FILE}, func() error {
+		tmp := SETTINGS_FILE + ".tmp"
+		if err := os.WriteFile(tmp, append(b, '\n'), 0o600); err != nil {
+			return err
+		}
+		return os.Rename(tmp, SETTINGS_FILE)
+	})
+}
+
+// updateSettings loads, mutates and saves settings in one step.
+func updateSettings(mutate func(st *ctlSettings)) error {
+	st := loadSettings()
+	mutate(&st)
+	return saveSettings(st)
+}
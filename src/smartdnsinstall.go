@@ -0,0 +1,338 @@
+package src
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+)
+
+// Native SmartDNS install. The binary from a release tarball is placed at
+// SMARTDNS_BIN, the service definition comes from the service manager (the
+// same one every other service uses) and everything written is recorded in
+// SMARTDNS_MANIFEST_FILE, so uninstall removes exactly that. An upgrade keeps
+// the replaced binary as SMARTDNS_BIN.prev and puts it back if the new one
+// does not come up answering queries.
+
+const (
+	manifestBinary  = "binary"
+	manifestBackup  = "backup"
+	manifestService = "service"
+	manifestConfig  = "config"
+)
+
+type manifestFile struct {
+	Path   string `json:"path"`
+	Kind   string `json:"kind"`
+	SHA256 string `json:"sha256,omitempty"`
+	// Keep marks user data (the config) that uninstall leaves in place.
+	Keep bool `json:"keep,omitempty"`
+}
+
+type smartdnsManifest struct {
+	Tag       string         `json:"tag"`
+	Version   string         `json:"version"`
+	Previous  string         `json:"previous,omitempty"` // version kept in SMARTDNS_BIN.prev
+	Init      string         `json:"init"`
+	Installed time.Time      `json:"installed"`
+	Files     []manifestFile `json:"files"`
+}
+
+func loadSmartDNSManifest() (smartdnsManifest, bool) {
+	var m smartdnsManifest
+	b, err := os.ReadFile(SMARTDNS_MANIFEST_FILE)
+	if err != nil || json.Unmarshal(b, &m) != nil {
+		return smartdnsManifest{}, false
+	}
+	return m, true
+}
+
+func saveSmartDNSManifest(m smartdnsManifest) error {
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ensureDir(filepath.Dir(SMARTDNS_MANIFEST_FILE)); err != nil {
+		return err
+	}
+	return os.WriteFile(SMARTDNS_MANIFEST_FILE, append(b, '\n'), 0o644)
+}
+
+// smartdnsServiceFile is where the current service manager keeps the definition.
+func smartdnsServiceFile() string {
+	switch svc().Name() {
+	case INIT_SYSTEMD:
+		return filepath.Join(systemdUnitDir, "smartdns.service")
+	case INIT_SUPERVISED:
+		return supervisedSpecPath("smartdns")
+	}
+	return "/etc/init.d/smartdns"
+}
+
+// findReleaseBinary locates the smartdns executable in an extracted tarball
+// (smartdns/usr/sbin/smartdns in current releases).
+func findReleaseBinary(root string) (string, error) {
+	var found string
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || found != "" {
+			return err
+		}
+		if d.Type().IsRegular() && d.Name() == "smartdns" && filepath.Base(filepath.Dir(path)) == "sbin" {
+			found = path
+		}
+		return nil
+	})
+	if err == nil && found == "" {
+		err = errors.New("安装包中未找到 usr/sbin/smartdns")
+	}
+	return found, err
+}
+
+// copyExecutable writes src to dst through a temporary file and rename, so a
+// running smartdns keeps its old inode and dst is never half written.
+func copyExecutable(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	if err := ensureDir(filepath.Dir(dst)); err != nil {
+		return err
+	}
+	tmp := dst + ".new"
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o755)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, dst)
+}
+
+// smartdnsAnswers waits up to timeout for the service to run and answer on
+// 127.0.0.1:53 (any reply counts; upstream trouble is not the binary's fault).
+func smartdnsAnswers(timeout time.Duration) error {
+	canary := loadSettings().Watchdog.withDefaults().Canary
+	deadline := time.Now().Add(timeout)
+	var last error
+	for time.Now().Before(deadline) {
+		time.Sleep(time.Second)
+		if !svc().Status("smartdns") {
+			last = errors.New("服务未运行")
+			continue
+		}
+		if _, err := dnsQuery("127.0.0.1:53", canary, dnsTypeA, 2*time.Second); err != nil {
+			last = fmt.Errorf("127.0.0.1:53 无应答: %w", err)
+			continue
+		}
+		return nil
+	}
+	return last
+}
+
+// installSmartDNSBinary installs (or upgrades to) the binary newBin of rel:
+// service definition, config and manifest included. A failed start after an
+// upgrade rolls back to the previous binary; a failed first install is undone.
+func installSmartDNSBinary(rel smartdnsRelease, newBin string, log func(string)) error {
+	out, err := exec.Command(newBin, "-v").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("新版本无法在本机运行（架构不符？）: %v %s", err, out)
+	}
+	old, hadManifest := loadSmartDNSManifest()
+	prevVersion := installedSmartDNSVersion()
+	upgrade := fileExists(SMARTDNS_BIN)
+	if upgrade {
+		log("保留当前版本为 " + SMARTDNS_BIN + ".prev")
+		if err := copyExecutable(SMARTDNS_BIN, SMARTDNS_BIN+".prev"); err != nil {
+			return fmt.Errorf("备份当前二进制失败: %w", err)
+		}
+	}
+	log("安装二进制到 " + SMARTDNS_BIN)
+	if err := copyExecutable(newBin, SMARTDNS_BIN); err != nil {
+		return fmt.Errorf("安装二进制失败: %w", err)
+	}
+
+	createdConfig := !fileExists(SMART_CONFIG_FILE)
+	if hadManifest {
+		for _, f := range old.Files {
+			if f.Kind == manifestConfig {
+				createdConfig = true // ours from an earlier install
+			}
+		}
+	}
+	log("写入推荐 SmartDNS 选项 …")
+	if err := ensureSmartDNSBaseDirectives(); err != nil {
+		log("[警告] 写入推荐选项失败: " + err.Error())
+	}
+
+	log("写入服务定义 (" + svc().Name() + ") ...")
+	spec := serviceSpec{Name: "smartdns", Description: "SmartDNS", Command: []string{SMARTDNS_BIN, "-f", "-c", SMART_CONFIG_FILE}}
+	if err := svc().Install(spec, log); err != nil {
+		if !upgrade {
+			undoFreshSmartDNSInstall(log)
+		}
+		return err
+	}
+
+	// the manifest goes first so whatever happens next can be uninstalled
+	m := smartdnsManifest{Tag: rel.Tag, Version: rel.Version, Init: svc().Name(), Installed: time.Now()}
+	sum, _ := fileSHA256(SMARTDNS_BIN)
+	m.Files = append(m.Files, manifestFile{Path: SMARTDNS_BIN, Kind: manifestBinary, SHA256: sum})
+	if upgrade {
+		m.Previous = prevVersion
+		m.Files = append(m.Files, manifestFile{Path: SMARTDNS_BIN + ".prev", Kind: manifestBackup})
+	}
+	m.Files = append(m.Files, manifestFile{Path: smartdnsServiceFile(), Kind: manifestService})
+	if createdConfig {
+		m.Files = append(m.Files, manifestFile{Path: SMART_CONFIG_FILE, Kind: manifestConfig, Keep: true})
+	}
+	if err := saveSmartDNSManifest(m); err != nil {
+		log("[警告] 写入安装清单失败: " + err.Error())
+	}
+
+	_ = svc().Enable("smartdns", log)
+	log("启动 smartdns ...")
+	pauseWatchdog("正在安装/升级 smartdns", 2*time.Minute)
+	err = svc().Restart("smartdns", log)
+	if err == nil {
+		err = smartdnsAnswers(10 * time.Second)
+	}
+	if err != nil {
+		if !upgrade {
+			log("[失败] smartdns 启动失败: " + err.Error())
+			undoFreshSmartDNSInstall(log)
+			return fmt.Errorf("启动失败，已撤销本次安装: %w", err)
+		}
+		log("[失败] 新版本启动失败: " + err.Error())
+		rerr := rollbackSmartDNS(log)
+		resumeWatchdog() // with or without a working smartdns, the watchdog should watch again
+		if rerr != nil {
+			return fmt.Errorf("新版本启动失败 (%v)，回滚也失败: %w", err, rerr)
+		}
+		return fmt.Errorf("新版本启动失败，已回滚到 %s: %w", prevVersion, err)
+	}
+	resumeWatchdog()
+	op := "smartdns.install"
+	if upgrade {
+		op = "smartdns.upgrade"
+	}
+	opAudit(op, prevVersion+" -> "+rel.Tag+" "+rel.Version, nil, nil)
+	return nil
+}
+
+// undoFreshSmartDNSInstall removes what a failed first install put in place
+// (service, binary, manifest; a config it created stays) and gives the host
+// its previous resolver back, since releaseDNSPort may have turned off the
+// systemd-resolved stub that was answering before.
+func undoFreshSmartDNSInstall(log func(string)) {
+	log("撤销本次安装 ...")
+	pauseWatchdog("smartdns 安装失败，已撤销", 0)
+	if err := svc().Remove("smartdns", log); err != nil {
+		log("[警告] 移除服务失败: " + err.Error())
+	}
+	_ = removeIfExists(smartdnsServiceFile())
+	_ = removeIfExists(SMARTDNS_BIN)
+	_ = removeIfExists(SMARTDNS_MANIFEST_FILE)
+	log("恢复系统 DNS ...")
+	if err := restoreSystemResolver(log); err != nil {
+		log("[警告] 恢复系统 DNS 失败: " + err.Error())
+	}
+	opAudit("smartdns.install", "启动失败，已撤销", nil, errors.New("smartdns 未能启动"))
+}
+
+// rollbackSmartDNS puts SMARTDNS_BIN.prev back and restarts smartdns.
+func rollbackSmartDNS(log func(string)) (err error) {
+	defer func() { opAudit("smartdns.rollback", "", nil, err) }()
+	prev := SMARTDNS_BIN + ".prev"
+	if !fileExists(prev) {
+		return errors.New("没有可回滚的上一版本")
+	}
+	pauseWatchdog("正在回滚 smartdns", 2*time.Minute)
+	defer resumeWatchdog()
+	log("回滚到上一版本 ...")
+	if err := os.Rename(prev, SMARTDNS_BIN); err != nil {
+		return err
+	}
+	if err := svc().Restart("smartdns", log); err != nil {
+		return err
+	}
+	if err := smartdnsAnswers(10 * time.Second); err != nil {
+		return err
+	}
+	if m, ok := loadSmartDNSManifest(); ok {
+		m.Tag, m.Version, m.Previous = "", installedSmartDNSVersion(), ""
+		sum, _ := fileSHA256(SMARTDNS_BIN)
+		files := m.Files[:0]
+		for _, f := range m.Files {
+			switch f.Kind {
+			case manifestBackup:
+				continue
+			case manifestBinary:
+				f.SHA256 = sum
+			}
+			files = append(files, f)
+		}
+		m.Files = files
+		_ = saveSmartDNSManifest(m)
+	}
+	log("已回滚到 " + installedSmartDNSVersion())
+	return nil
+}
+
+// uninstallSmartDNSStream removes what the manifest lists (the config stays).
+// Installs made by the release's own script have no manifest; for those the
+// paths that script is known to use are cleaned up instead.
+func uninstallSmartDNSStream(log func(string)) (err error) {
+	defer func() { opAudit("smartdns.uninstall", "", nil, err) }()
+	pauseWatchdog("smartdns 已卸载", 0)
+	m, ok := loadSmartDNSManifest()
+	if !ok {
+		log("未找到安装清单，按旧版安装脚本的位置清理")
+		stopDisabled("smartdns", log)
+		if fileExists("/etc/init.d/smartdns") {
+			_ = runCmdPipe(log, "/etc/init.d/smartdns", "stop")
+		}
+		for _, p := range []string{"/usr/sbin/smartdns", "/usr/bin/smartdns", "/etc/init.d/smartdns", "/etc/systemd/system/smartdns.service"} {
+			_ = removeIfExists(p)
+		}
+		if svc().Name() == INIT_SYSTEMD {
+			_ = runCmdPipe(log, "systemctl", "daemon-reload")
+		}
+		return removeIfExists(supervisedSpecPath("smartdns"))
+	}
+	// the service goes first so nothing runs from the files removed after it
+	for _, f := range m.Files {
+		if f.Kind == manifestService {
+			if err := svc().Remove("smartdns", log); err != nil {
+				log("[警告] 移除服务失败: " + err.Error())
+			}
+			_ = removeIfExists(f.Path)
+			log("已移除 " + f.Path)
+		}
+	}
+	for _, f := range m.Files {
+		switch {
+		case f.Kind == manifestService:
+		case f.Keep:
+			log("保留 " + f.Path)
+		default:
+			if err := removeIfExists(f.Path); err != nil {
+				return err
+			}
+			log("已移除 " + f.Path)
+		}
+	}
+	return os.Remove(SMARTDNS_MANIFEST_FILE)
+}
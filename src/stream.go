@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -83,13 +84,50 @@ func streamConfigPath() string {
 	return filepath.Join(d, "StreamConfig.yaml")
 }
 
-// lightweight parser for the existing StreamConfig.yaml structure
+// streamConfigLocalPath is the site-local overlay next to StreamConfig.yaml.
+// Its blocks are merged into the downloaded config and survive updates.
+func streamConfigLocalPath() string {
+	return filepath.Join(filepath.Dir(streamConfigPath()), "StreamConfig.local.yaml")
+}
+
+// loadStreamConfig reads StreamConfig.yaml and merges the local overlay into it.
 func loadStreamConfig() (StreamConfig, error) {
-	path := streamConfigPath()
-	b, err := os.ReadFile(path)
+	b, err := os.ReadFile(streamConfigPath())
 	if err != nil {
 		return nil, err
 	}
+	cfg := parseStreamConfig(b)
+	if lb, err := os.ReadFile(streamConfigLocalPath()); err == nil {
+		for top, subs := range parseStreamConfig(lb) {
+			if _, ok := cfg[top]; !ok {
+				cfg[top] = map[string][]string{}
+			}
+			for sub, domains := range subs {
+				seen := map[string]bool{}
+				for _, d := range cfg[top][sub] {
+					seen[d] = true
+				}
+				for _, d := range domains {
+					if !seen[d] {
+						seen[d] = true
+						cfg[top][sub] = append(cfg[top][sub], d)
+					}
+				}
+			}
+		}
+	}
+	return cfg, nil
+}
+
+func loadLocalStreamConfig() StreamConfig {
+	if b, err := os.ReadFile(streamConfigLocalPath()); err == nil {
+		return parseStreamConfig(b)
+	}
+	return StreamConfig{}
+}
+
+// lightweight parser for the existing StreamConfig.yaml structure
+func parseStreamConfig(b []byte) StreamConfig {
 	lines := strings.Split(strings.ReplaceAll(string(b), "\r\n", "\n"), "\n")
 	cfg := StreamConfig{}
 	var top string
@@ -134,7 +172,59 @@ func loadStreamConfig() (StreamConfig, error) {
 			}
 		}
 	}
-	return cfg, nil
+	return cfg
+}
+
+// addLocalDomains appends domains to top/sub in the local overlay.
+func addLocalDomains(top, sub string, domains []string) error {
+	local := loadLocalStreamConfig()
+	if _, ok := local[top]; !ok {
+		local[top] = map[string][]string{}
+	}
+	seen := map[string]bool{}
+	for _, d := range local[top][sub] {
+		seen[d] = true
+	}
+	for _, d := range domains {
+		if !seen[d] {
+			seen[d] = true
+			local[top][sub] = append(local[top][sub], d)
+		}
+	}
+	out := []string{"# 本地补充的平台域名，与 StreamConfig.yaml 合并，更新时不会被覆盖"}
+	tops := make([]string, 0, len(local))
+	for t := range local {
+		tops = append(tops, t)
+	}
+	sort.Strings(tops)
+	for _, t := range tops {
+		out = append(out, t+":")
+		subs := make([]string, 0, len(local[t]))
+		for s := range local[t] {
+			subs = append(subs, s)
+		}
+		sort.Strings(subs)
+		for _, s := range subs {
+			out = append(out, "  "+s+":")
+			for _, d := range local[t][s] {
+				out = append(out, "    - "+d)
+			}
+		}
+	}
+	return writeLines(streamConfigLocalPath(), out)
+}
+
+// reapplyPlatformRules rewrites an assigned platform's smartdns.conf block
+// with its current domains; unassigned platforms are left alone.
+func reapplyPlatformRules(sub string, domains []string) (bool, error) {
+	a, ok := parseAssignments()[sub]
+	if !ok || a.Method == "" {
+		return false, nil
+	}
+	if err := deletePlatformRules(sub); err != nil {
+		return false, err
+	}
+	return true, addDomainRules(a.Method, domains, a.Ident, sub)
 }
 
 func checkFiles() bool {
@@ -145,7 +235,7 @@ func checkFiles() bool {
 	}
 	if !fileExists(streamConfigPath()) {
 		logRed("未找到流媒体配置文件：" + streamConfigPath())
-		if err := downloadStreamConfig(); err != nil {
+		if err := downloadStreamConfig(func(s string) { fmt.Println(s) }); err != nil {
 			logRed("下载流媒体配置文件失败: " + err.Error())
 			return false
 		}
@@ -153,9 +243,9 @@ func checkFiles() bool {
 	return true
 }
 
-func downloadStreamConfig() error {
-	logCyan("正在下载流媒体配置配置文件...")
-	return downloadToFile(REMOTE_STREAM_CONFIG_FILE_URL, streamConfigPath(), 30*time.Second)
+func downloadStreamConfig(log func(string)) error {
+	log("正在下载流媒体配置文件: " + REMOTE_STREAM_CONFIG_FILE_URL)
+	return download(REMOTE_STREAM_CONFIG_FILE_URL, streamConfigPath(), downloadOptions{Log: log})
 }
 
 func isPlatformAdded(platform string) bool {
@@ -294,11 +384,6 @@ func resolveMultiSelection(input string, options []string) []string {
 	return out
 }
 
-// misc utilities retained
-func regionTest() {
-    _ = runShellInteractive("bash <(curl -L -s " + REMOTE_RegionRestrictionCheck_URL + ")")
-}
-
 func printBanner() {
     fmt.Println(BLUE + "======================================" + RESET)
     fmt.Println(GREEN + "     一键配置 SmartDNS 脚本                    " + RESET)
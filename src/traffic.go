@@ -0,0 +1,484 @@
+package src
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// trafficRecord is one proxied connection (or HTTP request) in the structured access log.
+// nginx (log_format smartdns_*) and the built-in proxy write the same JSON shape.
+type trafficRecord struct {
+	Time     string  `json:"time"`
+	Client   string  `json:"client"`
+	Host     string  `json:"host"`
+	BytesIn  int64   `json:"bytes_in"`  // client -> upstream
+	BytesOut int64   `json:"bytes_out"` // upstream -> client
+	Duration float64 `json:"duration"`  // seconds
+	Status   string  `json:"status"`
+	Proto    string  `json:"proto"` // tls / http / quic
+}
+
+// trafficLogFiles are every access log the analytics page reads.
+func trafficLogFiles() []string {
+	return []string{PROXY_ACCESS_LOG, NGINX_STREAM_ACCESS_LOG, NGINX_HTTP_ACCESS_LOG}
+}
+
+// ----- writer used by the built-in proxy -----
+
+type accessLogger struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+// openAccessLog opens path for appending; an empty path disables logging.
+func openAccessLog(path string) (*accessLogger, error) {
+	if path == "" {
+		return &accessLogger{}, nil
+	}
+	if err := ensureDir(filepath.Dir(path)); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o640)
+	if err != nil {
+		return nil, err
+	}
+	return &accessLogger{f: f}, nil
+}
+
+func (l *accessLogger) write(rec trafficRecord) {
+	if l == nil || l.f == nil {
+		return
+	}
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return
+	}
+	l.mu.Lock()
+	_, _ = l.f.Write(append(b, '\n'))
+	l.mu.Unlock()
+}
+
+// ----- rollups -----
+
+type trafficCounter struct {
+	Conns    int64   `json:"conns"`
+	BytesIn  int64   `json:"bytes_in"`
+	BytesOut int64   `json:"bytes_out"`
+	Duration float64 `json:"duration"`
+}
+
+func (c *trafficCounter) add(r trafficRecord) {
+	c.Conns++
+	c.BytesIn += r.BytesIn
+	c.BytesOut += r.BytesOut
+	c.Duration += r.Duration
+}
+
+func (c *trafficCounter) merge(o *trafficCounter) {
+	c.Conns += o.Conns
+	c.BytesIn += o.BytesIn
+	c.BytesOut += o.BytesOut
+	c.Duration += o.Duration
+}
+
+func (c *trafficCounter) total() int64 { return c.BytesIn + c.BytesOut }
+
+// trafficDay is the on-disk daily rollup (TRAFFIC_STATE_DIR/YYYY-MM-DD.json).
+type trafficDay struct {
+	Date      string                     `json:"date"`
+	Platforms map[string]*trafficCounter `json:"platforms"`
+	Clients   map[string]*trafficCounter `json:"clients"`
+	// ClientPlatforms is keyed by "client|platform".
+	ClientPlatforms map[string]*trafficCounter `json:"client_platforms"`
+}
+
+func newTrafficDay(date string) *trafficDay {
+	return &trafficDay{Date: date, Platforms: map[string]*trafficCounter{}, Clients: map[string]*trafficCounter{}, ClientPlatforms: map[string]*trafficCounter{}}
+}
+
+func bump(m map[string]*trafficCounter, key string, r trafficRecord) {
+	c := m[key]
+	if c == nil {
+		c = &trafficCounter{}
+		m[key] = c
+	}
+	c.add(r)
+}
+
+// trafficPlatformLabel maps a host back to its StreamConfig platform.
+func trafficPlatformLabel(rules *proxyRules, host string) string {
+	if p := rules.platformOf(host); p != "" {
+		return p
+	}
+	return "(其他)"
+}
+
+func (d *trafficDay) add(rules *proxyRules, r trafficRecord) {
+	p := trafficPlatformLabel(rules, r.Host)
+	bump(d.Platforms, p, r)
+	bump(d.Clients, r.Client, r)
+	bump(d.ClientPlatforms, r.Client+"|"+p, r)
+}
+
+func trafficDayPath(date string) string { return filepath.Join(TRAFFIC_STATE_DIR, date+".json") }
+
+func loadTrafficDay(date string) *trafficDay {
+	d := newTrafficDay(date)
+	if b, err := os.ReadFile(trafficDayPath(date)); err == nil {
+		_ = json.Unmarshal(b, d)
+	}
+	return d
+}
+
+func saveTrafficDay(d *trafficDay) error {
+	b, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	tmp := trafficDayPath(d.Date) + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, trafficDayPath(d.Date))
+}
+
+// trafficOffsets remembers how far each log has been rolled up (by inode, so a
+// rotated or truncated file starts again from zero).
+type trafficOffset struct {
+	Inode  uint64 `json:"inode"`
+	Offset int64  `json:"offset"`
+}
+
+func trafficOffsetsPath() string { return filepath.Join(TRAFFIC_STATE_DIR, "offsets.json") }
+
+func recordDate(r trafficRecord) string {
+	if t, err := time.Parse(time.RFC3339, r.Time); err == nil {
+		return t.Local().Format("2006-01-02")
+	}
+	return time.Now().Format("2006-01-02")
+}
+
+var rollupMu sync.Mutex
+
+func trafficLockPath() string { return filepath.Join(TRAFFIC_STATE_DIR, "rollup.lock") }
+
+// rollupTraffic folds new access-log lines into the daily rollups.
+// It is incremental and safe to run often (TUI refresh, logrotate prerotate).
+// The proxy, the quota timer, the TUI and logrotate all run it, so the whole
+// load -> fold -> save of day files and offsets.json happens under a flock;
+// otherwise one process could re-add bytes another had already saved.
+func rollupTraffic() error {
+	rollupMu.Lock()
+	defer rollupMu.Unlock()
+	if err := ensureDir(TRAFFIC_STATE_DIR); err != nil {
+		return err
+	}
+	return withFileLock(trafficLockPath(), rollupTrafficLocked)
+}
+
+func rollupTrafficLocked() error {
+	offsets := map[string]trafficOffset{}
+	if b, err := os.ReadFile(trafficOffsetsPath()); err == nil {
+		_ = json.Unmarshal(b, &offsets)
+	}
+	rules := loadProxyRules()
+	days := map[string]*trafficDay{}
+	for _, path := range trafficLogFiles() {
+		f, err := os.Open(path)
+		if err != nil {
+			continue
+		}
+		fi, err := f.Stat()
+		if err != nil {
+			f.Close()
+			continue
+		}
+		var inode uint64
+		if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+			inode = st.Ino
+		}
+		off := offsets[path]
+		misaligned := false
+		switch {
+		case off.Inode != inode:
+			off = trafficOffset{Inode: inode} // rotated: a new file
+		case off.Offset > fi.Size():
+			// same file but shorter than what was already counted (truncated in place)
+			logYellow(fmt.Sprintf("[流量统计] %s 的偏移量回退（已统计 %d 字节，文件现为 %d 字节），从头重新统计", path, off.Offset, fi.Size()))
+			off = trafficOffset{Inode: inode}
+		case off.Offset > 0 && !atLineStart(f, off.Offset):
+			// the stored offset does not fall between records: the file was
+			// rewritten under us, so resume at the next record rather than
+			// counting a half line (or re-counting earlier ones)
+			logYellow(fmt.Sprintf("[流量统计] %s 的偏移量 %d 不在记录边界，跳到下一条记录", path, off.Offset))
+			misaligned = true
+		}
+		if _, err := f.Seek(off.Offset, io.SeekStart); err != nil {
+			f.Close()
+			continue
+		}
+		br := bufio.NewReader(f)
+		if misaligned {
+			skip, err := br.ReadString('\n')
+			if err != nil {
+				f.Close()
+				continue
+			}
+			off.Offset += int64(len(skip))
+		}
+		for {
+			line, err := br.ReadString('\n')
+			if err != nil {
+				break // partial trailing line stays for next run
+			}
+			off.Offset += int64(len(line))
+			var r trafficRecord
+			if json.Unmarshal([]byte(line), &r) != nil || r.Client == "" {
+				continue
+			}
+			date := recordDate(r)
+			d := days[date]
+			if d == nil {
+				d = loadTrafficDay(date)
+				days[date] = d
+			}
+			d.add(rules, r)
+		}
+		f.Close()
+		offsets[path] = off
+	}
+	for _, d := range days {
+		if err := saveTrafficDay(d); err != nil {
+			return err
+		}
+	}
+	b, _ := json.Marshal(offsets)
+	tmp := trafficOffsetsPath() + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, trafficOffsetsPath())
+}
+
+// atLineStart reports whether offset directly follows a newline.
+func atLineStart(f *os.File, offset int64) bool {
+	b := make([]byte, 1)
+	_, err := f.ReadAt(b, offset-1)
+	return err == nil && b[0] == '\n'
+}
+
+// trafficSummary aggregates the rollups of the last n days (today included).
+type trafficSummary struct {
+	Platforms map[string]*trafficCounter
+	Clients   map[string]*trafficCounter
+}
+
+func summarizeTraffic(from, to time.Time) trafficSummary {
+	sum := trafficSummary{Platforms: map[string]*trafficCounter{}, Clients: map[string]*trafficCounter{}}
+	for d := from; !d.After(to); d = d.AddDate(0, 0, 1) {
+		day := loadTrafficDay(d.Format("2006-01-02"))
+		for k, c := range day.Platforms {
+			if sum.Platforms[k] == nil {
+				sum.Platforms[k] = &trafficCounter{}
+			}
+			sum.Platforms[k].merge(c)
+		}
+		for k, c := range day.Clients {
+			if sum.Clients[k] == nil {
+				sum.Clients[k] = &trafficCounter{}
+			}
+			sum.Clients[k].merge(c)
+		}
+	}
+	return sum
+}
+
+func lastNDays(n int) (time.Time, time.Time) {
+	now := time.Now()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	return today.AddDate(0, 0, -(n - 1)), today
+}
+
+// tailTraffic returns the newest n records across all access logs, newest last.
+func tailTraffic(n int) []trafficRecord {
+	var all []trafficRecord
+	for _, path := range trafficLogFiles() {
+		lines, err := tailLines(path, n, 256*1024)
+		if err != nil {
+			continue
+		}
+		for _, l := range lines {
+			var r trafficRecord
+			if json.Unmarshal([]byte(l), &r) == nil && r.Client != "" {
+				all = append(all, r)
+			}
+		}
+	}
+	sort.SliceStable(all, func(i, j int) bool { return all[i].Time < all[j].Time })
+	if len(all) > n {
+		all = all[len(all)-n:]
+	}
+	return all
+}
+
+// tailLines reads up to n complete lines from the last maxBytes of path.
+func tailLines(path string, n int, maxBytes int64) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	start := fi.Size() - maxBytes
+	if start < 0 {
+		start = 0
+	}
+	buf := make([]byte, fi.Size()-start)
+	if _, err := f.ReadAt(buf, start); err != nil && err != io.EOF {
+		return nil, err
+	}
+	lines := strings.Split(strings.TrimRight(string(buf), "\n"), "\n")
+	if start > 0 && len(lines) > 0 {
+		lines = lines[1:] // first line is likely partial
+	}
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return lines, nil
+}
+
+func humanBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for v := n / unit; v >= unit; v /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// sortedCounters returns keys ordered by total bytes, largest first.
+func sortedCounters(m map[string]*trafficCounter) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if m[keys[i]].total() != m[keys[j]].total() {
+			return m[keys[i]].total() > m[keys[j]].total()
+		}
+		return keys[i] < keys[j]
+	})
+	return keys
+}
+
+// renderTrafficReport formats the aggregates and recent records for the TUI page.
+func renderTrafficReport(days int) string {
+	from, to := lastNDays(days)
+	sum := summarizeTraffic(from, to)
+	var b strings.Builder
+	fmt.Fprintf(&b, "[yellow]范围: 最近 %d 天 (%s ~ %s)[-]\n\n", days, from.Format("01-02"), to.Format("01-02"))
+	table := func(title string, m map[string]*trafficCounter, limit int) {
+		fmt.Fprintf(&b, "[green]%s[-]\n", title)
+		fmt.Fprintf(&b, "  %-28s %8s %12s %12s\n", "", "连接", "上行", "下行")
+		keys := sortedCounters(m)
+		if len(keys) == 0 {
+			b.WriteString("  (无数据)\n")
+		}
+		for i, k := range keys {
+			if i >= limit {
+				fmt.Fprintf(&b, "  ... 其余 %d 项\n", len(keys)-limit)
+				break
+			}
+			c := m[k]
+			fmt.Fprintf(&b, "  %-28s %8d %12s %12s\n", k, c.Conns, humanBytes(c.BytesIn), humanBytes(c.BytesOut))
+		}
+		b.WriteString("\n")
+	}
+	table("按平台", sum.Platforms, 30)
+	table("按客户端", sum.Clients, 30)
+	rules := loadProxyRules()
+	b.WriteString("[green]最近连接[-]\n")
+	for _, r := range tailTraffic(20) {
+		fmt.Fprintf(&b, "  %s %-15s %-5s %-32s %-16s %10s %6.1fs %s\n", r.Time, r.Client, r.Proto, r.Host,
+			trafficPlatformLabel(rules, r.Host), humanBytes(r.BytesIn+r.BytesOut), r.Duration, r.Status)
+	}
+	return b.String()
+}
+
+// logrotateConf rotates the access logs daily; the prerotate rollup makes sure no
+// line is lost, and copytruncate lets nginx and the proxy keep their file handles.
+func logrotateConf() string {
+	exe, err := os.Executable()
+	if err != nil {
+		exe = "/usr/local/bin/smartdnsctl"
+	}
+	return strings.Join([]string{
+		"# Generated by smartdnsctl",
+		TRAFFIC_LOG_DIR + "/*.log {",
+		"    daily",
+		"    rotate 7",
+		"    compress",
+		"    delaycompress",
+		"    missingok",
+		"    notifempty",
+		"    copytruncate",
+		"    sharedscripts",
+		"    prerotate",
+		"        " + exe + " traffic rollup >/dev/null 2>&1 || true",
+		"    endscript",
+		"}",
+		"",
+	}, "\n")
+}
+
+// ensureTrafficLogging prepares the log directory and logrotate policy.
+func ensureTrafficLogging() error {
+	if err := ensureDir(TRAFFIC_LOG_DIR); err != nil {
+		return err
+	}
+	if fileExists(filepath.Dir(LOGROTATE_FILE)) {
+		return writeFileIfChanged(LOGROTATE_FILE, logrotateConf(), 0o644)
+	}
+	return nil
+}
+
+// runTrafficCommand implements `smartdnsctl traffic [rollup|report [days]]`.
+func runTrafficCommand(args []string) int {
+	if err := rollupTraffic(); err != nil {
+		fmt.Fprintln(os.Stderr, "汇总失败:", err)
+		return 1
+	}
+	if len(args) > 0 && args[0] == "rollup" {
+		return 0
+	}
+	days := 1
+	if len(args) > 1 && args[0] == "report" {
+		fmt.Sscanf(args[1], "%d", &days)
+	}
+	if days < 1 {
+		days = 1
+	}
+	report := renderTrafficReport(days)
+	// strip tview color tags for plain output
+	for _, tag := range []string{"[yellow]", "[green]", "[-]"} {
+		report = strings.ReplaceAll(report, tag, "")
+	}
+	fmt.Print(report)
+	return 0
+}
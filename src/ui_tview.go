@@ -1,29 +1,26 @@
 package src
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"os"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	tcell "github.com/gdamore/tcell/v2"
 	"github.com/rivo/tview"
 )
 
-func isSmartDNSActive() bool {
-	out, _ := runCmdCapture("systemctl", "is-active", "smartdns")
-	return strings.TrimSpace(out) == "active"
-}
+func isSmartDNSActive() bool { return svc().Status("smartdns") }
 
-func isNginxActive() bool {
-	out, _ := runCmdCapture("systemctl", "is-active", "nginx")
-	return strings.TrimSpace(out) == "active"
-}
+func isNginxActive() bool { return svc().Status("nginx") }
 
-func isSystemResolverActive() bool {
-	out, _ := runCmdCapture("systemctl", "is-active", "systemd-resolved")
-	return strings.TrimSpace(out) == "active"
-}
+func isSystemResolverActive() bool { return svc().Status("systemd-resolved") }
 
 func initSelectionFromConfig(sel map[string]bool, cfg StreamConfig, topKeys []string) {
 	lines, err := readLines(SMART_CONFIG_FILE)
@@ -63,7 +60,11 @@ type tvState struct {
 	ident    string
 	sdActive bool
 	ngActive bool
+	pxActive bool
 	syActive bool
+	backend  string // proxy backend: nginx or builtin
+	ports    []portListener // listeners on 53/80/443 we don't own
+	unlock   map[string]unlockResult // last unlock check per platform
 	cfg      StreamConfig
 	topKeys  []string
 	subMap   map[string][]string
@@ -79,6 +80,9 @@ type tvState struct {
 
 	dirty bool // 有未保存更改
 
+	// nginxErr holds the last nginx apply failure from a save (already rolled back).
+	nginxErr error
+
     // pendingDrops records assignments (method+ident) that should be treated as
     // removed in UI immediately and will be actually removed from file on save.
     pendingDrops []Assignment
@@ -86,6 +90,9 @@ type tvState struct {
 	// initial service states at app start; used for exit restart prompt
 	initialSdActive bool
 	initialNgActive bool
+
+	// reexec restarts the program after the TUI exits (set after a self-update)
+	reexec bool
 }
 
 func sortedKeys(m map[string][]string) []string {
@@ -159,25 +166,49 @@ func (s *tvState) headerText() string {
 	if s.ngActive {
 		ngx = "nginx: [green]运行中[-]"
 	}
+	if s.backend == PROXY_BACKEND_BUILTIN {
+		ngx = "内置代理: [red]未运行[-]"
+		if s.pxActive {
+			ngx = "内置代理: [green]运行中[-]"
+		}
+	}
 	sy := "systemd-resolved: [green]运行中[-]"
 	if !s.syActive {
 		sy = "systemd-resolved: [gray]已停用[-]"
+	} else if resolvedStubDisabled() {
+		sy = "systemd-resolved: [green]运行(已让出 53)[-]"
 	} else if s.sdActive {
-		// concurrent running may cause conflict
+		// resolved's stub still holds 127.0.0.53:53 beside smartdns
 		sy = "systemd-resolved: [yellow]运行(可能冲突)[-]"
 	}
 	grp := "组: [gray]无[-]"
 	if s.activeGroup != "" {
 		grp = "组: [green]" + s.activeGroup + "[-]"
 	}
-	return fmt.Sprintf(" %s  |  %s  |  %s  |  %s  |  %s  |  %s", way, dns, sd, ngx, sy, grp)
+	line := fmt.Sprintf(" %s  |  %s  |  %s  |  %s  |  %s  |  %s", way, dns, sd, ngx, sy, grp)
+	if len(s.ports) > 0 {
+		seen := map[string]bool{}
+		var occ []string
+		for _, l := range s.ports {
+			who := l.Comm
+			if l.Unit != "" {
+				who = l.Unit
+			}
+			if k := fmt.Sprintf("%d←%s", l.Port, who); !seen[k] {
+				seen[k] = true
+				occ = append(occ, k)
+			}
+		}
+		line += "  |  端口占用: [red]" + strings.Join(occ, " ") + "[-]"
+	}
+	return line
 }
 
 func (s *tvState) setHeader() { s.header.SetDynamicColors(true).SetText(s.headerText()) }
 
 func (s *tvState) setFooter() {
 	s.footer.SetDynamicColors(true)
-	txt := "空格: 二级勾选 / 一级全选  |  Enter 勾选  |  方向键切换  |  h/l 切换面板  |  n 新建分组  d 删除分组  r 刷新分组  |  m 切换方式  |  e 编辑组名/地址  |  s 保存  |  z 服务管理  |  q 返回分组/退出  |  Esc 关闭弹窗"
+	txt := "空格: 二级勾选 / 一级全选  |  Enter 勾选  |  方向键切换  |  h/l 切换面板  |  n 新建分组  d 删除分组  r 刷新分组  |  m 切换方式  |  e 编辑组名/地址  |  b 平台出口地址  o 平台出站链路  t 查询平台解析  c 解锁检测  |  s 保存  |  z 服务管理  |  q 返回分组/退出  |  Esc 关闭弹窗"
 	if s.dirty {
 		txt += "  [yellow]有未保存更改[-]，按 s 保存"
 	}
@@ -455,6 +486,7 @@ func (s *tvState) populateRight() {
 	cur := s.right.GetCurrentItem()
 	s.right.Clear()
 	subs := s.subMap[s.curTop]
+	settings := loadSettings()
 	for _, sub := range subs {
 		sub := sub
 		key := s.curTop + "/" + sub
@@ -476,6 +508,15 @@ func (s *tvState) populateRight() {
 				}
 			}
 		}
+		if addr := settings.Egress[sub]; addr != "" {
+			sec = strings.TrimSpace(sec + "  出口 " + addr)
+		}
+		if o, ok := settings.Outbounds[sub]; ok && !o.isDirect() {
+			sec = strings.TrimSpace(sec + "  经 " + o.Type + "://" + o.Addr)
+		}
+		if r, ok := s.unlock[sub]; ok {
+			sec = strings.TrimSpace(sec + "  " + r.label())
+		}
 		s.right.AddItem(fmt.Sprintf("%s %s", mark, sub), sec, 0, func() {
 			if s.isOccupiedByOtherGroup(sub) {
 				return
@@ -498,6 +539,151 @@ func (s *tvState) populateRight() {
 	}
 }
 
+// openEgressPicker chooses the local source address for a platform's proxied connections.
+func (s *tvState) openEgressPicker(sub string) {
+	current := loadSettings().Egress[sub]
+	list := tview.NewList().ShowSecondaryText(false)
+	list.SetBorder(true).SetTitle("出口地址: " + sub + " (Enter选择, Esc返回)")
+	choose := func(addr string) func() {
+		return func() {
+			s.pages.RemovePage("modal-egress")
+			err := updateSettings(func(st *ctlSettings) {
+				if st.Egress == nil {
+					st.Egress = map[string]string{}
+				}
+				if addr == "" {
+					delete(st.Egress, sub)
+				} else {
+					st.Egress[sub] = addr
+				}
+			})
+			if err != nil {
+				s.toast("保存出口地址失败: " + err.Error())
+				return
+			}
+			s.populateRight()
+			s.applyProxyConfigAfterChange("应用出口地址")
+		}
+	}
+	mark := func(addr string) string {
+		if addr == current {
+			return "[*] "
+		}
+		return "[ ] "
+	}
+	list.AddItem(mark("")+"默认（系统路由）", "", 0, choose(""))
+	present := current == ""
+	for _, addr := range localEgressAddrs() {
+		list.AddItem(mark(addr)+addr, "", 0, choose(addr))
+		present = present || addr == current
+	}
+	if !present {
+		list.AddItem(mark(current)+current+" (本机已不存在)", "", 0, choose(current))
+	}
+	list.SetInputCapture(func(ev *tcell.EventKey) *tcell.EventKey {
+		if ev.Key() == tcell.KeyEsc {
+			s.pages.RemovePage("modal-egress")
+			return nil
+		}
+		return ev
+	})
+	s.pages.AddPage("modal-egress", center(60, 14, list), true, true)
+}
+
+// openOutboundForm edits a platform's outbound route (direct / SOCKS5 / HTTP CONNECT)
+// and can test it by tunnelling a TLS handshake to the platform's first domain.
+func (s *tvState) openOutboundForm(top, sub string) {
+	settings := loadSettings()
+	cur := settings.Outbounds[sub]
+	types := []string{OUTBOUND_DIRECT, OUTBOUND_SOCKS5, OUTBOUND_HTTP}
+	typeIdx := 0
+	for i, t := range types {
+		if t == cur.Type {
+			typeIdx = i
+		}
+	}
+	form := tview.NewForm()
+	typeDrop := tview.NewDropDown().SetLabel("类型: ").SetOptions([]string{"直连", "SOCKS5", "HTTP CONNECT"}, nil).SetCurrentOption(typeIdx)
+	addr := tview.NewInputField().SetLabel("地址 host:port: ").SetText(cur.Addr)
+	user := tview.NewInputField().SetLabel("用户名: ").SetText(cur.User)
+	pass := tview.NewInputField().SetLabel("密码: ").SetText(cur.Pass).SetMaskCharacter('*')
+	form.AddFormItem(typeDrop).AddFormItem(addr).AddFormItem(user).AddFormItem(pass)
+	read := func() outboundRoute {
+		i, _ := typeDrop.GetCurrentOption()
+		o := outboundRoute{Type: types[i]}
+		if !o.isDirect() {
+			o.Addr = strings.TrimSpace(addr.GetText())
+			o.User = strings.TrimSpace(user.GetText())
+			o.Pass = pass.GetText()
+		}
+		return o
+	}
+	form.AddButton("保存", func() {
+		o := read()
+		if err := o.validate(); err != nil {
+			s.toast(err.Error())
+			return
+		}
+		err := updateSettings(func(st *ctlSettings) {
+			if st.Outbounds == nil {
+				st.Outbounds = map[string]outboundRoute{}
+			}
+			if o.isDirect() {
+				delete(st.Outbounds, sub)
+			} else {
+				st.Outbounds[sub] = o
+			}
+		})
+		if err != nil {
+			s.toast("保存出站链路失败: " + err.Error())
+			return
+		}
+		s.pages.RemovePage("modal-outbound")
+		s.populateRight()
+		s.applyProxyConfigAfterChange("应用出站链路")
+	})
+	form.AddButton("测试", func() {
+		o := read()
+		domains := s.cfg[top][sub]
+		if len(domains) == 0 {
+			s.toast("该平台没有域名可测试")
+			return
+		}
+		egress := loadSettings().Egress[sub]
+		logView := s.openLogModal("测试出站: " + sub)
+		go func() {
+			append := func(line string) { s.app.QueueUpdateDraw(func() { fmt.Fprintln(logView, line) }) }
+			if err := testOutbound(o, egress, domains[0], append); err != nil {
+				append("[失败] " + err.Error())
+			} else {
+				append("[完成] 出站可用")
+			}
+		}()
+	})
+	form.AddButton("取消", func() { s.pages.RemovePage("modal-outbound") })
+	form.SetBorder(true).SetTitle("出站链路: " + sub).SetTitleAlign(tview.AlignLeft)
+	form.SetCancelFunc(func() { s.pages.RemovePage("modal-outbound") })
+	s.pages.AddPage("modal-outbound", center(60, 15, form), true, true)
+}
+
+// applyProxyConfigAfterChange regenerates nginx config after a proxy setting change.
+// The built-in proxy picks the change up on its own.
+func (s *tvState) applyProxyConfigAfterChange(title string) {
+	if s.backend == PROXY_BACKEND_BUILTIN || !fileExists(NGINX_MAIN_CONF) {
+		return
+	}
+	logView := s.openLogModal(title)
+	go func() {
+		append := func(line string) { s.app.QueueUpdateDraw(func() { fmt.Fprintln(logView, line) }) }
+		if err := applyNginxProxyConfigs(append); err != nil {
+			append("[失败] " + err.Error())
+		} else {
+			append("[完成] Nginx 配置已生效")
+		}
+		s.flushUI()
+	}()
+}
+
 func (s *tvState) showEditIdent() {
 	form := tview.NewForm()
 	label := "DNS 组名"
@@ -538,6 +724,10 @@ func (s *tvState) saveSelection() {
 		s.toast(err.Error())
 		return
 	}
+	if s.nginxErr != nil {
+		s.showNginxError(s.nginxErr)
+		return
+	}
 	if count == 0 {
 		s.toast("没有可保存的变更")
 		return
@@ -547,8 +737,16 @@ func (s *tvState) saveSelection() {
 			AddButtons([]string{"重启", "稍后"}).SetDoneFunc(func(i int, l string) {
 			s.pages.RemovePage("modal")
 			if i == 0 {
-				_ = runCmdInteractive("systemctl", "restart", "smartdns")
-				s.toast("已重启 SmartDNS")
+				logView := s.openLogModal("重启 SmartDNS")
+				go func() {
+					append := func(line string) { s.app.QueueUpdateDraw(func() { fmt.Fprintln(logView, line) }) }
+					if err := svc().Restart("smartdns", append); err != nil {
+						append("[失败] " + err.Error())
+					} else {
+						append("[完成] 已重启 SmartDNS")
+					}
+					s.flushUI()
+				}()
 			} else {
 				s.toast("保存完成")
 			}
@@ -577,6 +775,7 @@ func (s *tvState) saveSelectionSilent() (int, error) {
 	if s.method == "address" && net.ParseIP(strings.TrimSpace(s.ident)) == nil {
 		return 0, fmt.Errorf("address 模式需要合法 IP，当前为 %s", s.ident)
 	}
+	snaps := snapshotFiles(SMART_CONFIG_FILE)
 	// ensure any pending drops are applied to file first
 	for _, pd := range s.pendingDrops {
 		s.removeAssignmentsForTarget(pd)
@@ -585,7 +784,8 @@ func (s *tvState) saveSelectionSilent() (int, error) {
 	// target assignment for this save
 	tgt := s.targetAssignment()
 	changed := 0
-	ngReady := fileExists(NGINX_MAIN_CONF)
+	// the built-in proxy reloads its allow-list by itself; only nginx needs regenerating
+	ngReady := s.backend != PROXY_BACKEND_BUILTIN && fileExists(NGINX_MAIN_CONF)
 	// Ensure base SmartDNS options exist
 	_ = ensureSmartDNSBaseDirectives()
 	// Build a quick set of selected subs (by sub name)
@@ -655,12 +855,11 @@ func (s *tvState) saveSelectionSilent() (int, error) {
 		_ = addDomainRules(s.method, domains, s.ident, sub)
 		changed++
 	}
-	// Ensure nginx proxy configs exist and reload nginx (if installed)
+	// Ensure nginx proxy configs exist and reload nginx (if installed); failures are rolled back
+	s.nginxErr = nil
 	if ngReady {
-		if err := ensureNginxProxyConfigs(func(s string) { /* no-op in silent save */ }); err != nil {
-			logYellow("写入 Nginx 代理配置失败: " + err.Error())
-		} else {
-			_ = nginxTestAndReload(func(string) {})
+		if err := applyNginxProxyConfigs(nil); err != nil {
+			s.nginxErr = err
 		}
 	}
 	if changed > 0 {
@@ -671,9 +870,24 @@ func (s *tvState) saveSelectionSilent() (int, error) {
 		s.dirty = false
 		s.setFooter()
 	}
+	auditSnapshots("assignment.save", s.method+" "+s.ident, snaps, nil)
 	return changed, nil
 }
 
+// showNginxError opens the log modal with an nginx apply failure that has been rolled back.
+func (s *tvState) showNginxError(err error) {
+	logView := s.openLogModal("Nginx 配置未生效")
+	fmt.Fprintln(logView, "[失败] 规则已保存，但 Nginx 配置应用失败，已回滚到修改前的配置：")
+	fmt.Fprintln(logView, err.Error())
+	src := journalSourceFor("nginx")
+	if lines, lerr := readJournal(src, 10, sevErr); lerr == nil && len(lines) > 0 {
+		fmt.Fprintln(logView, "\n最近的错误日志（"+src.String()+"）:")
+		for _, l := range lines {
+			fmt.Fprintln(logView, "  "+tview.Escape(l.String()))
+		}
+	}
+}
+
 func (s *tvState) toast(msg string) {
 	m := tview.NewModal().SetText(msg).AddButtons([]string{"确定"}).SetDoneFunc(func(i int, l string) { s.pages.RemovePage("modal") })
 	s.pages.AddPage("modal", center(50, 5, m), true, true)
@@ -701,8 +915,13 @@ func (s *tvState) openConfigViewer(title, path string) {
 		s.toast("读取配置失败: " + err.Error())
 		return
 	}
+	s.openTextViewer(title, string(data))
+}
+
+// openTextViewer shows read-only text in a scrollable modal.
+func (s *tvState) openTextViewer(title, text string) {
 	view := tview.NewTextView().
-		SetText(string(data)).
+		SetText(text).
 		SetScrollable(true).
 		SetWrap(false).
 		SetDynamicColors(true).
@@ -751,7 +970,10 @@ func (s *tvState) flushUI() {
 		// refresh runtime/service states
 		s.sdActive = isSmartDNSActive()
 		s.ngActive = isNginxActive()
+		s.pxActive = isProxyActive()
 		s.syActive = isSystemResolverActive()
+		s.backend = loadSettings().ProxyBackend
+		s.ports = currentPortConflicts()
 		// reload groups and assignments as files may have changed after install/uninstall
 		s.reloadGroups()
 		s.refreshAssignments()
@@ -779,7 +1001,7 @@ func (s *tvState) flushUI() {
 
 func runTUI() {
 	if !fileExists(streamConfigPath()) {
-		_ = downloadStreamConfig()
+		_ = downloadStreamConfig(func(s string) { fmt.Println(s) })
 	}
 	cfg, err := loadStreamConfig()
 	if err != nil {
@@ -799,7 +1021,11 @@ func runTUI() {
 		ident:    "",
 		sdActive: isSmartDNSActive(),
 		ngActive: isNginxActive(),
+		pxActive: isProxyActive(),
 		syActive: isSystemResolverActive(),
+		backend:  loadSettings().ProxyBackend,
+		ports:    currentPortConflicts(),
+		unlock:   loadUnlockResults(),
 		cfg:      cfg,
 		topKeys:  topKeys,
 		subMap:   subMap,
@@ -885,6 +1111,11 @@ func runTUI() {
 				st.setFooter()
 			}
 			return nil
+		case 'c':
+			if idx := st.left.GetCurrentItem(); idx >= 0 && idx < len(st.topKeys) {
+				st.runUnlockChecks(st.topKeys[idx], st.subMap[st.topKeys[idx]])
+			}
+			return nil
 		case 'l':
 			if idx := st.left.GetCurrentItem(); idx >= 0 && idx < len(st.topKeys) {
 				st.curTop = st.topKeys[idx]
@@ -916,6 +1147,31 @@ func runTUI() {
 				st.app.SetFocus(st.left)
 				return nil
 			}
+			if ev.Rune() == 'o' {
+				if idx := st.right.GetCurrentItem(); idx >= 0 && idx < len(st.subMap[st.curTop]) {
+					st.openOutboundForm(st.curTop, st.subMap[st.curTop][idx])
+				}
+				return nil
+			}
+			if ev.Rune() == 'b' {
+				if idx := st.right.GetCurrentItem(); idx >= 0 && idx < len(st.subMap[st.curTop]) {
+					st.openEgressPicker(st.subMap[st.curTop][idx])
+				}
+				return nil
+			}
+			if ev.Rune() == 'c' {
+				if idx := st.right.GetCurrentItem(); idx >= 0 && idx < len(st.subMap[st.curTop]) {
+					sub := st.subMap[st.curTop][idx]
+					st.runUnlockChecks(sub, []string{sub})
+				}
+				return nil
+			}
+			if ev.Rune() == 't' {
+				if idx := st.right.GetCurrentItem(); idx >= 0 && idx < len(st.subMap[st.curTop]) {
+					st.runDNSQuery(st.subMap[st.curTop][idx])
+				}
+				return nil
+			}
 			if ev.Rune() == ' ' {
 				if idx := st.right.GetCurrentItem(); idx >= 0 {
 					subs := st.subMap[st.curTop]
@@ -998,6 +1254,9 @@ func runTUI() {
 										st.toast("未选择任何平台，无需保存")
 									}
 									st.openGroupsPage()
+									if st.nginxErr != nil {
+										st.showNginxError(st.nginxErr)
+									}
 								}
 							case 1: // 丢弃并返回
 								st.dirty = false
@@ -1114,17 +1373,26 @@ func runTUI() {
 
 	// show groups page initially
 	st.openGroupsPage()
-	if err := st.app.Run(); err != nil {
+	// log* output would garble the screen; it still reaches OPLOG_FILE
+	consoleQuiet.Store(true)
+	err = st.app.Run()
+	consoleQuiet.Store(false)
+	if err != nil {
 		logRed("TUI 运行失败: " + err.Error())
 	}
+	if st.reexec {
+		if err := reexecSelf(); err != nil {
+			logRed("重新启动失败，请手动运行 smartdnsctl: " + err.Error())
+		}
+	}
 }
 
 // ----- Service Manager (SmartDNS / Nginx) -----
 
 func (s *tvState) openServiceManager() {
 	options := tview.NewList().ShowSecondaryText(false)
-	options.SetBorder(true).SetTitle("服务管理")
-	options.AddItem("紧急重置 DNS -> 8.8.8.8", "停止 smartdns/systemd-resolved 并覆盖 /etc/resolv.conf", 0, func() {
+	options.SetBorder(true).SetTitle("服务管理 (" + svc().Name() + ")")
+	options.AddItem("紧急重置 DNS -> 8.8.8.8", "停止 smartdns 并直接覆盖 /etc/resolv.conf", 0, func() {
 		s.pages.RemovePage("modal")
 		s.confirmEmergencyResetDNS()
 	})
@@ -1133,8 +1401,7 @@ func (s *tvState) openServiceManager() {
 		logView := s.openLogModal("更新流媒体配置")
 		go func() {
 			append := func(line string) { s.app.QueueUpdateDraw(func() { fmt.Fprintln(logView, line) }) }
-			append("下载最新 StreamConfig.yaml ...")
-			if err := downloadStreamConfig(); err != nil {
+			if err := downloadStreamConfig(append); err != nil {
 				append("[失败] 下载失败: " + err.Error())
 				return
 			}
@@ -1162,200 +1429,1402 @@ func (s *tvState) openServiceManager() {
 			append("[完成] 已更新并应用最新流媒体配置")
 		}()
 	})
-	options.AddItem("覆盖系统 DNS -> 127.0.0.1", "停用 systemd-resolved 并写入 /etc/resolv.conf", 0, func() {
+	options.AddItem("覆盖系统 DNS -> 127.0.0.1", resolverStatus(), 0, func() {
 		s.pages.RemovePage("modal")
 		logView := s.openLogModal("覆盖系统 DNS -> 127.0.0.1")
 		go func() {
 			append := func(line string) { s.app.QueueUpdateDraw(func() { fmt.Fprintln(logView, line) }) }
-			append("停止 systemd-resolved ...")
-			_ = runCmdPipe(append, "systemctl", "stop", "systemd-resolved")
-			append("禁用 systemd-resolved 开机自启 ...")
-			_ = runCmdPipe(append, "systemctl", "disable", "systemd-resolved")
-			append("写入 /etc/resolv.conf -> 127.0.0.1 ...")
-			modifyResolv("127.0.0.1")
-			append("完成: 已将系统 DNS 覆盖为 127.0.0.1")
+			if err := pointSystemDNS("127.0.0.1", append); err != nil {
+				append("[失败] " + err.Error())
+			} else {
+				append("完成: 已将系统 DNS 覆盖为 127.0.0.1")
+			}
 			s.flushUI()
 		}()
 	})
-	options.AddItem("恢复系统 DNS（systemd-resolved）", "启用并启动 systemd-resolved", 0, func() {
+	options.AddItem("恢复系统 DNS", "按记录还原 resolv.conf 与解析器配置", 0, func() {
 		s.pages.RemovePage("modal")
 		logView := s.openLogModal("恢复系统 DNS")
 		go func() {
 			append := func(line string) { s.app.QueueUpdateDraw(func() { fmt.Fprintln(logView, line) }) }
-			append("启用 systemd-resolved 开机自启 ...")
-			_ = runCmdPipe(append, "systemctl", "enable", "systemd-resolved")
-			append("启动 systemd-resolved ...")
-			_ = runCmdPipe(append, "systemctl", "start", "systemd-resolved")
-			append("完成: 已恢复系统 DNS（/etc/resolv.conf 可能由 resolved 接管）")
+			if err := restoreSystemResolver(append); err != nil {
+				append("[失败] " + err.Error())
+			} else {
+				append("完成: 已恢复系统 DNS")
+			}
 			s.flushUI()
 		}()
 	})
 	options.AddItem("SmartDNS", "安装/卸载/启动/停止/重启", 0, func() { s.pages.RemovePage("modal"); s.openSmartDNSActions() })
 	options.AddItem("Nginx", "安装/启动/停止/重载/查看配置", 0, func() { s.pages.RemovePage("modal"); s.openNginxActions() })
+	options.AddItem("内置代理", "安装服务/启动/停止/重启/查看放行列表", 0, func() { s.pages.RemovePage("modal"); s.openBuiltinProxyActions() })
+	options.AddItem("代理后端: "+proxyBackendLabel(s.backend), "选择由 nginx 或内置代理承担 80/443", 0, func() {
+		s.pages.RemovePage("modal")
+		s.openProxyBackendPicker()
+	})
+	options.AddItem("流量统计", "按平台/客户端汇总访问日志", 0, func() { s.pages.RemovePage("modal"); s.openTrafficStats() })
+	options.AddItem("DNS 查询统计", "按平台/分组/客户端汇总 smartdns 审计日志", 0, func() { s.pages.RemovePage("modal"); s.openQueryStats() })
+	options.AddItem("发现缺失域名", "从审计日志找出平台遗漏的 CDN/API 域名", 0, func() { s.pages.RemovePage("modal"); s.openDiscover() })
+	options.AddItem("限速与配额", "连接数/速率/月配额，超额客户端重置", 0, func() { s.pages.RemovePage("modal"); s.openLimits() })
+	options.AddItem("DNS 查询 / 规则解释", "查询域名或平台，对比本机/分组/默认上游", 0, func() { s.pages.RemovePage("modal"); s.openDNSQuery() })
+	options.AddItem("DNS 看门狗", watchdogStatus(), 0, func() { s.pages.RemovePage("modal"); s.openWatchdogForm() })
+	options.AddItem("操作日志", "谁在何时改了什么（"+OPLOG_FILE+"）", 0, func() { s.pages.RemovePage("modal"); s.openOpLog() })
+	options.AddItem("更新 smartdnsctl (当前 "+SCRIPT_VERSION+")", "检查新版本、查看更新说明、回滚", 0, func() { s.pages.RemovePage("modal"); s.openSelfUpdate() })
+	options.AddItem("下载设置", "下载代理 "+loadSettings().DownloadProxy.String()+"，GitHub 镜像", 0, func() { s.pages.RemovePage("modal"); s.openDownloadForm() })
 	options.AddItem("关闭", "", 0, func() { s.pages.RemovePage("modal") })
-	s.pages.AddPage("modal", center(50, 12, options), true, true)
+	s.pages.AddPage("modal", center(50, 23, options), true, true)
 }
 
-func (s *tvState) confirmEmergencyResetDNS() {
-	text := "将停止 smartdns 和 systemd-resolved，并把 /etc/resolv.conf 设置为 8.8.8.8。\n确定要执行紧急重置吗？"
-	m := tview.NewModal().SetText(text).AddButtons([]string{"执行", "取消"}).SetDoneFunc(func(i int, l string) {
-		s.pages.RemovePage("modal-emg")
-		if i == 0 {
-			logView := s.openLogModal("紧急重置 DNS")
-			go func() {
-				append := func(line string) { s.app.QueueUpdateDraw(func() { fmt.Fprintln(logView, line) }) }
-				append("停止 smartdns ...")
-				_ = runCmdPipe(append, "systemctl", "stop", "smartdns")
-				append("停止 systemd-resolved ...")
-				_ = runCmdPipe(append, "systemctl", "stop", "systemd-resolved")
-				append("禁用 systemd-resolved 开机自启 ...")
-				_ = runCmdPipe(append, "systemctl", "disable", "systemd-resolved")
-				append("写入 /etc/resolv.conf -> 8.8.8.8 ...")
-				modifyResolv("8.8.8.8")
-				append("完成: 已紧急重置 DNS 为 8.8.8.8")
-				s.flushUI()
-			}()
+// openLimits lists the client/platform limits and this month's quota usage.
+// Enter on a limit edits it; Enter on a usage line offers a quota reset.
+func (s *tvState) openLimits() {
+	st := loadSettings()
+	_ = rollupTraffic()
+	report := quotaReport()
+	list := tview.NewList().ShowSecondaryText(false)
+	list.SetBorder(true).SetTitle("限速与配额 (Esc 关闭)").SetTitleAlign(tview.AlignLeft)
+	list.AddItem("每个客户端: "+st.ClientLimit.String(), "", 0, func() { s.openLimitForm("", false) })
+	subs := make([]string, 0, len(st.PlatformLimits))
+	for sub := range st.PlatformLimits {
+		subs = append(subs, sub)
+	}
+	sort.Strings(subs)
+	for _, sub := range subs {
+		sub := sub
+		list.AddItem("平台 "+sub+": "+st.PlatformLimits[sub].String(), "", 0, func() { s.openLimitForm(sub, false) })
+	}
+	list.AddItem("+ 添加平台限制", "", 0, func() { s.openLimitForm("", true) })
+	if len(report) > 0 {
+		list.AddItem("[yellow]—— 本月配额用量 ——[-]", "", 0, nil)
+	}
+	for _, u := range report {
+		u := u
+		kind := "客户端"
+		if u.Kind == "platform" {
+			kind = "平台"
+		}
+		line := fmt.Sprintf("%s %s: %s / %s", kind, u.Name, humanBytes(u.Used), humanBytes(u.Quota))
+		if u.over() {
+			line = "[red]超额[-] " + line
 		}
+		list.AddItem(line, "", 0, func() { s.confirmResetQuota(u) })
+	}
+	list.AddItem("关闭", "", 0, func() { s.pages.RemovePage("modal-limits") })
+	list.SetInputCapture(func(ev *tcell.EventKey) *tcell.EventKey {
+		if ev.Key() == tcell.KeyEsc {
+			s.pages.RemovePage("modal-limits")
+			return nil
+		}
+		return ev
 	})
-	s.pages.AddPage("modal-emg", center(70, 8, m), true, true)
+	if s.pages.HasPage("modal-limits") {
+		s.pages.RemovePage("modal-limits")
+	}
+	s.pages.AddPage("modal-limits", center(80, 24, list), true, true)
+	s.app.SetFocus(list)
 }
 
-func (s *tvState) openSmartDNSActions() {
-	list := tview.NewList().ShowSecondaryText(false)
-	list.SetBorder(true).SetTitle("SmartDNS")
-	list.AddItem("安装", "从发布包安装", 0, func() {
-		s.pages.RemovePage("modal")
-		logView := s.openLogModal("安装 SmartDNS")
-		go func() {
-			append := func(line string) {
-				s.app.QueueUpdateDraw(func() { fmt.Fprintln(logView, line) })
+// openLimitForm edits the per-client limit (sub == "" and !adding) or a platform limit.
+func (s *tvState) openLimitForm(sub string, adding bool) {
+	st := loadSettings()
+	cur := st.ClientLimit
+	title := "每个客户端的限制"
+	if sub != "" {
+		cur = st.PlatformLimits[sub]
+		title = "平台限制: " + sub
+	}
+	form := tview.NewForm()
+	var platforms []string
+	var platformDrop *tview.DropDown
+	if adding {
+		seen := map[string]bool{}
+		for _, subs := range s.cfg {
+			for p := range subs {
+				if !seen[p] {
+					seen[p] = true
+					platforms = append(platforms, p)
+				}
 			}
-			if err := installSmartDNSStream(append); err != nil {
-				append("[失败] " + err.Error())
+		}
+		sort.Strings(platforms)
+		platformDrop = tview.NewDropDown().SetLabel("平台: ").SetOptions(platforms, nil).SetCurrentOption(0)
+		form.AddFormItem(platformDrop)
+		title = "添加平台限制"
+	}
+	conns := tview.NewInputField().SetLabel("并发连接数 (0 不限): ").SetText(strconv.Itoa(cur.Conns))
+	rate := tview.NewInputField().SetLabel("单连接速率/秒 (如 10M): ").SetText(formatSize(cur.Rate))
+	quota := tview.NewInputField().SetLabel("月配额 (如 500G): ").SetText(formatSize(cur.Quota))
+	form.AddFormItem(conns).AddFormItem(rate).AddFormItem(quota)
+	save := func(remove bool) {
+		target := sub
+		if adding {
+			i, _ := platformDrop.GetCurrentOption()
+			if i < 0 || i >= len(platforms) {
+				s.toast("请选择平台")
+				return
+			}
+			target = platforms[i]
+		}
+		var l trafficLimit
+		if !remove {
+			n, err := strconv.Atoi(strings.TrimSpace(conns.GetText()))
+			if err != nil || n < 0 {
+				s.toast("并发连接数需为非负整数")
+				return
+			}
+			l.Conns = n
+			if l.Rate, err = parseSize(rate.GetText()); err != nil {
+				s.toast(err.Error())
+				return
+			}
+			if l.Quota, err = parseSize(quota.GetText()); err != nil {
+				s.toast(err.Error())
+				return
+			}
+		}
+		err := updateSettings(func(st *ctlSettings) {
+			if target == "" {
+				st.ClientLimit = l
+				return
+			}
+			if st.PlatformLimits == nil {
+				st.PlatformLimits = map[string]trafficLimit{}
+			}
+			if l.empty() {
+				delete(st.PlatformLimits, target)
 			} else {
-				append("[完成] SmartDNS 安装成功")
+				st.PlatformLimits[target] = l
 			}
-			s.flushUI()
-		}()
-	})
-	list.AddItem("卸载", "移除服务与二进制（保留配置）", 0, func() {
-		s.pages.RemovePage("modal")
-		s.confirmUninstallSmartDNS()
-	})
-	list.AddItem("启动", "", 0, func() {
-		s.pages.RemovePage("modal")
-		logView := s.openLogModal("启动 SmartDNS")
-		go func() {
-			append := func(line string) { s.app.QueueUpdateDraw(func() { fmt.Fprintln(logView, line) }) }
-			append("启动 smartdns ...")
-			_ = runCmdPipe(append, "systemctl", "start", "smartdns")
-			append("启用 smartdns 开机自启 ...")
-			_ = runCmdPipe(append, "systemctl", "enable", "smartdns")
-			append("完成: SmartDNS 已启动（未覆盖系统 DNS）")
-			s.flushUI()
-		}()
-	})
-	list.AddItem("停止", "", 0, func() {
-		s.pages.RemovePage("modal")
-		logView := s.openLogModal("停止 SmartDNS")
-		go func() {
-			append := func(line string) { s.app.QueueUpdateDraw(func() { fmt.Fprintln(logView, line) }) }
-			append("停止 smartdns ...")
-			_ = runCmdPipe(append, "systemctl", "stop", "smartdns")
-			append("禁用 smartdns 开机自启 ...")
-			_ = runCmdPipe(append, "systemctl", "disable", "smartdns")
-			append("完成: SmartDNS 已停止")
-			s.flushUI()
-		}()
-	})
-	list.AddItem("重启", "", 0, func() {
-		s.pages.RemovePage("modal")
-		logView := s.openLogModal("重启 SmartDNS")
-		go func() {
-			append := func(line string) { s.app.QueueUpdateDraw(func() { fmt.Fprintln(logView, line) }) }
-			append("重启 smartdns ...")
-			_ = runCmdPipe(append, "systemctl", "restart", "smartdns")
-			append("完成: SmartDNS 已重启")
-			s.flushUI()
-		}()
+		})
+		if err != nil {
+			s.toast("保存限制失败: " + err.Error())
+			return
+		}
+		s.pages.RemovePage("modal-limit-form")
+		s.openLimits()
+		s.applyLimitsAfterChange()
+	}
+	form.AddButton("保存", func() { save(false) })
+	if sub != "" {
+		form.AddButton("删除", func() { save(true) })
+	}
+	form.AddButton("取消", func() { s.pages.RemovePage("modal-limit-form") })
+	form.SetBorder(true).SetTitle(title).SetTitleAlign(tview.AlignLeft)
+	form.SetCancelFunc(func() { s.pages.RemovePage("modal-limit-form") })
+	s.pages.AddPage("modal-limit-form", center(60, 13, form), true, true)
+}
+
+// openDNSQuery asks for a domain or a platform name (StreamConfig sub).
+func (s *tvState) openDNSQuery() {
+	input := tview.NewInputField().SetLabel("域名或平台: ").SetFieldWidth(40)
+	form := tview.NewForm().AddFormItem(input)
+	form.AddButton("查询", func() {
+		q := strings.TrimSpace(input.GetText())
+		if q == "" {
+			s.toast("请输入域名或平台名")
+			return
+		}
+		s.pages.RemovePage("modal-dns-query")
+		s.runDNSQuery(q)
 	})
-	list.AddItem("查看配置", SMART_CONFIG_FILE, 0, func() {
-		s.pages.RemovePage("modal")
-		s.openConfigViewer("SmartDNS 配置", SMART_CONFIG_FILE)
+	form.AddButton("解释规则", func() {
+		q := strings.TrimSpace(input.GetText())
+		if q == "" {
+			s.toast("请输入域名或平台名")
+			return
+		}
+		s.pages.RemovePage("modal-dns-query")
+		s.runExplain(q)
 	})
-	list.AddItem("返回", "", 0, func() { s.pages.RemovePage("modal"); s.openServiceManager() })
-	s.pages.AddPage("modal", center(50, 14, list), true, true)
+	form.AddButton("取消", func() { s.pages.RemovePage("modal-dns-query") })
+	form.SetBorder(true).SetTitle("DNS 查询").SetTitleAlign(tview.AlignLeft)
+	form.SetCancelFunc(func() { s.pages.RemovePage("modal-dns-query") })
+	s.pages.AddPage("modal-dns-query", center(60, 7, form), true, true)
 }
 
-func (s *tvState) confirmUninstallSmartDNS() {
-	m := tview.NewModal().SetText("确认卸载 SmartDNS？\n将移除服务与二进制，保留 /etc/smartdns 配置。").AddButtons([]string{"确定", "取消"}).SetDoneFunc(func(i int, l string) {
-		s.pages.RemovePage("modal")
-		if i == 0 {
-			s.runOutsideUI("卸载 SmartDNS", uninstallSmartDNS)
-			s.flushUI()
-			s.toast("已卸载 SmartDNS（配置保留），界面已刷新")
+// runUnlockChecks checks the given platforms in a log modal and refreshes the list.
+func (s *tvState) runUnlockChecks(title string, subs []string) {
+	checks, _ := loadUnlockChecks()
+	var todo []string
+	for _, sub := range subs {
+		if _, ok := checks[sub]; ok {
+			todo = append(todo, sub)
 		}
-	})
-	s.pages.AddPage("modal", center(60, 8, m), true, true)
+	}
+	logView := s.openLogModal("解锁检测: " + title)
+	go func() {
+		append := func(line string) { s.app.QueueUpdateDraw(func() { fmt.Fprintln(logView, tview.Escape(line)) }) }
+		if len(todo) == 0 {
+			append("没有可检测的平台（可在 " + UNLOCK_CHECKS_FILE + " 中添加检测定义）")
+			return
+		}
+		results, err := checkPlatforms(unlockChecker{}, todo, append)
+		if err != nil {
+			append("[失败] 保存检测结果: " + err.Error())
+		} else {
+			append("[完成]")
+		}
+		s.app.QueueUpdateDraw(func() {
+			s.unlock = results
+			s.populateRight()
+		})
+	}()
 }
 
-func (s *tvState) openNginxActions() {
-	list := tview.NewList().ShowSecondaryText(false)
-	list.SetBorder(true).SetTitle("Nginx")
-	list.AddItem("安装 (nginx-extras)", "通过 apt 安装 nginx-extras 并启用", 0, func() {
-		s.pages.RemovePage("modal")
-		logView := s.openLogModal("安装 Nginx")
+// queryDomains expands a platform name to its StreamConfig domains.
+func (s *tvState) queryDomains(q string) []string {
+	var domains []string
+	for _, subs := range s.cfg {
+		if ds, ok := subs[q]; ok {
+			domains = append(domains, ds...)
+		}
+	}
+	if len(domains) == 0 {
+		return []string{q}
+	}
+	return domains
+}
+
+// runExplain shows which smartdns.conf rules win for a domain or platform.
+func (s *tvState) runExplain(q string) {
+	logView := s.openLogModal("规则解释: " + q)
+	cfg, err := loadSmartDNSConfig()
+	if err != nil {
+		fmt.Fprintln(logView, "[red]读取 smartdns.conf 失败: "+err.Error()+"[-]")
+		return
+	}
+	for _, d := range s.queryDomains(q) {
+		for _, l := range cfg.explain(d).lines() {
+			fmt.Fprintln(logView, tview.Escape(l))
+		}
+		fmt.Fprintln(logView)
+	}
+	logView.ScrollToBeginning()
+}
+
+// runDNSQuery traces one domain, or every domain of a platform, in a log modal.
+func (s *tvState) runDNSQuery(q string) {
+	domains := s.queryDomains(q)
+	title := "DNS 查询: " + q
+	if len(domains) > 1 || domains[0] != q {
+		title = fmt.Sprintf("DNS 查询: 平台 %s（%d 个域名）", q, len(domains))
+	}
+	logView := s.openLogModal(title)
+	go func() {
+		append := func(line string) { s.app.QueueUpdateDraw(func() { fmt.Fprintln(logView, line) }) }
+		for _, d := range domains {
+			traceDomain(d, append)
+			append("")
+		}
+		append("[完成]")
+	}()
+}
+
+// openWatchdogForm edits the health watchdog settings and (re)installs its service.
+func (s *tvState) openWatchdogForm() {
+	cfg := loadSettings().Watchdog
+	def := cfg.withDefaults()
+	form := tview.NewForm()
+	enabled := tview.NewCheckbox().SetLabel("启用: ").SetChecked(cfg.Enabled)
+	canary := tview.NewInputField().SetLabel("探测域名: ").SetText(def.Canary)
+	interval := tview.NewInputField().SetLabel("探测间隔(秒): ").SetText(strconv.Itoa(def.Interval))
+	failures := tview.NewInputField().SetLabel("连续失败次数: ").SetText(strconv.Itoa(def.Failures))
+	fallback := tview.NewInputField().SetLabel("备用 DNS: ").SetText(def.Fallback)
+	form.AddFormItem(enabled).AddFormItem(canary).AddFormItem(interval).AddFormItem(failures).AddFormItem(fallback)
+	form.AddButton("保存", func() {
+		var c watchdogConfig
+		c.Enabled = enabled.IsChecked()
+		c.Canary = strings.TrimSpace(canary.GetText())
+		var err error
+		if c.Interval, err = strconv.Atoi(strings.TrimSpace(interval.GetText())); err != nil || c.Interval <= 0 {
+			s.toast("探测间隔需为正整数")
+			return
+		}
+		if c.Failures, err = strconv.Atoi(strings.TrimSpace(failures.GetText())); err != nil || c.Failures <= 0 {
+			s.toast("失败次数需为正整数")
+			return
+		}
+		c.Fallback = strings.TrimSpace(fallback.GetText())
+		if net.ParseIP(c.Fallback) == nil {
+			s.toast("备用 DNS 需为 IP 地址")
+			return
+		}
+		if err := updateSettings(func(st *ctlSettings) { st.Watchdog = c }); err != nil {
+			s.toast("保存失败: " + err.Error())
+			return
+		}
+		s.pages.RemovePage("modal-watchdog")
+		logView := s.openLogModal("DNS 看门狗")
 		go func() {
 			append := func(line string) { s.app.QueueUpdateDraw(func() { fmt.Fprintln(logView, line) }) }
-			if err := installNginxStream(append); err != nil {
+			if err := syncWatchdogService(append); err != nil {
 				append("[失败] " + err.Error())
+			} else if c.Enabled {
+				append("[完成] 看门狗已启用")
 			} else {
-				append("[完成] Nginx 安装成功")
+				append("[完成] 看门狗已停用")
 			}
 			s.flushUI()
 		}()
 	})
-	list.AddItem("修复并加载 stream 模块", "写入模块加载文件并校验 nginx -t", 0, func() {
-		s.pages.RemovePage("modal")
-		logView := s.openLogModal("修复 Nginx stream 模块")
+	form.AddButton("取消", func() { s.pages.RemovePage("modal-watchdog") })
+	form.SetBorder(true).SetTitle("DNS 看门狗").SetTitleAlign(tview.AlignLeft)
+	form.SetCancelFunc(func() { s.pages.RemovePage("modal-watchdog") })
+	s.pages.AddPage("modal-watchdog", center(60, 15, form), true, true)
+}
+
+func (s *tvState) confirmResetQuota(u quotaUsage) {
+	text := fmt.Sprintf("重置 %s 的本月配额用量？\n当前已用 %s / %s", u.Name, humanBytes(u.Used), humanBytes(u.Quota))
+	m := tview.NewModal().SetText(text).AddButtons([]string{"重置", "取消"}).SetDoneFunc(func(i int, l string) {
+		s.pages.RemovePage("modal-quota-reset")
+		if i != 0 {
+			return
+		}
+		if err := resetQuota(u.Kind, u.Name); err != nil {
+			s.toast("重置失败: " + err.Error())
+			return
+		}
+		s.openLimits()
+		s.applyLimitsAfterChange()
+	})
+	s.pages.AddPage("modal-quota-reset", center(60, 8, m), true, true)
+}
+
+// applyLimitsAfterChange pushes saved limits to nginx; the built-in proxy reloads them itself.
+func (s *tvState) applyLimitsAfterChange() {
+	if s.backend == PROXY_BACKEND_BUILTIN || !fileExists(NGINX_MAIN_CONF) {
+		go func() { _ = syncQuotaTimer(nil) }()
+		return
+	}
+	logView := s.openLogModal("应用限速与配额")
+	go func() {
+		append := func(line string) { s.app.QueueUpdateDraw(func() { fmt.Fprintln(logView, line) }) }
+		if err := applyLimits(append); err != nil {
+			append("[失败] " + err.Error())
+		} else {
+			append("[完成] 限制已生效")
+		}
+		s.flushUI()
+	}()
+}
+
+// openTrafficStats shows the access-log analytics and refreshes it every few seconds
+// while the page is open. 1 / 7 / 3 switch between today, 7 and 30 days.
+func (s *tvState) openTrafficStats() {
+	var days atomic.Int32
+	days.Store(1)
+	view := tview.NewTextView().SetScrollable(true).SetWrap(false).SetDynamicColors(true)
+	view.SetBorder(true).SetTitleAlign(tview.AlignLeft)
+	stop := make(chan struct{})
+	var once sync.Once
+	closePage := func() {
+		once.Do(func() { close(stop) })
+		s.pages.RemovePage("modal-traffic")
+	}
+	refresh := func() {
+		d := int(days.Load())
+		_ = rollupTraffic()
+		text := renderTrafficReport(d)
+		s.app.QueueUpdateDraw(func() {
+			view.SetTitle(fmt.Sprintf("流量统计 (%d 天) [1]今日 [7]7天 [3]30天 [r]刷新 (Esc/q 关闭)", d))
+			view.SetText(text)
+		})
+	}
+	view.SetInputCapture(func(ev *tcell.EventKey) *tcell.EventKey {
+		switch {
+		case ev.Key() == tcell.KeyEsc || ev.Rune() == 'q':
+			closePage()
+			return nil
+		case ev.Rune() == '1':
+			days.Store(1)
+		case ev.Rune() == '7':
+			days.Store(7)
+		case ev.Rune() == '3':
+			days.Store(30)
+		case ev.Rune() == 'r':
+		default:
+			return ev
+		}
+		go refresh()
+		return nil
+	})
+	if s.pages.HasPage("modal-traffic") {
+		s.pages.RemovePage("modal-traffic")
+	}
+	view.SetText("读取访问日志 ...")
+	s.pages.AddPage("modal-traffic", center(120, 34, view), true, true)
+	s.app.SetFocus(view)
+	go func() {
+		refresh()
+		t := time.NewTicker(5 * time.Second)
+		defer t.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-t.C:
+				refresh()
+			}
+		}
+	}()
+}
+
+// openQueryStats shows the smartdns audit log statistics, refreshed every few
+// seconds. h / 1 / 7 / 3 pick the window; e turns auditing on or off.
+func (s *tvState) openQueryStats() {
+	var window atomic.Int32
+	window.Store(1)
+	view := tview.NewTextView().SetScrollable(true).SetWrap(false).SetDynamicColors(true)
+	view.SetBorder(true).SetTitleAlign(tview.AlignLeft)
+	stop := make(chan struct{})
+	var once sync.Once
+	closePage := func() {
+		once.Do(func() { close(stop) })
+		s.pages.RemovePage("modal-queries")
+	}
+	refresh := func() {
+		w := int(window.Load())
+		_ = rollupQueries()
+		text := renderQueryReport(w)
+		if !queryAuditEnabled() {
+			text = "[yellow]smartdns 审计日志未开启，按 e 开启（会重启 smartdns）[-]\n\n" + text
+		}
+		s.app.QueueUpdateDraw(func() {
+			view.SetTitle(fmt.Sprintf("DNS 查询统计 (%s) [h]1小时 [1]24小时 [7]7天 [3]30天 [e]开关审计 [r]刷新 (Esc/q 关闭)", queryWindows[w].Key))
+			view.SetText(text)
+		})
+	}
+	toggleAudit := func() {
+		enable := !queryAuditEnabled()
+		title := "关闭查询审计"
+		if enable {
+			title = "开启查询审计"
+		}
+		logView := s.openLogModal(title)
 		go func() {
 			append := func(line string) { s.app.QueueUpdateDraw(func() { fmt.Fprintln(logView, line) }) }
-			if err := writeStreamLoaderConf(); err != nil {
-				append("写入模块加载文件失败: " + err.Error())
+			if err := setQueryAudit(enable); err != nil {
+				append("[失败] " + err.Error())
+				return
+			}
+			append("已更新 " + SMART_CONFIG_FILE + "，重启 smartdns ...")
+			if err := serviceAction(append, "restart", "smartdns"); err != nil {
+				append("[失败] " + err.Error())
 			} else {
-				append("已写入 /etc/nginx/modules-enabled/50-mod-stream.conf")
+				append("完成: 查询审计" + queryAuditStatus())
+			}
+			refresh()
+			s.flushUI()
+		}()
+	}
+	view.SetInputCapture(func(ev *tcell.EventKey) *tcell.EventKey {
+		switch {
+		case ev.Key() == tcell.KeyEsc || ev.Rune() == 'q':
+			closePage()
+			return nil
+		case ev.Rune() == 'h':
+			window.Store(0)
+		case ev.Rune() == '1':
+			window.Store(1)
+		case ev.Rune() == '7':
+			window.Store(2)
+		case ev.Rune() == '3':
+			window.Store(3)
+		case ev.Rune() == 'e':
+			toggleAudit()
+			return nil
+		case ev.Rune() == 'r':
+		default:
+			return ev
+		}
+		go refresh()
+		return nil
+	})
+	if s.pages.HasPage("modal-queries") {
+		s.pages.RemovePage("modal-queries")
+	}
+	view.SetText("读取审计日志 ...")
+	s.pages.AddPage("modal-queries", center(110, 40, view), true, true)
+	s.app.SetFocus(view)
+	go func() {
+		refresh()
+		t := time.NewTicker(5 * time.Second)
+		defer t.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-t.C:
+				refresh()
+			}
+		}
+	}()
+}
+
+// openDiscover analyses the audit log and lists the proposed domains for
+// review: Enter/space marks one, a adds the marked ones to the local overlay,
+// i ignores them for good, r analyses again.
+func (s *tvState) openDiscover() {
+	list := tview.NewList().ShowSecondaryText(true)
+	list.SetBorder(true).SetTitle("发现缺失域名 [Enter]选择 [a]接受 [i]忽略 [r]重新分析 (Esc/q 关闭)").SetTitleAlign(tview.AlignLeft)
+	var cands []discoverCandidate
+	marked := map[string]bool{}
+	var render func()
+	render = func() {
+		cur := list.GetCurrentItem()
+		list.Clear()
+		if len(cands) == 0 {
+			list.AddItem("(没有候选域名)", "需要先开启查询审计并积累一段时间的查询", 0, nil)
+		}
+		for _, c := range cands {
+			c := c
+			mark := "[ ] "
+			if marked[c.Domain] {
+				mark = "[*] "
+			}
+			sec := fmt.Sprintf("    %s/%s  %d 次 %d 客户端  %s", c.Top, c.Platform, c.Hits, c.Clients, strings.Join(c.Evidence, "; "))
+			list.AddItem(mark+c.Domain, sec, 0, func() {
+				marked[c.Domain] = !marked[c.Domain]
+				render()
+			})
+		}
+		if cur >= 0 && cur < list.GetItemCount() {
+			list.SetCurrentItem(cur)
+		}
+	}
+	analyse := func() {
+		list.Clear()
+		list.AddItem("分析审计日志 ...", "", 0, nil)
+		go func() {
+			res, err := discoverDomains(discoverOptions{Resolve: true}, nil)
+			s.app.QueueUpdateDraw(func() {
+				if err != nil {
+					list.Clear()
+					list.AddItem("[red]"+err.Error()+"[-]", "", 0, nil)
+					return
+				}
+				cands, marked = res, map[string]bool{}
+				render()
+			})
+		}()
+	}
+	chosen := func() []discoverCandidate {
+		var out []discoverCandidate
+		for _, c := range cands {
+			if marked[c.Domain] {
+				out = append(out, c)
+			}
+		}
+		return out
+	}
+	list.SetInputCapture(func(ev *tcell.EventKey) *tcell.EventKey {
+		switch {
+		case ev.Key() == tcell.KeyEsc || ev.Rune() == 'q':
+			s.pages.RemovePage("modal-discover")
+		case ev.Rune() == ' ':
+			if i := list.GetCurrentItem(); i >= 0 && i < len(cands) {
+				marked[cands[i].Domain] = !marked[cands[i].Domain]
+				render()
+			}
+		case ev.Rune() == 'r':
+			analyse()
+		case ev.Rune() == 'i':
+			sel := chosen()
+			if len(sel) == 0 {
+				s.toast("请先选择域名")
+				return nil
+			}
+			var names []string
+			for _, c := range sel {
+				names = append(names, c.Domain)
+			}
+			if err := ignoreDiscovered(names); err != nil {
+				s.toast("保存失败: " + err.Error())
+				return nil
+			}
+			cands = loadDiscoverCandidates()
+			render()
+		case ev.Rune() == 'a':
+			sel := chosen()
+			if len(sel) == 0 {
+				s.toast("请先选择域名")
+				return nil
+			}
+			s.pages.RemovePage("modal-discover")
+			s.acceptDiscovered(sel)
+		default:
+			return ev
+		}
+		return nil
+	})
+	if s.pages.HasPage("modal-discover") {
+		s.pages.RemovePage("modal-discover")
+	}
+	s.pages.AddPage("modal-discover", center(110, 30, list), true, true)
+	s.app.SetFocus(list)
+	analyse()
+}
+
+// acceptDiscovered writes the accepted names to the overlay, reloads
+// StreamConfig and brings smartdns and nginx in line.
+func (s *tvState) acceptDiscovered(sel []discoverCandidate) {
+	logView := s.openLogModal("接受候选域名")
+	go func() {
+		append := func(line string) { s.app.QueueUpdateDraw(func() { fmt.Fprintln(logView, line) }) }
+		restart, err := acceptDiscovered(sel, append)
+		if err != nil {
+			append("[失败] " + err.Error())
+			return
+		}
+		if restart {
+			append("重启 smartdns ...")
+			if err := serviceAction(append, "restart", "smartdns"); err != nil {
+				append("[失败] " + err.Error())
+			}
+		}
+		if s.backend == PROXY_BACKEND_NGINX && fileExists(NGINX_MAIN_CONF) {
+			if err := applyNginxProxyConfigs(append); err != nil {
+				append("[失败] " + err.Error())
+			}
+		}
+		if cfg, err := loadStreamConfig(); err == nil {
+			s.app.QueueUpdateDraw(func() {
+				s.cfg = cfg
+				s.topKeys, s.subMap = buildTopSub(cfg)
+				s.refreshAssignments()
+				s.populateLeft()
+				s.populateRight()
+			})
+		}
+		append("[完成] 已加入 " + streamConfigLocalPath())
+		s.flushUI()
+	}()
+}
+
+// openJournal follows a service's log (journal or log file). 1 / 2 / 3 show
+// everything, warnings and up, or errors only; the backlog is reloaded on change.
+func (s *tvState) openJournal(name string) {
+	src := journalSourceFor(name)
+	var maxSev atomic.Int32
+	maxSev.Store(sevDebug)
+	view := tview.NewTextView().SetScrollable(true).SetWrap(true).SetDynamicColors(true)
+	view.SetBorder(true).SetTitleAlign(tview.AlignLeft)
+	ctx, cancel := context.WithCancel(context.Background())
+	format := func(l journalLine) string {
+		color := "white"
+		switch {
+		case l.Severity <= sevErr:
+			color = "red"
+		case l.Severity == sevWarning:
+			color = "yellow"
+		case l.Severity >= sevDebug:
+			color = "gray"
+		}
+		return "[" + color + "]" + tview.Escape(l.String()) + "[-]"
+	}
+	load := func() {
+		sev := int(maxSev.Load())
+		levels := map[int]string{sevDebug: "全部", sevWarning: "警告及以上", sevErr: "仅错误"}
+		lines, err := readJournal(src, 300, sev)
+		s.app.QueueUpdateDraw(func() {
+			view.SetTitle(fmt.Sprintf("%s 日志 (%s, %s) [1]全部 [2]警告 [3]错误 (Esc/q 关闭)", name, src, levels[sev]))
+			view.Clear()
+			if err != nil {
+				fmt.Fprintln(view, "[red]读取失败: "+tview.Escape(err.Error())+"[-]")
+			}
+			for _, l := range lines {
+				fmt.Fprintln(view, format(l))
+			}
+			view.ScrollToEnd()
+		})
+	}
+	view.SetInputCapture(func(ev *tcell.EventKey) *tcell.EventKey {
+		switch {
+		case ev.Key() == tcell.KeyEsc || ev.Rune() == 'q':
+			cancel()
+			s.pages.RemovePage("modal-journal")
+			return nil
+		case ev.Rune() == '1':
+			maxSev.Store(sevDebug)
+		case ev.Rune() == '2':
+			maxSev.Store(sevWarning)
+		case ev.Rune() == '3':
+			maxSev.Store(sevErr)
+		default:
+			return ev
+		}
+		go load()
+		return nil
+	})
+	if s.pages.HasPage("modal-journal") {
+		s.pages.RemovePage("modal-journal")
+	}
+	s.pages.AddPage("modal-journal", center(130, 36, view), true, true)
+	s.app.SetFocus(view)
+	go func() {
+		load()
+		_ = followJournal(ctx, src, func(l journalLine) {
+			if l.Severity > int(maxSev.Load()) {
+				return
+			}
+			s.app.QueueUpdateDraw(func() {
+				fmt.Fprintln(view, format(l))
+				view.ScrollToEnd()
+			})
+		})
+	}()
+}
+
+// openOpLog shows the audit trail, newest at the bottom; a also shows the
+// ordinary log lines, r reloads.
+func (s *tvState) openOpLog() {
+	all := false
+	view := tview.NewTextView().SetScrollable(true).SetWrap(false).SetDynamicColors(true)
+	view.SetBorder(true).SetTitleAlign(tview.AlignLeft)
+	load := func() {
+		title := "操作日志: 审计记录"
+		if all {
+			title = "操作日志: 全部"
+		}
+		view.SetTitle(title + " [a]切换全部/审计 [r]刷新 (Esc/q 关闭)")
+		var b strings.Builder
+		entries := readOpEntries(500, all)
+		if len(entries) == 0 {
+			b.WriteString("(暂无记录)\n")
+		}
+		for _, e := range entries {
+			for _, l := range e.lines(true) {
+				b.WriteString(l + "\n")
+			}
+		}
+		view.SetText(b.String())
+		view.ScrollToEnd()
+	}
+	view.SetInputCapture(func(ev *tcell.EventKey) *tcell.EventKey {
+		switch {
+		case ev.Key() == tcell.KeyEsc || ev.Rune() == 'q':
+			s.pages.RemovePage("modal-oplog")
+		case ev.Rune() == 'a':
+			all = !all
+			load()
+		case ev.Rune() == 'r':
+			load()
+		default:
+			return ev
+		}
+		return nil
+	})
+	load()
+	if s.pages.HasPage("modal-oplog") {
+		s.pages.RemovePage("modal-oplog")
+	}
+	s.pages.AddPage("modal-oplog", center(120, 34, view), true, true)
+	s.app.SetFocus(view)
+}
+
+// openSelfUpdate shows the current and latest smartdnsctl with the changelog;
+// u updates, b rolls back, c switches the update channel.
+func (s *tvState) openSelfUpdate() {
+	view := tview.NewTextView().SetScrollable(true).SetWrap(true).SetDynamicColors(true)
+	view.SetBorder(true).SetTitle("更新 smartdnsctl [u]更新 [b]回滚 [c]切换通道 [r]刷新 (Esc/q 关闭)").SetTitleAlign(tview.AlignLeft)
+	var info selfUpdateInfo
+	load := func() {
+		view.SetText("检查更新 ...")
+		go func() {
+			res, err := checkSelfUpdate()
+			s.app.QueueUpdateDraw(func() {
+				info = res
+				var b strings.Builder
+				fmt.Fprintf(&b, "当前版本: %s    更新通道: %s\n", tview.Escape(res.Current), res.Channel)
+				if exe, err := selfExecutable(); err == nil && fileExists(exe+".prev") {
+					b.WriteString("可回滚: " + exe + ".prev\n")
+				}
+				switch {
+				case err != nil:
+					b.WriteString("[red]" + tview.Escape(err.Error()) + "[-]\n")
+				case !res.available():
+					b.WriteString("最新版本: " + res.Latest.Tag + "，[green]已是最新[-]\n")
+				default:
+					b.WriteString("最新版本: [yellow]" + res.Latest.Tag + "[-]，按 u 更新\n\n")
+					for _, l := range res.changelog() {
+						b.WriteString(tview.Escape(l) + "\n")
+					}
+				}
+				view.SetText(b.String())
+			})
+		}()
+	}
+	run := func(title string, fn func(log func(string)) error) {
+		logView := s.openLogModal(title)
+		go func() {
+			append := func(line string) { s.app.QueueUpdateDraw(func() { fmt.Fprintln(logView, line) }) }
+			if err := fn(append); err != nil {
+				append("[失败] " + err.Error())
+				return
+			}
+			append("[完成]")
+			s.app.QueueUpdateDraw(func() { s.confirmReexec() })
+		}()
+	}
+	view.SetInputCapture(func(ev *tcell.EventKey) *tcell.EventKey {
+		switch {
+		case ev.Key() == tcell.KeyEsc || ev.Rune() == 'q':
+			s.pages.RemovePage("modal-selfupdate")
+		case ev.Rune() == 'r':
+			load()
+		case ev.Rune() == 'u':
+			if !info.available() {
+				s.toast("没有可用的更新")
+				return nil
 			}
-			if err := nginxTestAndReload(append); err != nil {
-				append("[失败] nginx -t 或重载失败: " + err.Error())
+			rel := info.Latest
+			run("更新 smartdnsctl 到 "+rel.Tag, func(log func(string)) error { return applySelfUpdate(rel, false, log) })
+		case ev.Rune() == 'b':
+			run("回滚 smartdnsctl", rollbackSelf)
+		case ev.Rune() == 'c':
+			next := UPDATE_PRERELEASE
+			if info.Channel == UPDATE_PRERELEASE {
+				next = UPDATE_STABLE
+			}
+			if err := updateSettings(func(st *ctlSettings) { st.UpdateChannel = next }); err != nil {
+				s.toast("保存失败: " + err.Error())
+				return nil
+			}
+			load()
+		default:
+			return ev
+		}
+		return nil
+	})
+	load()
+	s.pages.AddPage("modal-selfupdate", center(100, 30, view), true, true)
+	s.app.SetFocus(view)
+}
+
+// openDownloadForm edits the download proxy and the GitHub mirror list; "测试"
+// fetches StreamConfig.yaml with the values in the form without saving them.
+func (s *tvState) openDownloadForm() {
+	settings := loadSettings()
+	cur := settings.DownloadProxy
+	types := []string{OUTBOUND_DIRECT, OUTBOUND_SOCKS5, OUTBOUND_HTTP}
+	typeIdx := 0
+	for i, t := range types {
+		if t == cur.Type {
+			typeIdx = i
+		}
+	}
+	form := tview.NewForm()
+	typeDrop := tview.NewDropDown().SetLabel("代理类型: ").SetOptions([]string{"直连（或 *_PROXY 环境变量）", "SOCKS5", "HTTP"}, nil).SetCurrentOption(typeIdx)
+	addr := tview.NewInputField().SetLabel("代理地址 host:port: ").SetText(cur.Addr)
+	user := tview.NewInputField().SetLabel("用户名: ").SetText(cur.User)
+	pass := tview.NewInputField().SetLabel("密码: ").SetText(cur.Pass).SetMaskCharacter('*')
+	mirrors := tview.NewTextArea().SetLabel("GitHub 镜像（每行一个）: ").SetText(strings.Join(settings.DownloadMirrors, "\n"), false).SetSize(5, 0)
+	mirrors.SetPlaceholder("https://ghproxy.net/\ndirect")
+	api := tview.NewInputField().SetLabel("发布 API: ").SetText(settings.ReleaseAPI).SetPlaceholder(GITHUB_API_URL)
+	form.AddFormItem(typeDrop).AddFormItem(addr).AddFormItem(user).AddFormItem(pass).AddFormItem(mirrors).AddFormItem(api)
+	read := func() (outboundRoute, []string) {
+		i, _ := typeDrop.GetCurrentOption()
+		o := outboundRoute{Type: types[i]}
+		if !o.isDirect() {
+			o.Addr = strings.TrimSpace(addr.GetText())
+			o.User = strings.TrimSpace(user.GetText())
+			o.Pass = pass.GetText()
+		}
+		var list []string
+		for _, l := range strings.Split(mirrors.GetText(), "\n") {
+			if l = strings.TrimSpace(l); l != "" {
+				list = append(list, l)
+			}
+		}
+		return o, list
+	}
+	form.AddButton("保存", func() {
+		o, list := read()
+		if err := o.validate(); err != nil {
+			s.toast(err.Error())
+			return
+		}
+		err := updateSettings(func(st *ctlSettings) {
+			st.DownloadProxy = o
+			if o.isDirect() {
+				st.DownloadProxy = outboundRoute{}
+			}
+			st.DownloadMirrors = list
+			st.ReleaseAPI = strings.TrimSpace(api.GetText())
+		})
+		if err != nil {
+			s.toast("保存下载设置失败: " + err.Error())
+			return
+		}
+		s.pages.RemovePage("modal-download")
+		s.toast("下载设置已保存")
+	})
+	form.AddButton("测试", func() {
+		o, list := read()
+		if err := o.validate(); err != nil {
+			s.toast(err.Error())
+			return
+		}
+		logView := s.openLogModal("测试下载")
+		go func() {
+			append := func(line string) { s.app.QueueUpdateDraw(func() { fmt.Fprintln(logView, line) }) }
+			dir, err := os.MkdirTemp("", "smartdnsctl-download-")
+			if err != nil {
+				append("[失败] " + err.Error())
+				return
+			}
+			defer os.RemoveAll(dir)
+			if list == nil {
+				list = []string{} // an empty form means no mirrors, not the saved ones
+			}
+			append("下载 " + REMOTE_STREAM_CONFIG_FILE_URL)
+			if err := download(REMOTE_STREAM_CONFIG_FILE_URL, dir+"/StreamConfig.yaml", downloadOptions{Proxy: &o, Mirrors: list, Log: append}); err != nil {
+				append("[失败] " + err.Error())
 			} else {
-				append("[完成] 模块加载并校验成功")
+				append("[完成] 下载可用")
 			}
+		}()
+	})
+	form.AddButton("取消", func() { s.pages.RemovePage("modal-download") })
+	form.SetBorder(true).SetTitle("下载设置").SetTitleAlign(tview.AlignLeft)
+	form.SetCancelFunc(func() { s.pages.RemovePage("modal-download") })
+	s.pages.AddPage("modal-download", center(76, 22, form), true, true)
+}
+
+// confirmReexec offers to restart into the new binary.
+func (s *tvState) confirmReexec() {
+	text := "smartdnsctl 已替换，是否立即重启程序？"
+	if s.dirty {
+		text += "\n注意：当前分组有未保存的更改，重启后将丢失。"
+	}
+	m := tview.NewModal().SetText(text).AddButtons([]string{"立即重启", "稍后"}).SetDoneFunc(func(i int, l string) {
+		s.pages.RemovePage("modal-reexec")
+		if i == 0 {
+			s.reexec = true
+			s.app.Stop()
+		}
+	})
+	s.pages.AddPage("modal-reexec", center(60, 8, m), true, true)
+}
+
+// withPortCheck runs fn in a log modal, first offering to stop whatever else
+// listens on ports (dnsmasq, named, caddy, apache ...).
+func (s *tvState) withPortCheck(title string, ports []int, owners []string, fn func(append func(string))) {
+	run := func(stop, disable bool, conflicts []portListener) {
+		logView := s.openLogModal(title)
+		go func() {
+			append := func(line string) { s.app.QueueUpdateDraw(func() { fmt.Fprintln(logView, line) }) }
+			if stop {
+				if err := stopPortOwners(append, conflicts, disable); err != nil {
+					append("[警告] " + err.Error())
+				}
+			}
+			fn(append)
 			s.flushUI()
 		}()
+	}
+	conflicts := portConflicts(ports, owners)
+	if len(conflicts) == 0 {
+		run(false, false, nil)
+		return
+	}
+	var b strings.Builder
+	b.WriteString("以下进程占用了所需端口：\n")
+	for _, l := range conflicts {
+		b.WriteString(l.String() + "\n")
+	}
+	b.WriteString("是否先停止它们？")
+	m := tview.NewModal().SetText(b.String()).
+		AddButtons([]string{"停止并禁用", "仅停止", "忽略继续", "取消"}).
+		SetDoneFunc(func(i int, l string) {
+			s.pages.RemovePage("modal-ports")
+			switch i {
+			case 0:
+				run(true, true, conflicts)
+			case 1:
+				run(true, false, conflicts)
+			case 2:
+				run(false, false, nil)
+			}
+		})
+	s.pages.AddPage("modal-ports", center(80, 10+len(conflicts), m), true, true)
+}
+
+func (s *tvState) confirmEmergencyResetDNS() {
+	text := "将停止 smartdns，并把 /etc/resolv.conf 直接设置为 8.8.8.8（保留 search/options）。\n确定要执行紧急重置吗？"
+	m := tview.NewModal().SetText(text).AddButtons([]string{"执行", "取消"}).SetDoneFunc(func(i int, l string) {
+		s.pages.RemovePage("modal-emg")
+		if i == 0 {
+			logView := s.openLogModal("紧急重置 DNS")
+			go func() {
+				append := func(line string) { s.app.QueueUpdateDraw(func() { fmt.Fprintln(logView, line) }) }
+				append("停止 smartdns ...")
+				_ = serviceAction(append, "stop", "smartdns")
+				append("写入 /etc/resolv.conf -> 8.8.8.8 ...")
+				if err := forceResolvConf("8.8.8.8", append); err != nil {
+					append("[失败] " + err.Error())
+				} else {
+					append("完成: 已紧急重置 DNS 为 8.8.8.8（可用“恢复系统 DNS”还原）")
+				}
+				s.flushUI()
+			}()
+		}
 	})
-	list.AddItem("写入/刷新代理配置并重载", "为 80/443 写入反向代理并 nginx -t && reload", 0, func() {
+	s.pages.AddPage("modal-emg", center(70, 8, m), true, true)
+}
+
+func (s *tvState) openSmartDNSActions() {
+	list := tview.NewList().ShowSecondaryText(false)
+	list.SetBorder(true).SetTitle("SmartDNS")
+	installed := installedSmartDNSVersion()
+	installLabel := "安装 / 升级（未安装）"
+	if installed != "" {
+		installLabel = "安装 / 升级（已安装 " + installed + "）"
+	}
+	list.AddItem(installLabel, "选择发布版本安装", 0, func() {
+		s.pages.RemovePage("modal")
+		s.openSmartDNSVersions()
+	})
+	// the latest release is looked up in the background and shown once known
+	go func() {
+		_, latest, err := smartdnsVersionStatus()
+		if err != nil {
+			return
+		}
+		s.app.QueueUpdateDraw(func() {
+			text := strings.TrimSuffix(installLabel, "）") + " / 最新 " + latest.Tag + "）"
+			if installed != "" && latest.newerThan(installed) {
+				text = "升级到 " + latest.Tag + "（已安装 " + installed + "）"
+			}
+			list.SetItemText(0, text, "选择发布版本安装")
+		})
+	}()
+	list.AddItem("从本地安装", "本地安装包 / .deb / 离线包目录", 0, func() {
+		s.pages.RemovePage("modal")
+		s.promptLocalSource("SmartDNS", s.installSmartDNSLocal)
+	})
+	list.AddItem("制作离线包", "下载本架构的 SmartDNS 与 nginx 供无网络节点使用", 0, func() {
+		s.pages.RemovePage("modal")
+		s.promptPath("制作离线包", "输出目录: ", "/root/smartdnsctl-bundle", func(dir string) {
+			logView := s.openLogModal("制作离线包")
+			go func() {
+				append := func(line string) { s.app.QueueUpdateDraw(func() { fmt.Fprintln(logView, line) }) }
+				if err := createBundle(dir, bundleOptions{Nginx: true}, append); err != nil {
+					append("[失败] " + err.Error())
+				} else {
+					append("[完成] 复制整个目录到目标节点后，用“从本地安装”选择该目录")
+				}
+			}()
+		})
+	})
+	list.AddItem("卸载", "移除服务与二进制（保留配置）", 0, func() {
+		s.pages.RemovePage("modal")
+		s.confirmUninstallSmartDNS()
+	})
+	if fileExists(SMARTDNS_BIN + ".prev") {
+		prev := "回滚到上一版本"
+		if m, ok := loadSmartDNSManifest(); ok && m.Previous != "" {
+			prev += "（" + m.Previous + "）"
+		}
+		list.AddItem(prev, "恢复升级前的二进制并重启", 0, func() {
+			s.pages.RemovePage("modal")
+			logView := s.openLogModal("回滚 SmartDNS")
+			go func() {
+				append := func(line string) { s.app.QueueUpdateDraw(func() { fmt.Fprintln(logView, line) }) }
+				if err := rollbackSmartDNS(append); err != nil {
+					append("[失败] " + err.Error())
+				} else {
+					append("[完成] 已回滚")
+				}
+				s.flushUI()
+			}()
+		})
+	}
+	list.AddItem("启动", "", 0, func() {
 		s.pages.RemovePage("modal")
-		logView := s.openLogModal("写入 Nginx 配置并重载")
+		logView := s.openLogModal("启动 SmartDNS")
 		go func() {
 			append := func(line string) { s.app.QueueUpdateDraw(func() { fmt.Fprintln(logView, line) }) }
-			if err := ensureNginxProxyConfigs(append); err != nil {
+			append("启动 smartdns ...")
+			if err := serviceAction(append, "start", "smartdns"); err != nil {
+				append("[失败] " + err.Error())
+				s.flushUI()
+				return
+			}
+			append("启用 smartdns 开机自启 ...")
+			_ = serviceAction(append, "enable", "smartdns")
+			append("完成: SmartDNS 已启动（未覆盖系统 DNS）")
+			s.flushUI()
+		}()
+	})
+	list.AddItem("停止", "", 0, func() {
+		s.pages.RemovePage("modal")
+		logView := s.openLogModal("停止 SmartDNS")
+		go func() {
+			append := func(line string) { s.app.QueueUpdateDraw(func() { fmt.Fprintln(logView, line) }) }
+			append("停止 smartdns ...")
+			_ = serviceAction(append, "stop", "smartdns")
+			append("禁用 smartdns 开机自启 ...")
+			_ = serviceAction(append, "disable", "smartdns")
+			append("完成: SmartDNS 已停止")
+			s.flushUI()
+		}()
+	})
+	list.AddItem("重启", "", 0, func() {
+		s.pages.RemovePage("modal")
+		logView := s.openLogModal("重启 SmartDNS")
+		go func() {
+			append := func(line string) { s.app.QueueUpdateDraw(func() { fmt.Fprintln(logView, line) }) }
+			append("重启 smartdns ...")
+			if err := serviceAction(append, "restart", "smartdns"); err != nil {
 				append("[失败] " + err.Error())
 			} else {
-				if err := nginxTestAndReload(append); err != nil {
-					append("[失败] nginx -t 或重载失败: " + err.Error())
+				append("完成: SmartDNS 已重启")
+			}
+			s.flushUI()
+		}()
+	})
+	list.AddItem("查看配置", SMART_CONFIG_FILE, 0, func() {
+		s.pages.RemovePage("modal")
+		s.openConfigViewer("SmartDNS 配置", SMART_CONFIG_FILE)
+	})
+	list.AddItem("查看日志", journalSourceFor("smartdns").String(), 0, func() {
+		s.pages.RemovePage("modal")
+		s.openJournal("smartdns")
+	})
+	list.AddItem("返回", "", 0, func() { s.pages.RemovePage("modal"); s.openServiceManager() })
+	s.pages.AddPage("modal", center(60, 16, list), true, true)
+}
+
+// openSmartDNSVersions lists the releases installable on this architecture;
+// Enter installs (or upgrades to) the selected one.
+func (s *tvState) openSmartDNSVersions() {
+	list := tview.NewList().ShowSecondaryText(true)
+	list.SetBorder(true).SetTitle("SmartDNS 版本 [Enter]安装 (Esc/q 返回)").SetTitleAlign(tview.AlignLeft)
+	list.AddItem("获取发布列表 ...", releaseAPIBase(), 0, nil)
+	list.SetInputCapture(func(ev *tcell.EventKey) *tcell.EventKey {
+		if ev.Key() == tcell.KeyEsc || ev.Rune() == 'q' {
+			s.pages.RemovePage("modal-versions")
+			s.openSmartDNSActions()
+			return nil
+		}
+		return ev
+	})
+	go func() {
+		rels, err := smartdnsReleases()
+		installed := installedSmartDNSVersion()
+		s.app.QueueUpdateDraw(func() {
+			list.Clear()
+			if err != nil {
+				list.AddItem("[red]"+tview.Escape(err.Error())+"[-]", "可在设置文件中配置 release_api 镜像", 0, nil)
+				return
+			}
+			latest := latestSmartDNSRelease(rels)
+			for _, r := range rels {
+				r := r
+				text := r.String()
+				switch {
+				case r.Version == installed:
+					text += " [已安装]"
+				case r.Tag == latest.Tag:
+					text += " [最新]"
+				}
+				sec := "    " + r.Published.Format("2006-01-02") + "  " + r.Asset.Name
+				if r.Asset.Digest == "" {
+					sec += "  (校验值需从校验文件获取或缺失)"
+				}
+				list.AddItem(tview.Escape(text), sec, 0, func() {
+					s.pages.RemovePage("modal-versions")
+					s.confirmInstallSmartDNS(r, installed)
+				})
+			}
+		})
+	}()
+	s.pages.AddPage("modal-versions", center(100, 24, list), true, true)
+}
+
+// confirmInstallSmartDNS asks before installing rel; a release without a
+// published checksum needs a second, explicit confirmation.
+func (s *tvState) confirmInstallSmartDNS(rel smartdnsRelease, installed string) {
+	install := func(insecure bool) {
+		s.withPortCheck("安装 SmartDNS "+rel.Tag, []int{53}, dnsPortOwners(), func(append func(string)) {
+			if err := installSmartDNSStream(rel.Tag, insecure, append); err != nil {
+				append("[失败] " + err.Error())
+				if isDownloadError(err) {
+					s.app.QueueUpdateDraw(func() { s.promptLocalSource("SmartDNS", s.installSmartDNSLocal) })
+				}
+			} else {
+				append("[完成] SmartDNS " + rel.Version + " 安装成功")
+			}
+		})
+	}
+	action := "安装"
+	if installed != "" {
+		action = "从 " + installed + " 切换到"
+	}
+	m := tview.NewModal().SetText(action + " " + rel.String() + "？").AddButtons([]string{"确定", "取消"}).SetDoneFunc(func(i int, l string) {
+		s.pages.RemovePage("modal-install")
+		if i != 0 {
+			return
+		}
+		go func() {
+			want, err := rel.expectedSHA256()
+			s.app.QueueUpdateDraw(func() {
+				switch {
+				case err != nil:
+					s.toast(err.Error())
+				case want != "":
+					install(false)
+				default:
+					w := tview.NewModal().SetText(rel.Tag + " 未发布校验值，无法校验安装包。\n确认来源可信并跳过校验？").
+						AddButtons([]string{"跳过校验安装", "取消"}).SetDoneFunc(func(i int, l string) {
+						s.pages.RemovePage("modal-install")
+						if i == 0 {
+							install(true)
+						}
+					})
+					s.pages.AddPage("modal-install", center(70, 8, w), true, true)
+				}
+			})
+		}()
+	})
+	s.pages.AddPage("modal-install", center(70, 8, m), true, true)
+}
+
+// promptPath asks for a filesystem path and hands it to fn.
+func (s *tvState) promptPath(title, label, def string, fn func(path string)) {
+	form := tview.NewForm()
+	input := tview.NewInputField().SetLabel(label).SetText(def).SetFieldWidth(50)
+	form.AddFormItem(input)
+	form.AddButton("确定", func() {
+		path := strings.TrimSpace(input.GetText())
+		if path == "" {
+			return
+		}
+		s.pages.RemovePage("modal-path")
+		fn(path)
+	})
+	form.AddButton("取消", func() { s.pages.RemovePage("modal-path") })
+	form.SetBorder(true).SetTitle(title).SetTitleAlign(tview.AlignLeft)
+	s.pages.AddPage("modal-path", center(80, 7, form), true, true)
+}
+
+// promptLocalSource offers a local package when downloading failed (or on request).
+func (s *tvState) promptLocalSource(what string, install func(path string)) {
+	s.promptPath("从本地安装 "+what+"（无法联网时使用）", "安装包 / .deb / 离线包目录: ", "", func(path string) {
+		if _, err := os.Stat(path); err != nil {
+			s.toast("路径不可用: " + err.Error())
+			return
+		}
+		install(path)
+	})
+}
+
+func (s *tvState) installSmartDNSLocal(path string) {
+	s.withPortCheck("从本地安装 SmartDNS", []int{53}, dnsPortOwners(), func(append func(string)) {
+		if err := installSmartDNSFrom(path, append); err != nil {
+			append("[失败] " + err.Error())
+		} else {
+			append("[完成] SmartDNS 安装成功")
+		}
+	})
+}
+
+func (s *tvState) installNginxLocal(path string) {
+	logView := s.openLogModal("从本地安装 Nginx")
+	go func() {
+		append := func(line string) { s.app.QueueUpdateDraw(func() { fmt.Fprintln(logView, line) }) }
+		if err := installNginxFrom(path, append); err != nil {
+			append("[失败] " + err.Error())
+		} else {
+			append("[完成] Nginx 安装成功")
+		}
+		s.flushUI()
+	}()
+}
+
+func (s *tvState) confirmUninstallSmartDNS() {
+	m := tview.NewModal().SetText("确认卸载 SmartDNS？\n将移除安装清单中的服务与二进制，保留 /etc/smartdns 配置。").AddButtons([]string{"确定", "取消"}).SetDoneFunc(func(i int, l string) {
+		s.pages.RemovePage("modal")
+		if i == 0 {
+			logView := s.openLogModal("卸载 SmartDNS")
+			go func() {
+				append := func(line string) { s.app.QueueUpdateDraw(func() { fmt.Fprintln(logView, line) }) }
+				if err := uninstallSmartDNSStream(append); err != nil {
+					append("[失败] " + err.Error())
 				} else {
-					append("[完成] Nginx 配置已生效")
+					append("[完成] 已卸载 SmartDNS（配置保留）")
+				}
+				s.flushUI()
+			}()
+		}
+	})
+	s.pages.AddPage("modal", center(60, 8, m), true, true)
+}
+
+func (s *tvState) openNginxActions() {
+	list := tview.NewList().ShowSecondaryText(false)
+	list.SetBorder(true).SetTitle("Nginx")
+	list.AddItem("安装 (nginx-extras)", "通过 apt 安装 nginx-extras 并启用", 0, func() {
+		s.pages.RemovePage("modal")
+		logView := s.openLogModal("安装 Nginx")
+		go func() {
+			append := func(line string) { s.app.QueueUpdateDraw(func() { fmt.Fprintln(logView, line) }) }
+			if err := installNginxStream(append); err != nil {
+				append("[失败] " + err.Error())
+				if isDownloadError(err) {
+					s.app.QueueUpdateDraw(func() { s.promptLocalSource("Nginx", s.installNginxLocal) })
+				}
+			} else {
+				append("[完成] Nginx 安装成功")
+			}
+			s.flushUI()
+		}()
+	})
+	list.AddItem("从本地安装", ".deb / deb 目录 / 离线包目录", 0, func() {
+		s.pages.RemovePage("modal")
+		s.promptLocalSource("Nginx", s.installNginxLocal)
+	})
+	list.AddItem("修复并加载 stream 模块", "写入模块加载文件并校验 nginx -t", 0, func() {
+		s.pages.RemovePage("modal")
+		logView := s.openLogModal("修复 Nginx stream 模块")
+		go func() {
+			append := func(line string) { s.app.QueueUpdateDraw(func() { fmt.Fprintln(logView, line) }) }
+			err := applyNginxChange(append, func() error {
+				if err := writeStreamLoaderConf(); err != nil {
+					return fmt.Errorf("写入模块加载文件失败: %w", err)
 				}
+				append("已写入 " + NGINX_STREAM_LOADER)
+				return nil
+			})
+			if err != nil {
+				append("[失败] " + err.Error())
+			} else {
+				append("[完成] 模块加载并校验成功")
 			}
 			s.flushUI()
 		}()
 	})
+	list.AddItem("写入/刷新代理配置并重载", "为 80/443 写入反向代理并 nginx -t && reload", 0, func() {
+		s.pages.RemovePage("modal")
+		s.withPortCheck("写入 Nginx 配置并重载", []int{80, 443}, proxyPortOwners(), func(append func(string)) {
+			if err := applyNginxProxyConfigs(append); err != nil {
+				append("[失败] " + err.Error())
+			} else {
+				append("[完成] Nginx 配置已生效")
+			}
+		})
+	})
 	list.AddItem("启动", "", 0, func() {
 		s.pages.RemovePage("modal")
 		logView := s.openLogModal("启动 Nginx")
 		go func() {
 			append := func(line string) { s.app.QueueUpdateDraw(func() { fmt.Fprintln(logView, line) }) }
-			_ = runCmdPipe(append, "systemctl", "start", "nginx")
+			if err := serviceAction(append, "start", "nginx"); err != nil {
+				append("[失败] " + err.Error())
+			} else {
+				append("[完成] Nginx 已启动")
+			}
 			s.flushUI()
 		}()
 	})
@@ -1364,7 +2833,7 @@ func (s *tvState) openNginxActions() {
 		logView := s.openLogModal("停止 Nginx")
 		go func() {
 			append := func(line string) { s.app.QueueUpdateDraw(func() { fmt.Fprintln(logView, line) }) }
-			_ = runCmdPipe(append, "systemctl", "stop", "nginx")
+			_ = serviceAction(append, "stop", "nginx")
 			s.flushUI()
 		}()
 	})
@@ -1373,10 +2842,35 @@ func (s *tvState) openNginxActions() {
 		logView := s.openLogModal("重启 Nginx")
 		go func() {
 			append := func(line string) { s.app.QueueUpdateDraw(func() { fmt.Fprintln(logView, line) }) }
-			_ = runCmdPipe(append, "systemctl", "restart", "nginx")
+			if err := serviceAction(append, "restart", "nginx"); err != nil {
+				append("[失败] " + err.Error())
+			} else {
+				append("[完成] Nginx 已重启")
+			}
 			s.flushUI()
 		}()
 	})
+	list.AddItem("UDP 443 (QUIC): "+quicPolicyStatus(), "", 0, func() {
+		s.pages.RemovePage("modal")
+		s.openQUICPolicyPicker()
+	})
+	allowList := loadSettings().NginxAllowList
+	allowLabel := "放行列表: 关闭（放行全部域名）"
+	if allowList {
+		allowLabel = "放行列表: 开启（仅放行 address 分配的平台）"
+	}
+	list.AddItem(allowLabel, "切换后重新生成配置并重载", 0, func() {
+		s.pages.RemovePage("modal")
+		s.withPortCheck("切换 Nginx 放行列表", []int{80, 443}, proxyPortOwners(), func(append func(string)) {
+			if err := setNginxAllowList(!allowList, append); err != nil {
+				append("[失败] " + err.Error())
+			} else if allowList {
+				append("[完成] 已关闭放行列表，Nginx 放行全部域名")
+			} else {
+				append("[完成] 已开启放行列表，列表外的域名将被拒绝")
+			}
+		})
+	})
 	list.AddItem("查看 nginx.conf", NGINX_MAIN_CONF, 0, func() {
 		s.pages.RemovePage("modal")
 		s.openConfigViewer("nginx.conf", NGINX_MAIN_CONF)
@@ -1389,8 +2883,114 @@ func (s *tvState) openNginxActions() {
 		s.pages.RemovePage("modal")
 		s.openConfigViewer("http 配置", NGINX_HTTP_CONF_FILE)
 	})
+	list.AddItem("查看日志", journalSourceFor("nginx").String(), 0, func() {
+		s.pages.RemovePage("modal")
+		s.openJournal("nginx")
+	})
 	list.AddItem("返回", "", 0, func() { s.pages.RemovePage("modal"); s.openServiceManager() })
-	s.pages.AddPage("modal", center(60, 16, list), true, true)
+	s.pages.AddPage("modal", center(60, 18, list), true, true)
+}
+
+// openProxyBackendPicker lets the user choose nginx or the built-in proxy for 80/443.
+func (s *tvState) openProxyBackendPicker() {
+	text := fmt.Sprintf("当前代理后端: %s\n\n切换后将停用另一方并由所选后端监听 80/443。", proxyBackendLabel(s.backend))
+	backends := []string{PROXY_BACKEND_NGINX, PROXY_BACKEND_BUILTIN}
+	m := tview.NewModal().SetText(text).AddButtons([]string{"Nginx", "内置代理", "取消"}).SetDoneFunc(func(i int, l string) {
+		s.pages.RemovePage("modal-backend")
+		if i < 0 || i >= len(backends) {
+			return
+		}
+		to := backends[i]
+		logView := s.openLogModal("切换代理后端 -> " + proxyBackendLabel(to))
+		go func() {
+			append := func(line string) { s.app.QueueUpdateDraw(func() { fmt.Fprintln(logView, line) }) }
+			if err := switchProxyBackend(to, append); err != nil {
+				append("[失败] " + err.Error())
+			} else {
+				append("[完成] 代理后端: " + proxyBackendLabel(to))
+			}
+			s.flushUI()
+		}()
+	})
+	s.pages.AddPage("modal-backend", center(60, 9, m), true, true)
+}
+
+func (s *tvState) openBuiltinProxyActions() {
+	list := tview.NewList().ShowSecondaryText(false)
+	list.SetBorder(true).SetTitle("内置代理")
+	service := func(title, action, name string) func() {
+		return func() {
+			s.pages.RemovePage("modal")
+			logView := s.openLogModal(title)
+			go func() {
+				append := func(line string) { s.app.QueueUpdateDraw(func() { fmt.Fprintln(logView, line) }) }
+				if err := serviceAction(append, action, name); err != nil {
+					append("[失败] " + err.Error())
+				} else {
+					append("[完成] " + title)
+				}
+				s.flushUI()
+			}()
+		}
+	}
+	list.AddItem("安装/更新服务", PROXY_SERVICE_NAME, 0, func() {
+		s.pages.RemovePage("modal")
+		logView := s.openLogModal("安装内置代理服务")
+		go func() {
+			append := func(line string) { s.app.QueueUpdateDraw(func() { fmt.Fprintln(logView, line) }) }
+			if err := installProxyService(append); err != nil {
+				append("[失败] " + err.Error())
+			} else {
+				append("[完成] 服务已安装；在“代理后端”中选择内置代理即可启用")
+			}
+			s.flushUI()
+		}()
+	})
+	list.AddItem("启动", "", 0, service("启动内置代理", "start", PROXY_SERVICE_NAME))
+	list.AddItem("停止", "", 0, service("停止内置代理", "stop", PROXY_SERVICE_NAME))
+	list.AddItem("重启", "", 0, service("重启内置代理", "restart", PROXY_SERVICE_NAME))
+	list.AddItem("UDP 443 (QUIC): "+quicPolicyStatus(), "", 0, func() {
+		s.pages.RemovePage("modal")
+		s.openQUICPolicyPicker()
+	})
+	list.AddItem("查看放行列表", "Nginx 开启放行列表时与其共用", 0, func() {
+		s.pages.RemovePage("modal")
+		rules := loadProxyRules()
+		text := "未分配 address 方式的平台：放行全部域名\n"
+		if !rules.open() {
+			text = strings.Join(rules.allowedDomains(), "\n")
+		}
+		s.openTextViewer("放行列表", text)
+	})
+	list.AddItem("返回", "", 0, func() { s.pages.RemovePage("modal"); s.openServiceManager() })
+	s.pages.AddPage("modal", center(60, 13, list), true, true)
+}
+
+// openQUICPolicyPicker sets how this node treats UDP 443.
+func (s *tvState) openQUICPolicyPicker() {
+	text := "当前 UDP 443 策略: " + quicPolicyStatus() + "\n\n" +
+		"拒绝: nftables 拒绝 UDP 443，客户端立即回退到 TCP\n" +
+		"代理: 解析 QUIC Initial 包中的 SNI 并按放行列表转发\n" +
+		"不处理: 移除上述规则/服务"
+	policies := []string{QUIC_POLICY_REJECT, QUIC_POLICY_PROXY, QUIC_POLICY_NONE}
+	m := tview.NewModal().SetText(text).AddButtons([]string{"拒绝", "代理", "不处理", "取消"}).SetDoneFunc(func(i int, l string) {
+		s.pages.RemovePage("modal-quic")
+		if i < 0 || i >= len(policies) {
+			return
+		}
+		policy := policies[i]
+		logView := s.openLogModal("UDP 443 策略 -> " + quicPolicyLabel(policy))
+		go func() {
+			append := func(line string) { s.app.QueueUpdateDraw(func() { fmt.Fprintln(logView, line) }) }
+			if err := applyQUICPolicy(policy, append); err != nil {
+				append("[失败] " + err.Error())
+			} else {
+				append("[完成] " + quicPolicyStatus())
+			}
+			s.flushUI()
+		}()
+	})
+	s.pages.AddPage("modal-quic", center(70, 12, m), true, true)
 }
 
 // ----- Upstream group management -----
@@ -1522,7 +3122,7 @@ func (s *tvState) openDefaultDNSManager() {
 	// build list of current default servers
 	ds := parseDefaultServers()
 	list := tview.NewList().ShowSecondaryText(false)
-	list.SetBorder(true).SetTitle("默认上游 DNS (A添加推荐, C自定义, X删除, Esc关闭)")
+	list.SetBorder(true).SetTitle("默认上游 DNS (A添加推荐, C自定义, X删除, B测速, Esc关闭)")
 	for i, ip := range ds {
 		idx := i
 		list.AddItem(ip, "", 0, func() {
@@ -1539,6 +3139,9 @@ func (s *tvState) openDefaultDNSManager() {
 			case 'c', 'C':
 				s.showAddDefaultDNS()
 				return nil
+			case 'b', 'B':
+				s.openDNSBenchmark()
+				return nil
 			case 'x', 'X':
 				if len(ds) == 0 {
 					return nil
@@ -1566,26 +3169,13 @@ func (s *tvState) openDefaultDNSManager() {
 func (s *tvState) refreshDefaultDNSManager() { s.openDefaultDNSManager() }
 
 func (s *tvState) showRecommendedDNS() {
-	type rec struct{ ip, desc string }
-	recs := []rec{
-		{"223.5.5.5", "AliDNS"},
-		{"223.6.6.6", "AliDNS"},
-		{"119.29.29.29", "DNSPod"},
-		{"1.1.1.1", "Cloudflare"},
-		{"1.0.0.1", "Cloudflare"},
-		{"8.8.8.8", "Google"},
-		{"8.8.4.4", "Google"},
-		{"9.9.9.9", "Quad9"},
-		{"114.114.114.114", "114DNS"},
-		{"180.76.76.76", "Baidu"},
-	}
 	list := tview.NewList().ShowSecondaryText(false)
 	list.SetBorder(true).SetTitle("添加推荐 DNS (Enter添加, Esc返回)")
-	for _, r := range recs {
+	for _, r := range recommendedDNS {
 		rr := r
-		label := rr.ip + " (" + rr.desc + ")"
+		label := rr.IP + " (" + rr.Name + ")"
 		list.AddItem(label, "", 0, func() {
-			_ = addDefaultServer(rr.ip)
+			_ = addDefaultServer(rr.IP)
 			s.pages.RemovePage("modal-rec-dns")
 			s.refreshDefaultDNSManager()
 		})
@@ -1600,6 +3190,61 @@ func (s *tvState) showRecommendedDNS() {
 	s.pages.AddPage("modal-rec-dns", center(50, 15, list), true, true)
 }
 
+// openDNSBenchmark benchmarks default, group and recommended servers; once done,
+// o reorders the default servers by the result and h shows earlier runs.
+func (s *tvState) openDNSBenchmark() {
+	view := tview.NewTextView().SetDynamicColors(false).SetScrollable(true).SetWrap(false)
+	view.SetBorder(true).SetTitle("DNS 测速 (o 按结果排序默认上游, h 历史, Esc/q 关闭)").SetTitleAlign(tview.AlignLeft)
+	view.SetChangedFunc(func() { s.app.Draw() })
+	var done atomic.Pointer[benchRun]
+	view.SetInputCapture(func(ev *tcell.EventKey) *tcell.EventKey {
+		switch {
+		case ev.Key() == tcell.KeyEsc || ev.Rune() == 'q':
+			s.pages.RemovePage("modal-bench")
+			s.refreshDefaultDNSManager()
+			return nil
+		case ev.Rune() == 'o':
+			run := done.Load()
+			if run == nil {
+				s.toast("测速尚未完成")
+				return nil
+			}
+			servers, err := reorderDefaultServers(*run)
+			if err != nil {
+				s.toast("排序失败: " + err.Error())
+				return nil
+			}
+			fmt.Fprintln(view, "\n默认上游已按结果排序: "+strings.Join(servers, ", "))
+			return nil
+		case ev.Rune() == 'h':
+			view.Clear()
+			for _, run := range loadBenchHistory() {
+				for _, l := range run.table() {
+					fmt.Fprintln(view, l)
+				}
+				fmt.Fprintln(view)
+			}
+			return nil
+		}
+		return ev
+	})
+	s.pages.AddPage("modal-bench", center(100, 30, view), true, true)
+	s.app.SetFocus(view)
+	targets := benchTargets(true)
+	fmt.Fprintf(view, "测试 %d 个服务器，3 轮 …\n", len(targets))
+	go func() {
+		append := func(line string) { s.app.QueueUpdateDraw(func() { fmt.Fprintln(view, line) }) }
+		run := runBenchmark(targets, 3, append)
+		done.Store(&run)
+		s.app.QueueUpdateDraw(func() {
+			view.Clear()
+			for _, l := range run.table() {
+				fmt.Fprintln(view, l)
+			}
+		})
+	}()
+}
+
 func (s *tvState) showAddDefaultDNS() {
 	form := tview.NewForm()
 	ip := tview.NewInputField().SetLabel("DNS IP: ")
@@ -1777,7 +3422,7 @@ func (s *tvState) confirmExit() {
 					append := func(line string) { s.app.QueueUpdateDraw(func() { fmt.Fprintln(logView, line) }) }
 					for _, svc := range toRestart {
 						append("重启 " + svc + " ...")
-						_ = runCmdPipe(append, "systemctl", "restart", svc)
+						_ = serviceAction(append, "restart", svc)
 					}
 					append("完成: 正在退出 ...")
 					s.app.QueueUpdateDraw(func() { s.pages.RemovePage("modal-log") })
@@ -0,0 +1,344 @@
+package src
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Native unlock checks. Each StreamConfig platform may have a check: one URL,
+// the statuses / body patterns that mean "unlocked" or "blocked", and a
+// pattern that extracts the region. Checks are dialled the way a client of
+// this node would reach the platform: straight to the address it's assigned
+// to, or to whatever its group's upstream DNS resolves. Built-in definitions
+// cover common platforms; UNLOCK_CHECKS_FILE adds or overrides them.
+
+type unlockCheck struct {
+	URL       string            `json:"url"`
+	Headers   map[string]string `json:"headers,omitempty"`
+	Status    []int             `json:"status,omitempty"`     // statuses meaning unlocked (default 200)
+	Body      string            `json:"body,omitempty"`       // regexp the body must match to count as unlocked
+	BlockBody string            `json:"block_body,omitempty"` // regexp in the body meaning blocked
+	BlockURL  string            `json:"block_url,omitempty"`  // regexp on the final URL meaning blocked
+	Region    string            `json:"region,omitempty"`     // regexp over final URL + body; group 1 is the region
+}
+
+var builtinUnlockChecks = map[string]unlockCheck{
+	"Netflix": {
+		// a licensed (non-original) title: 404 means only Netflix originals are available
+		URL:    "https://www.netflix.com/title/81280792",
+		Region: `netflix\.com/([a-z]{2})(?:-[a-z]{2})?/title`,
+	},
+	"DisneyPlus": {
+		URL:      "https://www.disneyplus.com/",
+		BlockURL: `unavailable|preview`,
+		Region:   `"countryCode"\s*:\s*"([A-Z]{2})"`,
+	},
+	"YouTube": {
+		URL:       "https://www.youtube.com/premium",
+		Headers:   map[string]string{"Accept-Language": "en"},
+		BlockBody: `Premium is not available in your country`,
+		Region:    `"countryCode"\s*:\s*"([A-Z]{2})"`,
+	},
+	"Openai": {
+		URL:    "https://chatgpt.com/cdn-cgi/trace",
+		Region: `loc=([A-Z]{2})`,
+	},
+	"Claude_2": {
+		URL:      "https://claude.ai/",
+		Status:   []int{200, 403},
+		BlockURL: `unavailable-in-region`,
+	},
+	"Tiktok": {
+		URL:    "https://www.tiktok.com/explore",
+		Region: `"region"\s*:\s*"([A-Z]{2})"`,
+	},
+	"Steam_Store": {
+		URL:    "https://store.steampowered.com/app/761830",
+		Region: `"priceCurrency"\s+content="([A-Z]{3})"`,
+	},
+	"BBC": {
+		URL:       "https://open.live.bbc.co.uk/mediaselector/6/select/version/2.0/mediaset/pc/vpid/bbc_one_london/format/json",
+		BlockBody: `geolocation`,
+	},
+}
+
+// loadUnlockChecks merges UNLOCK_CHECKS_FILE over the built-in definitions.
+func loadUnlockChecks() (map[string]unlockCheck, error) {
+	checks := map[string]unlockCheck{}
+	for k, v := range builtinUnlockChecks {
+		checks[k] = v
+	}
+	b, err := os.ReadFile(UNLOCK_CHECKS_FILE)
+	if errors.Is(err, os.ErrNotExist) {
+		return checks, nil
+	}
+	if err != nil {
+		return checks, err
+	}
+	var user map[string]unlockCheck
+	if err := json.Unmarshal(b, &user); err != nil {
+		return checks, fmt.Errorf("解析 %s 失败: %w", UNLOCK_CHECKS_FILE, err)
+	}
+	for k, v := range user {
+		if v.URL == "" {
+			delete(checks, k) // an empty definition disables a built-in check
+			continue
+		}
+		checks[k] = v
+	}
+	return checks, nil
+}
+
+const (
+	UNLOCK_OK      = "ok"
+	UNLOCK_BLOCKED = "blocked"
+	UNLOCK_ERROR   = "error"
+)
+
+type unlockResult struct {
+	Status string    `json:"status"`
+	Region string    `json:"region,omitempty"`
+	Detail string    `json:"detail,omitempty"`
+	Via    string    `json:"via,omitempty"`
+	Time   time.Time `json:"time"`
+}
+
+// label is the short form shown next to a platform.
+func (r unlockResult) label() string {
+	switch r.Status {
+	case UNLOCK_OK:
+		return strings.TrimSpace("解锁 ✓ " + r.Region)
+	case UNLOCK_BLOCKED:
+		return strings.TrimSpace("解锁 ✗ " + r.Region)
+	}
+	return "检测失败"
+}
+
+func loadUnlockResults() map[string]unlockResult {
+	out := map[string]unlockResult{}
+	if b, err := os.ReadFile(UNLOCK_RESULTS_FILE); err == nil {
+		_ = json.Unmarshal(b, &out)
+	}
+	return out
+}
+
+func saveUnlockResults(results map[string]unlockResult) error {
+	b, err := json.MarshalIndent(results, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(UNLOCK_RESULTS_FILE), 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(UNLOCK_RESULTS_FILE, b, 0o644)
+}
+
+// unlockVia says how a platform is reached: a fixed address, a DNS server to
+// resolve through, or (both empty) the system resolver.
+type unlockVia struct {
+	Label string
+	Addr  string
+	DNS   string
+}
+
+// unlockViaFor follows the platform's assignment in smartdns.conf.
+func unlockViaFor(sub string, assigned map[string]Assignment) unlockVia {
+	a, ok := assigned[sub]
+	switch {
+	case !ok:
+	case a.Method == "address" && net.ParseIP(a.Ident) != nil:
+		return unlockVia{Label: "address " + a.Ident, Addr: a.Ident}
+	case a.Method == "nameserver":
+		if ip := groupUpstream(a.Ident); ip != "" {
+			return unlockVia{Label: "分组 " + a.Ident + " (" + ip + ")", DNS: ip}
+		}
+	}
+	return unlockVia{Label: "系统解析"}
+}
+
+// groupUpstream returns the upstream IP of a `server ... -group name` entry.
+func groupUpstream(name string) string {
+	for _, g := range parseUpstreamGroups() {
+		if g.Name == name {
+			return g.IP
+		}
+	}
+	return ""
+}
+
+type unlockChecker struct {
+	// StandIn, when set (e.g. http://127.0.0.1:8080), receives every check
+	// instead of the real site; the Host header keeps the original host.
+	StandIn string
+	Timeout time.Duration
+}
+
+func (c unlockChecker) dial(via unlockVia) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	d := &net.Dialer{Timeout: c.Timeout}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if c.StandIn != "" {
+			return d.DialContext(ctx, network, addr)
+		}
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case via.Addr != "":
+			host = via.Addr
+		case via.DNS != "":
+			reply, err := dnsQuery(via.DNS, host, dnsTypeA, c.Timeout)
+			if err != nil {
+				return nil, fmt.Errorf("经 %s 解析 %s 失败: %w", via.DNS, host, err)
+			}
+			ips := reply.addresses()
+			if len(ips) == 0 {
+				return nil, fmt.Errorf("%s 对 %s 没有返回地址 (%s)", via.DNS, host, dnsRcodeName(reply.Rcode))
+			}
+			host = ips[0]
+		}
+		return d.DialContext(ctx, network, net.JoinHostPort(host, port))
+	}
+}
+
+// run performs one check.
+func (c unlockChecker) run(chk unlockCheck, via unlockVia) unlockResult {
+	res := unlockResult{Via: via.Label, Time: time.Now()}
+	fail := func(status, detail string) unlockResult {
+		res.Status, res.Detail = status, detail
+		return res
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = 10 * time.Second
+	}
+	target, err := url.Parse(chk.URL)
+	if err != nil {
+		return fail(UNLOCK_ERROR, err.Error())
+	}
+	req, err := http.NewRequest(http.MethodGet, chk.URL, nil)
+	if err != nil {
+		return fail(UNLOCK_ERROR, err.Error())
+	}
+	if c.StandIn != "" {
+		base, err := url.Parse(c.StandIn)
+		if err != nil {
+			return fail(UNLOCK_ERROR, "stand-in: "+err.Error())
+		}
+		req.URL.Scheme, req.URL.Host = base.Scheme, base.Host
+		req.Host = target.Host
+	}
+	req.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0 Safari/537.36")
+	for k, v := range chk.Headers {
+		req.Header.Set(k, v)
+	}
+	client := &http.Client{
+		Timeout:   c.Timeout,
+		Transport: &http.Transport{DialContext: c.dial(via), TLSHandshakeTimeout: c.Timeout},
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fail(UNLOCK_ERROR, err.Error())
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	finalURL := *resp.Request.URL
+	if c.StandIn != "" && finalURL.Host == req.URL.Host {
+		// report the address the real site would have shown
+		finalURL.Scheme, finalURL.Host = target.Scheme, target.Host
+	}
+	final := finalURL.String()
+	if chk.Region != "" {
+		if re, err := regexp.Compile(chk.Region); err == nil {
+			if m := re.FindStringSubmatch(final + "\n" + string(body)); len(m) > 1 {
+				res.Region = strings.ToUpper(m[1])
+			}
+		}
+	}
+	res.Detail = fmt.Sprintf("HTTP %d %s", resp.StatusCode, final)
+	if matches(chk.BlockURL, final) || matches(chk.BlockBody, string(body)) {
+		res.Status = UNLOCK_BLOCKED
+		return res
+	}
+	want := chk.Status
+	if len(want) == 0 {
+		want = []int{http.StatusOK}
+	}
+	okStatus := false
+	for _, s := range want {
+		okStatus = okStatus || s == resp.StatusCode
+	}
+	if !okStatus || (chk.Body != "" && !matches(chk.Body, string(body))) {
+		res.Status = UNLOCK_BLOCKED
+		return res
+	}
+	res.Status = UNLOCK_OK
+	return res
+}
+
+func matches(pattern, s string) bool {
+	if pattern == "" {
+		return false
+	}
+	re, err := regexp.Compile(pattern)
+	return err == nil && re.MatchString(s)
+}
+
+// checkPlatforms runs the checks for subs (all defined ones when empty),
+// stores the results and reports each one through log.
+func checkPlatforms(c unlockChecker, subs []string, log func(string)) (map[string]unlockResult, error) {
+	if log == nil {
+		log = func(string) {}
+	}
+	checks, err := loadUnlockChecks()
+	if err != nil {
+		log("[警告] " + err.Error())
+	}
+	if len(subs) == 0 {
+		for k := range checks {
+			subs = append(subs, k)
+		}
+		sort.Strings(subs)
+	}
+	assigned := parseAssignments()
+	results := loadUnlockResults()
+	for _, sub := range subs {
+		chk, ok := checks[sub]
+		if !ok {
+			log(sub + ": 没有检测定义")
+			continue
+		}
+		via := unlockViaFor(sub, assigned)
+		r := c.run(chk, via)
+		results[sub] = r
+		log(fmt.Sprintf("%s: %s  [%s]  %s", sub, r.label(), r.Via, r.Detail))
+	}
+	return results, saveUnlockResults(results)
+}
+
+func runCheckCommand(args []string) int {
+	fs := flag.NewFlagSet("check", flag.ContinueOnError)
+	standIn := fs.String("stand-in", "", "把所有检测发往此地址（如 http://127.0.0.1:8080，用于测试）")
+	timeout := fs.Duration("timeout", 10*time.Second, "单个检测超时")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	c := unlockChecker{StandIn: *standIn, Timeout: *timeout}
+	if _, err := checkPlatforms(c, fs.Args(), func(s string) { fmt.Println(s) }); err != nil {
+		fmt.Fprintln(os.Stderr, "保存检测结果失败:", err)
+		return 1
+	}
+	return 0
+}
@@ -12,15 +12,27 @@ import (
 	"os/exec"
 	"path/filepath"
 	"runtime"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 )
 
-func logGreen(s string)  { fmt.Printf("%s%s%s\n", GREEN, s, RESET) }
-func logRed(s string)    { fmt.Printf("%s%s%s\n", RED, s, RESET) }
-func logBlue(s string)   { fmt.Printf("%s%s%s\n", BLUE, s, RESET) }
-func logYellow(s string) { fmt.Printf("%s%s%s\n", YELLOW, s, RESET) }
-func logCyan(s string)   { fmt.Printf("%s%s%s\n", CYAN, s, RESET) }
+// log* print coloured text (unless the TUI owns the terminal) and always go
+// to the operation log: red is an error, yellow a warning, the rest info.
+func logColor(color, level, s string) {
+	opLog(level, s)
+	if !consoleQuiet.Load() {
+		fmt.Printf("%s%s%s\n", color, s, RESET)
+	}
+}
+
+func logGreen(s string)  { logColor(GREEN, LOG_INFO, s) }
+func logRed(s string)    { logColor(RED, LOG_ERROR, s) }
+func logBlue(s string)   { logColor(BLUE, LOG_INFO, s) }
+func logYellow(s string) { logColor(YELLOW, LOG_WARN, s) }
+func logCyan(s string)   { logColor(CYAN, LOG_INFO, s) }
 
 func mustRoot() {
 	if os.Geteuid() != 0 {
@@ -109,6 +121,67 @@ func runCmdPipe(onLine func(string), name string, args ...string) error {
 	return cmd.Wait()
 }
 
+// runCmdPipeTail is runCmdPipe that also returns the last n output lines,
+// so that callers can surface the actual failure reason in an error.
+func runCmdPipeTail(onLine func(string), n int, name string, args ...string) (string, error) {
+	var mu sync.Mutex
+	var tail []string
+	err := runCmdPipe(func(line string) {
+		mu.Lock()
+		tail = append(tail, line)
+		if len(tail) > n {
+			tail = tail[len(tail)-n:]
+		}
+		mu.Unlock()
+		if onLine != nil {
+			onLine(line)
+		}
+	}, name, args...)
+	return strings.Join(tail, "\n"), err
+}
+
+// waitPortsListening polls local TCP ports until all accept connections or timeout expires.
+// It returns the ports that are still not listening.
+func waitPortsListening(ports []int, timeout time.Duration) []int {
+	deadline := time.Now().Add(timeout)
+	for {
+		var missing []int
+		for _, p := range ports {
+			c, err := net.DialTimeout("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(p)), 500*time.Millisecond)
+			if err != nil {
+				missing = append(missing, p)
+				continue
+			}
+			c.Close()
+		}
+		if len(missing) == 0 || time.Now().After(deadline) {
+			return missing
+		}
+		time.Sleep(300 * time.Millisecond)
+	}
+}
+
+// withFileLock runs fn while holding an exclusive flock on path, so state
+// shared by several smartdnsctl processes (timers, services, the TUI) is
+// read-modified-written by one of them at a time.
+func withFileLock(path string, fn func() error) error {
+	if err := ensureDir(filepath.Dir(path)); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		return fmt.Errorf("锁定 %s 失败: %w", path, err)
+	}
+	defer syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+	return fn()
+}
+
+// httpGetTimeout is a direct request (no download proxy or mirrors; the
+// public IP lookups must see this host's own address). Downloads use download.go.
 func httpGetTimeout(url string, timeout time.Duration) ([]byte, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
@@ -116,6 +189,7 @@ func httpGetTimeout(url string, timeout time.Duration) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
+	req.Header.Set("User-Agent", "smartdnsctl/"+SCRIPT_VERSION)
 	client := &http.Client{}
 	resp, err := client.Do(req)
 	if err != nil {
@@ -128,14 +202,6 @@ func httpGetTimeout(url string, timeout time.Duration) ([]byte, error) {
 	return io.ReadAll(resp.Body)
 }
 
-func downloadToFile(url, path string, timeout time.Duration) error {
-    b, err := httpGetTimeout(url, timeout)
-    if err != nil {
-        return err
-    }
-    return os.WriteFile(path, b, 0o644)
-}
-
 // isPrivateIPv4 checks RFC1918, CGNAT, loopback and link-local ranges.
 func isPrivateIPv4(ip net.IP) bool {
     ip4 := ip.To4()
@@ -201,6 +267,27 @@ func firstPublicIPv4FromInterfaces() string {
     return ""
 }
 
+// localEgressAddrs lists addresses on up, non-loopback interfaces that outbound
+// connections can be bound to (IPv4 incl. private for 1:1 NAT, and global IPv6).
+func localEgressAddrs() []string {
+    var out []string
+    ifaces, _ := net.Interfaces()
+    for _, iface := range ifaces {
+        if iface.Flags&net.FlagLoopback != 0 || iface.Flags&net.FlagUp == 0 {
+            continue
+        }
+        addrs, _ := iface.Addrs()
+        for _, a := range addrs {
+            ipn, ok := a.(*net.IPNet)
+            if !ok || ipn.IP.IsLinkLocalUnicast() || ipn.IP.IsLoopback() {
+                continue
+            }
+            out = append(out, ipn.IP.String())
+        }
+    }
+    return out
+}
+
 // getPublicIPv4 tries multiple strategies to obtain the server's public IPv4.
 // Order: env override -> OpenDNS dig -> ipify -> ifconfig.co -> interface guess.
 func getPublicIPv4() string {
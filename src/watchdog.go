@@ -0,0 +1,314 @@
+package src
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// DNS health watchdog (`smartdnsctl watchdog`, service smartdnsctl-watchdog).
+// It queries 127.0.0.1:53 for a canary name; after Failures misses in a row it
+// restarts smartdns once, and if that doesn't help points resolv.conf at the
+// fallback resolver. When smartdns answers again the original resolv.conf is
+// put back.
+//
+// Intentional downtime (stopping, uninstalling or upgrading smartdns, an
+// emergency reset) pauses the watchdog through WATCHDOG_CONTROL_FILE, and a
+// resolver change made by the user since the fallback means the watchdog's
+// own snapshot is dropped instead of being restored over it.
+
+type watchdogConfig struct {
+	Enabled  bool   `json:"enabled,omitempty"`
+	Canary   string `json:"canary,omitempty"`
+	Interval int    `json:"interval,omitempty"` // seconds
+	Failures int    `json:"failures,omitempty"`
+	Fallback string `json:"fallback,omitempty"`
+}
+
+func (c watchdogConfig) withDefaults() watchdogConfig {
+	if c.Canary == "" {
+		c.Canary = "www.cloudflare.com"
+	}
+	if c.Interval <= 0 {
+		c.Interval = 10
+	}
+	if c.Failures <= 0 {
+		c.Failures = 3
+	}
+	if c.Fallback == "" {
+		c.Fallback = "8.8.8.8"
+	}
+	return c
+}
+
+const (
+	WATCHDOG_OK        = "ok"
+	WATCHDOG_FAILING   = "failing"
+	WATCHDOG_RESTARTED = "restarted"
+	WATCHDOG_FALLBACK  = "fallback"
+	WATCHDOG_PAUSED    = "paused"
+)
+
+// watchdogState survives watchdog restarts so a fallback is always undone.
+type watchdogState struct {
+	State     string     `json:"state"`
+	Since     time.Time  `json:"since"`
+	Failures  int        `json:"failures,omitempty"`
+	LastError string     `json:"last_error,omitempty"`
+	Saved     *savedFile `json:"saved,omitempty"` // resolv.conf before the fallback
+	SavedAt   time.Time  `json:"saved_at,omitempty"`
+}
+
+func loadWatchdogState() watchdogState {
+	st := watchdogState{State: WATCHDOG_OK}
+	if b, err := os.ReadFile(WATCHDOG_STATE_FILE); err == nil {
+		_ = json.Unmarshal(b, &st)
+	}
+	return st
+}
+
+func saveWatchdogState(st watchdogState) error {
+	b, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(WATCHDOG_STATE_FILE), 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(WATCHDOG_STATE_FILE, b, 0o644)
+}
+
+// watchdogControl is written by the rest of smartdnsctl and only read by the watchdog.
+type watchdogControl struct {
+	Paused bool      `json:"paused,omitempty"`
+	Reason string    `json:"reason,omitempty"`
+	Until  time.Time `json:"until,omitempty"` // zero: until resumeWatchdog
+	// ResolverChanged is the last time resolv.conf was deliberately rewritten or restored.
+	ResolverChanged time.Time `json:"resolver_changed,omitempty"`
+}
+
+func (c watchdogControl) paused() bool {
+	return c.Paused && (c.Until.IsZero() || time.Now().Before(c.Until))
+}
+
+func loadWatchdogControl() watchdogControl {
+	var c watchdogControl
+	if b, err := os.ReadFile(WATCHDOG_CONTROL_FILE); err == nil {
+		_ = json.Unmarshal(b, &c)
+	}
+	return c
+}
+
+func updateWatchdogControl(mutate func(c *watchdogControl)) {
+	c := loadWatchdogControl()
+	mutate(&c)
+	b, err := json.MarshalIndent(c, "", "  ")
+	if err != nil || os.MkdirAll(filepath.Dir(WATCHDOG_CONTROL_FILE), 0o755) != nil {
+		return
+	}
+	tmp := WATCHDOG_CONTROL_FILE + ".tmp"
+	if os.WriteFile(tmp, b, 0o644) == nil {
+		_ = os.Rename(tmp, WATCHDOG_CONTROL_FILE)
+	}
+}
+
+// pauseWatchdog stops the watchdog from acting while smartdns is down on
+// purpose; d bounds the pause (0 lasts until resumeWatchdog).
+func pauseWatchdog(reason string, d time.Duration) {
+	updateWatchdogControl(func(c *watchdogControl) {
+		c.Paused, c.Reason, c.Until = true, reason, time.Time{}
+		if d > 0 {
+			c.Until = time.Now().Add(d)
+		}
+	})
+}
+
+// resumeWatchdog ends a pause (smartdns is meant to run again).
+func resumeWatchdog() {
+	if !loadWatchdogControl().Paused {
+		return
+	}
+	updateWatchdogControl(func(c *watchdogControl) { c.Paused, c.Reason, c.Until = false, "", time.Time{} })
+}
+
+// noteResolverChanged records a deliberate resolv.conf change, which a
+// pending watchdog fallback must not undo.
+func noteResolverChanged() {
+	updateWatchdogControl(func(c *watchdogControl) { c.ResolverChanged = time.Now() })
+}
+
+// restoreWatchdogFallback puts back the resolv.conf saved before the fallback,
+// unless the user has changed the resolver since.
+func restoreWatchdogFallback(st *watchdogState, log func(string)) error {
+	if st.Saved == nil {
+		return nil
+	}
+	if loadWatchdogControl().ResolverChanged.After(st.SavedAt) {
+		log("切换备用 DNS 后用户修改过 " + RESOLV_CONF + "，保持不变")
+	} else if err := st.Saved.restore(); err != nil {
+		return err
+	} else {
+		log("已恢复 " + RESOLV_CONF)
+	}
+	st.Saved, st.SavedAt = nil, time.Time{}
+	return nil
+}
+
+// probeSmartDNS treats NOERROR and NXDOMAIN as healthy; SERVFAIL, REFUSED and
+// timeouts mean clients can't resolve.
+func probeSmartDNS(canary string) error {
+	reply, err := dnsQuery("127.0.0.1:53", canary, dnsTypeA, 2*time.Second)
+	if err != nil {
+		return err
+	}
+	if reply.Rcode != dnsRcodeNoError && reply.Rcode != dnsRcodeNXDomain {
+		return fmt.Errorf("应答码 %d", reply.Rcode)
+	}
+	return nil
+}
+
+func runWatchdogCommand(args []string) int {
+	if len(args) > 0 && args[0] == "status" {
+		fmt.Println(watchdogStatus())
+		return 0
+	}
+	st := loadWatchdogState()
+	logf := func(format string, a ...any) { log.Printf("看门狗: "+format, a...) }
+	transition := func(state, reason string) {
+		if st.State != state {
+			logf("%s -> %s: %s", watchdogStateLabel(st.State), watchdogStateLabel(state), reason)
+			st.State = state
+			st.Since = time.Now()
+		}
+		_ = saveWatchdogState(st)
+	}
+	logf("已启动（状态: %s）", watchdogStateLabel(st.State))
+	for {
+		cfg := loadSettings().Watchdog.withDefaults()
+		ctl := loadWatchdogControl()
+		if st.Saved != nil && ctl.ResolverChanged.After(st.SavedAt) {
+			logf("切换备用 DNS 后用户修改过 %s，不再恢复切换前的副本", RESOLV_CONF)
+			st.Saved, st.SavedAt = nil, time.Time{}
+			_ = saveWatchdogState(st)
+		}
+		if ctl.paused() {
+			st.Failures, st.LastError = 0, ""
+			transition(WATCHDOG_PAUSED, ctl.Reason)
+			time.Sleep(time.Duration(cfg.Interval) * time.Second)
+			continue
+		}
+		if st.State == WATCHDOG_PAUSED {
+			if st.Saved != nil {
+				transition(WATCHDOG_FALLBACK, "已恢复探测，"+RESOLV_CONF+" 仍为备用 DNS")
+			} else {
+				transition(WATCHDOG_OK, "已恢复探测")
+			}
+		}
+		err := probeSmartDNS(cfg.Canary)
+		switch {
+		case err == nil:
+			if rerr := restoreWatchdogFallback(&st, func(s string) { logf("%s", s) }); rerr != nil {
+				logf("恢复 %s 失败: %v", RESOLV_CONF, rerr)
+				break
+			}
+			st.Failures, st.LastError = 0, ""
+			transition(WATCHDOG_OK, "smartdns 已能解析 "+cfg.Canary)
+		default:
+			st.Failures++
+			st.LastError = err.Error()
+			if st.Failures < cfg.Failures {
+				if st.State == WATCHDOG_OK {
+					transition(WATCHDOG_FAILING, err.Error())
+				}
+				break
+			}
+			switch st.State {
+			case WATCHDOG_OK, WATCHDOG_FAILING:
+				transition(WATCHDOG_RESTARTED, fmt.Sprintf("连续 %d 次探测失败（%v），重启 smartdns", st.Failures, err))
+				if rerr := serviceAction(func(s string) { logf("%s", s) }, "restart", "smartdns"); rerr != nil {
+					logf("重启 smartdns 失败: %v", rerr)
+				}
+				st.Failures = 0
+			case WATCHDOG_RESTARTED:
+				saved, serr := snapshotFile(RESOLV_CONF)
+				if serr != nil {
+					logf("备份 %s 失败: %v", RESOLV_CONF, serr)
+					break
+				}
+				if werr := writeResolvConfFile(cfg.Fallback, "", func(s string) { logf("%s", s) }); werr != nil {
+					logf("写入备用 DNS %s 失败: %v", cfg.Fallback, werr)
+					break
+				}
+				st.Saved, st.SavedAt = &saved, time.Now()
+				transition(WATCHDOG_FALLBACK, "重启后 smartdns 仍无法解析，"+RESOLV_CONF+" 切换到 "+cfg.Fallback)
+			default:
+				_ = saveWatchdogState(st)
+			}
+		}
+		time.Sleep(time.Duration(cfg.Interval) * time.Second)
+	}
+}
+
+// syncWatchdogService installs and runs the watchdog when enabled, else removes it from boot.
+func syncWatchdogService(log func(string)) error {
+	if log == nil {
+		log = func(string) {}
+	}
+	if !loadSettings().Watchdog.Enabled {
+		stopDisabled(WATCHDOG_SERVICE_NAME, log)
+		// nothing would ever switch a fallback back once the watchdog is gone
+		st := loadWatchdogState()
+		if st.Saved != nil {
+			if err := restoreWatchdogFallback(&st, log); err != nil {
+				return fmt.Errorf("恢复看门狗切换前的 %s 失败: %w", RESOLV_CONF, err)
+			}
+		}
+		st.State, st.Since, st.Failures, st.LastError = WATCHDOG_OK, time.Now(), 0, ""
+		return saveWatchdogState(st)
+	}
+	if err := installSelfService(WATCHDOG_SERVICE_NAME, "smartdns health watchdog", log, "watchdog"); err != nil {
+		return err
+	}
+	if err := startEnabled(WATCHDOG_SERVICE_NAME, log); err != nil {
+		return fmt.Errorf("启动看门狗失败: %w", err)
+	}
+	return nil
+}
+
+// watchdogStatus is a one-line description for menus and `watchdog status`.
+// watchdogStateLabel names a watchdog state for status and log lines.
+func watchdogStateLabel(state string) string {
+	label := map[string]string{
+		WATCHDOG_OK:        "正常",
+		WATCHDOG_FAILING:   "探测失败",
+		WATCHDOG_RESTARTED: "已重启 smartdns",
+		WATCHDOG_FALLBACK:  "已切换到备用 DNS",
+		WATCHDOG_PAUSED:    "已暂停",
+	}[state]
+	if label == "" {
+		return state
+	}
+	return label
+}
+
+func watchdogStatus() string {
+	if !svc().Status(WATCHDOG_SERVICE_NAME) {
+		return "看门狗: 未运行"
+	}
+	st := loadWatchdogState()
+	out := "看门狗: " + watchdogStateLabel(st.State)
+	if !st.Since.IsZero() {
+		out += "（自 " + st.Since.Format("01-02 15:04:05") + "）"
+	}
+	if st.State == WATCHDOG_PAUSED {
+		if ctl := loadWatchdogControl(); ctl.Reason != "" {
+			out += " " + ctl.Reason
+		}
+	} else if st.LastError != "" && st.State != WATCHDOG_OK {
+		out += " " + st.LastError
+	}
+	return out
+}